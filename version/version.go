@@ -0,0 +1,107 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package version describes the build of zssh and zscp. Version, Commit and Date are set when building with
+//
+//	go build -ldflags "-X zssh/version.Version=v1.2.3 -X zssh/version.Commit=abc1234 -X zssh/version.Date=2024-01-02T03:04:05Z" ./...
+//
+// Builds without them, such as with go install, fall back to what the go toolchain recorded.
+package version
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	// Version is the semantic version of the build, e.g. v1.2.3
+	Version = "v0.0.0"
+	// Commit is the git commit the build is from
+	Commit = "unknown"
+	// Date is when the build was made
+	Date = "unknown"
+)
+
+// dependencies are the modules whose versions are reported, those most likely to matter when filing an issue
+var dependencies = []string{
+	"github.com/openziti/sdk-golang",
+	"golang.org/x/crypto",
+	"github.com/pkg/sftp",
+}
+
+// Info is the build information of the running binary
+type Info struct {
+	Version      string
+	Commit       string
+	Date         string
+	GoVersion    string
+	Dependencies []Dependency
+}
+
+// Dependency is a module built into the binary and its version
+type Dependency struct {
+	Path    string
+	Version string
+}
+
+// Get returns the build information of the running binary
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "v0.0.0" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.Commit == "unknown":
+			info.Commit = setting.Value
+		case setting.Key == "vcs.time" && info.Date == "unknown":
+			info.Date = setting.Value
+		}
+	}
+	for _, path := range dependencies {
+		for _, dep := range build.Deps {
+			if dep.Path == path {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				info.Dependencies = append(info.Dependencies, Dependency{Path: path, Version: dep.Version})
+			}
+		}
+	}
+	return info
+}
+
+// String returns the version, build date and commit on one line, e.g. v1.2.3 (built:2024-01-02T03:04:05Z, hash:abc1234)
+func (i Info) String() string {
+	return fmt.Sprintf("%s (built:%s, hash:%s)", i.Version, i.Date, i.Commit)
+}
+
+// Write writes the build information to out, one item per line, as printed by the version command and --version
+func (i Info) Write(out io.Writer, program string) {
+	_, _ = fmt.Fprintf(out, "%s %s\n", program, i.Version)
+	_, _ = fmt.Fprintf(out, "  commit: %s\n", i.Commit)
+	_, _ = fmt.Fprintf(out, "  built:  %s\n", i.Date)
+	_, _ = fmt.Fprintf(out, "  go:     %s %s/%s\n", i.GoVersion, runtime.GOOS, runtime.GOARCH)
+	for _, dep := range i.Dependencies {
+		_, _ = fmt.Fprintf(out, "  %s %s\n", dep.Path, dep.Version)
+	}
+}
@@ -17,206 +17,604 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/openziti/cobra-to-md"
-	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
 	"zssh/zsshlib"
 
 	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/openziti/ziti/common/enrollment"
 	"github.com/openziti/ziti/ziti/cmd/common"
 )
 
 var (
-	flags   = zsshlib.ScpFlags{}
-	version = "v0.0.0"
-	commit  = "unknown"
-	date    = "unknown"
+	flags = zsshlib.ScpFlags{}
+	// commandLine is flags as given on the command line, which establish starts each remote from, and commandLineSet
+	// names the flags which were given
+	commandLine    *zsshlib.ScpFlags
+	commandLineSet map[string]bool
 )
 
 var rootCmd = &cobra.Command{
 	Use: "zscp <remoteUsername>@<targetIdentity>:[Remote Path] [Local Path] or " +
-		"zscp [Local Path] <remoteUsername>@<targetIdentity>:[Remote Path]",
-	Short:   "Z(iti)scp, Carb-loaded ssh performs faster and stronger than ssh",
-	Long:    "Z(iti)scp is a version of ssh that utilizes a ziti network to provide a faster and more secure remote connection. A ziti connection must be established before use",
-	Version: fmt.Sprintf("%s (built:%s, hash:%s)", version, date, commit),
-	Args:    cobra.MinimumNArgs(2),
+		"zscp [Local Path...] <remoteUsername>@<targetIdentity>:[Remote Path] or " +
+		"zscp --interactive <remoteUsername>@<targetIdentity>[:Remote Path] or " +
+		"zscp --batch <file>. A Local Path of - sends stdin or writes to stdout",
+	Short: "Z(iti)scp, Carb-loaded ssh performs faster and stronger than ssh",
+	Long:  "Z(iti)scp is a version of ssh that utilizes a ziti network to provide a faster and more secure remote connection. A ziti connection must be established before use",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if flags.Interactive {
+			return cobra.ExactArgs(1)(cmd, args)
+		}
+		if flags.Batch != "" {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.MinimumNArgs(2)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		var remoteFilePath string
+		var remote *zsshlib.RemoteSpec
 		var localFilePaths []string
 		var isCopyToRemote bool
 
 		logrus.StandardLogger().Level = logrus.FatalLevel
-		if flags.Debug {
-			zsshlib.Logger().SetLevel(logrus.DebugLevel)
+		if err := flags.ConfigureLogger(); err != nil {
+			logrus.Fatal(err)
+		}
+
+		// an interrupt cancels the transfer in progress, removing the partially transferred file
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if flags.Interactive {
+			interactive(ctx, cmd, args[0])
+			return
+		}
+		if flags.Batch != "" {
+			batch(ctx, cmd, flags.Batch)
+			return
 		}
 
-		if strings.ContainsAny(args[0], ":") {
-			remoteFilePath = args[0]
+		specs := make([]*zsshlib.RemoteSpec, len(args))
+		for i, arg := range args {
+			spec, err := zsshlib.ParseRemoteSpec(arg)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			if spec != nil && i > 0 && i < len(args)-1 {
+				logrus.Fatalf("[%s] is remote: only the first or last argument can be remote", arg)
+			}
+			specs[i] = spec
+		}
+		first, last := specs[0], specs[len(args)-1]
+		switch {
+		case first != nil && last != nil:
+			logrus.Fatal("copying between two remotes is not supported")
+		case first != nil:
+			remote = first
 			localFilePaths = args[1:]
 			if len(localFilePaths) > 1 {
 				logrus.Fatalf("remote to local cannot have more than two arguments")
 			}
 			isCopyToRemote = false
-
-		} else if strings.ContainsAny(args[len(args)-1], ":") {
-			remoteFilePath = args[len(args)-1]
+		case last != nil:
+			remote = last
 			localFilePaths = args[0 : len(args)-1]
 			isCopyToRemote = true
-		} else {
+		default:
 			logrus.Fatal(`cannot determine remote file PATH use ":" for remote path`)
 		}
+		if slices.Contains(localFilePaths, zsshlib.StdioPath) {
+			if len(localFilePaths) > 1 {
+				logrus.Fatalf("%s cannot be combined with other local paths", zsshlib.StdioPath)
+			}
+			stdio(ctx, cmd, remote, isCopyToRemote)
+			return
+		}
+
 		var err error
+		if isCopyToRemote && !flags.NoGlob {
+			if localFilePaths, err = zsshlib.ExpandLocalGlobs(localFilePaths); err != nil {
+				logrus.Fatal(err)
+			}
+		}
 		for i, path := range localFilePaths {
 			if localFilePaths[i], err = filepath.Abs(path); err != nil {
 				logrus.Fatalf("cannot determine absolute local file path, unrecognized file name: %s", path)
 			}
-			if _, err := os.Stat(localFilePaths[i]); err != nil {
-				logrus.Fatal(err)
+			if isCopyToRemote {
+				if _, err := os.Stat(localFilePaths[i]); err != nil {
+					logrus.Fatal(err)
+				}
+			} else if strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator)) {
+				// Abs drops the trailing separator marking the destination as a directory
+				localFilePaths[i] += string(filepath.Separator)
 			}
 			zsshlib.Logger().Debugf("           local path: %s", localFilePaths[i])
 		}
 
-		targetIdentity := zsshlib.ParseTargetIdentity(remoteFilePath)
-		cfg := zsshlib.FindConfigByKey(targetIdentity)
-		zsshlib.Combine(cmd, &flags.SshFlags, cfg)
-
-		remoteFilePath = zsshlib.ParseFilePath(remoteFilePath)
-
-		sshConn := zsshlib.EstablishClient(&flags.SshFlags, remoteFilePath, targetIdentity)
-		defer func() { _ = sshConn.Close() }()
-
-		client, err := sftp.NewClient(sshConn)
+		transferOpts, err := flags.TransferOptions()
 		if err != nil {
-			logrus.Fatalf("error creating sftp client: %v", err)
+			logrus.Fatal(err)
 		}
-		defer func() { _ = client.Close() }()
-
-		if remoteFilePath == "~" {
-			remoteFilePath = ""
-		} else if len(remoteFilePath) > 1 && remoteFilePath[0:1] == "~" {
-			remoteFilePath = remoteFilePath[2:]
+		if flags.Protocol == zsshlib.ProtocolScp {
+			scpCopy(ctx, cmd, remote, localFilePaths, isCopyToRemote, transferOpts)
+			return
 		}
 
-		remoteFilePath, err = client.RealPath(remoteFilePath)
-		if err != nil {
-			logrus.Fatalf("cannot find remote file path: %s [%v]", remoteFilePath, err)
+		sshConn, client, remoteFilePath := connect(cmd, remote)
+		defer func() { _ = sshConn.Close() }()
+		defer func() { _ = client.Close() }()
+
+		if isCopyToRemote && len(localFilePaths) > 1 {
+			if flags.MakeDirs && !flags.DryRun {
+				if err := zsshlib.MakeRemoteDir(client, remoteFilePath); err != nil {
+					logrus.Fatal(err)
+				}
+			}
+			if info, err := client.Stat(remoteFilePath); err != nil || !info.IsDir() {
+				logrus.Fatalf("cannot copy %d files to [%s]: remote path is not a directory", len(localFilePaths), remoteFilePath)
+			}
 		}
 
-		remoteGlob, err := client.Glob(remoteFilePath)
-		if err != nil {
-			logrus.Fatalf("file pattern [%s] not recognized [%v]", remoteFilePath, err)
-		} else if remoteGlob == nil {
-			remoteGlob = append(remoteGlob, remoteFilePath)
+		// a failed transfer is fatal unless --keep-going, which carries on with the rest and reports every failure at
+		// the end
+		var failures []error
+		fail := func(err error) {
+			if !flags.KeepGoing || ctx.Err() != nil {
+				logrus.Fatal(err)
+			}
+			failures = append(failures, err)
 		}
 
 		if isCopyToRemote { //local to remote
-			for i, localFilePath := range localFilePaths {
+			for _, localFilePath := range localFilePaths {
 				if flags.Recursive {
-					baseDir := filepath.Base(localFilePath)
-					err := filepath.WalkDir(localFilePath, func(path string, info fs.DirEntry, err error) error {
-						remotePath := filepath.Join(remoteFilePath, baseDir, after(path, baseDir))
-						remotePath = strings.ReplaceAll(remotePath, `\`, `/`)
-						if info.IsDir() {
-							err = client.Mkdir(remotePath)
-							if err != nil {
-								zsshlib.Logger().Debugf("%s", err) //occurs when directories exist already. Is not fatal. Only logs when debug flag is set.
-							} else {
-								zsshlib.Logger().Debugf("made directory: %s", remotePath)
-							}
-						} else {
-							err = zsshlib.SendFile(client, path, remotePath)
-							if err != nil {
-								return fmt.Errorf("could not send file: %s [%v]", path, err)
-							} else {
-								logrus.Infof("sent file: %s ==> %s", path, remotePath)
-							}
-						}
-						return nil
-					})
-					if err != nil {
-						logrus.Fatal(err)
+					if err := zsshlib.SendDir(ctx, client, localFilePath, remoteFilePath, transferOpts); err != nil {
+						fail(err)
 					}
 				} else {
-					if i > 0 {
-						remoteFilePath = filepath.Join(filepath.Dir(remoteFilePath), filepath.Base(localFilePath))
+					remotePath := zsshlib.AppendBaseName(client, remoteFilePath, localFilePath, zsshlib.Logger().IsLevelEnabled(logrus.DebugLevel))
+					remotePath = strings.ReplaceAll(remotePath, `\`, `/`)
+					if flags.Compress {
+						err = zsshlib.SendFileCompressed(ctx, sshConn, client, localFilePath, remotePath, transferOpts)
+					} else {
+						err = zsshlib.SendFile(ctx, client, localFilePath, remotePath, transferOpts)
 					}
-					remoteFilePath = zsshlib.AppendBaseName(client, remoteFilePath, localFilePath, flags.Debug)
-					remoteFilePath = strings.ReplaceAll(remoteFilePath, `\`, `/`)
-					err = zsshlib.SendFile(client, localFilePath, remoteFilePath)
 					if err != nil {
-						logrus.Errorf("could not send file: %s [%v]", localFilePath, err)
+						fail(fmt.Errorf("could not send file: %s [%w]", localFilePath, err))
 					} else {
-						logrus.Infof("sent file: %s ==> %s", localFilePath, remoteFilePath)
+						zsshlib.Logger().Infof("sent file: %s ==> %s", localFilePath, remotePath)
 					}
 				}
 			}
 		} else { //remote to local
 			localFilePath := localFilePaths[0]
+			remoteGlob := []string{remoteFilePath}
+			if !flags.NoGlob {
+				if remoteGlob, err = zsshlib.ExpandRemoteGlob(client, remoteFilePath, flags.Recursive); err != nil {
+					logrus.Fatal(err)
+				}
+				if err = zsshlib.PrepareGlobDestination(localFilePath, len(remoteGlob), flags.DryRun); err != nil {
+					logrus.Fatal(err)
+				}
+			}
 			for _, remoteFilePath = range remoteGlob {
 				if flags.Recursive {
-					baseDir := filepath.Base(remoteFilePath)
-					walker := client.Walk(remoteFilePath)
-					for walker.Step() {
-						localPath := filepath.Join(localFilePath, baseDir, after(walker.Path(), baseDir)) //saves base directory to cut remote directory after it to append to localpath
-						if walker.Stat().IsDir() {
-							err = os.Mkdir(localPath, os.ModePerm)
-							if err != nil {
-								zsshlib.Logger().Debugf("failed to make directory: %s [%v]", localPath, err) //occurs when directories exist already. Is not fatal. Only logs when debug flag is set.
-							} else {
-								zsshlib.Logger().Debugf("made directory: %s", localPath)
-							}
-						} else {
-							err = zsshlib.RetrieveRemoteFiles(client, localPath, walker.Path())
-							if err != nil {
-								logrus.Fatalf("failed to retrieve file: %s [%v]", walker.Path(), err)
-							}
-						}
+					err = zsshlib.RetrieveRemoteDir(ctx, client, localFilePath, remoteFilePath, transferOpts)
+					if err != nil {
+						fail(fmt.Errorf("failed to retrieve directory: %s [%w]", remoteFilePath, err))
 					}
 				} else {
-					if info, _ := os.Lstat(localFilePaths[0]); info.IsDir() {
-						localFilePath = filepath.Join(localFilePaths[0], filepath.Base(remoteFilePath))
+					if localFilePath, err = zsshlib.AppendLocalBaseName(localFilePaths[0], remoteFilePath); err != nil {
+						fail(err)
+						continue
+					}
+					if flags.Compress {
+						err = zsshlib.RetrieveFileCompressed(ctx, sshConn, client, localFilePath, remoteFilePath, transferOpts)
+					} else {
+						err = zsshlib.RetrieveRemoteFiles(ctx, client, localFilePath, remoteFilePath, transferOpts)
 					}
-					err = zsshlib.RetrieveRemoteFiles(client, localFilePath, remoteFilePath)
 					if err != nil {
-						logrus.Fatalf("failed to retrieve file: %s [%v]", remoteFilePath, err)
+						fail(fmt.Errorf("failed to retrieve file: %s [%w]", remoteFilePath, err))
 					}
 				}
 			}
 		}
+		if isCopyToRemote {
+			reportStats(transferOpts, "sent")
+		} else {
+			reportStats(transferOpts, "received")
+		}
+		runExec(ctx, sshConn, joinFailures(failures))
 	},
 }
 
-func init() {
-	flags.OIDCFlags(rootCmd)
-	rootCmd.Flags().BoolVarP(&flags.Recursive, "recursive", "r", false, "pass to enable recursive file transfer")
+var (
+	longListing bool
+	rmRecursive bool
+)
+
+var lsCmd = newRemoteCmd("ls", "List a remote directory", func(client *sftp.Client, remotePath string) error {
+	return zsshlib.ListRemote(client, remotePath, longListing, os.Stdout)
+})
+
+var rmCmd = newRemoteCmd("rm", "Remove a remote file or directory", func(client *sftp.Client, remotePath string) error {
+	return zsshlib.RemoveRemote(client, remotePath, rmRecursive)
+})
+
+var mkdirCmd = newRemoteCmd("mkdir", "Make a remote directory, including any missing parents", func(client *sftp.Client, remotePath string) error {
+	return zsshlib.MakeRemoteDir(client, remotePath)
+})
+
+// newRemoteCmd creates a subcommand which connects to the remote given as its only argument and runs action against
+// the remote path, exiting non-zero when action fails
+func newRemoteCmd(use string, short string, action func(client *sftp.Client, remotePath string) error) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " <remoteUsername>@<targetIdentity>:[Remote Path]",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logrus.StandardLogger().Level = logrus.FatalLevel
+			if err := flags.ConfigureLogger(); err != nil {
+				logrus.Fatal(err)
+			}
+			remote, err := zsshlib.ParseRemoteSpec(args[0])
+			if err != nil {
+				logrus.Fatal(err)
+			} else if remote == nil {
+				logrus.Fatal(`cannot determine remote file PATH use ":" for remote path`)
+			}
+
+			sshConn, client, remotePath := connect(cmd, remote)
+			err = action(client, remotePath)
+			_ = client.Close()
+			_ = sshConn.Close()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+		},
+	}
 }
 
-func after(value string, a string) string {
-	// Get substring after a string.
-	pos := strings.LastIndex(value, a)
-	if pos == -1 {
-		return ""
+// interactive opens an sftp shell on arg, <remoteUsername>@<targetIdentity>[:Remote Path], starting in the remote path
+// when given
+func interactive(ctx context.Context, cmd *cobra.Command, arg string) {
+	remote, err := zsshlib.ParseRemoteSpec(arg)
+	if err == nil && remote == nil {
+		remote, err = zsshlib.ParseRemoteSpec(arg + ":")
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	} else if remote == nil {
+		logrus.Fatalf("[%s] is not a remote: expected <remoteUsername>@<targetIdentity>[:Remote Path]", arg)
 	}
-	adjustedPos := pos + len(a)
-	if adjustedPos >= len(value) {
-		return ""
+	transferOpts, err := flags.TransferOptions()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	sshConn, client, remotePath := connect(cmd, remote)
+	defer func() { _ = sshConn.Close() }()
+	defer func() { _ = client.Close() }()
+
+	shell, err := zsshlib.NewSftpShell(client, remotePath, transferOpts, os.Stdout)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err := shell.Run(ctx, os.Stdin, os.Stdout); err != nil {
+		logrus.Fatal(err)
 	}
-	return value[adjustedPos:]
 }
 
-func main() {
+// stdio sends stdin to remote when upload is set, otherwise it writes the remote file(s) matching remote to stdout
+func stdio(ctx context.Context, cmd *cobra.Command, remote *zsshlib.RemoteSpec, upload bool) {
+	if flags.Recursive || flags.Compress || flags.Sparse || flags.Protocol == zsshlib.ProtocolScp {
+		logrus.Fatalf("%s cannot be combined with --recursive, --compress, --sparse or --protocol %s", zsshlib.StdioPath, zsshlib.ProtocolScp)
+	}
+	if flags.Exec != "" && !upload {
+		logrus.Fatalf("--exec cannot be combined with writing to stdout, its output would be mixed with the file's")
+	}
+	transferOpts, err := flags.TransferOptions()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	sshConn, client, remotePath := connect(cmd, remote)
+	defer func() { _ = sshConn.Close() }()
+	defer func() { _ = client.Close() }()
+
+	if upload {
+		if info, err := client.Stat(remotePath); err == nil && info.IsDir() {
+			logrus.Fatalf("cannot send stdin to [%s]: remote path is a directory, name the remote file", remotePath)
+		}
+		if err := zsshlib.SendStream(ctx, client, os.Stdin, remotePath, transferOpts); err != nil {
+			logrus.Fatal(err)
+		}
+		reportStats(transferOpts, "sent")
+		runExec(ctx, sshConn, nil)
+		return
+	}
+
+	matches := []string{remotePath}
+	if !flags.NoGlob {
+		var err error
+		if matches, err = zsshlib.ExpandRemoteGlob(client, remotePath, false); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	for _, match := range matches {
+		if err := zsshlib.RetrieveStream(ctx, client, os.Stdout, match, transferOpts); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	reportStats(transferOpts, "received")
+}
+
+// batch runs the transfers listed in batchFile in order, connecting once to each remote they refer to, and exits
+// non-zero when any of them fail
+func batch(ctx context.Context, cmd *cobra.Command, batchFile string) {
+	f, err := os.Open(batchFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	transfers, err := zsshlib.ParseBatch(f)
+	_ = f.Close()
+	if err != nil {
+		logrus.Fatalf("invalid batch file [%s]: %v", batchFile, err)
+	}
+	transferOpts, err := flags.TransferOptions()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	clients := map[string]*sftp.Client{}
+	cwds := map[string]string{}
+	var conns []*ssh.Client
+	closeAll := func() {
+		for _, client := range clients {
+			_ = client.Close()
+		}
+		for _, sshConn := range conns {
+			_ = sshConn.Close()
+		}
+	}
+	failed := 0
+	for _, transfer := range transfers {
+		remote := *transfer.Remote
+		key := remote.User + "@" + remote.Identity
+		client, found := clients[key]
+		if !found {
+			remote.Path = ""
+			var sshConn *ssh.Client
+			sshConn, client, cwds[key] = connect(cmd, &remote)
+			conns = append(conns, sshConn)
+			clients[key] = client
+		}
+		if flags.Cwd != "" {
+			transfer.Remote.Path = zsshlib.RemotePathIn(cwds[key], transfer.Remote.Path)
+		}
+
+		if err := transfer.Run(ctx, client, transferOpts, flags.Recursive); err != nil {
+			failed++
+			zsshlib.Logger().Errorf("line %d: %s failed: %v", transfer.Line, transfer, err)
+			if ctx.Err() != nil {
+				break
+			}
+		} else {
+			zsshlib.Logger().Infof("line %d: %s", transfer.Line, transfer)
+		}
+	}
+	closeAll()
+	reportStats(transferOpts, "transferred")
+	if failed > 0 {
+		zsshlib.Logger().Errorf("%d of %d transfers failed", failed, len(transfers))
+		os.Exit(1)
+	}
+	zsshlib.Logger().Infof("all %d transfers succeeded", len(transfers))
+}
+
+// scpCopy copies between the local paths and remote with the scp protocol rather than sftp, see --protocol
+func scpCopy(ctx context.Context, cmd *cobra.Command, remote *zsshlib.RemoteSpec, localFilePaths []string, upload bool, opts *zsshlib.TransferOptions) {
+	sshConn := establish(cmd, remote)
+	defer func() { _ = sshConn.Close() }()
+	if flags.Cwd != "" {
+		if err := zsshlib.CheckRemoteDir(ctx, sshConn, flags.Cwd); err != nil {
+			logrus.Fatal(err)
+		}
+		remote.Path = zsshlib.RemotePathIn(flags.Cwd, remote.Path)
+	}
+
+	if !upload {
+		if err := zsshlib.ScpRetrieve(ctx, sshConn, localFilePaths[0], remote.Path, flags.Recursive, opts); err != nil {
+			logrus.Fatalf("failed to retrieve: %s [%v]", remote.Path, err)
+		}
+		reportStats(opts, "received")
+		runExec(ctx, sshConn, nil)
+		return
+	}
+	var failures []error
+	for _, localFilePath := range localFilePaths {
+		if err := zsshlib.ScpSend(ctx, sshConn, localFilePath, remote.Path, flags.Recursive, opts); err != nil {
+			err = fmt.Errorf("could not send: %s [%w]", localFilePath, err)
+			if !flags.KeepGoing || ctx.Err() != nil {
+				logrus.Fatal(err)
+			}
+			failures = append(failures, err)
+		}
+	}
+	reportStats(opts, "sent")
+	runExec(ctx, sshConn, joinFailures(failures))
+}
+
+// reportStats writes a summary of the bytes transferred, in the direction given by verb, and the throughput to stderr
+// unless --quiet
+func reportStats(opts *zsshlib.TransferOptions, verb string) {
+	if flags.Quiet {
+		return
+	}
+	if summary := opts.Stats.Summary(verb); summary != "" {
+		_, _ = fmt.Fprintln(os.Stderr, summary)
+	}
+}
+
+// joinFailures returns the error zscp fails with after the transfers which failed with --keep-going, nil when none did
+func joinFailures(failures []error) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d transfers failed:\n%w", len(failures), errors.Join(failures...))
+}
+
+// runExec runs --exec on sshConn once every transfer has succeeded, streaming its output, and otherwise fails with
+// transferErr. zscp exits with the command's exit code when it fails.
+func runExec(ctx context.Context, sshConn *ssh.Client, transferErr error) {
+	if flags.DryRun && flags.Exec != "" && transferErr == nil {
+		zsshlib.Logger().Infof("would execute: %s", flags.Exec)
+		return
+	}
+	exitCode, err := zsshlib.ExecAfterTransfer(ctx, sshConn, transferErr, flags.Cwd, flags.Exec, os.Stdout, os.Stderr)
+	if err != nil {
+		if transferErr == nil {
+			err = fmt.Errorf("error executing remote command: %w", err)
+		}
+		logrus.Fatal(err)
+	}
+	if exitCode != 0 {
+		_ = sshConn.Close()
+		os.Exit(exitCode)
+	}
+}
+
+// establish establishes the ssh connection to remote. The settings ~/.ssh/config and the config file have for remote
+// are applied to the flags as given on the command line, so those of one remote of a --batch don't carry over to the
+// next, and the connection is made with a copy of the result.
+func establish(cmd *cobra.Command, remote *zsshlib.RemoteSpec) *ssh.Client {
+	resetFlags(cmd)
+	targetIdentity := zsshlib.ApplySshConfig(&flags.SshFlags, remote.Identity)
+	cfg := zsshlib.FindConfig(flags.ConfigFile, targetIdentity)
+	zsshlib.Combine(cmd, &flags.SshFlags, cfg)
+
+	f := flags.SshFlags
+	sshConn, err := zsshlib.EstablishClient(&f, remote.User, targetIdentity)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return sshConn
+}
+
+// resetFlags puts flags, and whether each of cmd's flags was set, back to how they were given on the command line,
+// undoing what was applied for a previous remote. The first call records them.
+func resetFlags(cmd *cobra.Command) {
+	if commandLine == nil {
+		given := flags
+		commandLine, commandLineSet = &given, map[string]bool{}
+		cmd.Flags().Visit(func(flag *pflag.Flag) { commandLineSet[flag.Name] = true })
+		return
+	}
+	flags = *commandLine
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) { flag.Changed = commandLineSet[flag.Name] })
+}
+
+// connect establishes the ssh connection and sftp client for remote, returning them along with the remote path as
+// resolved by the remote, relative to --cwd when set
+func connect(cmd *cobra.Command, remote *zsshlib.RemoteSpec) (*ssh.Client, *sftp.Client, string) {
+	sshConn := establish(cmd, remote)
+	client, err := zsshlib.NewSftpClient(sshConn, flags.SftpSubsystem)
+	if err != nil {
+		_ = sshConn.Close()
+		if zsshlib.IsSftpUnavailable(err) {
+			logrus.Fatalf("error creating sftp client: %v. the server may not offer sftp, try --sftp-subsystem or --protocol %s", err, zsshlib.ProtocolScp)
+		}
+		logrus.Fatalf("error creating sftp client: %v", err)
+	}
+
+	remotePath := remote.Path
+	if flags.Cwd != "" {
+		cwd, err := zsshlib.ResolveRemoteDir(client, flags.Cwd)
+		if err != nil {
+			_ = client.Close()
+			_ = sshConn.Close()
+			logrus.Fatal(err)
+		}
+		remotePath = zsshlib.RemotePathIn(cwd, remotePath)
+	}
+	remotePath, err = zsshlib.ExpandRemoteHome(client, remotePath)
+	if err != nil {
+		_ = client.Close()
+		_ = sshConn.Close()
+		logrus.Fatal(err)
+	}
+	resolved, err := client.RealPath(remotePath)
+	if err != nil {
+		_ = client.Close()
+		_ = sshConn.Close()
+		logrus.Fatalf("cannot find remote file path: %s [%v]", remotePath, err)
+	}
+	return sshConn, client, resolved
+}
+
+const sftpSubsystemUsage = "sftp subsystem to request, e.g. internal-sftp for servers offering sftp under another name, or the path of an sftp server to run, e.g. /usr/lib/openssh/sftp-server. a refused subsystem falls back to sftp"
+
+func init() {
+	lsCmd.Flags().BoolVarP(&longListing, "long", "l", false, "long listing showing the mode, size and modification time of each entry")
+	rmCmd.Flags().BoolVarP(&rmRecursive, "recursive", "r", false, "remove directories and their contents recursively")
+	for _, remoteCmd := range []*cobra.Command{lsCmd, rmCmd, mkdirCmd} {
+		remoteCmd.Flags().StringVar(&flags.Cwd, "cwd", "", "remote directory relative remote paths are resolved against. it must exist")
+		remoteCmd.Flags().StringVar(&flags.SftpSubsystem, "sftp-subsystem", zsshlib.DefaultSftpSubsystem, sftpSubsystemUsage)
+		flags.OIDCFlags(remoteCmd)
+		flags.AddCommonFlags(remoteCmd)
+		rootCmd.AddCommand(remoteCmd)
+	}
+
+	flags.OIDCFlags(rootCmd)
+	rootCmd.Flags().BoolVarP(&flags.Interactive, "interactive", "I", false, "open an interactive sftp> shell on <remoteUsername>@<targetIdentity>[:Remote Path]. type help for its commands")
+	rootCmd.Flags().StringVar(&flags.Batch, "batch", "", "run the transfers listed in a file, one `src dst` pair per line, over a single connection to each remote. blank lines and lines starting with # are ignored")
+	rootCmd.Flags().BoolVarP(&flags.Recursive, "recursive", "r", false, "pass to enable recursive file transfer")
+	rootCmd.Flags().IntVar(&flags.Parallel, "parallel", 1, "number of files to send concurrently during recursive uploads, at most 8")
+	rootCmd.Flags().IntVar(&flags.Concurrency, "concurrency", zsshlib.DefaultConcurrency, "sftp requests kept in flight for each file, at most 64. raising it speeds up transfers over high latency links")
+	rootCmd.Flags().BoolVar(&flags.KeepGoing, "keep-going", false, "carry on with the remaining files when one fails, reporting every failure at the end")
+	rootCmd.Flags().IntVar(&flags.FileRetries, "file-retries", 0, "times to retry each file of a recursive transfer before skipping it")
+	rootCmd.Flags().BoolVar(&flags.FollowSymlinks, "follow-symlinks", false, "copy what symlinks point to instead of recreating the links. links may lead outside the source directory, only use with trusted sources")
+	rootCmd.Flags().BoolVar(&flags.DryRun, "dry-run", false, "connect and log what would be transferred and created without writing anything")
+	rootCmd.Flags().BoolVar(&flags.Progress, "progress", false, "show transfer progress, rate and ETA on stderr")
+	rootCmd.Flags().BoolVar(&flags.Verify, "verify", false, "verify the SHA-256 checksum of each file after it is transferred")
+	rootCmd.Flags().StringVar(&flags.Limit, "limit", "", "limit each transfer to a rate in bytes per second, e.g. 512K or 2M. default: unlimited")
+	rootCmd.Flags().BoolVar(&flags.KeepPartial, "keep-partial", false, "keep the .part files of failed transfers, which are otherwise removed, without continuing from them")
+	rootCmd.Flags().BoolVar(&flags.Resume, "resume", false, "keep the .part files of interrupted transfers and continue from them")
+	rootCmd.Flags().BoolVar(&flags.NoGlob, "no-glob", false, "don't expand *, ? and [ in paths, for file names containing them")
+	rootCmd.Flags().BoolVar(&flags.Sparse, "sparse", false, "skip writing blocks of zeros, leaving holes in the destination so sparse files such as VM images stay sparse")
+	rootCmd.Flags().BoolVarP(&flags.Compress, "compress", "C", false, "gzip files in transit, trading CPU for bandwidth on slow links. requires gzip on the remote")
+	rootCmd.Flags().BoolVar(&flags.MakeDirs, "mkdirs", false, "create missing remote parent directories of the destination. recursive uploads always create the destination directory")
+	rootCmd.Flags().StringVar(&flags.SftpSubsystem, "sftp-subsystem", zsshlib.DefaultSftpSubsystem, sftpSubsystemUsage)
+	rootCmd.Flags().StringVar(&flags.Protocol, "protocol", zsshlib.ProtocolSftp, "transfer protocol: sftp, or scp for servers without sftp, which requires scp on the remote")
+	rootCmd.Flags().StringVar(&flags.Cwd, "cwd", "", "remote directory relative remote paths are resolved against, and --exec is run in. it must exist")
+	rootCmd.Flags().StringVar(&flags.Exec, "exec", "", "command to run on the remote, over the same connection, once every transfer has succeeded, e.g. to unpack or restart. zscp exits with its exit code")
+	rootCmd.Flags().BoolVar(&flags.Preserve, "preserve", false, "preserve modification times, like scp -p. permissions are always preserved. there is no -p, which is --callbackPort")
+}
+
+// addCommands completes rootCmd with the common flags and the subcommands
+func addCommands() {
 	p := common.NewOptionsProvider(os.Stdout, os.Stderr)
 	flags.AddCommonFlags(rootCmd)
+	zsshlib.AddVersionCommand(rootCmd)
+	flags.SshFlags.AddListAlgorithmsFlag(rootCmd)
 	rootCmd.AddCommand(enrollment.NewEnrollCommand(p))
 	rootCmd.AddCommand(zsshlib.NewMfaCmd(&flags.SshFlags))
 	rootCmd.AddCommand(gendoc.NewGendocCmd(rootCmd))
+}
+
+func main() {
+	addCommands()
 	e := rootCmd.Execute()
 	if e != nil {
 		logrus.Error(e)
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCommandTree builds every command, as main does, and parses --help for each so a flag or shorthand claimed twice
+// panics here rather than on startup
+func TestCommandTree(t *testing.T) {
+	addCommands()
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		path := strings.Fields(cmd.CommandPath())[1:]
+		rootCmd.SetArgs(append(path, "--help"))
+		rootCmd.SetOut(io.Discard)
+		assert.NotPanics(t, func() { _ = rootCmd.Execute() }, cmd.CommandPath())
+		for _, sub := range cmd.Commands() {
+			visit(sub)
+		}
+	}
+	visit(rootCmd)
+}
@@ -18,12 +18,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"zssh/zsshlib"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/openziti/cobra-to-md"
 	"github.com/openziti/ziti/common/enrollment"
@@ -33,44 +39,219 @@ import (
 const ExpectedServiceAndExeName = "zssh"
 
 var (
-	flags   = zsshlib.SshFlags{}
-	version = "v0.0.0"
-	commit  = "unknown"
-	date    = "unknown"
+	flags = zsshlib.SshFlags{}
 )
 
 var rootCmd = &cobra.Command{
-	Use:     fmt.Sprintf("%s %s <remoteUsername>@<targetIdentity>", ExpectedServiceAndExeName, flags.ServiceName),
-	Short:   "Z(iti)ssh, Carb-loaded ssh performs faster and stronger than ssh",
-	Long:    "Z(iti)ssh is a version of ssh that utilizes a ziti network to provide a faster and more secure remote connection. A ziti connection must be established before use",
-	Version: fmt.Sprintf("%s (built:%s, hash:%s)", version, date, commit),
-	Args:    cobra.MinimumNArgs(1),
+	Use:   fmt.Sprintf("%s %s <remoteUsername>@<targetIdentity> [-- command [args...]]", ExpectedServiceAndExeName, flags.ServiceName),
+	Short: "Z(iti)ssh, Carb-loaded ssh performs faster and stronger than ssh",
+	Long:  "Z(iti)ssh is a version of ssh that utilizes a ziti network to provide a faster and more secure remote connection. A ziti connection must be established before use",
+	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 1 {
-			fmt.Println("You need to specify at least one positional argument")
+			fmt.Fprintln(os.Stderr, "You need to specify at least one positional argument")
 			os.Exit(1)
 		}
 
 		logrus.StandardLogger().Level = logrus.FatalLevel
-		if flags.Debug {
-			zsshlib.Logger().SetLevel(logrus.DebugLevel)
+		if err := flags.ConfigureLogger(); err != nil {
+			logrus.Fatal(err)
 		}
 
-		targetIdentity := zsshlib.ParseTargetIdentity(args[0])
-		cfg := zsshlib.FindConfigByKey(targetIdentity)
+		if len(flags.Targets) > 0 {
+			os.Exit(runOnTargets(cmd, args))
+		}
+
+		targetIdentity := flags.ParseTarget(args[0])
+		targetIdentity = zsshlib.ApplySshConfig(&flags, targetIdentity)
+		cfg := zsshlib.FindConfig(flags.ConfigFile, targetIdentity)
 		zsshlib.Combine(cmd, &flags, cfg)
 
+		env, err := flags.Environment()
+		if err != nil {
+			zsshlib.Logger().Fatal(err)
+		}
+
 		cmdArgs := args[1:]
-		sshClient := zsshlib.EstablishClient(&flags, args[0], targetIdentity)
+		if flags.Cwd != "" && len(cmdArgs) == 0 {
+			zsshlib.Logger().Fatal("--cwd requires a command to run")
+		}
+		if flags.ControlMaster {
+			if flags.ControlPath == "" {
+				zsshlib.Logger().Fatal("--control-master requires --control-path")
+			}
+			if len(cmdArgs) > 0 || flags.ForwardAgent {
+				zsshlib.Logger().Fatal("--control-master cannot be combined with a command or --forward-agent, it only serves later invocations")
+			}
+		}
+		userName := zsshlib.ParseUserName(args[0], false)
+		if flags.ControlPath != "" && !flags.ControlMaster && len(cmdArgs) > 0 {
+			if exitCode, ok := runThroughControlMaster(userName, targetIdentity, cmdArgs, env); ok {
+				os.Exit(exitCode)
+			}
+		}
+		sshClient, err := zsshlib.EstablishClient(&flags, userName, targetIdentity)
+		if err != nil {
+			zsshlib.Logger().Fatal(err)
+		}
 		defer func() { _ = sshClient.Close() }()
-		if err := zsshlib.RemoteShell(sshClient, cmdArgs); err != nil {
+
+		// an interrupt stops port forwarding, and abandons the remote command rather than leaving zssh waiting on it
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		forwards := startForwards(ctx, sshClient)
+		if flags.ControlMaster {
+			exitCode := serveControl(ctx, sshClient, flags.ControlSocket(userName, targetIdentity), env)
+			_ = sshClient.Close()
+			os.Exit(exitCode)
+		}
+		if flags.ForwardOnly {
+			forwards.Wait()
+			return
+		}
+
+		sessionOpts := []zsshlib.SessionOption{zsshlib.WithEnv(env)}
+		if flags.ForwardAgent {
+			if err := zsshlib.ForwardAgent(sshClient); err != nil {
+				zsshlib.Logger().Fatalf("unable to forward agent: %v", err)
+			}
+			sessionOpts = append(sessionOpts, zsshlib.WithAgentForwarding())
+		}
+		if len(cmdArgs) > 0 {
+			exitCode, err := zsshlib.RunCommand(ctx, sshClient, zsshlib.CommandIn(flags.Cwd, strings.Join(cmdArgs, " ")), zsshlib.PipedStdin(), os.Stdout, os.Stderr, sessionOpts...)
+			if err != nil {
+				zsshlib.Logger().Fatalf("error executing remote command: %v", err)
+			}
+			_ = sshClient.Close()
+			os.Exit(exitCode)
+		}
+		var exitCode int
+		if flags.Reconnect {
+			reconnect := func() (*ssh.Client, error) {
+				client, err := zsshlib.EstablishClient(&flags, userName, targetIdentity)
+				if err == nil && flags.ForwardAgent {
+					if err = zsshlib.ForwardAgent(client); err != nil {
+						_ = client.Close()
+					}
+				}
+				return client, err
+			}
+			sshClient, exitCode, err = zsshlib.ReconnectShell(ctx, sshClient, &flags, flags.ReconnectAttempts, reconnect, sessionOpts...)
+		} else {
+			exitCode, err = zsshlib.RemoteShell(ctx, sshClient, &flags, cmdArgs, sessionOpts...)
+		}
+		if errors.Is(err, zsshlib.ErrIdleTimeout) {
+			zsshlib.Logger().Warn(err)
+			_ = sshClient.Close()
+			os.Exit(1)
+		} else if errors.Is(err, zsshlib.ErrConnectionLost) {
+			zsshlib.Logger().Error(err)
+			_ = sshClient.Close()
+			os.Exit(255)
+		} else if err != nil {
 			zsshlib.Logger().Fatalf("error opening remote shell: %v", err)
 		}
+		_ = sshClient.Close()
+		os.Exit(exitCode)
 	},
 }
 
+// runOnTargets runs the command in args on each of --targets, reporting the exit status of each, and returns the exit
+// code for zssh
+func runOnTargets(cmd *cobra.Command, args []string) int {
+	zsshlib.Combine(cmd, &flags, zsshlib.FindConfig(flags.ConfigFile, zsshlib.DefaultsKey))
+	if flags.ForwardOnly || flags.ForwardAgent || len(flags.LocalForwards) > 0 || len(flags.RemoteForwards) > 0 {
+		zsshlib.Logger().Fatal("port and agent forwarding are not supported with --targets")
+	}
+	env, err := flags.Environment()
+	if err != nil {
+		zsshlib.Logger().Fatal(err)
+	}
+	transport, err := zsshlib.NewZitiTransport(&flags)
+	if err != nil {
+		zsshlib.Logger().Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	results := zsshlib.RunOnTargets(ctx, &flags, transport, flags.Targets, zsshlib.CommandIn(flags.Cwd, strings.Join(args, " ")), os.Stdout, os.Stderr,
+		flags.ParallelTargets, zsshlib.WithEnv(env))
+	return zsshlib.ReportTargetResults(os.Stderr, results)
+}
+
+// runThroughControlMaster runs the command in cmdArgs over the connection of the control master for the target, see
+// --control-path, reporting false when there is no master to run it through so zssh connects itself
+func runThroughControlMaster(userName string, targetIdentity string, cmdArgs []string, env []string) (int, bool) {
+	if flags.ForwardAgent || len(flags.LocalForwards) > 0 || len(flags.RemoteForwards) > 0 {
+		zsshlib.Logger().Debug("not using the control master, forwarding requires a connection of its own")
+		return 0, false
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	socket := flags.ControlSocket(userName, targetIdentity)
+	exitCode, err := zsshlib.RunControlCommand(ctx, socket, zsshlib.CommandIn(flags.Cwd, strings.Join(cmdArgs, " ")), env, zsshlib.PipedStdin(), os.Stdout, os.Stderr)
+	if errors.Is(err, zsshlib.ErrNoControlMaster) {
+		zsshlib.Logger().Debugf("%v, connecting directly", err)
+		return 0, false
+	} else if err != nil {
+		zsshlib.Logger().Fatalf("error executing remote command through the control master: %v", err)
+	}
+	return exitCode, true
+}
+
+// serveControl shares sshClient with later invocations on socket until ctx is done, see --control-master, and returns
+// the exit code for zssh
+func serveControl(ctx context.Context, sshClient *ssh.Client, socket string, env []string) int {
+	err := zsshlib.ServeControl(ctx, sshClient, socket, zsshlib.WithEnv(env))
+	if errors.Is(err, zsshlib.ErrConnectionLost) {
+		zsshlib.Logger().Error(err)
+		return 255
+	} else if err != nil {
+		zsshlib.Logger().Fatal(err)
+	}
+	return 0
+}
+
+// startForwards starts each requested local and remote port forward in the background, until ctx is done
+func startForwards(ctx context.Context, sshClient *ssh.Client) *sync.WaitGroup {
+	forwards := &sync.WaitGroup{}
+	start := func(forward func(context.Context, *ssh.Client, string) error, spec string) {
+		forwards.Add(1)
+		go func() {
+			defer forwards.Done()
+			if err := forward(ctx, sshClient, spec); err != nil {
+				zsshlib.Logger().Errorf("port forward %s failed: %v", spec, err)
+			}
+		}()
+	}
+	for _, spec := range flags.LocalForwards {
+		start(zsshlib.Forward, spec)
+	}
+	for _, spec := range flags.RemoteForwards {
+		start(zsshlib.ReverseForward, spec)
+	}
+	return forwards
+}
+
 func init() {
 	flags.OIDCFlags(rootCmd)
+	rootCmd.Flags().StringArrayVarP(&flags.LocalForwards, "local-forward", "L", []string{}, "forward a local port to a host reachable from the target: [bind_address:]port:host:hostport. Can specify multiple times")
+	rootCmd.Flags().StringArrayVarP(&flags.RemoteForwards, "remote-forward", "R", []string{}, "forward a port on the target to a host reachable locally: [bind_address:]port:host:hostport. Can specify multiple times")
+	rootCmd.Flags().BoolVarP(&flags.ForwardOnly, "forward-only", "N", false, "do not open a shell or run a command, only forward ports until interrupted")
+	rootCmd.Flags().BoolVarP(&flags.ForwardAgent, "forward-agent", "A", false, "forward the local ssh agent to the remote. only enable for trusted remotes")
+	rootCmd.Flags().StringArrayVar(&flags.Env, "env", []string{}, "KEY=VALUE to set in the remote environment. Can specify multiple times")
+	rootCmd.Flags().StringArrayVar(&flags.SendEnv, "send-env", []string{}, "send local environment variables with names matching the pattern, e.g. 'LC_*'. Can specify multiple times")
+	rootCmd.Flags().StringSliceVar(&flags.Targets, "targets", []string{}, "run the command on each of these comma separated [user@]identities instead, e.g. --targets a,b,c -- uptime")
+	rootCmd.Flags().IntVar(&flags.ParallelTargets, "parallel", zsshlib.DefaultParallelTargets, "the number of --targets to run the command on at once")
+	rootCmd.Flags().BoolVar(&flags.Reconnect, "reconnect", false, "reconnect and reopen the interactive shell when the connection drops, rather than exiting. port forwards are not restarted")
+	rootCmd.Flags().IntVar(&flags.ReconnectAttempts, "reconnect-attempts", zsshlib.DefaultReconnectAttempts, "times to try reconnecting each time the connection drops, see --reconnect")
+	rootCmd.Flags().BoolVar(&flags.ControlMaster, "control-master", false, "keep the connection open, along with any port forwards, and share it on the --control-path socket with later invocations until interrupted")
+	rootCmd.Flags().StringVar(&flags.ControlPath, "control-path", "", "unix socket of a --control-master. commands run with it go over the master's connection rather than connecting, falling back to connecting when no master is listening. %h is replaced by the target identity and %r the remote user, e.g. ~/.ssh/zssh-%r@%h")
+	rootCmd.Flags().StringVar(&flags.Cwd, "cwd", "", "remote directory to run the command in. the command isn't run when it doesn't exist")
+	rootCmd.Flags().DurationVar(&flags.DeadAfter, "dead-after", 0, "during an interactive shell, probe the server and report the connection lost once it hasn't answered for this long, e.g. 30s. default: 0 (only report failed connections)")
+	rootCmd.Flags().DurationVar(&flags.IdleTimeout, "idle-timeout", 0, "disconnect an interactive shell after no input for this long, e.g. 15m. default: 0 (never)")
+	rootCmd.Flags().StringVar(&flags.Term, "term", "", "terminal type to request for the remote pty. default: $TERM or "+zsshlib.DEFAULT_TERM)
 }
 
 // AuthCmd holds the required data for the init cmd
@@ -97,14 +278,22 @@ func (cmd *AuthCmd) Run(_ *cobra.Command, _ []string) error {
 	return err
 }
 
-func main() {
+// addCommands completes rootCmd with the common flags and the subcommands
+func addCommands() {
 	flags.AddCommonFlags(rootCmd)
+	zsshlib.AddVersionCommand(rootCmd)
+	flags.AddListAlgorithmsFlag(rootCmd)
 	rootCmd.AddCommand(zsshlib.NewMfaCmd(&flags))
+	rootCmd.AddCommand(zsshlib.NewCheckCmd(&flags))
 	rootCmd.AddCommand(gendoc.NewGendocCmd(rootCmd))
 	p := common.NewOptionsProvider(os.Stdout, os.Stderr)
 	rootCmd.AddCommand(enrollment.NewEnrollCommand(p))
 
 	// leave out for now // rootCmd.AddCommand(NewAuthCmd(p))
+}
+
+func main() {
+	addCommands()
 	e := rootCmd.Execute()
 	if e != nil {
 		zsshlib.Logger().Error(e)
@@ -0,0 +1,112 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The algorithms golang.org/x/crypto/ssh supports as a client, which doesn't export them, and those it offers by
+// default. The rest are offered only when selected, as they are weak or slow, but may be all an older server accepts.
+var (
+	supportedCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	}
+	defaultCiphers = supportedCiphers[:6]
+
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+	defaultMACs = supportedMACs
+
+	supportedKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+		"diffie-hellman-group16-sha512", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+		"diffie-hellman-group1-sha1",
+	}
+	defaultKeyExchanges = supportedKeyExchanges[:7]
+)
+
+// Algorithms are the ciphers, MACs and key exchange algorithms offered to servers, in order of preference. Empty
+// lists offer the defaults.
+type Algorithms struct {
+	Ciphers      []string
+	MACs         []string
+	KeyExchanges []string
+}
+
+// Algorithms returns the algorithms selected with --ciphers, --macs and --kex, failing on any that aren't supported
+func (f *SshFlags) Algorithms() (Algorithms, error) {
+	a := Algorithms{Ciphers: f.Ciphers, MACs: f.MACs, KeyExchanges: f.KexAlgorithms}
+	for _, check := range []struct {
+		kind      string
+		selected  []string
+		supported []string
+	}{
+		{"cipher", a.Ciphers, supportedCiphers},
+		{"MAC", a.MACs, supportedMACs},
+		{"key exchange algorithm", a.KeyExchanges, supportedKeyExchanges},
+	} {
+		for _, name := range check.selected {
+			if !slices.Contains(check.supported, name) {
+				return a, fmt.Errorf("unsupported %s [%s], expected one of: %s", check.kind, name, strings.Join(check.supported, ", "))
+			}
+		}
+	}
+	return a, nil
+}
+
+// apply sets the algorithms of config which were selected
+func (a Algorithms) apply(config *ssh.Config) {
+	if len(a.Ciphers) > 0 {
+		config.Ciphers = a.Ciphers
+	}
+	if len(a.MACs) > 0 {
+		config.MACs = a.MACs
+	}
+	if len(a.KeyExchanges) > 0 {
+		config.KeyExchanges = a.KeyExchanges
+	}
+}
+
+// ListAlgorithms writes the supported ciphers, MACs and key exchange algorithms to out, marking those offered by
+// default, for --list-algorithms
+func ListAlgorithms(out io.Writer) {
+	list := func(title string, supported []string, defaults []string) {
+		_, _ = fmt.Fprintf(out, "%s:\n", title)
+		for _, name := range supported {
+			if slices.Contains(defaults, name) {
+				_, _ = fmt.Fprintf(out, "  %s (default)\n", name)
+			} else {
+				_, _ = fmt.Fprintf(out, "  %s\n", name)
+			}
+		}
+	}
+	list("ciphers (--ciphers)", supportedCiphers, defaultCiphers)
+	list("MACs (--macs)", supportedMACs, defaultMACs)
+	list("key exchange algorithms (--kex)", supportedKeyExchanges, defaultKeyExchanges)
+}
@@ -0,0 +1,62 @@
+package zsshlib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAlgorithms(t *testing.T) {
+	a, err := (&SshFlags{}).Algorithms()
+	assert.NoError(t, err)
+	assert.Empty(t, a.Ciphers)
+
+	a, err = (&SshFlags{Ciphers: []string{"aes256-ctr", "aes128-cbc"}, MACs: []string{"hmac-sha1"}, KexAlgorithms: []string{"diffie-hellman-group1-sha1"}}).Algorithms()
+	assert.NoError(t, err)
+	factory := NewSshConfigFactoryImpl("test", nil, WithInsecure(true), WithAlgorithms(a))
+	config := factory.Config()
+	assert.Equal(t, []string{"aes256-ctr", "aes128-cbc"}, config.Ciphers)
+	assert.Equal(t, []string{"hmac-sha1"}, config.MACs)
+	assert.Equal(t, []string{"diffie-hellman-group1-sha1"}, config.KeyExchanges)
+
+	_, err = (&SshFlags{Ciphers: []string{"blowfish-cbc"}}).Algorithms()
+	assert.ErrorContains(t, err, "unsupported cipher [blowfish-cbc], expected one of: aes128-gcm@openssh.com")
+	_, err = (&SshFlags{MACs: []string{"umac-64@openssh.com"}}).Algorithms()
+	assert.ErrorContains(t, err, "unsupported MAC [umac-64@openssh.com]")
+	_, err = (&SshFlags{KexAlgorithms: []string{"sntrup761x25519-sha512@openssh.com"}}).Algorithms()
+	assert.ErrorContains(t, err, "unsupported key exchange algorithm [sntrup761x25519-sha512@openssh.com]")
+
+	out := &bytes.Buffer{}
+	ListAlgorithms(out)
+	assert.Contains(t, out.String(), "  aes128-ctr (default)\n")
+	assert.Contains(t, out.String(), "  3des-cbc\n")
+	assert.Contains(t, out.String(), "key exchange algorithms (--kex):\n")
+}
+
+func TestAlgorithmsHandshake(t *testing.T) {
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		_ = newChannel.Reject(ssh.Prohibited, "no channels")
+	})
+	dial := func(flags *SshFlags) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags.Insecure = true
+		client, err := EstablishClientWithConn(flags, conn, "test", "target")
+		if err == nil {
+			_ = client.Close()
+		}
+		return err
+	}
+	assert.NoError(t, dial(&SshFlags{Ciphers: []string{"aes256-ctr"}, KexAlgorithms: []string{"ecdh-sha2-nistp384"}}))
+	assert.ErrorContains(t, dial(&SshFlags{Ciphers: []string{"3des-cbc"}}), "no common algorithm", "the server doesn't accept 3des-cbc")
+
+	conn, unused := net.Pipe()
+	defer func() { _ = unused.Close() }()
+	_, err := EstablishClientWithConn(&SshFlags{Insecure: true, MACs: []string{"md5"}}, conn, "test", "target")
+	assert.ErrorContains(t, err, "unsupported MAC [md5]")
+}
@@ -0,0 +1,44 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// askpassProgram returns the program set in ASKPASS_ENV, or an empty string when there is none
+func askpassProgram() string {
+	return os.Getenv(ASKPASS_ENV)
+}
+
+// askpass runs the ASKPASS_ENV program with prompt as its only argument, as ssh does SSH_ASKPASS, and returns the
+// first line it writes to stdout. A program exiting with a non-zero status, such as when its dialog is cancelled, is
+// an error.
+func askpass(prompt string) (string, error) {
+	program := askpassProgram()
+	cmd := exec.Command(program, prompt)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s program [%s] failed: %w", ASKPASS_ENV, program, err)
+	}
+	answer, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSuffix(answer, "\r"), nil
+}
@@ -3,8 +3,10 @@ package zsshlib
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/openziti/edge-api/rest_model"
@@ -12,26 +14,58 @@ import (
 	"github.com/openziti/sdk-golang/ziti"
 )
 
-func NewContext(flags *SshFlags, enableMfaListener bool) ziti.Context {
+// ErrPreJumpUnsupported is returned for --pre-jump. Reaching the ziti network through a bastion needs the edge router
+// connections of the ziti SDK to be dialed through it, which the SDK has no option for.
+var ErrPreJumpUnsupported = errors.New("--pre-jump is not supported: the ziti SDK can't dial edge routers through an ssh bastion")
+
+// NewContext creates a ziti context from the identity file or, for OIDC only auth, from the controller and the token
+// obtained by the OIDC flow
+func NewContext(flags *SshFlags, enableMfaListener bool) (ziti.Context, error) {
 	oidcToken := ""
 	var oidcErr error
 
 	if flags.OIDC.OIDCOnly && !flags.OIDC.Mode {
 		flags.OIDC.Mode = true //override Mode to true
 	}
+	if flags.OIDC.UserFromCert && !flags.OIDC.Mode {
+		return nil, fmt.Errorf("--user-from-cert requires --oidc")
+	}
+	if flags.Enroll != "" && flags.OIDC.OIDCOnly {
+		return nil, fmt.Errorf("--enroll can't be used with --oidcOnly, which doesn't use a ziti identity")
+	}
+	if flags.EnrollSave && flags.Enroll == "" {
+		return nil, fmt.Errorf("--enroll-save requires --enroll")
+	}
+	if flags.PreJump != "" {
+		return nil, ErrPreJumpUnsupported
+	}
 
 	if flags.OIDC.Mode {
 		oidcToken, oidcErr = OIDCFlow(context.Background(), flags)
 		if oidcErr != nil {
-			log.Fatalf("error performing OIDC flow: %v", oidcErr)
+			return nil, fmt.Errorf("error performing OIDC flow: %w", oidcErr)
 		}
 	}
 	var ctx ziti.Context
 	if !flags.OIDC.OIDCOnly {
-		conf := getConfig(flags.ZConfig)
+		var conf *ziti.Config
+		if flags.Enroll != "" {
+			enrolled, err := flags.enrolledConfig()
+			if err != nil {
+				return nil, err
+			}
+			conf = enrolled
+		} else {
+			selected, err := selectConfig(flags.ZConfigs, flags.Network)
+			if err != nil {
+				return nil, err
+			}
+			conf = selected.Config
+		}
+		requestServiceConfigs(conf)
 		c, err := ziti.NewContext(conf)
 		if err != nil {
-			log.Fatalf("error creating ziti context: %v", err)
+			return nil, fmt.Errorf("error creating ziti context: %w", err)
 		}
 		ctx = c
 		conf.Credentials.AddJWT(oidcToken)
@@ -42,7 +76,7 @@ func NewContext(flags *SshFlags, enableMfaListener bool) ziti.Context {
 		}
 		caPool, err := ziti.GetControllerWellKnownCaPool(ozController)
 		if err != nil {
-			log.Fatalf("error creating ziti context: %v", err)
+			return nil, fmt.Errorf("error retrieving the controller CA pool: %w", err)
 		}
 
 		credentials := edgeapis.NewJwtCredentials(oidcToken)
@@ -56,7 +90,7 @@ func NewContext(flags *SshFlags, enableMfaListener bool) ziti.Context {
 
 		c, ctxErr := ziti.NewContext(cfg)
 		if ctxErr != nil {
-			log.Fatalf("error creating ziti context: %v", ctxErr)
+			return nil, fmt.Errorf("error creating ziti context: %w", ctxErr)
 		}
 		ctx = c
 	}
@@ -65,10 +99,10 @@ func NewContext(flags *SshFlags, enableMfaListener bool) ziti.Context {
 		ctx.Events().AddMfaTotpCodeListener(func(c ziti.Context, detail *rest_model.AuthQueryDetail, response ziti.MfaCodeResponse) {
 			ok := false
 			for !ok {
-				fmt.Println("MFA TOTP required to fully authenticate")
+				fmt.Fprintln(os.Stderr, "MFA TOTP required to fully authenticate")
 				code := ReadCode(false)
 				if err := response(code); err != nil {
-					fmt.Println("error verifying MFA TOTP: ", err)
+					fmt.Fprintln(os.Stderr, "error verifying MFA TOTP: ", err)
 				} else {
 					ok = true
 				}
@@ -76,21 +110,42 @@ func NewContext(flags *SshFlags, enableMfaListener bool) ziti.Context {
 		})
 	}
 
-	return ctx
+	return ctx, nil
 }
 
-func Auth(ctx ziti.Context) {
+// requestServiceConfigs adds the config types LookupServiceConfig reads to those conf requests, as the controller only
+// returns the service configs of the types requested
+func requestServiceConfigs(conf *ziti.Config) {
+	if slices.Contains(conf.ConfigTypes, "all") {
+		return
+	}
+	for _, configType := range []string{ziti.InterceptV1, ziti.ClientConfigV1} {
+		if !slices.Contains(conf.ConfigTypes, configType) {
+			conf.ConfigTypes = append(conf.ConfigTypes, configType)
+		}
+	}
+}
+
+func Auth(ctx ziti.Context) error {
 	if err := ctx.Authenticate(); err != nil {
-		log.Errorf("error creating ziti context: %v", err)
-		log.Fatalf("could not authenticate. verify your identity is correct and matches all necessary authentication conditions.")
+		return fmt.Errorf("could not authenticate. verify your identity is correct and matches all necessary authentication conditions: %w", err)
 	}
+	return nil
 }
 
+// ReadCode reads an MFA TOTP code from the terminal, or from the ASKPASS_ENV program when set
 func ReadCode(allowEmpty bool) string {
+	if askpassProgram() != "" {
+		code, err := askpass("MFA TOTP code: ")
+		if err == nil {
+			return strings.TrimSpace(code)
+		}
+		log.Warnf("%v, reading the code from the terminal", err)
+	}
 	code := ""
 	reader := bufio.NewReader(os.Stdin)
 	for code == "" {
-		fmt.Print("MFA TOTP code: ")
+		fmt.Fprint(os.Stderr, "MFA TOTP code: ")
 		code, _ = reader.ReadString('\n')
 		code = strings.TrimSpace(code)
 		if allowEmpty {
@@ -0,0 +1,63 @@
+package zsshlib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewContextRequestsServiceConfigs(t *testing.T) {
+	identityPath := filepath.Join(t.TempDir(), "zssh.json")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "zssh"}, NotAfter: time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	cfg := &ziti.Config{ZtAPI: "https://ctrl.example.com/edge/client/v1"}
+	cfg.ID.Cert = "pem:" + certPem
+	cfg.ID.Key = "pem:" + string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	cfg.ID.CA = "pem:" + certPem
+	if err := SaveIdentity(cfg, identityPath); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(&SshFlags{ZConfigs: []string{identityPath}}, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	impl, ok := ctx.(*ziti.ContextImpl)
+	if assert.True(t, ok) {
+		assert.ElementsMatch(t, []string{ziti.InterceptV1, ziti.ClientConfigV1}, impl.CtrlClt.ConfigTypes, "the configs LookupServiceConfig reads should be requested")
+	}
+
+	all := &ziti.Config{ConfigTypes: []string{"all"}}
+	requestServiceConfigs(all)
+	assert.Equal(t, []string{"all"}, all.ConfigTypes)
+	some := &ziti.Config{ConfigTypes: []string{"host.v1", ziti.InterceptV1}}
+	requestServiceConfigs(some)
+	assert.Equal(t, []string{"host.v1", ziti.InterceptV1, ziti.ClientConfigV1}, some.ConfigTypes)
+}
+
+func TestPreJumpUnsupported(t *testing.T) {
+	_, err := NewContext(&SshFlags{PreJump: "alice@bastion:22"}, false)
+	assert.ErrorIs(t, err, ErrPreJumpUnsupported)
+}
@@ -0,0 +1,140 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// BatchTransfer is a single transfer read from a batch file by ParseBatch
+type BatchTransfer struct {
+	// Line is the line of the batch file the transfer was read from
+	Line int
+
+	// Remote is the remote side of the transfer, either the source or the destination
+	Remote *RemoteSpec
+
+	// Local is the local side of the transfer
+	Local string
+
+	// Upload is true when the local path is sent to the remote, false when the remote path is retrieved
+	Upload bool
+}
+
+func (t *BatchTransfer) String() string {
+	remote := t.Remote.Identity + ":" + t.Remote.Path
+	if t.Remote.User != "" {
+		remote = t.Remote.User + "@" + remote
+	}
+	if t.Upload {
+		return t.Local + " => " + remote
+	}
+	return remote + " => " + t.Local
+}
+
+// ParseBatch reads the transfers of a batch file, one `src dst` pair per line, where exactly one of src or dst is
+// remote, [user@]identity:path. Words containing spaces can be quoted. Blank lines and lines starting with # are
+// ignored. Every line is checked before any transfer is run, so a mistake part way through is caught up front.
+func ParseBatch(r io.Reader) ([]*BatchTransfer, error) {
+	var transfers []*BatchTransfer
+	lines := bufio.NewScanner(r)
+	for lineNum := 1; lines.Scan(); lineNum++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words, err := splitShellWords(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if len(words) != 2 {
+			return nil, fmt.Errorf("line %d: expected `src dst`, got %d words", lineNum, len(words))
+		}
+		src, err := ParseRemoteSpec(words[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		dst, err := ParseRemoteSpec(words[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		switch {
+		case src != nil && dst != nil:
+			return nil, fmt.Errorf("line %d: copying between two remotes is not supported", lineNum)
+		case src != nil:
+			transfers = append(transfers, &BatchTransfer{Line: lineNum, Remote: src, Local: words[1]})
+		case dst != nil:
+			transfers = append(transfers, &BatchTransfer{Line: lineNum, Remote: dst, Local: words[0], Upload: true})
+		default:
+			return nil, fmt.Errorf(`line %d: neither [%s] nor [%s] is remote, use ":" for the remote path`, lineNum, words[0], words[1])
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+// Run performs the transfer over client, recursively when recursive is set
+func (t *BatchTransfer) Run(ctx context.Context, client *sftp.Client, opts *TransferOptions, recursive bool) error {
+	remotePath, err := ExpandRemoteHome(client, t.Remote.Path)
+	if err != nil {
+		return err
+	}
+	if remotePath == "" {
+		remotePath = "."
+	}
+	local := expandHome(t.Local)
+	if t.Upload {
+		if _, err := os.Stat(local); err != nil {
+			return err
+		}
+		if recursive {
+			return SendDir(ctx, client, local, remotePath, opts)
+		}
+		return SendFile(ctx, client, local, AppendBaseName(client, remotePath, local, false), opts)
+	}
+
+	if recursive {
+		return RetrieveRemoteDir(ctx, client, local, remotePath, opts)
+	}
+	local, err = AppendLocalBaseName(local, remotePath)
+	if err != nil {
+		return err
+	}
+	return RetrieveRemoteFiles(ctx, client, local, remotePath, opts)
+}
+
+// RemoteHomeRelative strips a leading ~ from remotePath. sftp and scp resolve relative paths against the remote home
+// directory, so ~/dir becomes dir, and ~ the home directory itself. It is for the scp protocol, which has no sftp
+// client to find the home directory with, see ExpandRemoteHome.
+func RemoteHomeRelative(remotePath string) string {
+	if remotePath == "~" {
+		return ""
+	}
+	if strings.HasPrefix(remotePath, "~/") {
+		return remotePath[2:]
+	}
+	return remotePath
+}
@@ -0,0 +1,81 @@
+package zsshlib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBatch(t *testing.T) {
+	transfers, err := ParseBatch(strings.NewReader(`
+# deploy
+./app.tar.gz   deploy@web:/srv/app/
+
+web:/var/log/app.log   logs/
+"my file.txt" 'web:dir with spaces/'
+`))
+	assert.NoError(t, err)
+	if assert.Len(t, transfers, 3) {
+		assert.Equal(t, &BatchTransfer{Line: 3, Local: "./app.tar.gz", Upload: true,
+			Remote: &RemoteSpec{User: "deploy", Identity: "web", Path: "/srv/app/"}}, transfers[0])
+		assert.Equal(t, &BatchTransfer{Line: 5, Local: "logs/",
+			Remote: &RemoteSpec{Identity: "web", Path: "/var/log/app.log"}}, transfers[1])
+		assert.Equal(t, "my file.txt => web:dir with spaces/", transfers[2].String())
+	}
+
+	for batch, expected := range map[string]string{
+		"a.txt":                "line 1: expected `src dst`, got 1 words",
+		"a.txt b.txt c.txt":    "line 1: expected `src dst`, got 3 words",
+		"\n\na.txt b.txt":      "line 3: neither [a.txt] nor [b.txt] is remote",
+		"web:a.txt db:a.txt":   "line 1: copying between two remotes is not supported",
+		"'a.txt web:a.txt":     "line 1: unterminated ' quote",
+		"a.txt @web:":          "line 1: [@web:] has an empty user",
+		"# only comments\n\n ": "",
+	} {
+		_, err := ParseBatch(strings.NewReader(batch))
+		if expected == "" {
+			assert.NoError(t, err, batch)
+		} else {
+			assert.ErrorContains(t, err, expected, batch)
+		}
+	}
+}
+
+func TestBatchTransferRun(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local.txt")
+	if err := os.WriteFile(local, []byte("batch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remoteDir := filepath.Join(dir, "remote")
+	if err := os.Mkdir(remoteDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+	remote := func(p string) *RemoteSpec { return &RemoteSpec{Identity: "test", Path: filepath.ToSlash(p)} }
+
+	upload := &BatchTransfer{Local: local, Remote: remote(remoteDir), Upload: true}
+	assert.NoError(t, upload.Run(context.Background(), client, nil, false))
+	assert.FileExists(t, filepath.Join(remoteDir, "local.txt"), "files sent to a directory keep their name")
+
+	downloadDir := filepath.Join(dir, "download")
+	if err := os.Mkdir(downloadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	download := &BatchTransfer{Local: downloadDir, Remote: remote(filepath.Join(remoteDir, "local.txt"))}
+	assert.NoError(t, download.Run(context.Background(), client, nil, false))
+	content, err := os.ReadFile(filepath.Join(downloadDir, "local.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "batch", string(content))
+
+	recursive := &BatchTransfer{Local: downloadDir, Remote: remote(filepath.Join(dir, "copy")), Upload: true}
+	assert.NoError(t, recursive.Run(context.Background(), client, nil, true))
+	assert.FileExists(t, filepath.Join(dir, "copy", "download", "local.txt"))
+
+	missing := &BatchTransfer{Local: filepath.Join(dir, "missing.txt"), Remote: remote(remoteDir), Upload: true}
+	assert.Error(t, missing.Run(context.Background(), client, nil, false))
+}
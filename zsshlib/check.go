@@ -0,0 +1,181 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// checkStages are the stages of Check, in order. Each depends on the one before it.
+var checkStages = []string{"config", "authenticate", "service", "dial", "ssh"}
+
+// defaultCheckTimeout bounds waiting for the ssh server's version when no --timeout is set
+const defaultCheckTimeout = 30 * time.Second
+
+// NewCheckCmd creates the check command, verifying the ziti plumbing to a target without opening an ssh session
+func NewCheckCmd(flags *SshFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check <targetIdentity>",
+		Short: "Check the ziti connection to the target without opening an ssh session",
+		Long: "Check loads the ziti identity, authenticates, checks the service is available to the identity, dials " +
+			"the target and waits for the ssh server's version, reporting each stage. It doesn't authenticate to ssh, " +
+			"separating ziti and network problems from ssh and auth problems.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := flags.ConfigureLogger(); err != nil {
+				log.Fatal(err)
+			}
+			targetIdentity := flags.ParseTarget(args[0])
+			targetIdentity = ApplySshConfig(flags, targetIdentity)
+			Combine(cmd, flags, FindConfig(flags.ConfigFile, targetIdentity))
+			if err := Check(flags, targetIdentity, os.Stdout); err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	flags.AddCommonFlags(cmd)
+	flags.OIDCFlags(cmd)
+	return cmd
+}
+
+// Check verifies the ziti plumbing used to reach targetIdentity without authenticating to ssh: the identity file
+// loads, the identity authenticates, the service is available to it, the target can be dialed and an ssh server
+// answers. A line reporting the pass or fail of each stage is written to out, and the first failure is returned.
+// Stages following a failure are reported as skipped.
+func Check(f *SshFlags, targetIdentity string, out io.Writer) error {
+	if f.OIDC.OIDCOnly {
+		reportStage(out, "config", nil, "not used with --oidcOnly")
+	} else if f.Enroll != "" {
+		reportStage(out, "config", nil, "enrolling with "+f.Enroll)
+	} else {
+		selected, err := selectConfig(f.ZConfigs, f.Network)
+		if err != nil {
+			return failStage(out, "config", err)
+		}
+		reportStage(out, "config", nil, "loaded "+selected.Path)
+	}
+
+	start := time.Now()
+	transport, err := NewZitiTransport(f)
+	if err != nil {
+		return failStage(out, "authenticate", err)
+	}
+	reportStage(out, "authenticate", nil, "authenticated in "+roundDuration(time.Since(start)))
+	return checkTransport(f, transport, targetIdentity, out)
+}
+
+// checkTransport runs the stages of Check following authentication over transport
+func checkTransport(f *SshFlags, transport Transport, targetIdentity string, out io.Writer) error {
+	service, err := transport.Service(f.ServiceName)
+	if err != nil {
+		return failStage(out, "service", err)
+	}
+	svcCfg, err := LookupServiceConfig(service)
+	if err != nil {
+		log.Warnf("ignoring config of service %s: %v", f.ServiceName, err)
+	}
+	reportStage(out, "service", nil, f.ServiceName+" is available to this identity")
+
+	targetIdentity, err = f.ResolveTarget(targetIdentity)
+	if err != nil {
+		return failStage(out, "dial", err)
+	}
+	dialOptions, err := f.dialOptions(svcCfg, targetIdentity)
+	if err != nil {
+		return failStage(out, "dial", err)
+	}
+	start := time.Now()
+	conn, err := transport.Dial(f.ServiceName, dialOptions)
+	if err != nil {
+		return failStage(out, "dial", fmt.Errorf("unable to dial %s: %w", targetIdentity, err))
+	}
+	defer func() { _ = conn.Close() }()
+	reportStage(out, "dial", nil, fmt.Sprintf("connected to %s in %s", targetIdentity, roundDuration(time.Since(start))))
+
+	start = time.Now()
+	version, err := readServerVersion(conn, f.Timeout)
+	if err != nil {
+		return failStage(out, "ssh", err)
+	}
+	reportStage(out, "ssh", nil, fmt.Sprintf("%s answered in %s", version, roundDuration(time.Since(start))))
+	return nil
+}
+
+// readServerVersion reads the version an ssh server sends as soon as it accepts a connection, e.g.
+// SSH-2.0-OpenSSH_9.6. Servers may send other lines before it, which are skipped.
+func readServerVersion(conn net.Conn, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	lines := bufio.NewReader(io.LimitReader(conn, 8192))
+	for {
+		line, err := lines.ReadString('\n')
+		if strings.HasPrefix(line, "SSH-") {
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+		if err != nil {
+			if isTimeout(err) {
+				return "", fmt.Errorf("no ssh server version received after %v, is an ssh server listening?", timeout)
+			}
+			return "", fmt.Errorf("no ssh server version received, is an ssh server listening? (%w)", err)
+		}
+	}
+}
+
+// failStage reports stage as failed with err, and the stages after it as skipped
+func failStage(out io.Writer, stage string, err error) error {
+	reportStage(out, stage, err, "")
+	skip := false
+	for _, s := range checkStages {
+		if skip {
+			_, _ = fmt.Fprintf(out, "SKIP  %-13s\n", s)
+		}
+		skip = skip || s == stage
+	}
+	return fmt.Errorf("%s check failed: %w", stage, err)
+}
+
+func reportStage(out io.Writer, stage string, err error, detail string) {
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "FAIL  %-13s %v\n", stage, err)
+	} else {
+		_, _ = fmt.Fprintf(out, "PASS  %-13s %s\n", stage, detail)
+	}
+}
+
+// roundDuration rounds d for display, e.g. 12.3ms rather than 12.345678ms
+func roundDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(100 * time.Microsecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
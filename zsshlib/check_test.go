@@ -0,0 +1,65 @@
+package zsshlib
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCheckTransport(t *testing.T) {
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {})
+	services := map[string]*rest_model.ServiceDetail{"zssh": {}}
+	flags := &SshFlags{ServiceName: "zssh", Timeout: time.Second}
+
+	out := &bytes.Buffer{}
+	transport := &fakeTransport{services: services, dial: func(int) (net.Conn, error) { return net.Dial("tcp", addr) }}
+	assert.NoError(t, checkTransport(flags, transport, "server", out))
+	assert.Regexp(t, `^PASS  service +zssh is available to this identity
+PASS  dial +connected to server in \S+
+PASS  ssh +SSH-2.0-Go answered in \S+
+$`, out.String())
+	if assert.Len(t, transport.dials, 1) {
+		assert.Equal(t, "server", transport.dials[0].Identity)
+	}
+
+	out.Reset()
+	missing := &SshFlags{ServiceName: "missing", Timeout: time.Second}
+	assert.ErrorContains(t, checkTransport(missing, transport, "server", out), "service check failed")
+	assert.Regexp(t, `^FAIL  service +service not found: missing
+SKIP  dial +
+SKIP  ssh +
+$`, out.String())
+
+	out.Reset()
+	transport.dial = func(int) (net.Conn, error) { return nil, errors.New("no terminators") }
+	assert.ErrorContains(t, checkTransport(flags, transport, "server", out), "no terminators")
+	assert.Contains(t, out.String(), "FAIL  dial          unable to dial server: no terminators\nSKIP  ssh")
+
+	// a listener which accepts but never speaks ssh
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = silent.Close() }()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+	out.Reset()
+	transport.dial = func(int) (net.Conn, error) { return net.Dial("tcp", silent.Addr().String()) }
+	quick := &SshFlags{ServiceName: "zssh", Timeout: 50 * time.Millisecond}
+	assert.ErrorContains(t, checkTransport(quick, transport, "server", out), "is an ssh server listening?")
+	assert.Contains(t, out.String(), "PASS  dial")
+	assert.Contains(t, out.String(), "FAIL  ssh")
+}
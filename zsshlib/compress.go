@@ -0,0 +1,203 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SendFileCompressed sends localPath to remotePath like SendFile, but gzip compressed in transit, trading CPU on both
+// ends for bandwidth. golang.org/x/crypto/ssh doesn't implement ssh's zlib compression, so the file is streamed
+// through gzip run on the remote, which must be installed there, while sftp applies permissions and times. Resume is
+// not supported, the file is always sent in full, and Limit applies to the uncompressed bytes. remotePath is written in
+// place and removed should the transfer fail, as with SendStream.
+func SendFileCompressed(ctx context.Context, sshClient *ssh.Client, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+	if opts.dryRun() {
+		log.Infof("[dry run] would send file: %s ==> %s", localPath, remotePath)
+		return nil
+	}
+
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open local file %v", localPath)
+	}
+	defer func() { _ = localFile.Close() }()
+
+	info, err := localFile.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat local file %v", localPath)
+	}
+
+	if err := opts.makeRemoteParent(client, remotePath); err != nil {
+		return err
+	}
+	src, checksum, err := opts.sourceReader(ctx, localFile, filepath.Base(localPath), info.Size(), 0)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read local file %v", localPath)
+	}
+	compressed := compressReader(src)
+	defer func() { _ = compressed.Close() }()
+	_, regular := remoteDestination(client, remotePath)
+	if err := runRemote(ctx, sshClient, "gzip -dc > "+shellQuote(remotePath), compressed, io.Discard); err != nil {
+		if regular {
+			opts.removePartial(remotePath, client.Remove)
+		}
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "sending %v cancelled", localPath)
+		}
+		return errors.Wrapf(err, "unable to copy local file %v to remote file %v", localPath, remotePath)
+	}
+	if !regular {
+		// the permissions and times of e.g. /dev/null aren't the file's to change
+		return nil
+	}
+	return finishRemoteFile(client, remotePath, info, checksum, opts)
+}
+
+// RetrieveFileCompressed retrieves remotePath to localPath like RetrieveRemoteFiles, but gzip compressed in transit,
+// see SendFileCompressed. As with RetrieveRemoteFiles, the file is written with partSuffix appended and only renamed
+// into place once complete and verified, while a localPath which isn't a regular file is written in place.
+func RetrieveFileCompressed(ctx context.Context, sshClient *ssh.Client, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+	if opts.dryRun() {
+		log.Infof("[dry run] would retrieve file: %s ==> %s", remotePath, localPath)
+		return nil
+	}
+
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("error reading remote file [%s] (%w)", remotePath, err)
+	}
+	dest, replaceable := localDestination(localPath)
+	partPath := dest + partSuffix
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !replaceable {
+		partPath, flags = dest, os.O_WRONLY
+	}
+	lf, err := os.OpenFile(partPath, flags, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error opening local file [%s] (%w)", partPath, err)
+	}
+	defer func() { _ = lf.Close() }()
+	fail := func(err error) error {
+		_ = lf.Close()
+		if replaceable {
+			opts.removePartial(partPath, os.Remove)
+		}
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	defer func() { _ = pr.Close() }()
+	done := make(chan error, 1)
+	go func() {
+		err := runRemote(ctx, sshClient, "gzip -c < "+shellQuote(remotePath), nil, pw)
+		_ = pw.CloseWithError(err)
+		done <- err
+	}()
+
+	gz, err := gzip.NewReader(pr)
+	if err != nil {
+		_ = pr.Close()
+		if remoteErr := <-done; remoteErr != nil {
+			err = remoteErr
+		}
+		return fail(fmt.Errorf("error copying remote file to local [%s] (%w)", remotePath, err))
+	}
+	var checksum hash.Hash
+	if opts != nil && opts.Verify {
+		checksum = sha256.New()
+	}
+	_, err = io.Copy(lf, &contextReader{ctx: ctx, r: opts.wrapSource(ctx, gz, path.Base(remotePath), info.Size(), 0, checksum)})
+	_ = pr.Close()
+	if remoteErr := <-done; err == nil {
+		err = remoteErr
+	}
+	if ctx.Err() != nil {
+		return fail(fmt.Errorf("retrieving [%s] cancelled (%w)", remotePath, ctx.Err()))
+	}
+	if err != nil {
+		return fail(fmt.Errorf("error copying remote file to local [%s] (%w)", remotePath, err))
+	}
+	if !replaceable {
+		if err = lf.Close(); err != nil {
+			return fmt.Errorf("error closing local file [%s] (%w)", localPath, err)
+		}
+		log.Infof("%s => %s", remotePath, localPath)
+		return nil
+	}
+	if err = lf.Sync(); err == nil {
+		err = lf.Close()
+	}
+	if err != nil {
+		return fail(fmt.Errorf("error closing local file [%s] (%w)", partPath, err))
+	}
+	if err := finishLocalFile(partPath, info, checksum, opts); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, dest); err != nil {
+		return fmt.Errorf("error renaming local file [%s] to [%s] (%w)", partPath, dest, err)
+	}
+	log.Infof("%s => %s", remotePath, localPath)
+	return nil
+}
+
+// compressReader returns a reader of the gzip compressed bytes read from src. Closing it stops the compression.
+func compressReader(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, src)
+		if err == nil {
+			err = gz.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// runRemote runs cmd on the remote with the given stdin and stdout, failing with what the command wrote to stderr when
+// it exits with a non-zero status
+func runRemote(ctx context.Context, client *ssh.Client, cmd string, stdin io.Reader, stdout io.Writer) error {
+	stderr := &bytes.Buffer{}
+	code, err := RunCommand(ctx, client, cmd, stdin, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("remote command [%s] exited with status %d: %s", cmd, code, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
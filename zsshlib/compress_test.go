@@ -0,0 +1,111 @@
+package zsshlib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestShellClient returns a client connected to an in-process ssh server which runs exec requests with sh
+func newTestShellClient(t *testing.T) *ssh.Client {
+	return newTestSshClient(t, func(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			if req.Type != "exec" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			command := struct{ Command string }{}
+			if err := ssh.Unmarshal(req.Payload, &command); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				cmd := exec.Command("sh", "-c", command.Command)
+				cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+				// like sshd, the command exiting ends the session without waiting for the client to close stdin
+				stdin, err := cmd.StdinPipe()
+				if err != nil {
+					sendExitStatus(ch, 1)
+					return
+				}
+				go func() {
+					_, _ = io.Copy(stdin, ch)
+					_ = stdin.Close()
+				}()
+				status := uint32(0)
+				if err := cmd.Run(); err != nil {
+					status = 1
+					if exitErr, ok := err.(*exec.ExitError); ok {
+						status = uint32(exitErr.ExitCode())
+					}
+				}
+				sendExitStatus(ch, status)
+			}()
+		}
+	})
+}
+
+func TestTransferCompressed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("compressed transfers require sh and gzip")
+	}
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("compressed transfers require gzip")
+	}
+	sshClient := newTestShellClient(t)
+	client := newTestSftpClient(t)
+	dir := t.TempDir()
+
+	content := []byte(strings.Repeat("a very compressible line of text\n", 10000))
+	local := filepath.Join(dir, "it's local.txt")
+	if err := os.WriteFile(local, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := filepath.Join(dir, "remote.txt")
+	opts := &TransferOptions{Verify: true}
+	assert.NoError(t, SendFileCompressed(context.Background(), sshClient, client, local, remote, opts))
+	assert.Equal(t, hashFile(t, local), hashFile(t, remote))
+	info, err := os.Stat(remote)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), "permissions should be preserved")
+	}
+
+	retrieved := filepath.Join(dir, "retrieved.txt")
+	assert.NoError(t, RetrieveFileCompressed(context.Background(), sshClient, client, retrieved, remote, opts))
+	assert.Equal(t, hashFile(t, local), hashFile(t, retrieved))
+
+	err = RetrieveFileCompressed(context.Background(), sshClient, client, filepath.Join(dir, "missing-copy.txt"), filepath.Join(dir, "missing.txt"), opts)
+	assert.Error(t, err, "a missing remote file should fail")
+
+	err = SendFileCompressed(context.Background(), sshClient, client, local, filepath.Join(dir, "no-such-dir", "remote.txt"), opts)
+	assert.ErrorContains(t, err, "exited with status", "a failed remote gzip should fail")
+}
+
+func TestCompressReader(t *testing.T) {
+	content := bytes.Repeat([]byte("compress me "), 1000)
+	compressed := &bytes.Buffer{}
+	r := compressReader(bytes.NewReader(content))
+	_, err := compressed.ReadFrom(r)
+	assert.NoError(t, err)
+	assert.Less(t, compressed.Len(), len(content))
+
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, content, decompressed)
+}
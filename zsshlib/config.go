@@ -7,22 +7,35 @@ import (
 )
 
 type OIDC struct {
-	CallbackPort string `yaml:"callback_port"`
-	ClientID     string `yaml:"client_id"`
-	ClientSecret string `yaml:"client_secret"`
-	Issuer       string `yaml:"issuer"`
-	Enabled      bool   `yaml:"enabled"`
+	CallbackHost  string   `yaml:"callback_host"`
+	CallbackPort  string   `yaml:"callback_port"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	Issuer        string   `yaml:"issuer"`
+	Enabled       bool     `yaml:"enabled"`
+	AuthFlow      string   `yaml:"auth_flow"`
+	OfflineAccess bool     `yaml:"offline_access"`
+	Provider      string   `yaml:"provider"`
+	Scopes        []string `yaml:"scopes"`
 }
 
 type Config struct {
 	SshKeyPath string `yaml:"ssh_key_path"`
 	ZConfig    string `yaml:"zconfig"`
+	Network    string `yaml:"network"`
 	Debug      bool   `yaml:"debug"`
 	Service    string `yaml:"service"`
 	OIDC       OIDC   `yaml:"oidc"`
 	Username   string `yaml:"user"`
+	LogLevel   string `yaml:"log_level"`
+	// Flags sets any other flag by its long name, e.g. timeout: 10s, unless it's given on the command line. A list
+	// sets a flag which can be specified multiple times.
+	Flags map[string]interface{} `yaml:"flags"`
 }
 
+// DefaultsKey is the entry of the config file applied to every target, under the target's own entry
+const DefaultsKey = "defaults"
+
 type ConfigMap map[string]Config
 
 func ConfigHome() string {
@@ -72,40 +85,115 @@ func SaveConfigs(configs []Config, filePath string) error {
 	return nil
 }
 
+// DefaultKeyNames are the private keys in $HOME/.ssh probed, in order, when no key is specified
+var DefaultKeyNames = []string{ID_ED25519, ID_ECDSA, ID_RSA}
+
+// DefaultKeyPath returns the first of DefaultKeyNames which exists, or id_rsa when none of them exist
+func DefaultKeyPath() string {
+	sshDir := filepath.Join(os.Getenv("HOME"), SSH_DIR)
+	for _, name := range DefaultKeyNames {
+		keyPath := filepath.Join(sshDir, name)
+		if _, err := os.Stat(keyPath); err == nil {
+			return keyPath
+		}
+	}
+	return filepath.Join(sshDir, ID_RSA)
+}
+
 // DefaultConfig returns a default configuration.
 func DefaultConfig() *Config {
 	return &Config{
-		SshKeyPath: filepath.Join(os.Getenv("HOME"), ".ssh", "id_rsa"),
+		SshKeyPath: DefaultKeyPath(),
 		ZConfig:    filepath.Join(os.Getenv("HOME"), ".ziti", "zssh.json"),
 		Debug:      false,
 		Service:    "zssh",
 		OIDC: OIDC{
+			CallbackHost: DefaultCallbackHost,
 			CallbackPort: "63275",
 			ClientID:     "openziti-client",
 			ClientSecret: "",
 			Issuer:       "https://dev-yourid.okta.com",
 			Enabled:      false,
+			AuthFlow:     AuthFlowCode,
 		},
 	}
 }
 
-// FindConfigByKey finds a configuration by the targetIdentity/key
+// FindConfigByKey finds a configuration by the targetIdentity/key in the default config file, see FindConfig
 func FindConfigByKey(key string) *Config {
-	configs := LoadConfigFile()
-	if cfg, exists := configs[key]; exists {
+	return FindConfig("", key)
+}
+
+// FindConfig finds the configuration of the targetIdentity/key in configFile, or the default config file when
+// configFile is empty. The DefaultsKey entry fills in whatever the target's entry leaves unset. A missing config
+// file is not an error.
+func FindConfig(configFile string, key string) *Config {
+	configs := loadConfigFile(configFile)
+	defaults, hasDefaults := configs[DefaultsKey]
+	cfg, exists := configs[key]
+	switch {
+	case exists && hasDefaults:
+		return mergeConfig(&cfg, &defaults)
+	case exists:
 		return &cfg
+	case hasDefaults:
+		return &defaults
 	}
 	return DefaultConfig()
 }
 
+// mergeConfig fills the fields of cfg which are unset from defaults
+func mergeConfig(cfg *Config, defaults *Config) *Config {
+	fill := func(value *string, fallback string) {
+		if *value == "" {
+			*value = fallback
+		}
+	}
+	fill(&cfg.SshKeyPath, defaults.SshKeyPath)
+	fill(&cfg.ZConfig, defaults.ZConfig)
+	fill(&cfg.Network, defaults.Network)
+	fill(&cfg.Service, defaults.Service)
+	fill(&cfg.Username, defaults.Username)
+	fill(&cfg.LogLevel, defaults.LogLevel)
+	fill(&cfg.OIDC.CallbackHost, defaults.OIDC.CallbackHost)
+	fill(&cfg.OIDC.CallbackPort, defaults.OIDC.CallbackPort)
+	fill(&cfg.OIDC.ClientID, defaults.OIDC.ClientID)
+	fill(&cfg.OIDC.ClientSecret, defaults.OIDC.ClientSecret)
+	fill(&cfg.OIDC.Issuer, defaults.OIDC.Issuer)
+	fill(&cfg.OIDC.AuthFlow, defaults.OIDC.AuthFlow)
+	fill(&cfg.OIDC.Provider, defaults.OIDC.Provider)
+	cfg.Debug = cfg.Debug || defaults.Debug
+	cfg.OIDC.Enabled = cfg.OIDC.Enabled || defaults.OIDC.Enabled
+	cfg.OIDC.OfflineAccess = cfg.OIDC.OfflineAccess || defaults.OIDC.OfflineAccess
+	if len(cfg.OIDC.Scopes) == 0 {
+		cfg.OIDC.Scopes = defaults.OIDC.Scopes
+	}
+	for name, value := range defaults.Flags {
+		if _, found := cfg.Flags[name]; !found {
+			if cfg.Flags == nil {
+				cfg.Flags = map[string]interface{}{}
+			}
+			cfg.Flags[name] = value
+		}
+	}
+	return cfg
+}
+
 func LoadConfigFile() ConfigMap {
-	configFilePath := GetConfigFilePath()
+	return loadConfigFile("")
+}
+
+func loadConfigFile(configFilePath string) ConfigMap {
+	if configFilePath == "" {
+		configFilePath = GetConfigFilePath()
+	}
 	// Load the configurations from the file, or use defaults if the file doesn't exist
 	configs, err := LoadConfigs(configFilePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			Logger().Fatalf("Error loading config: %v", err)
 		}
+		log.Debugf("no config file at %s", configFilePath)
 	}
 	return configs
 }
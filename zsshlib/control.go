@@ -0,0 +1,304 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoControlMaster is returned by RunControlCommand when no control master is listening on the control socket
+var ErrNoControlMaster = errors.New("no control master")
+
+// The frames exchanged over a control socket, each a type byte and a big endian uint32 length followed by the
+// payload. A client sends a controlRequest then its stdin, and the master answers with the command's output followed
+// by controlExit, or controlError when the command couldn't be run.
+const (
+	controlRequest byte = iota + 1
+	controlStdin
+	controlStdinEOF
+	controlStdout
+	controlStderr
+	controlExit
+	controlError
+)
+
+// controlFrameMax bounds the payload of a frame, so a corrupt length can't exhaust memory
+const controlFrameMax = 1 << 20
+
+// controlCommand is the payload of a controlRequest
+type controlCommand struct {
+	Command string   `json:"command"`
+	Env     []string `json:"env,omitempty"`
+}
+
+// ControlSocket returns the control socket for userName at targetIdentity, see --control-path. A leading ~ is
+// expanded to the home directory, %h to the target identity, %r to the remote user and %% to %.
+func (f *SshFlags) ControlSocket(userName string, targetIdentity string) string {
+	if userName == "" {
+		userName = f.Username
+	}
+	if userName == "" {
+		userName = ParseUserName("", true)
+	}
+	replacer := strings.NewReplacer("%%", "%", "%h", targetIdentity, "%r", userName)
+	return replacer.Replace(expandHome(f.ControlPath))
+}
+
+// ServeControl shares client with later zssh invocations, see --control-master, by listening on the unix socket at
+// socketPath and running the command each connection requests in a new session of client. It returns once ctx is
+// done, or with ErrConnectionLost once client's connection fails, removing the socket. Only the user may connect to
+// the socket.
+func ServeControl(ctx context.Context, client *ssh.Client, socketPath string, opts ...SessionOption) error {
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("a control master is already listening on %s", socketPath)
+	}
+	// a socket left behind by a master which didn't exit cleanly, anything else at the path is the user's
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return fmt.Errorf("control path %s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return fmt.Errorf("unable to remove stale control socket %s: %w", socketPath, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("unable to listen on control socket %s: %w", socketPath, err)
+	}
+	defer func() { _ = listener.Close() }()
+	// windows doesn't apply permission bits to sockets, access follows the ACL of the directory
+	if err := os.Chmod(socketPath, 0600); err != nil && runtime.GOOS != "windows" {
+		return fmt.Errorf("unable to restrict control socket %s: %w", socketPath, err)
+	}
+	log.Infof("control master listening on %s", socketPath)
+
+	lost := make(chan error, 1)
+	go func() { lost <- client.Wait() }()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-lost:
+		}
+		_ = listener.Close()
+	}()
+
+	sessions := &sync.WaitGroup{}
+	defer sessions.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case err := <-lost:
+				if err == nil {
+					err = fmt.Errorf("closed by the server")
+				}
+				return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+			default:
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			serveControlConn(ctx, client, conn, opts)
+		}()
+	}
+}
+
+// serveControlConn runs the command requested over conn, relaying its stdin, output and exit status. The command is
+// abandoned if the client goes away.
+func serveControlConn(ctx context.Context, client *ssh.Client, conn net.Conn, opts []SessionOption) {
+	defer func() { _ = conn.Close() }()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	typ, payload, err := readControlFrame(conn)
+	if err != nil {
+		log.Debugf("control client went away: %v", err)
+		return
+	}
+	out := &controlWriter{conn: conn, mu: &sync.Mutex{}, typ: controlStdout}
+	req := controlCommand{}
+	if typ != controlRequest {
+		_ = out.frame(controlError, []byte("expected a command"))
+		return
+	} else if err := json.Unmarshal(payload, &req); err != nil {
+		_ = out.frame(controlError, []byte("invalid command: "+err.Error()))
+		return
+	}
+
+	stdin, stdinWriter := io.Pipe()
+	go func() {
+		for {
+			typ, payload, err := readControlFrame(conn)
+			switch {
+			case err != nil:
+				_ = stdinWriter.CloseWithError(err)
+				cancel()
+				return
+			case typ == controlStdin:
+				if _, err := stdinWriter.Write(payload); err != nil {
+					// the command no longer reads its stdin, but the client going away must still be noticed
+					continue
+				}
+			case typ == controlStdinEOF:
+				_ = stdinWriter.Close()
+			}
+		}
+	}()
+
+	log.Debugf("running %q for control client", req.Command)
+	sessionOpts := append([]SessionOption{WithEnv(req.Env)}, opts...)
+	code, err := RunCommand(ctx, client, req.Command, stdin, out, &controlWriter{conn: conn, mu: out.mu, typ: controlStderr}, sessionOpts...)
+	_ = stdin.Close()
+	if err != nil {
+		_ = out.frame(controlError, []byte(err.Error()))
+		return
+	}
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(code))
+	_ = out.frame(controlExit, status)
+}
+
+// RunControlCommand runs cmd with the environment variables env through the control master listening on socketPath,
+// as RunCommand would over its connection, and returns the remote exit status. It fails with ErrNoControlMaster when
+// nothing is listening, so the caller can connect itself instead. Cancelling ctx abandons the command.
+func RunControlCommand(ctx context.Context, socketPath string, cmd string, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return -1, fmt.Errorf("%w on %s: %v", ErrNoControlMaster, socketPath, err)
+	}
+	defer func() { _ = conn.Close() }()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	payload, err := json.Marshal(controlCommand{Command: cmd, Env: env})
+	if err != nil {
+		return -1, err
+	}
+	in := &controlWriter{conn: conn, mu: &sync.Mutex{}, typ: controlStdin}
+	if err := in.frame(controlRequest, payload); err != nil {
+		return -1, err
+	}
+	go func() {
+		if stdin != nil {
+			if _, err := io.Copy(in, stdin); err != nil {
+				return
+			}
+		}
+		_ = in.frame(controlStdinEOF, nil)
+	}()
+
+	for {
+		typ, payload, err := readControlFrame(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			return -1, fmt.Errorf("control master closed the connection: %w", err)
+		}
+		switch typ {
+		case controlStdout:
+			_, err = stdout.Write(payload)
+		case controlStderr:
+			_, err = stderr.Write(payload)
+		case controlExit:
+			if len(payload) != 4 {
+				return -1, fmt.Errorf("invalid exit status from control master")
+			}
+			return int(binary.BigEndian.Uint32(payload)), nil
+		case controlError:
+			return -1, errors.New(string(payload))
+		}
+		if err != nil {
+			return -1, err
+		}
+	}
+}
+
+// controlWriter writes what is written to it to conn as frames of typ. Writers sharing conn share mu so their frames
+// don't interleave.
+type controlWriter struct {
+	conn net.Conn
+	mu   *sync.Mutex
+	typ  byte
+}
+
+func (w *controlWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), controlFrameMax)
+		if err := w.frame(w.typ, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// frame writes a single frame of typ carrying payload
+func (w *controlWriter) frame(typ byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.conn.Write(append(header, payload...))
+	return err
+}
+
+// readControlFrame reads the next frame from r, returning its type and payload
+func readControlFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > controlFrameMax {
+		return 0, nil, fmt.Errorf("control frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
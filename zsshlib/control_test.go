@@ -0,0 +1,110 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControlSocket(t *testing.T) {
+	t.Setenv("HOME", "/home/alice")
+	f := &SshFlags{ControlPath: "~/.ssh/zssh-%r@%h-100%%"}
+	assert.Equal(t, filepath.Join("/home/alice", ".ssh", "zssh-bob@web01-100%"), f.ControlSocket("bob", "web01"))
+	f.Username = "carol"
+	assert.Equal(t, filepath.Join("/home/alice", ".ssh", "zssh-carol@web01-100%"), f.ControlSocket("", "web01"), "the configured username is used when none is given")
+}
+
+func TestControlMaster(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("remote commands require sh")
+	}
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	_, err := RunControlCommand(context.Background(), socket, "true", nil, nil, &bytes.Buffer{}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrNoControlMaster)
+
+	client := newTestShellClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ServeControl(ctx, client, socket) }()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	if info, err := os.Stat(socket); assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "only the user should be able to use the connection")
+	}
+	assert.ErrorContains(t, ServeControl(context.Background(), client, socket), "already listening")
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code, err := RunControlCommand(context.Background(), socket, "echo out; echo err >&2; exit 3", nil, nil, stdout, stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, code)
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+
+	// sessions are independent, so several can run over the connection at once
+	results := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			stdout := &bytes.Buffer{}
+			_, err := RunControlCommand(context.Background(), socket, "tr a-z A-Z", nil, strings.NewReader("select 1;\n"), stdout, &bytes.Buffer{})
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			results <- stdout.String()
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "SELECT 1;\n", <-results)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the control master should stop once its context is done")
+	}
+	_, err = RunControlCommand(context.Background(), socket, "true", nil, nil, &bytes.Buffer{}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrNoControlMaster)
+}
+
+func TestControlMasterKeepsOtherFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("remote commands require sh")
+	}
+	client := newTestShellClient(t)
+	config := filepath.Join(t.TempDir(), "config")
+	assert.NoError(t, os.WriteFile(config, []byte("Host *\n"), 0600))
+	assert.ErrorContains(t, ServeControl(context.Background(), client, config), "is not a socket")
+	content, err := os.ReadFile(config)
+	assert.NoError(t, err, "a file at the control path isn't a stale socket and must not be removed")
+	assert.Equal(t, "Host *\n", string(content))
+
+	// a socket left behind by a master which didn't exit cleanly is replaced
+	stale := filepath.Join(t.TempDir(), "control.sock")
+	listener, err := net.Listen("unix", stale)
+	if !assert.NoError(t, err) {
+		return
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ServeControl(ctx, client, stale) }()
+	assert.Eventually(t, func() bool {
+		code, err := RunControlCommand(context.Background(), stale, "true", nil, nil, &bytes.Buffer{}, &bytes.Buffer{})
+		return err == nil && code == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, <-served)
+}
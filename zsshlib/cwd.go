@@ -0,0 +1,110 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// CommandIn returns cmd run from the remote directory dir, see --cwd, or cmd itself when dir is empty. cmd isn't run
+// when the directory doesn't exist, as the cd before it fails.
+func CommandIn(dir string, cmd string) string {
+	if dir == "" {
+		return cmd
+	}
+	return "cd " + quoteRemoteDir(dir) + " && " + cmd
+}
+
+// quoteRemoteDir quotes dir for the remote shell, leaving a leading ~ unquoted so the shell expands it
+func quoteRemoteDir(dir string) string {
+	if dir == "~" {
+		return dir
+	}
+	if strings.HasPrefix(dir, "~/") {
+		return "~/" + shellQuote(dir[2:])
+	}
+	return shellQuote(dir)
+}
+
+// CheckRemoteDir checks dir is an existing remote directory by changing to it in a remote shell, for servers reached
+// without sftp, see ResolveRemoteDir
+func CheckRemoteDir(ctx context.Context, client *ssh.Client, dir string) error {
+	if err := runRemote(ctx, client, CommandIn(dir, "true"), nil, io.Discard); err != nil {
+		return fmt.Errorf("remote working directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// ExpandRemoteHome returns remotePath with a leading ~ replaced by the remote home directory, the directory sftp
+// sessions start in, so ~/dir works even on servers which don't expand ~ themselves. Absolute and relative paths are
+// returned as they are, the server resolving relative paths against the home directory. A trailing slash is kept.
+func ExpandRemoteHome(client *sftp.Client, remotePath string) (string, error) {
+	if remotePath != "~" && !strings.HasPrefix(remotePath, "~/") {
+		return remotePath, nil
+	}
+	home, err := client.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("cannot find the remote home directory to expand %s: %w", remotePath, err)
+	}
+	expanded := path.Join(home, remotePath[1:])
+	if strings.HasSuffix(remotePath, "/") && !strings.HasSuffix(expanded, "/") {
+		expanded += "/"
+	}
+	return expanded, nil
+}
+
+// ResolveRemoteDir returns the absolute path of the remote directory dir, which may start with ~, failing unless it
+// is an existing directory
+func ResolveRemoteDir(client *sftp.Client, dir string) (string, error) {
+	expanded, err := ExpandRemoteHome(client, dir)
+	if err != nil {
+		return "", fmt.Errorf("remote working directory %s: %w", dir, err)
+	}
+	resolved, err := client.RealPath(expanded)
+	if err != nil {
+		return "", fmt.Errorf("remote working directory %s: %w", dir, err)
+	}
+	info, err := client.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("remote working directory %s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("remote working directory %s is not a directory", dir)
+	}
+	return resolved, nil
+}
+
+// RemotePathIn returns remotePath relative to the remote working directory dir. Absolute paths, and those starting
+// with ~, are returned as they are, and an empty path is dir itself. A trailing slash, marking remotePath as a
+// directory, is kept.
+func RemotePathIn(dir string, remotePath string) string {
+	if dir == "" || path.IsAbs(remotePath) || remotePath == "~" || strings.HasPrefix(remotePath, "~/") {
+		return remotePath
+	}
+	joined := path.Join(dir, remotePath)
+	if strings.HasSuffix(remotePath, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+	return joined
+}
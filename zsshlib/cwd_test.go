@@ -0,0 +1,102 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemotePathIn(t *testing.T) {
+	for _, test := range []struct {
+		dir, remotePath, want string
+	}{
+		{"/srv/app", "subpath", "/srv/app/subpath"},
+		{"/srv/app", "sub/dir/", "/srv/app/sub/dir/"},
+		{"/srv/app", "", "/srv/app"},
+		{"/srv/app", "../logs", "/srv/logs"},
+		{"/srv/app", "/etc/hosts", "/etc/hosts"},
+		{"/srv/app", "~/file", "~/file"},
+		{"/srv/app", "~", "~"},
+		{"~/app", "file", "~/app/file"},
+		{"/", "file", "/file"},
+		{"", "file", "file"},
+	} {
+		assert.Equal(t, test.want, RemotePathIn(test.dir, test.remotePath), "%s in %s", test.remotePath, test.dir)
+	}
+}
+
+func TestExpandRemoteHome(t *testing.T) {
+	client := newTestSftpClient(t)
+	home, err := client.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remotePath, want string
+	}{
+		{"~", home},
+		{"~/", home + "/"},
+		{"~/sub", home + "/sub"},
+		{"~/sub/dir/", home + "/sub/dir/"},
+		{"sub/file.txt", "sub/file.txt"},
+		{"", ""},
+		{"/etc/hosts", "/etc/hosts"},
+		{"/srv/~/file", "/srv/~/file"},
+		{"~user/file", "~user/file"},
+	} {
+		expanded, err := ExpandRemoteHome(client, test.remotePath)
+		assert.NoError(t, err)
+		assert.Equal(t, test.want, expanded, test.remotePath)
+	}
+
+	resolved, err := ResolveRemoteDir(client, "~")
+	assert.NoError(t, err)
+	assert.Equal(t, home, resolved)
+}
+
+func TestCommandIn(t *testing.T) {
+	assert.Equal(t, "make", CommandIn("", "make"))
+	assert.Equal(t, "cd '/srv/my app' && make", CommandIn("/srv/my app", "make"))
+	assert.Equal(t, "cd ~/'it'\\''s' && make", CommandIn("~/it's", "make"))
+	assert.Equal(t, "cd ~ && make", CommandIn("~", "make"))
+}
+
+func TestResolveRemoteDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+
+	resolved, err := ResolveRemoteDir(client, filepath.ToSlash(dir))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.ToSlash(dir), resolved)
+
+	_, err = ResolveRemoteDir(client, filepath.ToSlash(filepath.Join(dir, "missing")))
+	assert.ErrorContains(t, err, "remote working directory")
+	_, err = ResolveRemoteDir(client, filepath.ToSlash(filepath.Join(dir, "file.txt")))
+	assert.ErrorContains(t, err, "is not a directory")
+}
+
+func TestCheckRemoteDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("remote commands require sh")
+	}
+	dir := t.TempDir()
+	client := newTestShellClient(t)
+	assert.NoError(t, CheckRemoteDir(context.Background(), client, dir))
+	assert.ErrorContains(t, CheckRemoteDir(context.Background(), client, filepath.Join(dir, "missing")), "remote working directory")
+
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	code, err := RunCommand(context.Background(), client, CommandIn(dir, "pwd"), nil, out, errOut)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Empty(t, errOut.String())
+	resolved, _ := filepath.EvalSymlinks(dir)
+	assert.Contains(t, []string{dir + "\n", resolved + "\n"}, out.String())
+}
@@ -0,0 +1,135 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/openziti/sdk-golang/ziti/enroll"
+)
+
+// EnrollIdentity enrolls the ziti identity of the one-time enrollment token in jwtFile, returning its config. The
+// identity's key and certificate are held in the config rather than written anywhere, see SaveIdentity.
+func EnrollIdentity(jwtFile string) (*ziti.Config, error) {
+	content, err := os.ReadFile(jwtFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read enrollment token: %w", err)
+	}
+	jwtString := strings.TrimSpace(string(content))
+	claims, token, err := enroll.ParseToken(jwtString)
+	if err != nil {
+		return nil, enrollmentError(jwtFile, err)
+	}
+	cfg, err := enroll.Enroll(enroll.EnrollmentFlags{
+		Token:     claims,
+		JwtToken:  token,
+		JwtString: jwtString,
+		KeyAlg:    "EC",
+	})
+	if err != nil {
+		return nil, enrollmentError(jwtFile, err)
+	}
+	log.Infof("enrolled identity %s with %s", claims.Subject, jwtFile)
+	return cfg, nil
+}
+
+// enrollmentError explains the usual reasons enrolling with the token in jwtFile fails: the token has expired, or
+// was already used, whether by an earlier zssh --enroll or ziti edge enroll
+func enrollmentError(jwtFile string, err error) error {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired) || strings.Contains(msg, "ENROLLMENT_EXPIRED"):
+		return fmt.Errorf("the enrollment token in %s has expired, ask your ziti administrator for a new one", jwtFile)
+	case strings.Contains(msg, "INVALID_ENROLLMENT_TOKEN") || strings.Contains(msg, "already been enrolled"):
+		return fmt.Errorf("the enrollment token in %s has already been used. if it was used to enroll this identity "+
+			"before, pass the identity file with -c instead, otherwise ask your ziti administrator for a new token", jwtFile)
+	}
+	return fmt.Errorf("unable to enroll with %s: %w", jwtFile, err)
+}
+
+// SaveIdentity writes the enrolled identity cfg to path, readable only by the current user, to be used with -c from
+// then on. An existing file is never overwritten.
+func SaveIdentity(cfg *ziti.Config, path string) error {
+	content, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// enrollSavePath returns the identity file --enroll-save writes to: the -c file, ~/.ziti/zssh.json by default. It's
+// checked before enrolling, as the token can only be used once.
+func (f *SshFlags) enrollSavePath() (string, error) {
+	if len(f.ZConfigs) != 1 {
+		return "", fmt.Errorf("--enroll-save needs a single -c file to save the identity to")
+	}
+	path := f.ZConfigs[0]
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return "", fmt.Errorf("--enroll-save needs -c to name a file, %s is a directory", path)
+		}
+		return "", fmt.Errorf("not saving the enrolled identity, %s already exists", path)
+	}
+	return path, nil
+}
+
+// enrolledConfig enrolls the identity of --enroll, once, saving it when --enroll-save is set. The token can only be
+// used once, so later connections, such as reconnects, reuse the config.
+func (f *SshFlags) enrolledConfig() (*ziti.Config, error) {
+	if f.enrolled != nil {
+		return f.enrolled, nil
+	}
+	savePath := ""
+	if f.EnrollSave {
+		p, err := f.enrollSavePath()
+		if err != nil {
+			return nil, err
+		}
+		savePath = p
+	}
+	cfg, err := EnrollIdentity(f.Enroll)
+	if err != nil {
+		return nil, err
+	}
+	f.enrolled = cfg
+	if savePath != "" {
+		if err := SaveIdentity(cfg, savePath); err != nil {
+			log.Warnf("unable to save the enrolled identity to %s, the enrollment token can't be used again: %v", savePath, err)
+		} else {
+			log.Infof("saved the enrolled identity to %s", savePath)
+		}
+	}
+	return cfg, nil
+}
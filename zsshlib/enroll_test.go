@@ -0,0 +1,59 @@
+package zsshlib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnrollmentError(t *testing.T) {
+	expired := fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, jwt.ErrTokenExpired)
+	assert.EqualError(t, enrollmentError("id.jwt", expired), "the enrollment token in id.jwt has expired, ask your ziti administrator for a new one")
+
+	used := fmt.Errorf("enroll error: 404 Not Found - code: INVALID_ENROLLMENT_TOKEN - message: The supplied token is not valid - cause: ")
+	assert.ErrorContains(t, enrollmentError("id.jwt", used), "the enrollment token in id.jwt has already been used")
+	assert.ErrorContains(t, enrollmentError("id.jwt", fmt.Errorf("the provided identity has already been enrolled")), "has already been used")
+
+	other := fmt.Errorf("connection refused")
+	assert.ErrorIs(t, enrollmentError("id.jwt", other), other)
+
+	_, err := EnrollIdentity(filepath.Join(t.TempDir(), "missing.jwt"))
+	assert.ErrorContains(t, err, "unable to read enrollment token")
+}
+
+func TestSaveIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".ziti", "zssh.json")
+	cfg := &ziti.Config{ZtAPI: "https://ctrl.example.com/edge/client/v1"}
+	cfg.ID.Cert = "pem:cert"
+	cfg.ID.Key = "pem:key"
+
+	f := &SshFlags{ZConfigs: []string{path}}
+	savePath, err := f.enrollSavePath()
+	assert.NoError(t, err)
+	assert.Equal(t, path, savePath)
+
+	assert.NoError(t, SaveIdentity(cfg, path))
+	saved, err := ziti.NewConfigFromFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, cfg.ZtAPI, saved.ZtAPI)
+		assert.Equal(t, cfg.ID.Key, saved.ID.Key)
+	}
+	if runtime.GOOS != "windows" {
+		info, _ := os.Stat(path)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the identity's key should only be readable by the user")
+	}
+
+	assert.Error(t, SaveIdentity(cfg, path), "an existing identity should never be overwritten")
+	_, err = f.enrollSavePath()
+	assert.ErrorContains(t, err, "already exists")
+
+	f.ZConfigs = []string{filepath.Dir(path)}
+	_, err = f.enrollSavePath()
+	assert.ErrorContains(t, err, "is a directory")
+}
@@ -0,0 +1,38 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ExecAfterTransfer runs cmd over client from the remote directory dir, see --exec and --cwd, once a transfer has
+// ended with transferErr, streaming its output to stdout and stderr, and returns the code zscp exits with: that of
+// cmd. When the transfer failed cmd isn't run, and transferErr is returned with an exit code of 1. An empty cmd
+// leaves the exit code at 0.
+func ExecAfterTransfer(ctx context.Context, client *ssh.Client, transferErr error, dir string, cmd string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if transferErr != nil {
+		return 1, transferErr
+	}
+	if cmd == "" {
+		return 0, nil
+	}
+	return RunCommand(ctx, client, CommandIn(dir, cmd), nil, stdout, stderr)
+}
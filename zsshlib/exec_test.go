@@ -0,0 +1,47 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecAfterTransfer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("remote commands require sh")
+	}
+	client := newTestShellClient(t)
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ran")
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	failed := errors.New("2 transfers failed")
+	code, err := ExecAfterTransfer(context.Background(), client, failed, dir, "touch ran", stdout, stderr)
+	assert.ErrorIs(t, err, failed)
+	assert.Equal(t, 1, code)
+	assert.NoFileExists(t, marker, "the command must not run after a failed transfer")
+
+	code, err = ExecAfterTransfer(context.Background(), client, nil, dir, "touch ran && echo deployed", stdout, stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.FileExists(t, marker, "the command runs from the remote directory once the transfer succeeded")
+	assert.Equal(t, "deployed\n", stdout.String())
+
+	code, err = ExecAfterTransfer(context.Background(), client, nil, "", "echo restart failed >&2; exit 4", stdout, stderr)
+	assert.NoError(t, err, "a command exiting non-zero isn't an error")
+	assert.Equal(t, 4, code, "zscp exits with the command's exit code")
+	assert.Equal(t, "restart failed\n", stderr.String())
+
+	code, err = ExecAfterTransfer(context.Background(), client, nil, filepath.Join(dir, "missing"), "true", stdout, stderr)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, code, "the command isn't run when the directory doesn't exist")
+
+	code, err = ExecAfterTransfer(context.Background(), client, nil, dir, "", stdout, stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+}
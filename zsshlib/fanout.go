@@ -0,0 +1,150 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultParallelTargets bounds the targets --targets connects to at once when --parallel isn't set
+const DefaultParallelTargets = 10
+
+// TargetResult is the outcome of running a command on one of the targets of RunOnTargets
+type TargetResult struct {
+	Target   string
+	ExitCode int
+	Err      error
+}
+
+// Failed reports whether the command couldn't be run on the target, or exited with a non-zero status
+func (r TargetResult) Failed() bool {
+	return r.Err != nil || r.ExitCode != 0
+}
+
+// RunOnTargets connects to each of targets, given as [user@]identity, over transport and runs cmd on it with
+// RunCommand. At most parallel targets are connected to at once. Each line the command outputs is written to stdout
+// or stderr prefixed with the identity of the target it came from. A failure on one target doesn't stop the others.
+// The results are returned in the order of targets.
+func RunOnTargets(ctx context.Context, f *SshFlags, transport Transport, targets []string, cmd string, stdout io.Writer, stderr io.Writer, parallel int, opts ...SessionOption) []TargetResult {
+	if parallel < 1 {
+		parallel = DefaultParallelTargets
+	}
+	outMu := &sync.Mutex{}
+	results := make([]TargetResult, len(targets))
+	slots := make(chan struct{}, parallel)
+	wg := &sync.WaitGroup{}
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			identity := f.ParseTarget(target)
+			out := newPrefixWriter(stdout, outMu, identity)
+			errOut := newPrefixWriter(stderr, outMu, identity)
+			exitCode, err := runOnTarget(ctx, f, transport, ParseUserName(target, false), identity, cmd, out, errOut, opts)
+			_ = out.Flush()
+			_ = errOut.Flush()
+			results[i] = TargetResult{Target: identity, ExitCode: exitCode, Err: err}
+		}(i, target)
+	}
+	wg.Wait()
+	return results
+}
+
+func runOnTarget(ctx context.Context, f *SshFlags, transport Transport, userName string, identity string, cmd string, stdout io.Writer, stderr io.Writer, opts []SessionOption) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	client, err := EstablishClientWithTransport(f, transport, userName, identity)
+	if err != nil {
+		return -1, err
+	}
+	defer func() { _ = client.Close() }()
+	return RunCommand(ctx, client, cmd, nil, stdout, stderr, opts...)
+}
+
+// ReportTargetResults writes the exit status of each target followed by a summary to out, and returns the exit code
+// for zssh: 0 when the command succeeded on every target, 1 otherwise
+func ReportTargetResults(out io.Writer, results []TargetResult) int {
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			_, _ = fmt.Fprintf(out, "[%s] error: %v\n", r.Target, r.Err)
+		default:
+			_, _ = fmt.Fprintf(out, "[%s] exit status %d\n", r.Target, r.ExitCode)
+		}
+		if r.Failed() {
+			failed++
+		}
+	}
+	_, _ = fmt.Fprintf(out, "%d of %d targets succeeded, %d failed\n", len(results)-failed, len(results), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// prefixWriter writes each complete line written to it to w, prefixed with the target it came from. Writers for
+// several targets share a mutex so lines from different targets don't interleave.
+type prefixWriter struct {
+	w       io.Writer
+	mu      *sync.Mutex
+	prefix  []byte
+	pending []byte
+}
+
+func newPrefixWriter(w io.Writer, mu *sync.Mutex, target string) *prefixWriter {
+	return &prefixWriter{w: w, mu: mu, prefix: []byte("[" + target + "] ")}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	for {
+		i := bytes.IndexByte(p.pending, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.pending[:i+1]); err != nil {
+			return len(b), err
+		}
+		p.pending = p.pending[i+1:]
+	}
+}
+
+// Flush writes any final line which wasn't terminated by a newline
+func (p *prefixWriter) Flush() error {
+	if len(p.pending) == 0 {
+		return nil
+	}
+	line := append(p.pending, '\n')
+	p.pending = nil
+	return p.writeLine(line)
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
@@ -0,0 +1,96 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// identityTransport dials the address registered for the identity being dialed
+type identityTransport struct {
+	addrs map[string]string
+}
+
+func (t *identityTransport) Service(string) (*rest_model.ServiceDetail, error) {
+	return &rest_model.ServiceDetail{}, nil
+}
+
+func (t *identityTransport) Dial(_ string, opts *ziti.DialOptions) (net.Conn, error) {
+	addr, ok := t.addrs[opts.Identity]
+	if !ok {
+		return nil, fmt.Errorf("no terminator for %s", opts.Identity)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// newExitServer starts an ssh server which prints the user and command it was given, then exits with status
+func newExitServer(t *testing.T, status uint32) string {
+	return newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		for req := range reqs {
+			_ = req.Reply(req.Type == "exec", nil)
+			if req.Type == "exec" {
+				var exec struct{ Command string }
+				_ = ssh.Unmarshal(req.Payload, &exec)
+				_, _ = fmt.Fprintf(ch, "%s ran\n%s", conn.User(), exec.Command)
+				_, _ = fmt.Fprint(ch.Stderr(), "warning\n")
+				sendExitStatus(ch, status)
+				return
+			}
+		}
+	})
+}
+
+func TestRunOnTargets(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	transport := &identityTransport{addrs: map[string]string{
+		"a": newExitServer(t, 0),
+		"b": newExitServer(t, 3),
+	}}
+	f := &SshFlags{ServiceName: "zssh", Username: "fallback", Insecure: true}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	results := RunOnTargets(context.Background(), f, transport, []string{"a", "ops@b", "c"}, "uptime", stdout, stderr, 2)
+	if !assert.Len(t, results, 3) {
+		return
+	}
+	assert.Equal(t, TargetResult{Target: "a", ExitCode: 0}, results[0])
+	assert.Equal(t, TargetResult{Target: "b", ExitCode: 3}, results[1])
+	assert.Equal(t, "c", results[2].Target)
+	assert.ErrorContains(t, results[2].Err, "no terminator for c", "a failed target shouldn't stop the others")
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"[a] fallback ran", "[a] uptime", "[b] ops ran", "[b] uptime"}, lines)
+	assert.Contains(t, stderr.String(), "[a] warning\n")
+	assert.Contains(t, stderr.String(), "[b] warning\n")
+
+	report := &bytes.Buffer{}
+	assert.Equal(t, 1, ReportTargetResults(report, results))
+	assert.Equal(t, "[a] exit status 0\n[b] exit status 3\n[c] error: error when dialing service name zssh: no terminator for c\n"+
+		"1 of 3 targets succeeded, 2 failed\n", report.String())
+	assert.Equal(t, 0, ReportTargetResults(&bytes.Buffer{}, results[:1]))
+}
+
+func TestPrefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := newPrefixWriter(out, &sync.Mutex{}, "a")
+	_, _ = w.Write([]byte("one\ntw"))
+	assert.Equal(t, "[a] one\n", out.String(), "partial lines should be held back")
+	_, _ = w.Write([]byte("o\nthree"))
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, "[a] one\n[a] two\n[a] three\n", out.String())
+}
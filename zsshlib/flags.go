@@ -1,20 +1,74 @@
 package zsshlib
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"os"
 	"os/user"
+	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
+
+	"zssh/version"
 )
 
 type SshFlags struct {
-	ZConfig     string
-	SshKeyPath  string
-	Debug       bool
-	ServiceName string
-	Username    string
-	OIDC        OIDCFlags
+	ConfigFile        string
+	ZConfigs          []string
+	Network           string
+	SshKeyPaths       []string
+	Debug             bool
+	Quiet             bool
+	Trace             bool
+	ClientVersion     string
+	Ciphers           []string
+	MACs              []string
+	KexAlgorithms     []string
+	ListAlgorithms    bool
+	LogLevel          string
+	LogFormat         string
+	ServiceName       string
+	Username          string
+	Insecure          bool
+	NoAgent           bool
+	Term              string
+	Timeout           time.Duration
+	KeepAlive         time.Duration
+	KeepAliveMax      int
+	Retries           int
+	Jump              string
+	PreJump           string
+	LocalForwards     []string
+	RemoteForwards    []string
+	ForwardOnly       bool
+	ForwardAgent      bool
+	AppData           []string
+	Env               []string
+	SendEnv           []string
+	Targets           []string
+	ParallelTargets   int
+	Reconnect         bool
+	ReconnectAttempts int
+	IdleTimeout       time.Duration
+	DeadAfter         time.Duration
+	Cwd               string
+	ControlMaster     bool
+	ControlPath       string
+	HostsFile         string
+	Gateway           bool
+	Enroll            string
+	EnrollSave        bool
+	OIDC              OIDCFlags
+
+	// enrolled is the identity enrolled with Enroll, see enrolledConfig
+	enrolled *ziti.Config
 }
 
 type OIDCFlags struct {
@@ -22,16 +76,118 @@ type OIDCFlags struct {
 	Issuer                string
 	ClientID              string
 	ClientSecret          string
+	CallbackHost          string
 	CallbackPort          string
 	AsAscii               bool
 	OIDCOnly              bool
 	ControllerUrl         string
 	AdditionalLoginParams []string
+	Logout                bool
+	AuthFlow              string
+	OfflineAccess         bool
+	Provider              string
+	Scopes                []string
+	AuthTimeout           time.Duration
+	UserFromCert          bool
+	UserClaim             string
 }
 
 type ScpFlags struct {
 	SshFlags
-	Recursive bool
+	Recursive      bool
+	Progress       bool
+	Preserve       bool
+	Verify         bool
+	Limit          string
+	Resume         bool
+	Parallel       int
+	DryRun         bool
+	FollowSymlinks bool
+	Compress       bool
+	Interactive    bool
+	MakeDirs       bool
+	Batch          string
+	Protocol       string
+	FileRetries    int
+	Concurrency    int
+	KeepGoing      bool
+	Exec           string
+	Sparse         bool
+	NoGlob         bool
+	KeepPartial    bool
+	SftpSubsystem  string
+}
+
+// TransferOptions returns the TransferOptions requested by the flags
+func (f *ScpFlags) TransferOptions() (*TransferOptions, error) {
+	if f.Compress && (f.Recursive || f.Resume || f.Batch != "") {
+		return nil, fmt.Errorf("--compress cannot be combined with --recursive, --resume or --batch")
+	}
+	if f.Sparse && f.Compress {
+		return nil, fmt.Errorf("--sparse cannot be combined with --compress")
+	}
+	if f.Exec != "" && (f.Batch != "" || f.Interactive) {
+		return nil, fmt.Errorf("--exec cannot be combined with --batch or --interactive")
+	}
+	switch f.Protocol {
+	case "", ProtocolSftp:
+	case ProtocolScp:
+		if f.Compress || f.Resume || f.Verify || f.MakeDirs || f.Batch != "" || f.Interactive || f.FileRetries > 0 || f.Sparse || f.KeepPartial || (f.SftpSubsystem != "" && f.SftpSubsystem != DefaultSftpSubsystem) {
+			return nil, fmt.Errorf("--protocol %s cannot be combined with --compress, --resume, --verify, --mkdirs, --batch, --interactive, --file-retries, --sparse, --keep-partial or --sftp-subsystem", ProtocolScp)
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol [%s], expected %s or %s", f.Protocol, ProtocolSftp, ProtocolScp)
+	}
+	limit, err := ParseByteRate(f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	opts := &TransferOptions{
+		PreserveTimes:  f.Preserve,
+		Verify:         f.Verify,
+		Limit:          limit,
+		Resume:         f.Resume,
+		Parallel:       f.Parallel,
+		DryRun:         f.DryRun,
+		FollowSymlinks: f.FollowSymlinks,
+		MakeDirs:       f.MakeDirs,
+		FileRetries:    f.FileRetries,
+		KeepGoing:      f.KeepGoing,
+		Concurrency:    f.Concurrency,
+		Sparse:         f.Sparse,
+		KeepPartial:    f.KeepPartial,
+		Stats:          &TransferStats{},
+	}
+	if f.Progress {
+		opts.Progress = NewProgressBar(os.Stderr).Update
+	}
+	return opts, nil
+}
+
+// ConfigureLogger applies the requested log level and format, --debug being shorthand for --log-level debug and
+// --quiet for --log-level error
+func (f *SshFlags) ConfigureLogger() error {
+	level := f.LogLevel
+	if f.Debug && f.Quiet {
+		return fmt.Errorf("--quiet cannot be combined with --debug")
+	}
+	if f.Debug {
+		level = logrus.DebugLevel.String()
+	}
+	if f.Quiet {
+		level = logrus.ErrorLevel.String()
+	}
+	if f.Trace {
+		if f.Quiet {
+			return fmt.Errorf("--quiet cannot be combined with --trace")
+		}
+		level = logrus.TraceLevel.String()
+	}
+	if err := ConfigureLogger(level, f.LogFormat); err != nil {
+		return err
+	}
+	log.Debugf("%s %s, %s", filepath.Base(os.Args[0]), version.Get(), runtime.Version())
+	return nil
 }
 
 func (f *SshFlags) GetUserAndIdentity(input string) (string, string) {
@@ -42,11 +198,8 @@ func (f *SshFlags) GetUserAndIdentity(input string) (string, string) {
 }
 
 func ParseUserName(input string, returnDefault bool) string {
-	var username string
-	if strings.ContainsAny(input, "@") {
-		userServiceName := strings.Split(input, "@")
-		username = userServiceName[0]
-	} else {
+	username, _ := splitUserHost(input)
+	if username == "" {
 		if returnDefault {
 
 			curUser, err := user.Current()
@@ -63,19 +216,220 @@ func ParseUserName(input string, returnDefault bool) string {
 }
 
 func ParseTargetIdentity(input string) string {
-	var targetIdentity string
-	if strings.ContainsAny(input, "@") {
-		targetIdentity = strings.Split(input, "@")[1]
-	} else {
-		targetIdentity = input
+	_, targetIdentity := splitUserHost(input)
+	if strings.HasPrefix(targetIdentity, "[") {
+		if end := strings.Index(targetIdentity, "]"); end > 0 {
+			return targetIdentity[1:end]
+		}
 	}
-
 	if strings.Contains(targetIdentity, ":") {
 		return strings.Split(targetIdentity, ":")[0]
 	}
 	return targetIdentity
 }
 
+// ParseTarget returns the target of input, [user@]target, as given on the command line. With --gateway it is the
+// host[:port] of the ssh server behind the service, for ParseGatewayTarget, kept whole. Otherwise it is the ziti
+// identity, as ParseTargetIdentity returns it, which has no port, so one looking like a port hints at --gateway.
+func (f *SshFlags) ParseTarget(input string) string {
+	_, target := splitUserHost(input)
+	if f.Gateway {
+		return target
+	}
+	if !strings.HasPrefix(target, "[") && looksLikeHostPort(target) {
+		log.Warnf("ziti identities have no port, ignoring it in %s. to reach %s behind a gateway service, use --gateway", target, target)
+	}
+	return ParseTargetIdentity(input)
+}
+
+// splitUserHost splits input, [user@]identity, at the last @ before any bracketed identity, so user names may contain
+// @, such as first.last@example.com@identity, and so may bracketed identities: user@[name@domain]
+func splitUserHost(input string) (string, string) {
+	prefix := input
+	if bracket := strings.Index(input, "["); bracket >= 0 {
+		prefix = input[:bracket]
+	}
+	if at := strings.LastIndex(prefix, "@"); at >= 0 {
+		return input[:at], input[at+1:]
+	}
+	return "", input
+}
+
+// RemoteSpec is a remote location given to zscp as [user@]identity:[path]
+type RemoteSpec struct {
+	User     string
+	Identity string
+	Path     string
+}
+
+// ParseRemoteSpec parses a zscp argument, returning nil when it refers to a local path. As with scp, an argument is
+// remote when it has a colon with no slash before it, and only the first colon separates the identity from the path,
+// so the path may contain colons itself. An identity containing colons or @ can be given in brackets:
+// user@[identity:with:colons]:path, and a path may be quoted, see unquotePath. Arguments which can't be told apart, such as C:/dir outside of windows, are
+// rejected rather than guessed at.
+func ParseRemoteSpec(arg string) (*RemoteSpec, error) {
+	return parseRemoteSpec(arg, runtime.GOOS == "windows")
+}
+
+func parseRemoteSpec(arg string, windows bool) (*RemoteSpec, error) {
+	if isDrivePath(arg) {
+		if windows {
+			return nil, nil
+		}
+		if len(arg) > 2 {
+			return nil, fmt.Errorf("[%s] is ambiguous: use ./%s for a local path or user@%s for identity %s", arg, arg, arg, arg[:1])
+		}
+	}
+
+	colon := strings.Index(arg, ":")
+	if colon < 0 {
+		return nil, nil
+	}
+	host, remotePath := arg[:colon], arg[colon+1:]
+	bracket := strings.Index(host, "[")
+	if bracket >= 0 {
+		end := strings.Index(arg[bracket:], "]")
+		if end < 0 {
+			return nil, fmt.Errorf("[%s] is missing the ] closing the bracketed identity", arg)
+		}
+		end += bracket
+		if end+1 >= len(arg) || arg[end+1] != ':' {
+			return nil, fmt.Errorf("[%s] is missing the : after the bracketed identity", arg)
+		}
+		host, remotePath = arg[:end+1], arg[end+2:]
+	}
+
+	prefix := host
+	if bracket >= 0 {
+		prefix = host[:bracket]
+	}
+	if strings.ContainsAny(prefix, `/\`) {
+		// a slash before the colon, such as ./file:name or dir/file:name, is a local path
+		return nil, nil
+	}
+
+	unquoted, err := unquotePath(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %w", arg, err)
+	}
+	spec := &RemoteSpec{Identity: host, Path: unquoted}
+	if strings.Contains(prefix, "@") {
+		spec.User, spec.Identity = splitUserHost(host)
+		if spec.User == "" {
+			return nil, fmt.Errorf("[%s] has an empty user before the @", arg)
+		}
+	}
+	if bracket >= 0 {
+		if !strings.HasPrefix(spec.Identity, "[") {
+			return nil, fmt.Errorf("[%s] has characters before the bracketed identity", arg)
+		}
+		spec.Identity = spec.Identity[1 : len(spec.Identity)-1]
+	}
+	if spec.Identity == "" {
+		return nil, fmt.Errorf("[%s] has an empty identity before the :", arg)
+	}
+	return spec, nil
+}
+
+// unquotePath removes the quotes around a remote path given as "path" or 'path', which protect spaces through a
+// second round of shell parsing, as with scp. Within double quotes a backslash escapes a quote or backslash, within
+// single quotes nothing is escaped. Unquoted paths are returned as they are, backslashes included.
+func unquotePath(p string) (string, error) {
+	if p == "" || (p[0] != '"' && p[0] != '\'') {
+		return p, nil
+	}
+	quote := p[0]
+	var unquoted strings.Builder
+	for i := 1; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == quote:
+			if i != len(p)-1 {
+				return "", fmt.Errorf("has characters after the quoted path")
+			}
+			return unquoted.String(), nil
+		case c == '\\' && quote == '"' && i+1 < len(p) && (p[i+1] == '"' || p[i+1] == '\\'):
+			i++
+			unquoted.WriteByte(p[i])
+		default:
+			unquoted.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("is missing the %c closing the quoted path", quote)
+}
+
+// isDrivePath reports whether arg looks like a windows path starting with a drive letter, such as C:\dir or C:/dir
+func isDrivePath(arg string) bool {
+	if len(arg) < 2 || arg[1] != ':' {
+		return false
+	}
+	letter := arg[0]
+	if (letter < 'a' || letter > 'z') && (letter < 'A' || letter > 'Z') {
+		return false
+	}
+	return len(arg) == 2 || arg[2] == '\\' || arg[2] == '/'
+}
+
+// ParseAppData JSON encodes key=value pairs as an object for use as ziti dial app data. No pairs results in nil.
+func ParseAppData(pairs []string) ([]byte, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	appData, err := parseAppDataPairs(pairs)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(appData)
+}
+
+// parseAppDataPairs parses key=value pairs into a map
+func parseAppDataPairs(pairs []string) (map[string]string, error) {
+	appData := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid app data [%s]: expected key=value", pair)
+		}
+		appData[key] = value
+	}
+	return appData, nil
+}
+
+// Environment returns the variables to send to the remote, as KEY=VALUE sorted by name: the local variables with
+// names matching the --send-env patterns, overridden by those given explicitly with --env
+func (f *SshFlags) Environment() ([]string, error) {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		for _, pattern := range f.SendEnv {
+			if matched, err := path.Match(pattern, name); err != nil {
+				return nil, fmt.Errorf("invalid --send-env pattern [%s]: %w", pattern, err)
+			} else if matched {
+				env[name] = value
+				break
+			}
+		}
+	}
+	for _, kv := range f.Env {
+		name, value, found := strings.Cut(kv, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid environment variable [%s]: expected KEY=VALUE", kv)
+		}
+		env[name] = value
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		result = append(result, name+"="+env[name])
+	}
+	return result, nil
+}
+
 func ParseFilePath(input string) string {
 	if strings.Contains(input, ":") {
 		colPos := strings.Index(input, ":") + 1
@@ -88,21 +442,63 @@ func ParseFilePath(input string) string {
 func (f *SshFlags) OIDCFlags(cmd *cobra.Command) {
 	defaults := DefaultConfig()
 	cmd.Flags().StringVarP(&f.OIDC.CallbackPort, "callbackPort", "p", "", "Port for Callback. default: "+defaults.OIDC.CallbackPort)
+	cmd.Flags().StringVar(&f.OIDC.CallbackHost, "callbackHost", "", "Host the callback listens on and the provider redirects to. default: "+defaults.OIDC.CallbackHost)
 	cmd.Flags().StringVarP(&f.OIDC.ClientID, "clientID", "n", "", "IdP ClientID. default: "+defaults.OIDC.ClientID)
 	cmd.Flags().StringVarP(&f.OIDC.ClientSecret, "clientSecret", "e", "", "IdP ClientSecret. default: (empty string - use PKCE)")
 	cmd.Flags().StringVarP(&f.OIDC.Issuer, "oidcIssuer", "a", "", "URL of the OpenID Connect provider. required")
 	cmd.Flags().BoolVarP(&f.OIDC.Mode, "oidc", "o", false, fmt.Sprintf("toggle OIDC mode. default: %t", defaults.OIDC.Enabled))
 	cmd.Flags().BoolVar(&f.OIDC.OIDCOnly, "oidcOnly", false, "toggle OIDC only mode. default: false")
 	cmd.Flags().StringVar(&f.OIDC.ControllerUrl, "controllerUrl", "", "the url of the controller to use. only used with --oidcOnly")
-	cmd.Flags().StringArrayVarP(&f.OIDC.AdditionalLoginParams, "additionalLoginParams", "l", []string{}, "Additional parameters to specify to the login. Can specify multiple times. Must be in the format of param=value")
+	cmd.Flags().StringVar(&f.OIDC.AuthFlow, "auth-flow", "", fmt.Sprintf("OIDC flow to use: %s (opens a local browser) or %s (for headless machines). default: %s", AuthFlowCode, AuthFlowDevice, defaults.OIDC.AuthFlow))
+	cmd.Flags().StringVar(&f.OIDC.Provider, "oidc-provider", "", "OIDC provider preset setting the scopes and issuer conventions: "+strings.Join(OIDCProviderNames(), ", ")+". default: none")
+	cmd.Flags().StringSliceVar(&f.OIDC.Scopes, "scopes", nil, "OIDC scopes to request, overriding those of --oidc-provider. default: "+strings.ReplaceAll(DefaultAuthScopes, " ", ","))
+	cmd.Flags().BoolVar(&f.OIDC.OfflineAccess, "offline-access", false, "request the offline_access scope so the cached OIDC token can be refreshed without logging in again. default: false")
+	cmd.Flags().DurationVar(&f.OIDC.AuthTimeout, "auth-timeout", DefaultAuthTimeout, "how long to wait for the OIDC login to be completed in the browser")
+	cmd.Flags().BoolVar(&f.OIDC.UserFromCert, "user-from-cert", false, "use a claim of the OIDC ID token, see --user-claim, as the ssh username unless given as user@identity. default: false")
+	cmd.Flags().StringVar(&f.OIDC.UserClaim, "user-claim", DefaultUserClaim, "the ID token claim --user-from-cert takes the ssh username from, e.g. email")
+	cmd.Flags().BoolVar(&f.OIDC.Logout, "logout", false, "remove the cached OIDC token, forcing a new login. tokens are cached in: "+TokenCacheFile())
+	cmd.Flags().StringArrayVarP(&f.OIDC.AdditionalLoginParams, "additionalLoginParams", unusedShorthand(cmd, "l"), []string{}, "Additional parameters to specify to the login. Can specify multiple times. Must be in the format of param=value")
+}
+
+// unusedShorthand returns shorthand unless cmd has already claimed it for a flag of its own, such as -l for ls --long
+func unusedShorthand(cmd *cobra.Command, shorthand string) string {
+	if cmd.Flags().ShorthandLookup(shorthand) != nil {
+		return ""
+	}
+	return shorthand
 }
 
 func (f *SshFlags) AddCommonFlags(cmd *cobra.Command) {
 	defaults := DefaultConfig()
 	cmd.Flags().StringVarP(&f.ServiceName, "service", "s", "", fmt.Sprintf("service name. default: %s", defaults.Service))
-	cmd.Flags().StringVarP(&f.SshKeyPath, "SshKeyPath", "i", "", "Path to ssh key. default: $HOME/.ssh/id_rsa")
-	cmd.Flags().StringVarP(&f.ZConfig, "ZConfig", "c", "", fmt.Sprintf("Path to ziti config file. default: "+DefaultIdentityFile()))
+	cmd.Flags().StringArrayVarP(&f.SshKeyPaths, "SshKeyPath", "i", []string{}, "Path to ssh key, or - to read the key from stdin. Can specify multiple times, keys are tried in order. A key in $"+PRIVATE_KEY_ENV+" is tried first. default: the first of $HOME/.ssh/"+strings.Join(DefaultKeyNames, ", ")+" found")
+	cmd.Flags().StringVar(&f.ConfigFile, "config", "", "Path to the zssh config file of per-target settings and defaults. default: "+GetConfigFilePath())
+	cmd.Flags().StringArrayVarP(&f.ZConfigs, "ZConfig", "c", []string{}, "Path to a ziti config file, or a directory of them, also --ziti-config. Can specify multiple times, see --network. default: "+DefaultIdentityFile())
+	cmd.Flags().StringVar(&f.Enroll, "enroll", "", "path to a one-time enrollment token (jwt) to enroll the ziti identity with, rather than loading an identity file")
+	cmd.Flags().BoolVar(&f.EnrollSave, "enroll-save", false, "save the identity enrolled with --enroll to the -c file, "+DefaultConfig().ZConfig+" by default, to use it from then on")
+	cmd.Flags().StringVar(&f.Network, "network", "", "name of the ziti config to use when several are given with -c, the file name without .json, e.g. prod for prod.json")
+	cmd.Flags().SetNormalizeFunc(zitiConfigAlias)
 	cmd.Flags().BoolVarP(&f.Debug, "debug", "d", false, "pass to enable any additional debug information")
+	_ = cmd.Flags().MarkDeprecated("debug", "use --log-level debug")
+	cmd.Flags().BoolVarP(&f.Quiet, "quiet", unusedShorthand(cmd, "q"), false, "only log errors. status messages are always written to stderr, leaving stdout to the remote's output")
+	cmd.Flags().StringVar(&f.LogLevel, "log-level", "info", "log level: trace, debug, info, warn or error")
+	cmd.Flags().BoolVar(&f.Trace, "trace", false, "log the ssh handshake: the versions, key exchange algorithms and ciphers offered and negotiated, and the keys offered to authenticate. implies --log-level trace")
+	cmd.Flags().StringVar(&f.LogFormat, "log-format", LogFormatText, fmt.Sprintf("log format: %s or %s", LogFormatText, LogFormatJSON))
+	cmd.Flags().DurationVar(&f.Timeout, "timeout", 30*time.Second, "how long to wait when connecting to the target. 0 waits forever")
+	cmd.Flags().DurationVar(&f.KeepAlive, "keepalive", 0, "interval between keepalives sent to the server, e.g. 30s. default: 0 (off)")
+	cmd.Flags().IntVar(&f.KeepAliveMax, "keepalive-max", 3, "consecutive keepalives which may fail before the connection is closed")
+	cmd.Flags().IntVar(&f.Retries, "retries", 0, "times to retry dialing the target after a transient failure, such as a timeout, backing off between attempts. 3 is a good choice on busy networks")
+	cmd.Flags().StringVar(&f.HostsFile, "hosts-file", "", "file of `name identity` lines mapping friendly names to target identities. names it doesn't list are used as identities")
+	cmd.Flags().StringVarP(&f.Jump, "jump", "J", "", "user@identity of a jump host to connect through. the target is then a host reachable from the jump host on port 22")
+	cmd.Flags().StringVar(&f.PreJump, "pre-jump", "", "user@host:port of a plain ssh bastion to reach the ziti network through. not supported yet, see the README")
+	cmd.Flags().BoolVar(&f.NoAgent, "no-agent", false, "don't offer the keys of the ssh agent, only the key files. agent keys are otherwise tried after every key file")
+	cmd.Flags().BoolVar(&f.Insecure, "insecure", false, "skip host key verification against known_hosts. not recommended")
+	cmd.Flags().StringVar(&f.ClientVersion, "client-version", "", "identification string sent to the ssh server, starting with SSH-2.0-. default: "+clientVersionPrefix+"zssh_<version>")
+	cmd.Flags().StringSliceVar(&f.Ciphers, "ciphers", []string{}, "comma separated ciphers to offer the server, in order of preference, e.g. for servers requiring ones not offered by default. see --list-algorithms")
+	cmd.Flags().StringSliceVar(&f.MACs, "macs", []string{}, "comma separated MACs to offer the server, in order of preference. see --list-algorithms")
+	cmd.Flags().StringSliceVar(&f.KexAlgorithms, "kex", []string{}, "comma separated key exchange algorithms to offer the server, in order of preference. see --list-algorithms")
+	cmd.Flags().BoolVar(&f.Gateway, "gateway", false, "the target is the host[:port] of an ssh server behind the service, passed to the hosting side as dial app data, rather than a ziti identity")
+	cmd.Flags().StringArrayVar(&f.AppData, "app-data", []string{}, "key=value passed to the hosting identity as dial app data. Can specify multiple times")
 
 	/*
 		if f.SshKeyPath == "" {
@@ -125,20 +521,88 @@ func (f *SshFlags) AddCommonFlags(cmd *cobra.Command) {
 	*/
 }
 
+// AddListAlgorithmsFlag adds --list-algorithms to cmd, which lists the algorithms --ciphers, --macs and --kex accept
+// instead of running cmd, so requires none of its arguments
+func (f *SshFlags) AddListAlgorithmsFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&f.ListAlgorithms, "list-algorithms", false, "list the supported ciphers, MACs and key exchange algorithms and exit")
+	args, run := cmd.Args, cmd.Run
+	cmd.Args = func(cmd *cobra.Command, a []string) error {
+		if f.ListAlgorithms || args == nil {
+			return nil
+		}
+		return args(cmd, a)
+	}
+	cmd.Run = func(cmd *cobra.Command, a []string) {
+		if f.ListAlgorithms {
+			ListAlgorithms(cmd.OutOrStdout())
+			return
+		}
+		run(cmd, a)
+	}
+}
+
+// applyConfigFlags sets the flags of cmd named in flags which are still at their defaults, being neither given on
+// the command line nor filled in from ~/.ssh/config. A list value sets a flag which can be specified multiple times.
+func applyConfigFlags(cmd *cobra.Command, flags map[string]interface{}) {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			log.Debugf("config sets flag %s which %s doesn't have", name, cmd.Name())
+			continue
+		}
+		if flag.Changed || flag.Value.String() != flag.DefValue {
+			continue
+		}
+		values, isList := flags[name].([]interface{})
+		if !isList {
+			values = []interface{}{flags[name]}
+		}
+		for _, value := range values {
+			if err := cmd.Flags().Set(name, fmt.Sprint(value)); err != nil {
+				log.Warnf("ignoring config for flag %s: %v", name, err)
+				break
+			}
+		}
+	}
+}
+
+// zitiConfigAlias accepts --ziti-config for -c/--ZConfig
+func zitiConfigAlias(_ *pflag.FlagSet, name string) pflag.NormalizedName {
+	if name == "ziti-config" {
+		name = "ZConfig"
+	}
+	return pflag.NormalizedName(name)
+}
+
 func Combine(cmd *cobra.Command, c *SshFlags, cfg *Config) {
 	d := DefaultConfig()
-	if c.ZConfig == "" {
+	applyConfigFlags(cmd, cfg.Flags)
+	if !cmd.Flags().Changed("log-level") && cfg.LogLevel != "" {
+		c.LogLevel = cfg.LogLevel
+	}
+	if err := c.ConfigureLogger(); err != nil {
+		log.Warnf("ignoring configured log settings: %v", err)
+	}
+	if len(c.ZConfigs) == 0 {
 		if cfg.ZConfig == "" {
-			c.ZConfig = d.ZConfig
+			c.ZConfigs = []string{d.ZConfig}
 		} else {
-			c.ZConfig = cfg.ZConfig
+			c.ZConfigs = []string{cfg.ZConfig}
 		}
 	}
-	if c.SshKeyPath == "" {
+	if c.Network == "" {
+		c.Network = cfg.Network
+	}
+	if len(c.SshKeyPaths) == 0 {
 		if cfg.SshKeyPath == "" {
-			c.SshKeyPath = d.SshKeyPath
+			c.SshKeyPaths = []string{d.SshKeyPath}
 		} else {
-			c.SshKeyPath = cfg.SshKeyPath
+			c.SshKeyPaths = []string{cfg.SshKeyPath}
 		}
 	}
 	if c.ServiceName == "" {
@@ -161,12 +625,28 @@ func Combine(cmd *cobra.Command, c *SshFlags, cfg *Config) {
 		c.OIDC.Mode = cfg.OIDC.Enabled
 	}
 	if c.OIDC.Mode {
+		if !cmd.Flags().Changed("offline-access") {
+			c.OIDC.OfflineAccess = cfg.OIDC.OfflineAccess
+		}
+		if c.OIDC.Provider == "" {
+			c.OIDC.Provider = cfg.OIDC.Provider
+		}
+		if len(c.OIDC.Scopes) == 0 {
+			c.OIDC.Scopes = cfg.OIDC.Scopes
+		}
 		if c.OIDC.Issuer == "" {
-			c.OIDC.Issuer = cfg.OIDC.Issuer
-			if cfg.OIDC.Issuer == "" {
+			if cfg.OIDC.Issuer != "" {
+				c.OIDC.Issuer = cfg.OIDC.Issuer
+			} else if c.OIDC.Provider == "" {
+				// a provider's well known issuer, if it has one, is set by OIDCConfig.validateAndSetDefaults
 				c.OIDC.Issuer = d.OIDC.Issuer
+			}
+		}
+		if c.OIDC.CallbackHost == "" {
+			if cfg.OIDC.CallbackHost == "" {
+				c.OIDC.CallbackHost = d.OIDC.CallbackHost
 			} else {
-				c.OIDC.Issuer = cfg.OIDC.Issuer
+				c.OIDC.CallbackHost = cfg.OIDC.CallbackHost
 			}
 		}
 		if c.OIDC.CallbackPort == "" {
@@ -188,5 +668,12 @@ func Combine(cmd *cobra.Command, c *SshFlags, cfg *Config) {
 		if c.OIDC.ClientSecret == "" {
 			// good
 		}
+		if c.OIDC.AuthFlow == "" {
+			if cfg.OIDC.AuthFlow == "" {
+				c.OIDC.AuthFlow = d.OIDC.AuthFlow
+			} else {
+				c.OIDC.AuthFlow = cfg.OIDC.AuthFlow
+			}
+		}
 	}
 }
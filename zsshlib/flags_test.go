@@ -1,12 +1,19 @@
 package zsshlib
 
 import (
+	"os"
 	"os/user"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
+)
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
 )
-import "github.com/stretchr/testify/assert"
 
 func TestParseTargetIdentity(t *testing.T) {
 	result := ParseTargetIdentity("user@hostname:port")
@@ -20,6 +27,10 @@ func TestParseTargetIdentity(t *testing.T) {
 
 	result = ParseTargetIdentity("user@hostname")
 	assert.Equal(t, result, "hostname", "user not correct")
+
+	assert.Equal(t, "hostname", ParseTargetIdentity("first.last@example.com@hostname"))
+	assert.Equal(t, "host@corp", ParseTargetIdentity("user@[host@corp]"))
+	assert.Equal(t, "fd00::1", ParseTargetIdentity("user@[fd00::1]:path"))
 }
 
 func getOsUser() string {
@@ -45,6 +56,10 @@ func TestParseUserName(t *testing.T) {
 
 	result = ParseUserName("user@hostname", true)
 	assert.Equal(t, result, "user", "user not correct")
+
+	assert.Equal(t, "first.last@example.com", ParseUserName("first.last@example.com@hostname", false))
+	assert.Equal(t, "user", ParseUserName("user@[host@corp]", false))
+	assert.Equal(t, "", ParseUserName("[host@corp]", false))
 }
 func TestParseFilePath(t *testing.T) {
 	result := ParseFilePath("user@hostname:/*/bob")
@@ -59,3 +74,156 @@ func TestParseFilePath(t *testing.T) {
 	result = ParseFilePath(`user@hostname:/haha://two\:colons`)
 	assert.Equal(t, result, `/haha://two\:colons`, "user not correct")
 }
+
+func TestParseRemoteSpec(t *testing.T) {
+	tests := []struct {
+		arg     string
+		windows bool
+		want    *RemoteSpec
+		err     string
+	}{
+		{arg: "user@identity:/tmp/file", want: &RemoteSpec{User: "user", Identity: "identity", Path: "/tmp/file"}},
+		{arg: "identity:file", want: &RemoteSpec{Identity: "identity", Path: "file"}},
+		{arg: "user@identity:", want: &RemoteSpec{User: "user", Identity: "identity"}},
+		{arg: "user@identity:/a:b/c:d", want: &RemoteSpec{User: "user", Identity: "identity", Path: "/a:b/c:d"}},
+		{arg: `user@identity:/haha://two\:colons`, want: &RemoteSpec{User: "user", Identity: "identity", Path: `/haha://two\:colons`}},
+		{arg: "first.last@example.com@identity:x", want: &RemoteSpec{User: "first.last@example.com", Identity: "identity", Path: "x"}},
+		{arg: "user@[fd00::1]:/tmp", want: &RemoteSpec{User: "user", Identity: "fd00::1", Path: "/tmp"}},
+		{arg: "[identity:with:colons]:", want: &RemoteSpec{Identity: "identity:with:colons"}},
+		{arg: "C:", want: &RemoteSpec{Identity: "C"}},
+		{arg: "user@C:/tmp", want: &RemoteSpec{User: "user", Identity: "C", Path: "/tmp"}},
+		{arg: "file.txt"},
+		{arg: "/abs/path"},
+		{arg: "./local:file"},
+		{arg: "dir/file:name"},
+		{arg: `dir\file:name`},
+		{arg: ""},
+		{arg: `C:\Users\me\file`, windows: true},
+		{arg: "C:/Users/me/file", windows: true},
+		{arg: "C:", windows: true},
+		{arg: `C:\Users\me\file`, err: "ambiguous"},
+		{arg: "c:/tmp", err: "ambiguous"},
+		{arg: ":path", err: "empty identity"},
+		{arg: "user@:path", err: "empty identity"},
+		{arg: "@identity:path", err: "empty user"},
+		{arg: "user@[fd00::1", err: "missing the ]"},
+		{arg: "user@[fd00::1]/tmp", err: "missing the : after"},
+		{arg: "user@x[fd00::1]:/tmp", err: "before the bracketed identity"},
+		{arg: "user@[host@corp]:/tmp", want: &RemoteSpec{User: "user", Identity: "host@corp", Path: "/tmp"}},
+		{arg: "[host@corp]:/tmp", want: &RemoteSpec{Identity: "host@corp", Path: "/tmp"}},
+		{arg: "me@example.com@[fd00::1]:x", want: &RemoteSpec{User: "me@example.com", Identity: "fd00::1", Path: "x"}},
+		{arg: "user@identity:/srv/my app/file 1.txt", want: &RemoteSpec{User: "user", Identity: "identity", Path: "/srv/my app/file 1.txt"}},
+		{arg: `user@identity:"/srv/my app/file.txt"`, want: &RemoteSpec{User: "user", Identity: "identity", Path: "/srv/my app/file.txt"}},
+		{arg: `user@identity:'/srv/$HOME "x"'`, want: &RemoteSpec{User: "user", Identity: "identity", Path: `/srv/$HOME "x"`}},
+		{arg: `user@identity:"a \"quoted\" \\ name"`, want: &RemoteSpec{User: "user", Identity: "identity", Path: `a "quoted" \ name`}},
+		{arg: `user@identity:"c:\d"`, want: &RemoteSpec{User: "user", Identity: "identity", Path: `c:\d`}},
+		{arg: `user@identity:""`, want: &RemoteSpec{User: "user", Identity: "identity"}},
+		{arg: `user@identity:a"b"`, want: &RemoteSpec{User: "user", Identity: "identity", Path: `a"b"`}},
+		{arg: `user@identity:"/srv/app`, err: `missing the " closing the quoted path`},
+		{arg: `user@identity:'/srv/app`, err: "missing the ' closing the quoted path"},
+		{arg: `user@identity:"/srv"/app`, err: "characters after the quoted path"},
+	}
+	for _, test := range tests {
+		spec, err := parseRemoteSpec(test.arg, test.windows)
+		if test.err != "" {
+			assert.ErrorContains(t, err, test.err, "[%s]", test.arg)
+			continue
+		}
+		assert.NoError(t, err, "[%s]", test.arg)
+		assert.Equal(t, test.want, spec, "[%s]", test.arg)
+	}
+}
+
+func TestParseAppData(t *testing.T) {
+	appData, err := ParseAppData(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, appData)
+
+	appData, err = ParseAppData([]string{"tag=blue", "region=us-east=1", "empty="})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"tag":"blue","region":"us-east=1","empty":""}`, string(appData))
+
+	for _, invalid := range []string{"novalue", "=value", ""} {
+		_, err = ParseAppData([]string{invalid})
+		assert.ErrorContains(t, err, "expected key=value", "[%s] should be invalid", invalid)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	t.Setenv("ZSSH_TEST_LC_ALL", "C")
+	t.Setenv("ZSSH_TEST_LC_TIME", "en_GB")
+	t.Setenv("ZSSH_TEST_OTHER", "ignored")
+
+	f := &SshFlags{SendEnv: []string{"ZSSH_TEST_LC_*"}, Env: []string{"ZSSH_TEST_LC_TIME=C", "EDITOR=vim"}}
+	env, err := f.Environment()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EDITOR=vim", "ZSSH_TEST_LC_ALL=C", "ZSSH_TEST_LC_TIME=C"}, env)
+
+	_, err = (&SshFlags{Env: []string{"NOVALUE"}}).Environment()
+	assert.ErrorContains(t, err, "expected KEY=VALUE")
+
+	_, err = (&SshFlags{SendEnv: []string{"["}}).Environment()
+	assert.ErrorContains(t, err, "invalid --send-env pattern")
+}
+
+func TestZitiConfigFlags(t *testing.T) {
+	flags := &SshFlags{}
+	cmd := &cobra.Command{}
+	flags.AddCommonFlags(cmd)
+	assert.NoError(t, cmd.ParseFlags([]string{"-c", "prod.json", "--ziti-config", "networks", "--network", "prod"}))
+	assert.Equal(t, []string{"prod.json", "networks"}, flags.ZConfigs)
+
+	Combine(cmd, flags, &Config{ZConfig: "ignored.json", Network: "ignored"})
+	assert.Equal(t, []string{"prod.json", "networks"}, flags.ZConfigs)
+	assert.Equal(t, "prod", flags.Network)
+
+	flags = &SshFlags{}
+	Combine(cmd, flags, &Config{ZConfig: "staging.json", Network: "staging"})
+	assert.Equal(t, []string{"staging.json"}, flags.ZConfigs)
+	assert.Equal(t, "staging", flags.Network)
+}
+
+func TestConfigFile(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+defaults:
+  service: shared-zssh
+  user: ops
+  log_level: warn
+  flags:
+    timeout: 5s
+    keepalive: 20s
+    env: [A=1, B=2]
+web:
+  user: deploy
+  flags:
+    timeout: 9s
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := &SshFlags{}
+	cmd := &cobra.Command{}
+	flags.AddCommonFlags(cmd)
+	cmd.Flags().StringArrayVar(&flags.Env, "env", []string{}, "")
+	assert.NoError(t, cmd.ParseFlags([]string{"--keepalive", "1m"}))
+	Combine(cmd, flags, FindConfig(configFile, "web"))
+	assert.Equal(t, "deploy", flags.Username, "the target's entry should take precedence over the defaults")
+	assert.Equal(t, "shared-zssh", flags.ServiceName, "the defaults should fill in the target's entry")
+	assert.Equal(t, 9*time.Second, flags.Timeout)
+	assert.Equal(t, time.Minute, flags.KeepAlive, "flags should take precedence over the config file")
+	assert.Equal(t, []string{"A=1", "B=2"}, flags.Env)
+	assert.Equal(t, "warn", flags.LogLevel)
+	assert.Equal(t, logrus.WarnLevel, log.GetLevel())
+
+	flags = &SshFlags{}
+	cmd = &cobra.Command{}
+	flags.AddCommonFlags(cmd)
+	assert.NoError(t, cmd.ParseFlags(nil))
+	Combine(cmd, flags, FindConfig(configFile, "db"))
+	assert.Equal(t, "ops", flags.Username, "targets without an entry should use the defaults")
+	assert.Equal(t, 5*time.Second, flags.Timeout)
+
+	assert.Equal(t, DefaultConfig(), FindConfig(filepath.Join(t.TempDir(), "missing.yaml"), "web"), "a missing config file is not an error")
+}
@@ -0,0 +1,150 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Forward listens locally as described by a -L style spec, [bind_address:]port:host:hostport, and forwards each
+// accepted connection to host:hostport through the ssh client. It blocks until ctx is done, at which point the
+// listener is closed.
+func Forward(ctx context.Context, client *ssh.Client, spec string) error {
+	listenAddr, targetAddr, err := ParseForwardSpec(spec)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", listenAddr, err)
+	}
+	log.Infof("forwarding local %s => remote %s", listenAddr, targetAddr)
+	return serveForward(ctx, listener, func() (net.Conn, error) {
+		return client.Dial("tcp", targetAddr)
+	})
+}
+
+// ReverseForward asks the remote to listen as described by a -R style spec, [bind_address:]port:host:hostport, and
+// forwards each connection it accepts to host:hostport from the local machine. It blocks until ctx is done, at which
+// point the remote listener is closed.
+func ReverseForward(ctx context.Context, client *ssh.Client, spec string) error {
+	listenAddr, targetAddr, err := ParseForwardSpec(spec)
+	if err != nil {
+		return err
+	}
+	listener, err := client.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("remote was unable to listen on %s: %w", listenAddr, err)
+	}
+	log.Infof("forwarding remote %s => local %s", listenAddr, targetAddr)
+	return serveForward(ctx, listener, func() (net.Conn, error) {
+		return net.Dial("tcp", targetAddr)
+	})
+}
+
+// ParseForwardSpec parses a forwarding spec of the form [bind_address:]port:host:hostport into the address to listen
+// on and the address to forward to. IPv6 addresses must be enclosed in square brackets.
+func ParseForwardSpec(spec string) (listenAddr string, targetAddr string, err error) {
+	var parts []string
+	for rest := spec; rest != ""; {
+		var part string
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return "", "", fmt.Errorf("invalid forward [%s]: unterminated [", spec)
+			}
+			part, rest = rest[1:end], rest[end+1:]
+			if rest != "" && !strings.HasPrefix(rest, ":") {
+				return "", "", fmt.Errorf("invalid forward [%s]: expected : after ]", spec)
+			}
+			rest = strings.TrimPrefix(rest, ":")
+		} else if i := strings.Index(rest, ":"); i >= 0 {
+			part, rest = rest[:i], rest[i+1:]
+		} else {
+			part, rest = rest, ""
+		}
+		parts = append(parts, part)
+	}
+
+	switch len(parts) {
+	case 3:
+		parts = append([]string{"localhost"}, parts...)
+	case 4:
+	default:
+		return "", "", fmt.Errorf("invalid forward [%s]: expected [bind_address:]port:host:hostport", spec)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", "", fmt.Errorf("invalid forward [%s]: expected [bind_address:]port:host:hostport", spec)
+		}
+	}
+	return net.JoinHostPort(parts[0], parts[1]), net.JoinHostPort(parts[2], parts[3]), nil
+}
+
+// serveForward accepts connections from listener, bridging each to a connection obtained from dial, until ctx is
+// done
+func serveForward(ctx context.Context, listener net.Listener, dial func() (net.Conn, error)) error {
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+	defer func() { _ = listener.Close() }()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error accepting forwarded connection: %w", err)
+		}
+		go func() {
+			target, err := dial()
+			if err != nil {
+				log.Errorf("unable to open forwarded connection: %v", err)
+				_ = conn.Close()
+				return
+			}
+			bridge(conn, target)
+		}()
+	}
+}
+
+// bridge copies bytes in both directions between a and b until both directions are done, then closes both
+func bridge(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+}
@@ -0,0 +1,155 @@
+package zsshlib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec   string
+		listen string
+		target string
+		err    bool
+	}{
+		{spec: "8080:localhost:80", listen: "localhost:8080", target: "localhost:80"},
+		{spec: "0.0.0.0:8080:db.internal:5432", listen: "0.0.0.0:8080", target: "db.internal:5432"},
+		{spec: "[::1]:8080:[fe80::1]:22", listen: "[::1]:8080", target: "[fe80::1]:22"},
+		{spec: "8080:[::1]:22", listen: "localhost:8080", target: "[::1]:22"},
+		{spec: "8080:localhost", err: true},
+		{spec: "a:b:c:d:e", err: true},
+		{spec: "8080::80", err: true},
+		{spec: "[::1:8080:localhost:80", err: true},
+	}
+	for _, test := range tests {
+		listen, target, err := ParseForwardSpec(test.spec)
+		if test.err {
+			assert.Error(t, err, "expected an error for %s", test.spec)
+			continue
+		}
+		assert.NoError(t, err, test.spec)
+		assert.Equal(t, test.listen, listen, test.spec)
+		assert.Equal(t, test.target, target, test.spec)
+	}
+}
+
+func TestForward(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	// an echo server marking each line it returns, reachable from the ssh server
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = fmt.Fprintf(conn, "%s!\n", scanner.Text())
+				}
+			}()
+		}
+	}()
+
+	// the ssh server opens direct-tcpip channels as OpenSSH does
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			return
+		}
+		dest := struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}{}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &dest); err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			_, _ = io.Copy(ch, target)
+			_ = ch.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(target, ch)
+			_ = target.Close()
+		}()
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(&ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}, "target", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	// a free port to forward from
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := free.Addr().String()
+	_ = free.Close()
+	_, listenPort, _ := net.SplitHostPort(listenAddr)
+	echoHost, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	forwarded := make(chan error, 1)
+	go func() { forwarded <- Forward(ctx, client, "127.0.0.1:"+listenPort+":"+echoHost+":"+echoPort) }()
+	var local net.Conn
+	assert.Eventually(t, func() bool {
+		local, err = net.Dial("tcp", listenAddr)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	if local == nil {
+		t.FailNow()
+	}
+	defer func() { _ = local.Close() }()
+	reader := bufio.NewReader(local)
+	for _, line := range []string{"hello", "world"} {
+		_, err := fmt.Fprintln(local, line)
+		assert.NoError(t, err)
+		reply, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, line+"!\n", reply, "bytes should be forwarded in both directions")
+	}
+
+	cancel()
+	select {
+	case err := <-forwarded:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarding should stop once the context is done")
+	}
+	_, err = net.Dial("tcp", listenAddr)
+	assert.Error(t, err, "the listener should be closed")
+}
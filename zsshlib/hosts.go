@@ -0,0 +1,94 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// TargetResolver maps the friendly names operators use, such as web01, to the ziti identities hosting them
+type TargetResolver interface {
+	// ResolveTarget returns the identity registered for name, or name itself when there's none
+	ResolveTarget(name string) (string, error)
+}
+
+// HostsFile is a TargetResolver read from a file of `name identity` lines. Blank lines and lines starting with # are
+// ignored. A name listed with more than one identity is ambiguous and fails to resolve.
+type HostsFile struct {
+	path    string
+	targets map[string][]string
+}
+
+// LoadHostsFile reads the hosts file at path
+func LoadHostsFile(path string) (*HostsFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read hosts file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	hosts := &HostsFile{path: path, targets: map[string][]string{}}
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %d of hosts file %s: expected `name identity`", n, path)
+		}
+		name, identity := fields[0], fields[1]
+		if !slices.Contains(hosts.targets[name], identity) {
+			hosts.targets[name] = append(hosts.targets[name], identity)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read hosts file %s: %w", path, err)
+	}
+	return hosts, nil
+}
+
+func (h *HostsFile) ResolveTarget(name string) (string, error) {
+	identities := h.targets[name]
+	switch len(identities) {
+	case 0:
+		return name, nil
+	case 1:
+		log.Debugf("resolved %s to identity %s using %s", name, identities[0], h.path)
+		return identities[0], nil
+	default:
+		return "", fmt.Errorf("%s is ambiguous in hosts file %s: it maps to %s", name, h.path, strings.Join(identities, ", "))
+	}
+}
+
+// ResolveTarget returns the identity --hosts-file registers for name, or name itself when it isn't listed or no hosts
+// file is set
+func (f *SshFlags) ResolveTarget(name string) (string, error) {
+	if f.HostsFile == "" {
+		return name, nil
+	}
+	hosts, err := LoadHostsFile(f.HostsFile)
+	if err != nil {
+		return "", err
+	}
+	return hosts.ResolveTarget(name)
+}
@@ -0,0 +1,76 @@
+package zsshlib
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeHostsFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHostsFile(t *testing.T) {
+	path := writeHostsFile(t, `# web tier
+web01   ziti-web-01
+web02	ziti-web-02
+
+db      ziti-db-primary
+db      ziti-db-replica
+web01   ziti-web-01
+`)
+	hosts, err := LoadHostsFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	identity, err := hosts.ResolveTarget("web01")
+	assert.NoError(t, err)
+	assert.Equal(t, "ziti-web-01", identity, "a name listed twice with the same identity isn't ambiguous")
+	identity, err = hosts.ResolveTarget("web02")
+	assert.NoError(t, err)
+	assert.Equal(t, "ziti-web-02", identity)
+
+	identity, err = hosts.ResolveTarget("ziti-cache")
+	assert.NoError(t, err)
+	assert.Equal(t, "ziti-cache", identity, "unlisted names should be used as identities")
+
+	_, err = hosts.ResolveTarget("db")
+	assert.ErrorContains(t, err, "db is ambiguous in hosts file "+path+": it maps to ziti-db-primary, ziti-db-replica")
+
+	_, err = LoadHostsFile(writeHostsFile(t, "web01\n"))
+	assert.ErrorContains(t, err, "invalid line 1 of hosts file")
+	_, err = LoadHostsFile(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "unable to read hosts file")
+
+	identity, err = (&SshFlags{}).ResolveTarget("web01")
+	assert.NoError(t, err)
+	assert.Equal(t, "web01", identity, "names are identities without a hosts file")
+}
+
+func TestResolveTargetBeforeDial(t *testing.T) {
+	f := &SshFlags{ServiceName: "zssh", HostsFile: writeHostsFile(t, "web01 ziti-web-01\nweb01 ziti-web-02\napp ziti-app\n")}
+	transport := &fakeTransport{
+		services: map[string]*rest_model.ServiceDetail{"zssh": {}},
+		dial:     func(int) (net.Conn, error) { return nil, errors.New("no access") },
+	}
+
+	_, err := EstablishClientWithTransport(f, transport, "", "app")
+	assert.ErrorContains(t, err, "no access")
+	if assert.Len(t, transport.dials, 1) {
+		assert.Equal(t, "ziti-app", transport.dials[0].Identity, "the identity registered for the name should be dialed")
+	}
+
+	_, err = EstablishClientWithTransport(f, transport, "", "web01")
+	assert.ErrorContains(t, err, "ambiguous")
+	assert.Len(t, transport.dials, 1, "ambiguous names shouldn't be dialed")
+}
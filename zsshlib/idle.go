@@ -0,0 +1,67 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned by RemoteShell when the shell is closed by --idle-timeout
+var ErrIdleTimeout = errors.New("disconnected due to inactivity")
+
+// idleTimer calls onIdle once no input has been read through Reader for timeout, e.g. to close an unattended shell
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.expired.Store(true)
+		onIdle()
+	})
+	return t
+}
+
+// Reader returns r, resetting the timer each time input is read from it
+func (t *idleTimer) Reader(r io.Reader) io.Reader {
+	return &idleReader{r: r, t: t}
+}
+
+// Stop stops the timer, reporting whether it had already expired
+func (t *idleTimer) Stop() bool {
+	t.timer.Stop()
+	return t.expired.Load()
+}
+
+type idleReader struct {
+	r io.Reader
+	t *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && !r.t.expired.Load() {
+		r.t.timer.Reset(r.t.timeout)
+	}
+	return n, err
+}
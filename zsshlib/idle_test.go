@@ -0,0 +1,38 @@
+package zsshlib
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleTimer(t *testing.T) {
+	idle := make(chan struct{})
+	timer := newIdleTimer(50*time.Millisecond, func() { close(idle) })
+	r := timer.Reader(strings.NewReader("typing"))
+	buf := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		time.Sleep(30 * time.Millisecond)
+		_, err := r.Read(buf)
+		assert.NoError(t, err)
+	}
+	select {
+	case <-idle:
+		t.Fatal("reading input should reset the timer")
+	default:
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer didn't expire without input")
+	}
+	assert.True(t, timer.Stop(), "stop should report the timer expired")
+
+	timer = newIdleTimer(time.Hour, func() { t.Error("stopped timer shouldn't expire") })
+	_, _ = io.ReadAll(timer.Reader(strings.NewReader("x")))
+	assert.False(t, timer.Stop())
+}
@@ -0,0 +1,130 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const keepaliveRequest = "keepalive@openssh.com"
+
+// ErrConnectionLost is returned by RemoteShell when the connection fails during an interactive shell, or the server
+// stops answering for --dead-after
+var ErrConnectionLost = errors.New("connection lost")
+
+// StartKeepalive sends a keepalive request to the server every interval for as long as the client is open. Once
+// maxMissed consecutive keepalives fail or go unanswered, the client is closed. An interval of 0 disables keepalives.
+func StartKeepalive(client *ssh.Client, interval time.Duration, maxMissed int) {
+	if interval <= 0 {
+		return
+	}
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			}
+
+			if err := sendKeepalive(client, interval); err != nil {
+				missed++
+				log.Debugf("keepalive %d/%d failed: %v", missed, maxMissed, err)
+				if missed >= maxMissed {
+					log.Errorf("connection lost: %d consecutive keepalives failed, closing connection", missed)
+					_ = client.Close()
+					return
+				}
+			} else {
+				missed = 0
+			}
+		}
+	}()
+}
+
+// sendKeepalive sends a single keepalive, failing if no reply arrives within timeout. Any reply, including a
+// rejection of the request, shows the server is alive.
+func sendKeepalive(client *ssh.Client, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no reply after %v", timeout)
+	}
+}
+
+// watchConnection calls onLost, at most once, when the connection of client fails while done is open. With a threshold,
+// the server is also probed with keepalives, and declared lost once one goes unanswered for threshold, as a failed
+// ziti circuit may otherwise leave the connection silently open.
+func watchConnection(client *ssh.Client, threshold time.Duration, done <-chan struct{}, onLost func(error)) {
+	closed := make(chan error, 1)
+	go func() { closed <- client.Wait() }()
+
+	go func() {
+		var probe <-chan time.Time
+		if threshold > 0 {
+			ticker := time.NewTicker(threshold / 2)
+			defer ticker.Stop()
+			probe = ticker.C
+		}
+		lost := func(err error) {
+			select {
+			case <-done:
+			default:
+				onLost(err)
+			}
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case err := <-closed:
+				if err == nil {
+					err = fmt.Errorf("closed by the server")
+				}
+				lost(fmt.Errorf("%w: %v", ErrConnectionLost, err))
+				return
+			case <-probe:
+				if err := sendKeepalive(client, threshold); err != nil {
+					lost(fmt.Errorf("%w: the server hasn't answered for %v", ErrConnectionLost, threshold))
+					return
+				}
+			}
+		}
+	}()
+}
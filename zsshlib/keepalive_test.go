@@ -0,0 +1,102 @@
+package zsshlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newUnresponsiveSshClient returns a client connected to an ssh server which completes the handshake and then stops
+// answering, as a server behind a failed ziti circuit appears to
+func newUnresponsiveSshClient(t *testing.T) *ssh.Client {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		serverSide, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// requests are never read, so none are answered
+		_, _, _, _ = ssh.NewServerConn(serverSide, serverConfig)
+	}()
+
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := Dial(&ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}, "target", clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func waitLost(t *testing.T, lost <-chan error, timeout time.Duration) error {
+	select {
+	case err := <-lost:
+		return err
+	case <-time.After(timeout):
+		t.Fatal("the connection was not reported lost")
+		return nil
+	}
+}
+
+func TestWatchConnectionUnanswered(t *testing.T) {
+	client := newUnresponsiveSshClient(t)
+	done := make(chan struct{})
+	defer close(done)
+
+	lost := make(chan error, 1)
+	watchConnection(client, 100*time.Millisecond, done, func(err error) { lost <- err })
+	err := waitLost(t, lost, 5*time.Second)
+	assert.ErrorIs(t, err, ErrConnectionLost)
+	assert.ErrorContains(t, err, "the server hasn't answered for 100ms")
+}
+
+func TestWatchConnectionClosed(t *testing.T) {
+	client := newTestSshClient(t, func(_ *ssh.ServerConn, ch ssh.Channel, _ <-chan *ssh.Request) {})
+	done := make(chan struct{})
+	defer close(done)
+
+	lost := make(chan error, 1)
+	watchConnection(client, 0, done, func(err error) { lost <- err })
+	_ = client.Conn.Close()
+	assert.ErrorIs(t, waitLost(t, lost, 5*time.Second), ErrConnectionLost)
+}
+
+func TestWatchConnectionDone(t *testing.T) {
+	client := newTestSshClient(t, func(_ *ssh.ServerConn, ch ssh.Channel, _ <-chan *ssh.Request) {})
+	done := make(chan struct{})
+	lost := make(chan error, 1)
+	watchConnection(client, 50*time.Millisecond, done, func(err error) { lost <- err })
+
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+	_ = client.Close()
+	select {
+	case err := <-lost:
+		t.Fatalf("an answering server, or one closed after the shell, shouldn't be reported lost: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -21,6 +21,12 @@ import (
 	"github.com/mgutz/ansi"
 	"github.com/sirupsen/logrus"
 	"runtime"
+	"strings"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
 )
 
 var log *logrus.Logger
@@ -46,12 +52,35 @@ func init() {
 	}
 
 	log.SetFormatter(fmter)
+	log.AddHook(tokenRedactor{})
 }
 
 func Logger() *logrus.Logger {
 	return log
 }
 
+// ConfigureLogger sets the level (trace, debug, info, warn or error) and format (text or json) of the zssh logger.
+// The json format also applies to the standard logrus logger so all output can be ingested alike. An empty level or
+// format leaves it unchanged.
+func ConfigureLogger(level string, format string) error {
+	if level != "" {
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil || lvl < logrus.ErrorLevel {
+			return fmt.Errorf("invalid log level [%s]: expected trace, debug, info, warn or error", level)
+		}
+		log.SetLevel(lvl)
+	}
+	switch strings.ToLower(format) {
+	case "", LogFormatText:
+	case LogFormatJSON:
+		log.SetFormatter(&logrus.JSONFormatter{})
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format [%s]: expected %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
 type logrusFormatter struct {
 }
 
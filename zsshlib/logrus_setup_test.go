@@ -0,0 +1,53 @@
+package zsshlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConfigureLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	level, formatter, output := log.Level, log.Formatter, log.Out
+	stdFormatter := logrus.StandardLogger().Formatter
+	t.Cleanup(func() {
+		log.SetLevel(level)
+		log.SetFormatter(formatter)
+		log.SetOutput(output)
+		logrus.SetFormatter(stdFormatter)
+	})
+	log.SetOutput(out)
+
+	assert.NoError(t, ConfigureLogger("warn", LogFormatJSON))
+	log.Info("hidden")
+	log.Warn("shown")
+	entry := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entry), "expected a single JSON entry, got: %s", out.String())
+	assert.Equal(t, "shown", entry["msg"])
+	assert.Equal(t, "warning", entry["level"])
+
+	assert.ErrorContains(t, ConfigureLogger("loud", ""), "invalid log level")
+	assert.ErrorContains(t, ConfigureLogger("fatal", ""), "invalid log level")
+	assert.ErrorContains(t, ConfigureLogger("", "xml"), "invalid log format")
+}
+
+func TestConfigureLoggerQuiet(t *testing.T) {
+	level := log.Level
+	t.Cleanup(func() { log.SetLevel(level) })
+
+	f := &SshFlags{LogLevel: "debug", Quiet: true}
+	assert.NoError(t, f.ConfigureLogger())
+	assert.Equal(t, logrus.ErrorLevel, log.Level, "--quiet should only log errors")
+
+	f = &SshFlags{Debug: true, Quiet: true}
+	assert.ErrorContains(t, f.ConfigureLogger(), "--quiet cannot be combined with --debug")
+
+	f = &SshFlags{LogLevel: "info", Trace: true}
+	assert.NoError(t, f.ConfigureLogger())
+	assert.Equal(t, logrus.TraceLevel, log.Level, "--trace should log at trace level")
+
+	f = &SshFlags{Trace: true, Quiet: true}
+	assert.ErrorContains(t, f.ConfigureLogger(), "--quiet cannot be combined with --trace")
+}
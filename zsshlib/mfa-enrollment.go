@@ -24,15 +24,16 @@ func NewEnableCmd(flags *SshFlags) *cobra.Command {
 		Use:   "enable",
 		Short: "Enable MFA. Enables MFA TOTP for the provided identity",
 		Run: func(cmd *cobra.Command, args []string) {
-			cfg := DefaultConfig()
+			cfg := FindConfig(flags.ConfigFile, DefaultsKey)
 			Combine(cmd, flags, cfg)
 			EnableMFA(flags)
 		},
 	}
 
+	// registered first so it keeps -q, leaving --quiet without a shorthand
+	cmd.Flags().BoolVarP(&flags.OIDC.AsAscii, "qr-code", "q", false, fmt.Sprintf("display MFA secret as ascii QR code: %t", false))
 	flags.AddCommonFlags(cmd)
 	flags.OIDCFlags(cmd)
-	cmd.Flags().BoolVarP(&flags.OIDC.AsAscii, "qr-code", "q", false, fmt.Sprintf("display MFA secret as ascii QR code: %t", false))
 	return cmd
 }
 
@@ -41,7 +42,7 @@ func NewRemoveMfaCmd(flags *SshFlags) *cobra.Command {
 		Use:   "remove",
 		Short: "Remove MFA. Removes the MFA TOTP enablement for the provided identity",
 		Run: func(cmd *cobra.Command, args []string) {
-			cfg := DefaultConfig()
+			cfg := FindConfig(flags.ConfigFile, DefaultsKey)
 			Combine(cmd, flags, cfg)
 			RemoveMfa(flags)
 		},
@@ -53,8 +54,13 @@ func NewRemoveMfaCmd(flags *SshFlags) *cobra.Command {
 }
 
 func EnableMFA(flags *SshFlags) {
-	ctx := NewContext(flags, true)
-	Auth(ctx)
+	ctx, err := NewContext(flags, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := Auth(ctx); err != nil {
+		log.Fatal(err)
+	}
 
 	if deet, err := ctx.EnrollZitiMfa(); err != nil {
 		log.Error("Attempting to enroll for MFA TOTP failed.")
@@ -116,7 +122,10 @@ func EnableMFA(flags *SshFlags) {
 }
 
 func RemoveMfa(flags *SshFlags) {
-	ctx := NewContext(flags, true)
+	ctx, err := NewContext(flags, true)
+	if err != nil {
+		log.Fatal(err)
+	}
 	done := make(chan bool)
 	ctx.Events().AddAuthenticationStateFullListener(func(context ziti.Context, session edgeapis.ApiSession) {
 		go func() {
@@ -132,6 +141,8 @@ func RemoveMfa(flags *SshFlags) {
 			fmt.Println("MFA TOTP removed")
 		}()
 	})
-	Auth(ctx)
+	if err := Auth(ctx); err != nil {
+		log.Fatal(err)
+	}
 	<-done
 }
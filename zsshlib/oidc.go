@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
 	"github.com/zitadel/oidc/v2/pkg/client/rp"
 	"github.com/zitadel/oidc/v2/pkg/client/rp/cli"
 	httphelper "github.com/zitadel/oidc/v2/pkg/http"
@@ -17,40 +19,177 @@ import (
 	"golang.org/x/oauth2"
 )
 
+const (
+	// AuthFlowCode is the authorization code flow, completed in a local browser
+	AuthFlowCode = "code"
+	// AuthFlowDevice is the device authorization flow, completed on any device for headless machines
+	AuthFlowDevice = "device"
+
+	// DefaultAuthTimeout is how long the code flow waits for the user to log in unless configured otherwise
+	DefaultAuthTimeout = 2 * time.Minute
+
+	// DefaultCallbackHost is the host the code flow callback listens on unless configured otherwise, giving the
+	// http://localhost:63275/auth/callback redirect URI providers have registered for zssh
+	DefaultCallbackHost = "localhost"
+
+	// DefaultUserClaim is the ID token claim --user-from-cert takes the ssh username from unless configured otherwise
+	DefaultUserClaim = "preferred_username"
+)
+
 func OIDCFlow(initialContext context.Context, flags *SshFlags) (string, error) {
 	callbackPath := "/auth/callback"
 	cfg := &OIDCConfig{
 		Config: oauth2.Config{
 			ClientID:     flags.OIDC.ClientID,
 			ClientSecret: flags.OIDC.ClientSecret,
-			RedirectURL:  fmt.Sprintf("http://localhost:%v%v", flags.OIDC.CallbackPort, callbackPath),
+			RedirectURL:  callbackURL(flags.OIDC.CallbackHost, flags.OIDC.CallbackPort, callbackPath),
 		},
 		CallbackPath:          callbackPath,
+		CallbackHost:          flags.OIDC.CallbackHost,
 		CallbackPort:          flags.OIDC.CallbackPort,
 		Issuer:                flags.OIDC.Issuer,
 		Logf:                  log.Debugf,
 		AdditionalLoginParams: flags.OIDC.AdditionalLoginParams,
+		AuthFlow:              flags.OIDC.AuthFlow,
+		OfflineAccess:         flags.OIDC.OfflineAccess,
+		Provider:              flags.OIDC.Provider,
+		AuthTimeout:           flags.OIDC.AuthTimeout,
+	}
+	cfg.Scopes = flags.OIDC.Scopes
+	if err := cfg.validateAndSetDefaults(); err != nil {
+		return "", fmt.Errorf("invalid config: %w", err)
+	}
+	if p, err := LookupOIDCProvider(cfg.Provider); err == nil && !p.matchesIssuer(cfg.Issuer) {
+		log.Warnf("issuer [%s] doesn't look like a %s issuer, which are usually of the form %s", cfg.Issuer, p.Name, p.IssuerExample)
 	}
-	waitFor := 30 * time.Second
-	ctx, cancel := context.WithTimeout(initialContext, waitFor)
-	defer cancel() // Ensure the cancel function is called to release resources
 
-	log.Infof("OIDC requested. If the CLI appears to be hung, check your browser for a login prompt. Waiting up to %v", waitFor)
-	token, err := GetToken(ctx, cfg)
+	if flags.OIDC.Logout {
+		if err := ClearTokenCache(); err != nil {
+			return "", fmt.Errorf("unable to clear cached OIDC token: %w", err)
+		}
+		log.Infof("cleared cached OIDC token")
+	} else if cache, err := loadTokenCache(); err == nil && cache.matches(cfg.Issuer, cfg.ClientID) {
+		if !cache.expired() {
+			log.Debugf("using cached OIDC token from %s", TokenCacheFile())
+			return flags.useTokens(&cache.Tokens)
+		}
+		if cache.RefreshToken != "" {
+			if err := refreshTokens(cfg, cache); err == nil {
+				log.Debugf("refreshed cached OIDC token")
+				return flags.useTokens(&cache.Tokens)
+			} else {
+				log.Debugf("unable to refresh cached OIDC token: %v", err)
+			}
+		}
+	}
+
+	if cfg.AuthFlow != AuthFlowDevice {
+		log.Infof("OIDC requested. If the CLI appears to be hung, check your browser for a login prompt. Waiting up to %v", cfg.AuthTimeout)
+	}
+	tokens, err := GetTokens(initialContext, cfg)
 	if err != nil {
 		return "", err
 	}
 
 	log.Infof("OIDC auth flow succeeded")
 
-	return token, nil
+	cache := &tokenCache{Issuer: cfg.Issuer, ClientID: cfg.ClientID, Tokens: *tokens}
+	if err := saveTokenCache(cache); err != nil {
+		log.Warnf("unable to cache OIDC token: %v", err)
+	}
+
+	return flags.useTokens(tokens)
+}
+
+// useTokens returns the access token to authenticate to ziti with, first taking the ssh username from the ID token
+// when --user-from-cert is set. A username given as user@identity still takes precedence.
+func (f *SshFlags) useTokens(tokens *Tokens) (string, error) {
+	if f.OIDC.UserFromCert {
+		claim := f.OIDC.UserClaim
+		if claim == "" {
+			claim = DefaultUserClaim
+		}
+		userName, err := tokens.UserFromClaim(claim)
+		if err != nil {
+			return "", err
+		}
+		log.Debugf("using ssh username %s from the %s claim", userName, claim)
+		f.Username = userName
+	}
+	return tokens.AccessToken, nil
+}
+
+// refreshTokens uses the cached refresh token to obtain new tokens, updating the cache in place and on disk
+func refreshTokens(config *OIDCConfig, cache *tokenCache) error {
+	relyingParty, err := newRelyingParty(config)
+	if err != nil {
+		return err
+	}
+	token, err := rp.RefreshAccessToken(relyingParty, cache.RefreshToken, "", "")
+	if err != nil {
+		return err
+	}
+	refreshed := newTokens(token, "")
+	if idToken, ok := token.Extra("id_token").(string); ok {
+		refreshed.IDToken = idToken
+	}
+	if refreshed.IDToken == "" {
+		refreshed.IDToken = cache.IDToken
+	}
+	if refreshed.RefreshToken == "" {
+		// providers which don't rotate refresh tokens keep accepting the one they issued
+		refreshed.RefreshToken = cache.RefreshToken
+	}
+	cache.Tokens = *refreshed
+	if err := saveTokenCache(cache); err != nil {
+		log.Warnf("unable to cache OIDC token: %v", err)
+	}
+	return nil
+}
+
+// callbackURL is the URL of path served by the code flow callback listening on host and port
+func callbackURL(host string, port string, path string) string {
+	if host == "" {
+		host = DefaultCallbackHost
+	}
+	return "http://" + net.JoinHostPort(host, port) + path
 }
 
-func zsshCodeFlow[C oidc.IDClaims](ctx context.Context, relyingParty rp.RelyingParty, config *OIDCConfig) *oidc.Tokens[C] {
-	codeflowCtx, codeflowCancel := context.WithCancel(ctx)
-	defer codeflowCancel()
+// listenCallback opens the listener the code flow callback is served on, explaining the likely cause when the
+// port is taken rather than leaving the user waiting on a browser that can't complete the flow
+func listenCallback(config *OIDCConfig) (net.Listener, error) {
+	address := net.JoinHostPort(config.CallbackHost, config.CallbackPort)
+	listener, err := net.Listen("tcp", address)
+	if isAddrInUse(err) {
+		return nil, fmt.Errorf("unable to listen for the OIDC callback on %s: the port is already in use, "+
+			"choose another with --callbackPort and register the matching redirect URI with the provider", address)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to listen for the OIDC callback on %s: %w", address, err)
+	}
+	return listener, nil
+}
+
+// isAddrInUse reports whether err was caused by the address already being taken. Windows reports its own
+// WSAEADDRINUSE, so the message is checked as well.
+func isAddrInUse(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, syscall.EADDRINUSE) || strings.Contains(err.Error(), "address already in use") ||
+		strings.Contains(err.Error(), "Only one usage of each socket address")
+}
+
+// openBrowser opens the login page of the code flow, replaced in tests
+var openBrowser = cli.OpenBrowser
+
+func zsshCodeFlow[C oidc.IDClaims](ctx context.Context, relyingParty rp.RelyingParty, config *OIDCConfig) (*oidc.Tokens[C], error) {
+	listener, err := listenCallback(config)
+	if err != nil {
+		return nil, err
+	}
 
 	tokenChan := make(chan *oidc.Tokens[C], 1)
+	errChan := make(chan error, 1)
 
 	callback := func(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens[C], state string, rp rp.RelyingParty) {
 		tokenChan <- tokens
@@ -60,31 +199,69 @@ func zsshCodeFlow[C oidc.IDClaims](ctx context.Context, relyingParty rp.RelyingP
 	}
 
 	authHandlerWithQueryState := func(party rp.RelyingParty) http.HandlerFunc {
-		var urlParamOpts rp.URLParamOpt
+		var urlParamOpts []rp.URLParamOpt
 		for _, v := range config.AdditionalLoginParams {
-			parts := strings.Split(v, "=")
-			urlParamOpts = rp.WithURLParam(parts[0], parts[1])
-		}
-		if urlParamOpts == nil {
-			urlParamOpts = func() []oauth2.AuthCodeOption {
-				return []oauth2.AuthCodeOption{}
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) == 2 {
+				urlParamOpts = append(urlParamOpts, rp.WithURLParam(parts[0], parts[1]))
 			}
 		}
 		return func(w http.ResponseWriter, r *http.Request) {
 			rp.AuthURLHandler(func() string {
 				return uuid.New().String()
-			}, party, urlParamOpts /*rp.WithURLParam("audience", "openziti2")*/)(w, r)
+			}, party, urlParamOpts... /*rp.WithURLParam("audience", "openziti2")*/)(w, r)
 		}
 	}
 
-	http.Handle("/login", authHandlerWithQueryState(relyingParty))
-	http.Handle(config.CallbackPath, rp.CodeExchangeHandler(callback, relyingParty))
+	codeExchange := rp.CodeExchangeHandler(callback, relyingParty)
+	mux := http.NewServeMux()
+	mux.Handle("/login", authHandlerWithQueryState(relyingParty))
+	mux.HandleFunc(config.CallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		if providerErr := r.URL.Query().Get("error"); providerErr != "" {
+			select {
+			case errChan <- callbackError(config, providerErr, r.URL.Query().Get("error_description")):
+			default:
+			}
+		}
+		codeExchange(w, r)
+	})
+
+	// only the browser is expected to call, so requests are kept small and quick
+	server := &http.Server{Handler: mux, MaxHeaderBytes: 64 << 10, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			errChan <- fmt.Errorf("OIDC callback server failed: %w", err)
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+		// Shutdown misses the listener when Serve hasn't started yet, which would leave the port taken
+		_ = listener.Close()
+	}()
 
-	httphelper.StartServer(codeflowCtx, ":"+config.CallbackPort)
+	log.Debugf("OIDC redirect URI: %s", config.RedirectURL)
+	openBrowser(callbackURL(config.CallbackHost, config.CallbackPort, "/login"))
 
-	cli.OpenBrowser("http://localhost:" + config.CallbackPort + "/login")
+	select {
+	case tokens := <-tokenChan:
+		return tokens, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	return <-tokenChan
+// callbackError describes an error the provider redirected back with. Providers reject a redirect URI that isn't
+// registered for the client, so in that case the URI to register is included.
+func callbackError(config *OIDCConfig, providerErr string, description string) error {
+	err := fmt.Errorf("OIDC provider returned %s: %s", providerErr, description)
+	if strings.Contains(strings.ToLower(providerErr+description), "redirect") {
+		return fmt.Errorf("%w. ensure %s is registered as a redirect URI for client %s", err, config.RedirectURL, config.ClientID)
+	}
+	return err
 }
 
 // OIDCConfig represents a config for the OIDC auth flow.
@@ -92,6 +269,9 @@ type OIDCConfig struct {
 	// CallbackPath is the path of the callback handler.
 	CallbackPath string
 
+	// CallbackHost is the host the callback handler listens on and the provider redirects to.
+	CallbackHost string
+
 	// CallbackPort is the port of the callback handler.
 	CallbackPort string
 
@@ -113,15 +293,94 @@ type OIDCConfig struct {
 	// Additional params to add to the login request
 	AdditionalLoginParams []string
 
+	// AuthFlow selects the OIDC flow used to obtain tokens: AuthFlowCode (default) or AuthFlowDevice
+	AuthFlow string
+
+	// Provider selects an OIDCProvider preset, setting the default scopes and issuer conventions. Empty for none.
+	Provider string
+
+	// AuthTimeout bounds how long the code flow waits for the user to log in. default: DefaultAuthTimeout
+	AuthTimeout time.Duration
+
+	// OfflineAccess requests the offline_access scope, which providers require before issuing a refresh token
+	OfflineAccess bool
+
 	oauth2.Config
 }
 
+// Tokens are the tokens obtained from an OIDC flow, which callers can persist and later refresh
+type Tokens struct {
+	IDToken      string    `json:"id_token"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// Claims returns the claims of the ID token, such as preferred_username or email. The token is decoded, not verified
+// again.
+func (t *Tokens) Claims() (map[string]any, error) {
+	if t.IDToken == "" {
+		return nil, fmt.Errorf("the OIDC provider issued no ID token, check the openid scope is requested")
+	}
+	claims := map[string]any{}
+	if _, err := oidc.ParseToken(t.IDToken, &claims); err != nil {
+		return nil, fmt.Errorf("unable to read the claims of the ID token: %w", err)
+	}
+	return claims, nil
+}
+
+// UserFromClaim returns a username from the named claim of the ID token. An email address, e.g. from the email
+// claim, is reduced to the part before the @.
+func (t *Tokens) UserFromClaim(claim string) (string, error) {
+	claims, err := t.Claims()
+	if err != nil {
+		return "", err
+	}
+	value, found := claims[claim]
+	if !found {
+		return "", fmt.Errorf("the ID token has no %s claim", claim)
+	}
+	userName, ok := value.(string)
+	if !ok || userName == "" {
+		return "", fmt.Errorf("the %s claim of the ID token is not a username: %v", claim, value)
+	}
+	userName, _, _ = strings.Cut(userName, "@")
+	return userName, nil
+}
+
+func newTokens(token *oauth2.Token, idToken string) *Tokens {
+	return &Tokens{
+		IDToken:      idToken,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+}
+
 // GetToken starts a local HTTP server, opens the web browser to initiate the OIDC Discovery and
 // Token Exchange flow, blocks until the user completes authentication and is redirected back, and returns
-// the OIDC tokens.
+// the access token, as it always has. Use GetTokens for the ID and refresh tokens.
 func GetToken(ctx context.Context, config *OIDCConfig) (string, error) {
+	tokens, err := GetTokens(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// GetTokens runs the configured OIDC flow like GetToken, returning all the tokens obtained. RefreshToken is only
+// set when the provider issues one, which most do only when OfflineAccess is requested.
+func GetTokens(ctx context.Context, config *OIDCConfig) (*Tokens, error) {
+	tokens, err := getTokens(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return newTokens(tokens.Token, tokens.IDToken), nil
+}
+
+func newRelyingParty(config *OIDCConfig) (rp.RelyingParty, error) {
 	if err := config.validateAndSetDefaults(); err != nil {
-		return "", fmt.Errorf("invalid config: %w", err)
+		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
 	cookieHandler := httphelper.NewCookieHandler(config.HashKey, config.BlockKey, httphelper.WithUnsecure())
@@ -136,23 +395,83 @@ func GetToken(ctx context.Context, config *OIDCConfig) (string, error) {
 
 	relyingParty, err := rp.NewRelyingPartyOIDC(config.Issuer, config.ClientID, config.ClientSecret, config.RedirectURL, config.Scopes, options...)
 	if err != nil {
-		logrus.Fatalf("error creating relyingParty %s", err.Error())
+		return nil, fmt.Errorf("error creating relyingParty %w", err)
 	}
+	return relyingParty, nil
+}
 
-	resultChan := make(chan *oidc.Tokens[*oidc.IDTokenClaims])
+func getTokens(ctx context.Context, config *OIDCConfig) (*oidc.Tokens[*oidc.IDTokenClaims], error) {
+	if ctx.Err() != nil {
+		return nil, authContextError(ctx, config)
+	}
+	relyingParty, err := newRelyingParty(config)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		tokens := zsshCodeFlow[*oidc.IDTokenClaims](ctx, relyingParty, config)
-		resultChan <- tokens
-	}()
+	if config.AuthFlow == AuthFlowDevice {
+		return deviceFlow(ctx, relyingParty, config)
+	}
 
-	select {
-	case tokens := <-resultChan:
-		log.Debugf("ID token: %s", tokens.IDToken)
-		log.Debugf("Refresh token: %s", tokens.RefreshToken)
-		log.Debugf("Access token: %s", tokens.AccessToken)
-		return tokens.AccessToken, nil
-	case <-ctx.Done():
-		return "", errors.New("timeout: OIDC authentication took too long")
+	ctx, cancel := context.WithTimeout(ctx, config.AuthTimeout)
+	defer cancel()
+	tokens, err := zsshCodeFlow[*oidc.IDTokenClaims](ctx, relyingParty, config)
+	if ctx.Err() != nil {
+		return nil, authContextError(ctx, config)
+	} else if err != nil {
+		return nil, err
+	}
+	log.Debugf("ID token: %s", redactToken(tokens.IDToken))
+	log.Debugf("Refresh token: %s", redactToken(tokens.RefreshToken))
+	log.Debugf("Access token: %s", redactToken(tokens.AccessToken))
+	return tokens, nil
+}
+
+// authContextError explains why ctx ended the code flow before the user completed it
+func authContextError(ctx context.Context, config *OIDCConfig) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("OIDC authentication timed out after %v. complete the login in the browser sooner or raise "+
+			"--auth-timeout. if the provider reported an invalid redirect URI, register %s for client %s",
+			config.AuthTimeout, config.RedirectURL, config.ClientID)
+	}
+	return fmt.Errorf("OIDC authentication cancelled: %w", ctx.Err())
+}
+
+// deviceFlow performs the device authorization flow, printing the verification URL and user code to the terminal
+// and then polling until the user completes authentication on another device or the code expires.
+func deviceFlow(ctx context.Context, relyingParty rp.RelyingParty, config *OIDCConfig) (*oidc.Tokens[*oidc.IDTokenClaims], error) {
+	auth, err := rp.DeviceAuthorization(config.Scopes, relyingParty)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization failed: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "To authenticate, visit %s and enter the code: %s\n", auth.VerificationURI, auth.UserCode)
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(os.Stderr, "or visit: %s\n", auth.VerificationURIComplete)
+	}
+
+	if auth.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(auth.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	resp, err := rp.DeviceAccessToken(ctx, auth.DeviceCode, interval, relyingParty)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization was not completed: %w", err)
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  resp.AccessToken,
+		TokenType:    resp.TokenType,
+		RefreshToken: resp.RefreshToken,
+	}
+	if resp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
 	}
+	return &oidc.Tokens[*oidc.IDTokenClaims]{Token: token, IDToken: resp.IDToken}, nil
 }
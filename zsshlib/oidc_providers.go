@@ -0,0 +1,127 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// OIDCProvider is a preset for a well known OIDC provider, selected with --oidc-provider
+type OIDCProvider struct {
+	// Name is the name the provider is selected by
+	Name string
+
+	// Scopes are requested unless scopes are configured explicitly
+	Scopes []string
+
+	// Issuer is the issuer of providers with a single, well known one. Empty when each tenant has its own.
+	Issuer string
+
+	// IssuerExample shows the form of the provider's issuer URL
+	IssuerExample string
+
+	// issuerPattern matches the provider's issuer URLs, see IssuerExample. Custom domains won't match, so a
+	// mismatch is only warned about.
+	issuerPattern *regexp.Regexp
+
+	// issuerTrailingSlash is set for providers whose issuer ends with a slash. The issuer must match the iss
+	// claim exactly, so a missing slash fails token verification.
+	issuerTrailingSlash bool
+
+	// OfflineAccessParams are added to the login request, rather than the offline_access scope, when offline
+	// access is requested from providers which don't support the scope
+	OfflineAccessParams []string
+}
+
+var oidcProviders = map[string]*OIDCProvider{
+	"okta": {
+		Name:          "okta",
+		Scopes:        []string{"openid", "profile", "email"},
+		IssuerExample: "https://your-org.okta.com/oauth2/default",
+		issuerPattern: regexp.MustCompile(`^https://[^/]+\.okta(preview)?\.com(/oauth2/[^/]+)?/?$`),
+	},
+	"auth0": {
+		Name:                "auth0",
+		Scopes:              []string{"openid", "profile", "email"},
+		IssuerExample:       "https://your-tenant.auth0.com/",
+		issuerPattern:       regexp.MustCompile(`^https://[^/]+\.auth0\.com/?$`),
+		issuerTrailingSlash: true,
+	},
+	"keycloak": {
+		Name:          "keycloak",
+		Scopes:        []string{"openid", "profile", "email"},
+		IssuerExample: "https://keycloak.example.com/realms/your-realm",
+		issuerPattern: regexp.MustCompile(`^https?://.+/realms/[^/]+/?$`),
+	},
+	"google": {
+		Name:                "google",
+		Scopes:              []string{"openid", "profile", "email"},
+		Issuer:              "https://accounts.google.com",
+		IssuerExample:       "https://accounts.google.com",
+		issuerPattern:       regexp.MustCompile(`^https://accounts\.google\.com/?$`),
+		OfflineAccessParams: []string{"access_type=offline", "prompt=consent"},
+	},
+	"azure-ad": {
+		Name:          "azure-ad",
+		Scopes:        []string{"openid", "profile", "email"},
+		IssuerExample: "https://login.microsoftonline.com/your-tenant-id/v2.0",
+		issuerPattern: regexp.MustCompile(`^https://login\.microsoftonline\.com/[^/]+/v2\.0/?$`),
+	},
+}
+
+// OIDCProviderNames returns the names of the provider presets, sorted
+func OIDCProviderNames() []string {
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupOIDCProvider returns the preset named name, ignoring case
+func LookupOIDCProvider(name string) (*OIDCProvider, error) {
+	if p, found := oidcProviders[strings.ToLower(name)]; found {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown OIDC provider [%s], expected one of: %s", name, strings.Join(OIDCProviderNames(), ", "))
+}
+
+// scopes returns the scopes to request, adding offline_access when requested and supported by the provider
+func (p *OIDCProvider) scopes(offlineAccess bool) []string {
+	scopes := append([]string{}, p.Scopes...)
+	if offlineAccess && len(p.OfflineAccessParams) == 0 {
+		scopes = append(scopes, OfflineAccessScope)
+	}
+	return scopes
+}
+
+// normalizeIssuer returns issuer following the provider's conventions
+func (p *OIDCProvider) normalizeIssuer(issuer string) string {
+	if p.issuerTrailingSlash && !strings.HasSuffix(issuer, "/") {
+		issuer += "/"
+	}
+	return issuer
+}
+
+// matchesIssuer reports whether issuer looks like one of the provider's issuers
+func (p *OIDCProvider) matchesIssuer(issuer string) bool {
+	return p.issuerPattern.MatchString(issuer)
+}
@@ -0,0 +1,71 @@
+package zsshlib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCProviderScopes(t *testing.T) {
+	for name, expected := range map[string]struct {
+		issuer  string
+		scopes  []string
+		offline []string
+		params  []string
+	}{
+		"okta": {"https://acme.okta.com/oauth2/default",
+			[]string{"openid", "profile", "email"}, []string{"openid", "profile", "email", "offline_access"}, nil},
+		"auth0": {"https://acme.auth0.com/",
+			[]string{"openid", "profile", "email"}, []string{"openid", "profile", "email", "offline_access"}, nil},
+		"keycloak": {"https://keycloak.example.com/realms/acme",
+			[]string{"openid", "profile", "email"}, []string{"openid", "profile", "email", "offline_access"}, nil},
+		"google": {"https://accounts.google.com",
+			[]string{"openid", "profile", "email"}, []string{"openid", "profile", "email"}, []string{"access_type=offline", "prompt=consent"}},
+		"azure-ad": {"https://login.microsoftonline.com/acme/v2.0",
+			[]string{"openid", "profile", "email"}, []string{"openid", "profile", "email", "offline_access"}, nil},
+	} {
+		p, err := LookupOIDCProvider(name)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.True(t, p.matchesIssuer(expected.issuer), name)
+		assert.True(t, p.matchesIssuer(p.IssuerExample), name)
+
+		cfg := &OIDCConfig{Provider: name, Issuer: expected.issuer}
+		cfg.ClientID = "openziti-client"
+		assert.NoError(t, cfg.validateAndSetDefaults(), name)
+		assert.Equal(t, expected.scopes, cfg.Scopes, name)
+		assert.Empty(t, cfg.AdditionalLoginParams, name)
+
+		cfg = &OIDCConfig{Provider: name, Issuer: expected.issuer, OfflineAccess: true}
+		cfg.ClientID = "openziti-client"
+		assert.NoError(t, cfg.validateAndSetDefaults(), name)
+		assert.Equal(t, expected.offline, cfg.Scopes, name)
+		assert.Equal(t, expected.params, cfg.AdditionalLoginParams, name)
+	}
+	assert.Equal(t, []string{"auth0", "azure-ad", "google", "keycloak", "okta"}, OIDCProviderNames())
+}
+
+func TestOIDCProviderOverrides(t *testing.T) {
+	_, err := LookupOIDCProvider("ping")
+	assert.ErrorContains(t, err, "expected one of: auth0, azure-ad, google, keycloak, okta")
+
+	cfg := &OIDCConfig{Provider: "Google"}
+	cfg.ClientID = "openziti-client"
+	cfg.Scopes = []string{"openid", "groups"}
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Equal(t, []string{"openid", "groups"}, cfg.Scopes, "configured scopes should override the provider's")
+	assert.Equal(t, "https://accounts.google.com", cfg.Issuer, "google's issuer should be the default")
+
+	cfg = &OIDCConfig{Provider: "auth0", Issuer: "https://acme.auth0.com"}
+	cfg.ClientID = "openziti-client"
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Equal(t, "https://acme.auth0.com/", cfg.Issuer, "auth0 issuers end with a slash")
+
+	cfg = &OIDCConfig{Provider: "keycloak"}
+	cfg.ClientID = "openziti-client"
+	assert.ErrorContains(t, cfg.validateAndSetDefaults(), "an issuer must be set for keycloak")
+
+	okta, _ := LookupOIDCProvider("okta")
+	assert.False(t, okta.matchesIssuer("https://keycloak.example.com/realms/acme"))
+}
@@ -0,0 +1,177 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultPoolIdleTTL is how long a ClientPool keeps an unused connection open when no idle TTL is given
+const DefaultPoolIdleTTL = time.Minute
+
+// poolHealthTimeout bounds the keepalive checking a pooled connection is alive when --timeout isn't set
+const poolHealthTimeout = 5 * time.Second
+
+// ErrPoolClosed is returned by ClientPool.Get once the pool is closed
+var ErrPoolClosed = errors.New("client pool is closed")
+
+// PoolKey identifies the connections a ClientPool treats as interchangeable: those to the same target identity, over
+// the same service, as the same user. An empty User falls back as it does for EstablishClient.
+type PoolKey struct {
+	Service  string
+	Identity string
+	User     string
+}
+
+// ClientPool keeps ssh connections open between uses, so processes connecting to the same targets repeatedly only
+// pay for dialing and authenticating once. Connections are taken with Get and handed back with Put, and are closed
+// once left unused for the idle TTL. It is safe for concurrent use.
+type ClientPool struct {
+	flags     *SshFlags
+	transport Transport
+	idleTTL   time.Duration
+
+	mu     sync.Mutex
+	idle   map[PoolKey][]*pooledClient
+	closed bool
+}
+
+// pooledClient is an idle connection of a ClientPool, closed by expiry unless taken first
+type pooledClient struct {
+	client *ssh.Client
+	expiry *time.Timer
+}
+
+// NewClientPool creates a pool dialing targets over transport as configured by f. Connections left unused for
+// idleTTL are closed, an idleTTL below 1 keeping them for DefaultPoolIdleTTL.
+func NewClientPool(f *SshFlags, transport Transport, idleTTL time.Duration) *ClientPool {
+	if idleTTL < 1 {
+		idleTTL = DefaultPoolIdleTTL
+	}
+	return &ClientPool{flags: f, transport: transport, idleTTL: idleTTL, idle: map[PoolKey][]*pooledClient{}}
+}
+
+// Get returns an idle connection for key, checking with a keepalive that the server still answers, or establishes a
+// new one when there is none. The connection belongs to the caller until it is handed back with Put.
+func (p *ClientPool) Get(key PoolKey) (*ssh.Client, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		idle := p.idle[key]
+		if len(idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		pc := idle[len(idle)-1]
+		p.remove(key, pc)
+		p.mu.Unlock()
+
+		pc.expiry.Stop()
+		if err := sendKeepalive(pc.client, p.healthTimeout()); err != nil {
+			log.Debugf("discarding pooled connection to %s: %v", key.Identity, err)
+			_ = pc.client.Close()
+			continue
+		}
+		log.Debugf("reusing pooled connection to %s", key.Identity)
+		return pc.client, nil
+	}
+
+	f := *p.flags
+	f.ServiceName = key.Service
+	return EstablishClientWithTransport(&f, p.transport, key.User, key.Identity)
+}
+
+// Put hands client, taken for key with Get, back to the pool for reuse. It is closed instead when the pool is
+// closed.
+func (p *ClientPool) Put(key PoolKey, client *ssh.Client) {
+	if client == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		_ = client.Close()
+		return
+	}
+	pc := &pooledClient{client: client}
+	pc.expiry = time.AfterFunc(p.idleTTL, func() { p.expire(key, pc) })
+	p.idle[key] = append(p.idle[key], pc)
+}
+
+// Close closes every idle connection and stops the pool taking connections back. Connections taken with Get are
+// left to their callers, and closed when they are Put.
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = map[PoolKey][]*pooledClient{}
+	p.closed = true
+	p.mu.Unlock()
+
+	var errs []error
+	for _, clients := range idle {
+		for _, pc := range clients {
+			pc.expiry.Stop()
+			if err := pc.client.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expire closes pc once it has been idle for the idle TTL, unless Get took it in the meantime
+func (p *ClientPool) expire(key PoolKey, pc *pooledClient) {
+	p.mu.Lock()
+	found := p.remove(key, pc)
+	p.mu.Unlock()
+	if found {
+		log.Debugf("closing connection to %s, unused for %v", key.Identity, p.idleTTL)
+		_ = pc.client.Close()
+	}
+}
+
+// remove takes pc out of the idle connections for key, reporting whether it was there. p.mu must be held.
+func (p *ClientPool) remove(key PoolKey, pc *pooledClient) bool {
+	idle := p.idle[key]
+	for i, c := range idle {
+		if c == pc {
+			idle = append(idle[:i], idle[i+1:]...)
+			if len(idle) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = idle
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ClientPool) healthTimeout() time.Duration {
+	if p.flags.Timeout > 0 {
+		return p.flags.Timeout
+	}
+	return poolHealthTimeout
+}
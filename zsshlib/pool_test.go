@@ -0,0 +1,102 @@
+package zsshlib
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClientPool(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+	})
+	transport := &fakeTransport{
+		services: map[string]*rest_model.ServiceDetail{"zssh": {}, "other": {}},
+		dial:     func(int) (net.Conn, error) { return net.Dial("tcp", addr) },
+	}
+	pool := NewClientPool(&SshFlags{Insecure: true}, transport, time.Hour)
+	key := PoolKey{Service: "zssh", Identity: "target", User: "alice"}
+
+	client, err := pool.Get(key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, transport.dials, 1)
+	assert.Equal(t, "alice", client.User())
+	pool.Put(key, client)
+
+	reused, err := pool.Get(key)
+	assert.NoError(t, err)
+	assert.Same(t, client, reused, "the idle connection should be reused")
+	assert.Len(t, transport.dials, 1)
+
+	// connections are only shared between the same service, identity and user
+	for _, other := range []PoolKey{
+		{Service: "other", Identity: "target", User: "alice"},
+		{Service: "zssh", Identity: "elsewhere", User: "alice"},
+		{Service: "zssh", Identity: "target", User: "bob"},
+	} {
+		pool.Put(key, reused)
+		client, err := pool.Get(other)
+		assert.NoError(t, err)
+		assert.NotSame(t, reused, client, "%+v", other)
+		_ = client.Close()
+		reused, err = pool.Get(key)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, transport.dials, 4)
+
+	// a connection which died while idle is replaced
+	pool.Put(key, reused)
+	_ = reused.Close()
+	client, err = pool.Get(key)
+	assert.NoError(t, err)
+	assert.NotSame(t, reused, client)
+	assert.Len(t, transport.dials, 5)
+
+	pool.Put(key, client)
+	assert.NoError(t, pool.Close())
+	assert.Error(t, client.Wait(), "idle connections are closed with the pool")
+	_, err = pool.Get(key)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+func TestClientPoolIdleTTL(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+	})
+	transport := &fakeTransport{
+		services: map[string]*rest_model.ServiceDetail{"zssh": {}},
+		dial:     func(int) (net.Conn, error) { return net.Dial("tcp", addr) },
+	}
+	pool := NewClientPool(&SshFlags{Insecure: true}, transport, 50*time.Millisecond)
+	defer func() { _ = pool.Close() }()
+	key := PoolKey{Service: "zssh", Identity: "target"}
+
+	client, err := pool.Get(key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pool.Put(key, client)
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connection should be closed once its TTL elapses")
+	}
+
+	client, err = pool.Get(key)
+	assert.NoError(t, err)
+	assert.Len(t, transport.dials, 2)
+	_ = client.Close()
+}
@@ -0,0 +1,174 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultReconnectAttempts is the number of times --reconnect tries to reconnect after the connection drops
+const DefaultReconnectAttempts = 3
+
+// ReconnectShell runs an interactive RemoteShell on client. When the connection drops, rather than the shell exiting,
+// connect is called for a new client and the shell reopened on it, trying up to attempts times and backing off between
+// them like --retries. A shell which exits is never reopened, whatever its exit status, nor is one reading commands
+// from piped stdin, which can't be replayed. The client in use when the shell exits is returned for the caller to close.
+func ReconnectShell(ctx context.Context, client *ssh.Client, f *SshFlags, attempts int, connect func() (*ssh.Client, error), opts ...SessionOption) (*ssh.Client, int, error) {
+	shell := func(client *ssh.Client) (int, error) {
+		return RemoteShell(ctx, client, f, nil, opts...)
+	}
+	if PipedStdin() != nil {
+		exitCode, err := shell(client)
+		return client, exitCode, err
+	}
+	return reconnectLoop(ctx, client, attempts, connect, shell)
+}
+
+// reconnectLoop runs shell on client, reconnecting and running it again each time the connection drops
+func reconnectLoop(ctx context.Context, client *ssh.Client, attempts int, connect func() (*ssh.Client, error), shell func(*ssh.Client) (int, error)) (*ssh.Client, int, error) {
+	for {
+		exitCode, err := shell(client)
+		if err == nil || ctx.Err() != nil || !isConnectionDrop(err) {
+			return client, exitCode, err
+		}
+		log.Warnf("connection dropped: %v", err)
+		_ = client.Close()
+
+		next, err := reconnect(ctx, attempts, connect)
+		if err != nil {
+			return client, -1, err
+		}
+		client = next
+	}
+}
+
+// reconnect calls connect until it succeeds, backing off between attempts, or has failed attempts times
+func reconnect(ctx context.Context, attempts int, connect func() (*ssh.Client, error)) (*ssh.Client, error) {
+	backoff := retryBackoff
+	for i := 1; ; i++ {
+		log.Warnf("reconnecting in %v (%d/%d)", backoff, i, attempts)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("reconnecting cancelled: %w", ctx.Err())
+		}
+		client, err := connect()
+		if err == nil {
+			log.Info("reconnected")
+			return client, nil
+		}
+		if i >= attempts {
+			return nil, fmt.Errorf("unable to reconnect after %d attempts: %w", attempts, err)
+		}
+		log.Warnf("reconnect attempt %d failed: %v", i, err)
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// isConnectionDrop reports whether err, returned by a shell, means the connection failed rather than the shell
+// exiting. A shell which exits sends its exit status, even after an error, so a session closed without one was cut
+// off, as is one which can't be opened because the connection has closed, or found lost by RemoteShell.
+func isConnectionDrop(err error) bool {
+	var missing *ssh.ExitMissingError
+	return errors.As(err, &missing) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isTimeout(err) ||
+		errors.Is(err, ErrConnectionLost)
+}
+
+// terminalStdin is the input of interactive shells, read through a stdinPump so a shell reopened by ReconnectShell
+// gets the input typed after the connection dropped
+var terminalStdin = newStdinPump(os.Stdin)
+
+// stdinPump reads src in a single long-lived goroutine, handing what is read to whichever session is reading it. A
+// session given src directly leaves the goroutine copying it blocked in Read once the session ends, which then
+// swallows the next input, meant for the session which replaced it.
+type stdinPump struct {
+	src   io.Reader
+	start sync.Once
+	data  chan []byte
+	err   error
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func newStdinPump(src io.Reader) *stdinPump {
+	return &stdinPump{src: src, data: make(chan []byte)}
+}
+
+// Reader returns a reader of the pump's input for a single session, which ends with io.EOF once done is closed, leaving
+// the input it hasn't read for the next reader
+func (p *stdinPump) Reader(done <-chan struct{}) io.Reader {
+	p.start.Do(func() {
+		go func() {
+			for {
+				buf := make([]byte, 32*1024)
+				n, err := p.src.Read(buf)
+				if n > 0 {
+					p.data <- buf[:n]
+				}
+				if err != nil {
+					p.err = err
+					close(p.data)
+					return
+				}
+			}
+		}()
+	})
+	return &pumpReader{pump: p, done: done}
+}
+
+type pumpReader struct {
+	pump *stdinPump
+	done <-chan struct{}
+}
+
+func (r *pumpReader) Read(b []byte) (int, error) {
+	p := r.pump
+	p.mu.Lock()
+	if len(p.pending) > 0 {
+		n := copy(b, p.pending)
+		p.pending = p.pending[n:]
+		p.mu.Unlock()
+		return n, nil
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return 0, io.EOF
+	case chunk, ok := <-p.data:
+		if !ok {
+			return 0, p.err
+		}
+		n := copy(b, chunk)
+		if n < len(chunk) {
+			p.mu.Lock()
+			p.pending = append(chunk[n:], p.pending...)
+			p.mu.Unlock()
+		}
+		return n, nil
+	}
+}
@@ -0,0 +1,176 @@
+package zsshlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReconnectLoop(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = time.Second }()
+
+	// the first server drops the connection once the command starts, the second exits with a status
+	handle := func(drop bool) func(*ssh.ServerConn, ssh.NewChannel) {
+		return func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			for req := range reqs {
+				_ = req.Reply(req.Type == "exec", nil)
+				if req.Type == "exec" {
+					if drop {
+						_ = conn.Close()
+					} else {
+						sendExitStatus(ch, 7)
+					}
+					return
+				}
+			}
+		}
+	}
+	dropping, exiting := newTestSshServer(t, handle(true)), newTestSshServer(t, handle(false))
+	dial := func(addr string) (*ssh.Client, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return EstablishClientWithConn(&SshFlags{Insecure: true}, conn, "test", "target")
+	}
+	shell := func(client *ssh.Client) (int, error) {
+		return RunCommand(context.Background(), client, "shell", nil, nil, nil)
+	}
+
+	first, err := dial(dropping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connects := 0
+	client, exitCode, err := reconnectLoop(context.Background(), first, 3, func() (*ssh.Client, error) {
+		connects++
+		if connects < 2 {
+			return nil, errors.New("no terminators")
+		}
+		return dial(exiting)
+	}, shell)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, exitCode, "the exit status of the reopened shell should be returned")
+	assert.Equal(t, 2, connects, "a failed reconnect should be retried")
+	assert.NotEqual(t, first, client)
+	_ = client.Close()
+
+	// a shell which exits isn't reopened
+	first, err = dial(exiting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exitCode, err = reconnectLoop(context.Background(), first, 3, func() (*ssh.Client, error) {
+		t.Error("a shell which exited shouldn't reconnect")
+		return nil, nil
+	}, shell)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, exitCode)
+	_ = first.Close()
+
+	first, err = dial(dropping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connects = 0
+	client, _, err = reconnectLoop(context.Background(), first, 2, func() (*ssh.Client, error) {
+		connects++
+		return nil, fmt.Errorf("no terminators %d", connects)
+	}, shell)
+	assert.ErrorContains(t, err, "unable to reconnect after 2 attempts: no terminators 2")
+	assert.Equal(t, first, client, "the last client should be returned for the caller to close")
+}
+
+func TestIsConnectionDrop(t *testing.T) {
+	assert.True(t, isConnectionDrop(&ssh.ExitMissingError{}))
+	assert.True(t, isConnectionDrop(fmt.Errorf("failed to create session: %w", net.ErrClosed)))
+	assert.True(t, isConnectionDrop(fmt.Errorf("%w: the server hasn't answered for 30s", ErrConnectionLost)))
+	assert.False(t, isConnectionDrop(errors.New("shell interrupted by interrupt")))
+	assert.False(t, isConnectionDrop(context.Canceled))
+}
+
+func TestReconnectKeepsInput(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = time.Second }()
+
+	// the first server drops the connection while its session reads stdin, the second echoes a line of it and exits
+	dropping := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		_, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		for req := range reqs {
+			_ = req.Reply(req.Type == "exec", nil)
+			if req.Type == "exec" {
+				// time for the session to be left reading stdin
+				time.Sleep(50 * time.Millisecond)
+				_ = conn.Close()
+				return
+			}
+		}
+	})
+	echoing := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		for req := range reqs {
+			_ = req.Reply(req.Type == "exec", nil)
+			if req.Type == "exec" {
+				line, _ := bufio.NewReader(ch).ReadString('\n')
+				_, _ = io.WriteString(ch, line)
+				sendExitStatus(ch, 0)
+				return
+			}
+		}
+	})
+	dial := func(addr string) (*ssh.Client, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return EstablishClientWithConn(&SshFlags{Insecure: true}, conn, "test", "target")
+	}
+
+	typed, terminal := io.Pipe()
+	defer func() { _ = terminal.Close() }()
+	pump := newStdinPump(typed)
+	out := &bytes.Buffer{}
+	shell := func(client *ssh.Client) (int, error) {
+		done := make(chan struct{})
+		defer close(done)
+		return RunCommand(context.Background(), client, "shell", pump.Reader(done), out, io.Discard)
+	}
+	first, err := dial(dropping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, exitCode, err := reconnectLoop(context.Background(), first, 3, func() (*ssh.Client, error) {
+		client, err := dial(echoing)
+		if err == nil {
+			// typed once reconnected, while the dropped session's stdin is no longer read
+			go func() { _, _ = io.WriteString(terminal, "typed after reconnecting\n") }()
+		}
+		return client, err
+	}, shell)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "typed after reconnecting\n", out.String(), "input typed after reconnecting should reach the new shell")
+	_ = client.Close()
+}
@@ -0,0 +1,52 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jwtPattern matches JSON web tokens, such as OIDC ID tokens: three base64url segments, the first an encoded JSON
+// object, so starting with eyJ
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+// redactToken returns enough of token to tell tokens apart in logs, its first 6 and last 4 characters, without
+// revealing it. Short tokens are hidden entirely.
+func redactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if len(token) < 24 {
+		return "[redacted]"
+	}
+	return token[:6] + "..." + token[len(token)-4:]
+}
+
+// tokenRedactor is a logrus hook redacting any JWT in the messages of the zssh logger, in case one is logged
+// without being passed through redactToken, e.g. by the OIDC library through OIDCConfig.Logf
+type tokenRedactor struct{}
+
+func (tokenRedactor) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (tokenRedactor) Fire(entry *logrus.Entry) error {
+	entry.Message = jwtPattern.ReplaceAllStringFunc(entry.Message, redactToken)
+	return nil
+}
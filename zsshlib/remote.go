@@ -0,0 +1,102 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/sftp"
+)
+
+// ListRemote writes the entries of the remote directory remotePath to out sorted by name, or just remotePath itself
+// when it is not a directory. Plain listings contain only names, long listings also show the mode, size and
+// modification time of each entry.
+func ListRemote(client *sftp.Client, remotePath string, long bool, out io.Writer) error {
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("error reading remote path [%s] (%w)", remotePath, err)
+	}
+
+	entries := []os.FileInfo{info}
+	if info.IsDir() {
+		if entries, err = client.ReadDir(remotePath); err != nil {
+			return fmt.Errorf("error listing remote directory [%s] (%w)", remotePath, err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+
+	for _, entry := range entries {
+		if long {
+			_, err = fmt.Fprintf(out, "%s %12d %s %s\n", entry.Mode(), entry.Size(), entry.ModTime().Format("Jan _2 2006 15:04"), entry.Name())
+		} else {
+			_, err = fmt.Fprintln(out, entry.Name())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveRemote removes the remote file or empty directory remotePath. A directory which isn't empty is only removed,
+// along with everything beneath it, when recursive.
+func RemoveRemote(client *sftp.Client, remotePath string, recursive bool) error {
+	info, err := client.Lstat(remotePath)
+	if err != nil {
+		return fmt.Errorf("error reading remote path [%s] (%w)", remotePath, err)
+	}
+	if !info.IsDir() {
+		if err := client.Remove(remotePath); err != nil {
+			return fmt.Errorf("error removing remote file [%s] (%w)", remotePath, err)
+		}
+		return nil
+	}
+	if !recursive {
+		if err := client.RemoveDirectory(remotePath); err != nil {
+			return fmt.Errorf("error removing remote directory [%s], use -r to remove its contents (%w)", remotePath, err)
+		}
+		return nil
+	}
+
+	// files are removed as they are walked, directories once they are empty, deepest first
+	var dirs []string
+	walker := client.Walk(remotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("error walking remote path [%s] (%w)", walker.Path(), err)
+		}
+		if walker.Stat().IsDir() {
+			dirs = append(dirs, walker.Path())
+		} else if err := client.Remove(walker.Path()); err != nil {
+			return fmt.Errorf("error removing remote file [%s] (%w)", walker.Path(), err)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := client.RemoveDirectory(dirs[i]); err != nil {
+			return fmt.Errorf("error removing remote directory [%s] (%w)", dirs[i], err)
+		}
+	}
+	return nil
+}
+
+// MakeRemoteDir creates the remote directory remotePath along with any missing parents
+func MakeRemoteDir(client *sftp.Client, remotePath string) error {
+	return makeRemoteDirs(client, remotePath)
+}
@@ -0,0 +1,84 @@
+package zsshlib
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListRemote(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("12345"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2023, time.March, 4, 5, 6, 0, 0, time.Local)
+	if err := os.Chtimes(filepath.Join(dir, "b.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, ListRemote(client, filepath.ToSlash(dir), false, out))
+	assert.Equal(t, "b.txt\nsub\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, ListRemote(client, filepath.ToSlash(filepath.Join(dir, "b.txt")), true, out))
+	fields := strings.Fields(out.String())
+	assert.Equal(t, []string{"-rw-r-----", "5", "Mar", "4", "2023", "05:06", "b.txt"}, fields)
+
+	assert.Error(t, ListRemote(client, filepath.ToSlash(filepath.Join(dir, "missing")), false, out))
+}
+
+func TestRemoveRemote(t *testing.T) {
+	dir := t.TempDir()
+	tree := filepath.Join(dir, "tree")
+	for _, d := range []string{"a/b/c", "empty"} {
+		if err := os.MkdirAll(filepath.Join(tree, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"top.txt", "a/one.txt", "a/b/c/deep.txt"} {
+		if err := os.WriteFile(filepath.Join(tree, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := newTestSftpClient(t)
+	remote := func(name string) string { return filepath.ToSlash(filepath.Join(tree, name)) }
+
+	assert.NoError(t, RemoveRemote(client, remote("top.txt"), false))
+	assert.NoFileExists(t, filepath.Join(tree, "top.txt"))
+
+	assert.NoError(t, RemoveRemote(client, remote("empty"), false))
+	assert.NoDirExists(t, filepath.Join(tree, "empty"))
+
+	assert.ErrorContains(t, RemoveRemote(client, remote("a"), false), "use -r")
+	assert.DirExists(t, filepath.Join(tree, "a"))
+
+	assert.NoError(t, RemoveRemote(client, remote(""), true))
+	assert.NoDirExists(t, tree)
+
+	assert.Error(t, RemoveRemote(client, remote("missing"), true))
+}
+
+func TestMakeRemoteDir(t *testing.T) {
+	dir := t.TempDir()
+	client := newTestSftpClient(t)
+
+	nested := filepath.Join(dir, "x", "y", "z")
+	assert.NoError(t, MakeRemoteDir(client, filepath.ToSlash(nested)))
+	assert.DirExists(t, nested)
+	assert.NoError(t, MakeRemoteDir(client, filepath.ToSlash(nested)), "existing directories are not an error")
+
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := MakeRemoteDir(client, filepath.ToSlash(filepath.Join(dir, "file", "sub")))
+	assert.ErrorContains(t, err, filepath.ToSlash(filepath.Join(dir, "file"))+"]: it exists and is not a directory")
+}
@@ -0,0 +1,49 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"strings"
+	"time"
+)
+
+var (
+	// retryBackoff is the wait before the first retry, doubling for each retry after it up to maxRetryBackoff
+	retryBackoff    = time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// withRetries calls attempt until it succeeds, fails with an error which isRetryable rejects, or has been retried
+// retries times, backing off exponentially between attempts. The last error is returned.
+func withRetries(retries int, what string, attempt func() error) error {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || i >= retries || !isRetryable(err) {
+			return err
+		}
+		log.Infof("%s failed, retrying in %v (%d/%d): %v", what, backoff, i+1, retries, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// isRetryable reports whether err is likely transient, such as a timeout or a service which has no terminators
+// while the hosting identity (re)connects. Other failures, such as authentication errors, are not retried.
+func isRetryable(err error) bool {
+	return isTimeout(err) || strings.Contains(strings.ToLower(err.Error()), "no terminators")
+}
@@ -0,0 +1,50 @@
+package zsshlib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithRetries(t *testing.T) {
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = time.Second }()
+
+	attempts := 0
+	err := withRetries(3, "dialing", func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("service abc has no terminators")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts, "should succeed once the transient failure clears")
+
+	attempts = 0
+	err = withRetries(2, "dialing", func() error {
+		attempts++
+		return os.ErrDeadlineExceeded
+	})
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, 3, attempts, "should give up after the initial attempt and 2 retries")
+
+	attempts = 0
+	err = withRetries(3, "dialing", func() error {
+		attempts++
+		return errors.New("service not found: zssh")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts, "non-transient errors should not be retried")
+
+	attempts = 0
+	_ = withRetries(0, "dialing", func() error {
+		attempts++
+		return os.ErrDeadlineExceeded
+	})
+	assert.Equal(t, 1, attempts, "0 retries should only attempt once")
+}
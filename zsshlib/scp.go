@@ -0,0 +1,439 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ProtocolSftp transfers files with the sftp subsystem, the default
+	ProtocolSftp = "sftp"
+
+	// ProtocolScp transfers files with the classic scp protocol, running scp on the remote, for servers without sftp
+	ProtocolScp = "scp"
+)
+
+// IsSftpUnavailable reports whether err, returned creating an sftp client, means the server doesn't offer the sftp
+// subsystem, in which case ProtocolScp may work
+func IsSftpUnavailable(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "subsystem request failed") || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+// ScpSend sends localPath to remotePath using the scp protocol rather than sftp, for servers which don't offer the
+// sftp subsystem. scp must be installed on the remote, where it runs as `scp -t`. A directory is only sent when
+// recursive is set. Like scp, remotePath may name an existing directory to send into. opts.PreserveTimes, Progress,
+// Limit and DryRun apply; the other options need sftp.
+func ScpSend(ctx context.Context, sshClient *ssh.Client, localPath string, remotePath string, recursive bool, opts *TransferOptions) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory, use --recursive to send it", localPath)
+	}
+	if opts.dryRun() {
+		log.Infof("[dry run] would send: %s ==> %s", localPath, remotePath)
+		return nil
+	}
+
+	cmd := "scp -t" + scpFlags(recursive, opts) + " " + shellQuote(scpRemotePath(remotePath))
+	return runScp(ctx, sshClient, cmd, func(c *scpConn) error {
+		if err := c.ack(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return c.sendDir(ctx, localPath, info, opts)
+		}
+		return c.sendFile(ctx, localPath, info, opts)
+	})
+}
+
+// ScpRetrieve retrieves remotePath to localPath using the scp protocol, see ScpSend. scp runs on the remote as
+// `scp -f`. When localPath is an existing directory, or ends with a path separator, what is retrieved keeps its
+// remote name inside it. A directory is only retrieved when recursive is set.
+func ScpRetrieve(ctx context.Context, sshClient *ssh.Client, localPath string, remotePath string, recursive bool, opts *TransferOptions) error {
+	if opts.dryRun() {
+		log.Infof("[dry run] would retrieve: %s ==> %s", remotePath, localPath)
+		return nil
+	}
+
+	cmd := "scp -f" + scpFlags(recursive, opts) + " " + shellQuote(scpRemotePath(remotePath))
+	return runScp(ctx, sshClient, cmd, func(c *scpConn) error {
+		return c.sink(ctx, localPath, recursive, opts)
+	})
+}
+
+// scpFlags returns the flags requesting recursion and preserved times from the remote scp
+func scpFlags(recursive bool, opts *TransferOptions) string {
+	flags := ""
+	if recursive {
+		flags += " -r"
+	}
+	if opts != nil && opts.PreserveTimes {
+		flags += " -p"
+	}
+	return flags
+}
+
+// scpRemotePath returns remotePath as understood by the remote scp, which resolves relative paths against the home
+// directory like sftp does
+func scpRemotePath(remotePath string) string {
+	remotePath = RemoteHomeRelative(remotePath)
+	if remotePath == "" {
+		return "."
+	}
+	return remotePath
+}
+
+// runScp runs cmd, the remote end of the scp protocol, calling run to speak the protocol over its stdin and stdout
+func runScp(ctx context.Context, sshClient *ssh.Client, cmd string, run func(c *scpConn) error) error {
+	session, err := newSession(sshClient, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Close() }()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	session.Stderr = stderr
+
+	log.Debugf("executing remote command: %v", cmd)
+	if err := session.Start(cmd); err != nil {
+		return fmt.Errorf("unable to run scp on the remote: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = session.Close() })
+	defer stop()
+
+	err = run(&scpConn{r: bufio.NewReader(stdout), w: stdin})
+	_ = stdin.Close()
+	waitErr := session.Wait()
+	if ctx.Err() != nil {
+		return fmt.Errorf("scp cancelled (%w)", ctx.Err())
+	}
+	if err == nil && waitErr != nil {
+		err = fmt.Errorf("remote command [%s] failed: %w", cmd, waitErr)
+	}
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// scpConn speaks the scp protocol. Each side sends control lines, such as C0644 12 name for a file of 12 bytes
+// followed by its contents, which the other side acknowledges with a 0 byte, or a 1 (warning) or 2 (fatal error)
+// byte followed by a message line.
+type scpConn struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// ack reads the acknowledgement of what was last sent
+func (c *scpConn) ack() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("no response from the remote scp: %w", err)
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		message, _ := c.r.ReadString('\n')
+		return fmt.Errorf("remote scp: %s", strings.TrimSpace(message))
+	default:
+		return fmt.Errorf("unexpected response from the remote scp: %q", b)
+	}
+}
+
+// send writes a control line and waits for it to be acknowledged
+func (c *scpConn) send(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(c.w, format+"\n", args...); err != nil {
+		return err
+	}
+	return c.ack()
+}
+
+// sendTimes sends the times of info for the file or directory sent next
+func (c *scpConn) sendTimes(info os.FileInfo, opts *TransferOptions) error {
+	if opts == nil || !opts.PreserveTimes {
+		return nil
+	}
+	mtime := info.ModTime().Unix()
+	return c.send("T%d 0 %d 0", mtime, mtime)
+}
+
+func (c *scpConn) sendFile(ctx context.Context, localPath string, info os.FileInfo, opts *TransferOptions) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("unable to open local file %v: %w", localPath, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := c.sendTimes(info, opts); err != nil {
+		return err
+	}
+	name := filepath.Base(localPath)
+	if err := c.send("C%04o %d %s", info.Mode().Perm(), info.Size(), name); err != nil {
+		return err
+	}
+	src := &contextReader{ctx: ctx, r: opts.wrapSource(ctx, f, name, info.Size(), 0, nil)}
+	if _, err := io.CopyN(c.w, src, info.Size()); err != nil {
+		return fmt.Errorf("unable to send %v: %w", localPath, err)
+	}
+	if _, err := c.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	log.Infof("sent file: %s", localPath)
+	return nil
+}
+
+func (c *scpConn) sendDir(ctx context.Context, localPath string, info os.FileInfo, opts *TransferOptions) error {
+	if err := c.sendTimes(info, opts); err != nil {
+		return err
+	}
+	if err := c.send("D%04o 0 %s", info.Mode().Perm(), filepath.Base(localPath)); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryPath := filepath.Join(localPath, entry.Name())
+		entryInfo, err := os.Lstat(entryPath)
+		if err != nil {
+			return err
+		}
+		if entryInfo.Mode()&os.ModeSymlink != 0 {
+			if !opts.followSymlinks() {
+				log.Warnf("skipping symlink %s, scp can't recreate links. use --follow-symlinks to copy what it points to", entryPath)
+				continue
+			}
+			if entryInfo, err = os.Stat(entryPath); err != nil {
+				return err
+			}
+		}
+		switch {
+		case entryInfo.IsDir():
+			err = c.sendDir(ctx, entryPath, entryInfo, opts)
+		case entryInfo.Mode().IsRegular():
+			err = c.sendFile(ctx, entryPath, entryInfo, opts)
+		default:
+			log.Warnf("skipping %s, it isn't a regular file or directory", entryPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.send("E")
+}
+
+// sink receives what the remote scp sends, writing it to localPath
+func (c *scpConn) sink(ctx context.Context, localPath string, recursive bool, opts *TransferOptions) error {
+	// dirs are the local directories being received into, innermost last, with the times to set on each once complete
+	type dir struct {
+		path  string
+		times *[2]time.Time
+	}
+	var dirs []dir
+	var times *[2]time.Time
+	var warnings []string
+
+	if _, err := c.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := c.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil {
+			return fmt.Errorf("error reading from the remote scp: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("unexpected empty line from the remote scp")
+		}
+
+		switch line[0] {
+		case 1, 2:
+			// 1 is a warning, e.g. a file which couldn't be read, after which scp continues
+			warnings = append(warnings, strings.TrimSpace(line[1:]))
+			log.Warnf("remote scp: %s", strings.TrimSpace(line[1:]))
+			if line[0] == 2 {
+				return fmt.Errorf("remote scp: %s", strings.TrimSpace(line[1:]))
+			}
+			continue
+		case 'T':
+			var mtime, mtimeUsec, atime, atimeUsec int64
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &mtime, &mtimeUsec, &atime, &atimeUsec); err != nil {
+				return fmt.Errorf("invalid times from the remote scp [%s]", line)
+			}
+			times = &[2]time.Time{time.Unix(atime, atimeUsec*1000), time.Unix(mtime, mtimeUsec*1000)}
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("unexpected end of directory from the remote scp")
+			}
+			last := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if last.times != nil {
+				if err := os.Chtimes(last.path, last.times[0], last.times[1]); err != nil {
+					log.Warnf("unable to set times of %s: %v", last.path, err)
+				}
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseScpEntry(line)
+			if err != nil {
+				return err
+			}
+			target := localPath
+			if len(dirs) > 0 {
+				target = filepath.Join(dirs[len(dirs)-1].path, name)
+			} else if line[0] == 'D' {
+				// like scp -r, an existing directory is received into, otherwise it is created with the local name
+				if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+					target = filepath.Join(localPath, name)
+				}
+			} else if target, err = AppendLocalBaseName(localPath, name); err != nil {
+				return err
+			}
+
+			if line[0] == 'D' {
+				if !recursive {
+					return fmt.Errorf("the remote scp sent directory %s, use --recursive to retrieve directories", name)
+				}
+				if err := os.MkdirAll(target, mode|0700); err != nil {
+					return err
+				}
+				dirs = append(dirs, dir{path: target, times: times})
+				times = nil
+				break
+			}
+			if _, err := c.w.Write([]byte{0}); err != nil {
+				return err
+			}
+			if err := c.receiveFile(ctx, target, mode, size, opts); err != nil {
+				return err
+			}
+			if times != nil {
+				if err := os.Chtimes(target, times[0], times[1]); err != nil {
+					log.Warnf("unable to set times of %s: %v", target, err)
+				}
+				times = nil
+			}
+			if err := c.ack(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected line from the remote scp [%q]", line)
+		}
+		if _, err := c.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if len(warnings) > 0 {
+		return fmt.Errorf("remote scp: %s", strings.Join(warnings, "; "))
+	}
+	return nil
+}
+
+// receiveFile writes the size bytes of a file sent by the remote scp to localPath. As with RetrieveRemoteFiles, the
+// file is received with partSuffix appended and only renamed into place once complete, so a failed transfer leaves
+// an existing localPath as it was, and a localPath which isn't a regular file, such as /dev/null, is written in place.
+func (c *scpConn) receiveFile(ctx context.Context, localPath string, mode os.FileMode, size int64, opts *TransferOptions) error {
+	dest, replaceable := localDestination(localPath)
+	partPath := dest + partSuffix
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !replaceable {
+		partPath, flags = dest, os.O_WRONLY
+	}
+	lf, err := os.OpenFile(partPath, flags, mode)
+	if err != nil {
+		return fmt.Errorf("error opening local file [%s] (%w)", partPath, err)
+	}
+	defer func() { _ = lf.Close() }()
+	src := &contextReader{ctx: ctx, r: opts.wrapSource(ctx, io.LimitReader(c.r, size), filepath.Base(localPath), size, 0, nil)}
+	if n, err := io.Copy(lf, src); err != nil || n != size {
+		_ = lf.Close()
+		if replaceable {
+			opts.removePartial(partPath, os.Remove)
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("error copying remote file to local [%s] (%w)", localPath, err)
+	}
+	if err := lf.Close(); err != nil {
+		if replaceable {
+			opts.removePartial(partPath, os.Remove)
+		}
+		return fmt.Errorf("error closing local file [%s] (%w)", partPath, err)
+	}
+	if replaceable {
+		if err := os.Rename(partPath, dest); err != nil {
+			return fmt.Errorf("error renaming local file [%s] to [%s] (%w)", partPath, dest, err)
+		}
+	}
+	log.Infof("retrieved file: %s", localPath)
+	return nil
+}
+
+// parseScpEntry parses a C (file) or D (directory) line, e.g. C0644 12 name. The name is checked to be a single
+// path element, so a malicious server can't write outside of the destination.
+func parseScpEntry(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid line from the remote scp [%s]", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid mode from the remote scp [%s]", line)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid size from the remote scp [%s]", line)
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return 0, 0, "", fmt.Errorf("refusing unsafe name from the remote scp [%s]", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
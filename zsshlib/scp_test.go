@@ -0,0 +1,176 @@
+package zsshlib
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("scp transfers require sh and scp")
+	}
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp transfers require scp")
+	}
+	sshClient := newTestShellClient(t)
+	ctx := context.Background()
+	src, dst := t.TempDir(), t.TempDir()
+
+	local := filepath.Join(src, "it's local.txt")
+	if err := os.WriteFile(local, []byte("sent over scp"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(local, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	opts := &TransferOptions{PreserveTimes: true}
+
+	// file to file, then file into a directory
+	remote := filepath.Join(dst, "remote.txt")
+	assert.NoError(t, ScpSend(ctx, sshClient, local, remote, false, opts))
+	assertFile(t, remote, "sent over scp", 0640, mtime)
+	assert.NoError(t, ScpSend(ctx, sshClient, local, dst, false, opts))
+	assertFile(t, filepath.Join(dst, "it's local.txt"), "sent over scp", 0640, mtime)
+
+	retrieved := t.TempDir()
+	assert.NoError(t, ScpRetrieve(ctx, sshClient, filepath.Join(retrieved, "copy.txt"), remote, false, opts))
+	assertFile(t, filepath.Join(retrieved, "copy.txt"), "sent over scp", 0640, mtime)
+	assert.NoError(t, ScpRetrieve(ctx, sshClient, retrieved, remote, false, opts))
+	assertFile(t, filepath.Join(retrieved, "remote.txt"), "sent over scp", 0640, mtime)
+
+	// directories need --recursive
+	nested := filepath.Join(src, "project", "src")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(nested, "main.go"), []byte("package main"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, ScpSend(ctx, sshClient, filepath.Join(src, "project"), dst, false, opts), "use --recursive")
+	assert.NoError(t, ScpSend(ctx, sshClient, filepath.Join(src, "project"), dst, true, opts))
+	assertFile(t, filepath.Join(dst, "project", "src", "main.go"), "package main", 0600, time.Time{})
+
+	assert.ErrorContains(t, ScpRetrieve(ctx, sshClient, retrieved, filepath.Join(dst, "project"), false, opts), "not a regular file")
+	assert.NoError(t, ScpRetrieve(ctx, sshClient, filepath.Join(retrieved, "copied"), filepath.Join(dst, "project"), true, opts))
+	assertFile(t, filepath.Join(retrieved, "copied", "src", "main.go"), "package main", 0600, time.Time{})
+
+	err := ScpRetrieve(ctx, sshClient, retrieved, filepath.Join(dst, "missing.txt"), false, opts)
+	assert.ErrorContains(t, err, "missing.txt", "the remote scp's error should be reported")
+}
+
+// assertFile checks the content and permissions of path, and its modification time unless mtime is zero
+func assertFile(t *testing.T, path string, content string, perm os.FileMode, mtime time.Time) {
+	t.Helper()
+	actual, err := os.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, content, string(actual))
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, perm, info.Mode().Perm(), path)
+		if !mtime.IsZero() {
+			assert.True(t, mtime.Equal(info.ModTime()), "%s should have been modified at %v, not %v", path, mtime, info.ModTime())
+		}
+	}
+}
+
+// assertContent checks the content of path
+func assertContent(t *testing.T, path string, content string) {
+	t.Helper()
+	actual, err := os.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, content, string(actual), path)
+	}
+}
+
+func TestScpReceiveShortStream(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "existing.txt")
+	if err := os.WriteFile(dst, []byte("the original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &scpConn{r: bufio.NewReader(strings.NewReader("only part")), w: io.Discard}
+	err := c.receiveFile(context.Background(), dst, 0644, 100, &TransferOptions{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assertContent(t, dst, "the original")
+	assert.NoFileExists(t, dst+partSuffix, "the partial file should be removed")
+
+	c = &scpConn{r: bufio.NewReader(strings.NewReader("only part")), w: io.Discard}
+	assert.Error(t, c.receiveFile(context.Background(), dst, 0644, 100, &TransferOptions{KeepPartial: true}))
+	assertContent(t, dst, "the original")
+	assertContent(t, dst+partSuffix, "only part")
+
+	c = &scpConn{r: bufio.NewReader(strings.NewReader("replaced")), w: io.Discard}
+	assert.NoError(t, c.receiveFile(context.Background(), dst, 0644, 8, &TransferOptions{}))
+	assertContent(t, dst, "replaced")
+	assert.NoFileExists(t, dst+partSuffix)
+}
+
+func TestParseScpEntry(t *testing.T) {
+	mode, size, name, err := parseScpEntry("C0644 12 name with spaces.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), mode)
+	assert.Equal(t, int64(12), size)
+	assert.Equal(t, "name with spaces.txt", name)
+
+	for _, line := range []string{"C0644 12 ../escape", "D0755 0 ..", "C0644 1 a/b", "C0644 1 .", "C0644 1 a\\b"} {
+		_, _, _, err = parseScpEntry(line)
+		assert.ErrorContains(t, err, "refusing unsafe name", line)
+	}
+	_, _, _, err = parseScpEntry("C0644 -1 a")
+	assert.ErrorContains(t, err, "invalid size")
+	_, _, _, err = parseScpEntry("C0999 1 a")
+	assert.ErrorContains(t, err, "invalid mode")
+	_, _, _, err = parseScpEntry("C0644 1")
+	assert.ErrorContains(t, err, "invalid line")
+}
+
+func TestIsSftpUnavailable(t *testing.T) {
+	assert.True(t, IsSftpUnavailable(errors.New("ssh: subsystem request failed")))
+	assert.False(t, IsSftpUnavailable(errors.New("permission denied")))
+	assert.False(t, IsSftpUnavailable(nil))
+}
+
+func TestProtocolFlag(t *testing.T) {
+	f := &ScpFlags{Protocol: ProtocolScp, Preserve: true}
+	opts, err := f.TransferOptions()
+	assert.NoError(t, err)
+	assert.True(t, opts.PreserveTimes)
+
+	f = &ScpFlags{Protocol: ProtocolScp, Verify: true}
+	_, err = f.TransferOptions()
+	assert.ErrorContains(t, err, "--protocol scp cannot be combined with")
+
+	f = &ScpFlags{Protocol: ProtocolScp, SftpSubsystem: DefaultSftpSubsystem}
+	_, err = f.TransferOptions()
+	assert.NoError(t, err, "the default subsystem isn't a choice")
+	f = &ScpFlags{Protocol: ProtocolScp, SftpSubsystem: "internal-sftp"}
+	_, err = f.TransferOptions()
+	assert.ErrorContains(t, err, "--protocol scp cannot be combined with")
+
+	f = &ScpFlags{Protocol: "rcp"}
+	_, err = f.TransferOptions()
+	assert.ErrorContains(t, err, "unknown protocol [rcp]")
+}
+
+func TestExecFlag(t *testing.T) {
+	f := &ScpFlags{Exec: "tar xzf app.tgz"}
+	_, err := f.TransferOptions()
+	assert.NoError(t, err)
+
+	f = &ScpFlags{Exec: "tar xzf app.tgz", Batch: "transfers.txt"}
+	_, err = f.TransferOptions()
+	assert.ErrorContains(t, err, "--exec cannot be combined with --batch or --interactive")
+}
@@ -0,0 +1,199 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/sdk-golang/ziti"
+)
+
+// the app data keys ziti tunnelers use to pass the intercepted destination to the hosting side, which a host.v1
+// config with forwardProtocol, forwardAddress or forwardPort set forwards to
+const (
+	appDataProtocol = "dst_protocol"
+	appDataHostname = "dst_hostname"
+	appDataIp       = "dst_ip"
+	appDataPort     = "dst_port"
+)
+
+// ServiceConfig is where the ssh server behind a service is intended to be reached, as described by the service's
+// intercept.v1 config, or legacy ziti-tunneler-client.v1 config. The first protocol, address and port are used.
+type ServiceConfig struct {
+	Protocol string
+	Hostname string
+	Port     int
+}
+
+// LookupServiceConfig returns the ServiceConfig of service, or nil when it has no intercept config
+func LookupServiceConfig(service *rest_model.ServiceDetail) (*ServiceConfig, error) {
+	if service == nil || service.Config == nil {
+		return nil, nil
+	}
+
+	if raw, found := service.Config[ziti.InterceptV1]; found {
+		intercept := struct {
+			Protocols  []string `json:"protocols"`
+			Addresses  []string `json:"addresses"`
+			PortRanges []struct {
+				Low int `json:"low"`
+			} `json:"portRanges"`
+		}{}
+		if err := decodeServiceConfig(raw, &intercept); err != nil {
+			return nil, fmt.Errorf("invalid %s config: %w", ziti.InterceptV1, err)
+		}
+		cfg := &ServiceConfig{Protocol: "tcp"}
+		if len(intercept.Protocols) > 0 && !slices.Contains(intercept.Protocols, "tcp") {
+			cfg.Protocol = intercept.Protocols[0]
+		}
+		for _, addr := range intercept.Addresses {
+			// wildcards and CIDRs don't name a single host
+			if !strings.Contains(addr, "*") && !strings.Contains(addr, "/") {
+				cfg.Hostname = addr
+				break
+			}
+		}
+		if len(intercept.PortRanges) > 0 {
+			cfg.Port = intercept.PortRanges[0].Low
+		}
+		return cfg, nil
+	}
+
+	if raw, found := service.Config[ziti.ClientConfigV1]; found {
+		client := struct {
+			Hostname string `json:"hostname"`
+			Port     int    `json:"port"`
+		}{}
+		if err := decodeServiceConfig(raw, &client); err != nil {
+			return nil, fmt.Errorf("invalid %s config: %w", ziti.ClientConfigV1, err)
+		}
+		return &ServiceConfig{Protocol: "tcp", Hostname: client.Hostname, Port: client.Port}, nil
+	}
+	return nil, nil
+}
+
+// AppData returns the dial app data telling the hosting side where to forward the connection, keyed as ziti
+// tunnelers do, so a single identity can host ssh servers on any port
+func (c *ServiceConfig) AppData() map[string]string {
+	appData := map[string]string{}
+	if c == nil {
+		return appData
+	}
+	if c.Protocol != "" {
+		appData[appDataProtocol] = c.Protocol
+	}
+	if c.Hostname != "" {
+		if net.ParseIP(c.Hostname) != nil {
+			appData[appDataIp] = c.Hostname
+		} else {
+			appData[appDataHostname] = c.Hostname
+		}
+	}
+	if c.Port > 0 {
+		appData[appDataPort] = strconv.Itoa(c.Port)
+	}
+	return appData
+}
+
+// dialAppData merges the app data derived from the service config with the pairs given by --app-data, which take
+// precedence, JSON encoding the result. No app data results in nil.
+func dialAppData(svcCfg *ServiceConfig, pairs []string) ([]byte, error) {
+	appData := svcCfg.AppData()
+	explicit, err := parseAppDataPairs(pairs)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range explicit {
+		appData[key] = value
+	}
+	if len(appData) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(appData)
+}
+
+// defaultGatewayPort is the port of a --gateway target given without one
+const defaultGatewayPort = 22
+
+// ParseGatewayTarget parses a --gateway target, host[:port], naming the ssh server behind a gateway service rather
+// than a ziti identity. The port defaults to 22. IPv6 addresses with a port are bracketed, as in [::1]:2222.
+func ParseGatewayTarget(target string) (*ServiceConfig, error) {
+	host, port := target, strconv.Itoa(defaultGatewayPort)
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		host, port = h, p
+	} else if strings.Count(target, ":") == 1 {
+		return nil, fmt.Errorf("invalid gateway target [%s]: %w", target, err)
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return nil, fmt.Errorf("invalid gateway target [%s]: expected host[:port]", target)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 1 || portNum > 65535 {
+		return nil, fmt.Errorf("invalid gateway target [%s]: port must be a number from 1 to 65535", target)
+	}
+	return &ServiceConfig{Protocol: "tcp", Hostname: host, Port: portNum}, nil
+}
+
+// looksLikeHostPort reports whether target, taken as a ziti identity, looks like the host:port of a --gateway target
+func looksLikeHostPort(target string) bool {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.Atoi(port)
+	return err == nil
+}
+
+// dialOptions returns the options dialing the service to reach target. target is the ziti identity hosting the
+// service, or with --gateway the host[:port] the hosting side forwards to, sent as app data in place of that of the
+// service config svcCfg, the service being dialed without an identity.
+func (f *SshFlags) dialOptions(svcCfg *ServiceConfig, target string) (*ziti.DialOptions, error) {
+	identity := target
+	if f.Gateway {
+		backend, err := ParseGatewayTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("dialing %s:%d through gateway service %s", backend.Hostname, backend.Port, f.ServiceName)
+		svcCfg, identity = backend, ""
+	}
+	appData, err := dialAppData(svcCfg, f.AppData)
+	if err != nil {
+		return nil, err
+	}
+	return &ziti.DialOptions{
+		ConnectTimeout: f.Timeout,
+		Identity:       identity,
+		AppData:        appData,
+	}, nil
+}
+
+// decodeServiceConfig decodes a service config, as returned by the controller, into target
+func decodeServiceConfig(raw map[string]interface{}, target interface{}) error {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, target)
+}
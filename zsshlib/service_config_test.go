@@ -0,0 +1,156 @@
+package zsshlib
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupServiceConfig(t *testing.T) {
+	cfg, err := LookupServiceConfig(&rest_model.ServiceDetail{})
+	assert.NoError(t, err)
+	assert.Nil(t, cfg, "a service without configs has no ServiceConfig")
+
+	cfg, err = LookupServiceConfig(&rest_model.ServiceDetail{Config: map[string]map[string]interface{}{
+		ziti.InterceptV1: {
+			"protocols":  []interface{}{"udp", "tcp"},
+			"addresses":  []interface{}{"*.ssh.ziti", "ssh.internal"},
+			"portRanges": []interface{}{map[string]interface{}{"low": 2222, "high": 2222}},
+		},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, &ServiceConfig{Protocol: "tcp", Hostname: "ssh.internal", Port: 2222}, cfg)
+
+	cfg, err = LookupServiceConfig(&rest_model.ServiceDetail{Config: map[string]map[string]interface{}{
+		ziti.ClientConfigV1: {"hostname": "10.0.0.5", "port": 22},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, &ServiceConfig{Protocol: "tcp", Hostname: "10.0.0.5", Port: 22}, cfg)
+	assert.Equal(t, map[string]string{"dst_protocol": "tcp", "dst_ip": "10.0.0.5", "dst_port": "22"}, cfg.AppData())
+
+	_, err = LookupServiceConfig(&rest_model.ServiceDetail{Config: map[string]map[string]interface{}{
+		ziti.InterceptV1: {"portRanges": "not a list"},
+	}})
+	assert.Error(t, err)
+}
+
+func TestDialAppData(t *testing.T) {
+	appData, err := dialAppData(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, appData)
+
+	svcCfg := &ServiceConfig{Protocol: "tcp", Hostname: "ssh.internal", Port: 2222}
+	appData, err = dialAppData(svcCfg, []string{"dst_port=22", "tag=blue"})
+	assert.NoError(t, err)
+	decoded := map[string]string{}
+	assert.NoError(t, json.Unmarshal(appData, &decoded))
+	assert.Equal(t, map[string]string{
+		"dst_protocol": "tcp",
+		"dst_hostname": "ssh.internal",
+		"dst_port":     "22",
+		"tag":          "blue",
+	}, decoded, "explicit app data should take precedence over the service config")
+
+	_, err = dialAppData(svcCfg, []string{"invalid"})
+	assert.Error(t, err)
+}
+
+func TestParseGatewayTarget(t *testing.T) {
+	for target, expected := range map[string]*ServiceConfig{
+		"backend-host:2222": {Protocol: "tcp", Hostname: "backend-host", Port: 2222},
+		"backend-host":      {Protocol: "tcp", Hostname: "backend-host", Port: 22},
+		"10.0.0.5:22":       {Protocol: "tcp", Hostname: "10.0.0.5", Port: 22},
+		"[fd00::5]:2222":    {Protocol: "tcp", Hostname: "fd00::5", Port: 2222},
+		"fd00::5":           {Protocol: "tcp", Hostname: "fd00::5", Port: 22},
+	} {
+		cfg, err := ParseGatewayTarget(target)
+		assert.NoError(t, err, target)
+		assert.Equal(t, expected, cfg, target)
+	}
+	for _, target := range []string{"", ":22", "host:ssh", "host:0", "host:70000", "host:"} {
+		_, err := ParseGatewayTarget(target)
+		assert.ErrorContains(t, err, "invalid gateway target", target)
+	}
+
+	assert.True(t, looksLikeHostPort("backend-host:2222"))
+	assert.False(t, looksLikeHostPort("backend-host"))
+	assert.False(t, looksLikeHostPort("identity:name"))
+}
+
+func TestDialOptionsGateway(t *testing.T) {
+	svcCfg := &ServiceConfig{Protocol: "tcp", Hostname: "ssh.internal", Port: 22}
+	opts, err := (&SshFlags{}).dialOptions(svcCfg, "server-identity")
+	assert.NoError(t, err)
+	assert.Equal(t, "server-identity", opts.Identity)
+
+	f := &SshFlags{Gateway: true, AppData: []string{"tag=blue"}}
+	opts, err = f.dialOptions(svcCfg, "backend-host:2222")
+	assert.NoError(t, err)
+	assert.Empty(t, opts.Identity, "a gateway is dialed without an identity")
+	decoded := map[string]string{}
+	assert.NoError(t, json.Unmarshal(opts.AppData, &decoded))
+	assert.Equal(t, map[string]string{
+		"dst_protocol": "tcp",
+		"dst_hostname": "backend-host",
+		"dst_port":     "2222",
+		"tag":          "blue",
+	}, decoded, "the gateway target should replace the service config")
+
+	_, err = f.dialOptions(svcCfg, "backend-host:ssh")
+	assert.ErrorContains(t, err, "invalid gateway target")
+
+	// a host:port dialed as an identity suggests --gateway
+	transport := &fakeTransport{
+		services: map[string]*rest_model.ServiceDetail{"sshgw": {}},
+		dial:     func(int) (net.Conn, error) { return nil, errors.New("service sshgw has no terminators") },
+	}
+	_, err = EstablishClientWithTransport(&SshFlags{ServiceName: "sshgw"}, transport, "user", "backend-host:2222")
+	assert.ErrorContains(t, err, "use --gateway")
+	f = &SshFlags{ServiceName: "sshgw", Gateway: true}
+	_, err = EstablishClientWithTransport(f, transport, "user", "backend-host:2222")
+	assert.NotContains(t, err.Error(), "use --gateway")
+	assert.Empty(t, transport.dials[1].Identity)
+}
+
+func TestGatewayTargetArgs(t *testing.T) {
+	transport := &fakeTransport{
+		services: map[string]*rest_model.ServiceDetail{"sshgw": {}},
+		dial:     func(int) (net.Conn, error) { return nil, errors.New("unreachable") },
+	}
+	// as zssh parses its arguments
+	for _, test := range []struct {
+		args     []string
+		identity string
+		appData  map[string]string
+	}{
+		{[]string{"--service", "sshgw", "--gateway", "user@backend-host:2222"}, "", map[string]string{"dst_protocol": "tcp", "dst_hostname": "backend-host", "dst_port": "2222"}},
+		{[]string{"--service", "sshgw", "--gateway", "user@[fd00::1]:2222"}, "", map[string]string{"dst_protocol": "tcp", "dst_ip": "fd00::1", "dst_port": "2222"}},
+		{[]string{"--service", "sshgw", "--gateway", "backend-host"}, "", map[string]string{"dst_protocol": "tcp", "dst_hostname": "backend-host", "dst_port": "22"}},
+		{[]string{"--service", "sshgw", "user@server-identity:2222"}, "server-identity", nil},
+	} {
+		flags := &SshFlags{}
+		cmd := &cobra.Command{}
+		flags.AddCommonFlags(cmd)
+		assert.NoError(t, cmd.ParseFlags(test.args))
+		arg := cmd.Flags().Arg(0)
+		transport.dials = nil
+		_, err := EstablishClientWithTransport(flags, transport, ParseUserName(arg, false), flags.ParseTarget(arg))
+		assert.Error(t, err)
+		if !assert.NotEmpty(t, transport.dials, "%v", test.args) {
+			continue
+		}
+		dial := transport.dials[0]
+		assert.Equal(t, test.identity, dial.Identity, "%v", test.args)
+		var appData map[string]string
+		if dial.AppData != nil {
+			assert.NoError(t, json.Unmarshal(dial.AppData, &appData))
+		}
+		assert.Equal(t, test.appData, appData, "%v", test.args)
+	}
+}
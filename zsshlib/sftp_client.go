@@ -0,0 +1,80 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultSftpSubsystem is the subsystem sftp is requested on unless --sftp-subsystem names another
+const DefaultSftpSubsystem = "sftp"
+
+// NewSftpClient starts an sftp session over client on subsystem, see --sftp-subsystem. A subsystem starting with / is
+// the path of an sftp server to run as a command instead, as with sftp -s, for servers which only allow running it
+// directly. When the server refuses a named subsystem, the default sftp subsystem is tried before giving up.
+func NewSftpClient(client *ssh.Client, subsystem string) (*sftp.Client, error) {
+	if subsystem == "" || subsystem == DefaultSftpSubsystem {
+		return sftp.NewClient(client)
+	}
+	sftpClient, err := newSftpClientOn(client, subsystem)
+	if err == nil || strings.HasPrefix(subsystem, "/") || !IsSftpUnavailable(err) {
+		return sftpClient, err
+	}
+	log.Warnf("%v, trying the %s subsystem", err, DefaultSftpSubsystem)
+	return sftp.NewClient(client)
+}
+
+// newSftpClientOn starts an sftp session on the named subsystem, or running the sftp server at a path
+func newSftpClientOn(client *ssh.Client, subsystem string) (*sftp.Client, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	if strings.HasPrefix(subsystem, "/") {
+		log.Debugf("running sftp server %s", subsystem)
+		if err := session.Start(subsystem); err != nil {
+			_ = session.Close()
+			return nil, fmt.Errorf("unable to run sftp server %s: %w", subsystem, err)
+		}
+	} else {
+		log.Debugf("requesting sftp subsystem %s", subsystem)
+		if err := session.RequestSubsystem(subsystem); err != nil {
+			_ = session.Close()
+			return nil, fmt.Errorf("sftp subsystem %s: %w", subsystem, err)
+		}
+	}
+	sftpClient, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	return sftpClient, nil
+}
@@ -0,0 +1,80 @@
+package zsshlib
+
+import (
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSubsystemSftpClient returns a client connected to a server serving sftp only on the subsystems in subsystems,
+// or when running the command serverPath, recording the subsystems requested
+func newSubsystemSftpClient(t *testing.T, subsystems []string, serverPath string) (*ssh.Client, *[]string) {
+	requested := &[]string{}
+	client := newTestSshClient(t, func(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			name := struct{ Name string }{}
+			if (req.Type != "subsystem" && req.Type != "exec") || ssh.Unmarshal(req.Payload, &name) != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			allowed := req.Type == "exec" && name.Name == serverPath
+			if req.Type == "subsystem" {
+				*requested = append(*requested, name.Name)
+				for _, subsystem := range subsystems {
+					allowed = allowed || subsystem == name.Name
+				}
+			}
+			_ = req.Reply(allowed, nil)
+			if !allowed {
+				continue
+			}
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = server.Serve()
+				sendExitStatus(ch, 0)
+			}()
+		}
+	})
+	return client, requested
+}
+
+func TestNewSftpClient(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		subsystems []string
+		serverPath string
+		subsystem  string
+		requested  []string
+		err        string
+	}{
+		{name: "default", subsystems: []string{"sftp"}, subsystem: "", requested: []string{"sftp"}},
+		{name: "custom subsystem", subsystems: []string{"internal-sftp"}, subsystem: "internal-sftp", requested: []string{"internal-sftp"}},
+		{name: "falls back to sftp", subsystems: []string{"sftp"}, subsystem: "internal-sftp", requested: []string{"internal-sftp", "sftp"}},
+		{name: "server path", serverPath: "/usr/lib/openssh/sftp-server", subsystem: "/usr/lib/openssh/sftp-server"},
+		{name: "refused", subsystems: []string{"other"}, subsystem: "internal-sftp", requested: []string{"internal-sftp", "sftp"}, err: "subsystem request failed"},
+		{name: "default refused", subsystems: []string{"internal-sftp"}, subsystem: "sftp", requested: []string{"sftp"}, err: "subsystem request failed"},
+		{name: "server path refused", subsystem: "/usr/lib/openssh/sftp-server", err: "unable to run sftp server"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, requested := newSubsystemSftpClient(t, test.subsystems, test.serverPath)
+			sftpClient, err := NewSftpClient(client, test.subsystem)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+			} else if assert.NoError(t, err) {
+				_, err := sftpClient.Getwd()
+				assert.NoError(t, err)
+				_ = sftpClient.Close()
+			}
+			if test.requested == nil {
+				assert.Empty(t, *requested)
+			} else {
+				assert.Equal(t, test.requested, *requested)
+			}
+		})
+	}
+}
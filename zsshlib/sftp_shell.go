@@ -0,0 +1,314 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const sftpPrompt = "sftp> "
+
+// errExitShell is returned by SftpShell.Execute when the user asks to leave the shell
+var errExitShell = errors.New("exit")
+
+// SftpShell is an interactive sftp session, keeping track of the remote and local working directories between commands
+type SftpShell struct {
+	client     *sftp.Client
+	opts       *TransferOptions
+	out        io.Writer
+	remoteDir  string
+	localDir   string
+	remoteHome string
+}
+
+// NewSftpShell creates a shell over client starting in the remote directory remoteDir and the current local
+// directory, transferring files with opts and writing output to out
+func NewSftpShell(client *sftp.Client, remoteDir string, opts *TransferOptions, out io.Writer) (*SftpShell, error) {
+	home, err := client.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the remote working directory (%w)", err)
+	}
+	localDir, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the local working directory (%w)", err)
+	}
+	if remoteDir == "" {
+		remoteDir = home
+	}
+	return &SftpShell{client: client, opts: opts, out: out, remoteDir: remoteDir, localDir: localDir, remoteHome: home}, nil
+}
+
+// Run reads and executes commands until stdin is exhausted or the user exits. When stdin is a terminal, lines are
+// read with line editing and history, otherwise commands are read a line at a time, allowing scripted sessions.
+func (s *SftpShell) Run(ctx context.Context, stdin *os.File, stdout *os.File) error {
+	fd := int(stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return s.run(ctx, bufio.NewScanner(stdin))
+	}
+
+	oldState, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = terminal.Restore(fd, oldState) }()
+
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{stdin, stdout}, sftpPrompt)
+	out := s.out
+	s.out = term
+	defer func() { s.out = out }()
+	for {
+		line, err := term.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := s.Execute(ctx, line); err == errExitShell {
+			return nil
+		} else if err != nil {
+			_, _ = fmt.Fprintln(term, err)
+		}
+	}
+}
+
+// run executes each line read from lines, echoing them after the prompt as a terminal would
+func (s *SftpShell) run(ctx context.Context, lines *bufio.Scanner) error {
+	for lines.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		_, _ = fmt.Fprintln(s.out, sftpPrompt+lines.Text())
+		if err := s.Execute(ctx, lines.Text()); err == errExitShell {
+			return nil
+		} else if err != nil {
+			_, _ = fmt.Fprintln(s.out, err)
+		}
+	}
+	return lines.Err()
+}
+
+// Execute runs a single shell command line, cancelling any transfer it starts when ctx is done
+func (s *SftpShell) Execute(ctx context.Context, line string) error {
+	args, err := splitShellWords(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, args := args[0], args[1:]
+	recursive, long := false, false
+	if len(args) > 0 && (args[0] == "-r" || args[0] == "-l") {
+		recursive, long = args[0] == "-r", args[0] == "-l"
+		if (long && cmd != "ls") || (recursive && cmd != "get" && cmd != "put" && cmd != "rm") {
+			return fmt.Errorf("%s: unknown option %s", cmd, args[0])
+		}
+		args = args[1:]
+	}
+
+	switch cmd {
+	case "pwd":
+		_, err = fmt.Fprintf(s.out, "Remote working directory: %s\n", s.remoteDir)
+		return err
+	case "lpwd":
+		_, err = fmt.Fprintf(s.out, "Local working directory: %s\n", s.localDir)
+		return err
+	case "cd":
+		dir := s.remoteHome
+		if len(args) > 0 {
+			dir = s.remotePath(args[0])
+		}
+		info, err := s.client.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("cd: %s (%w)", dir, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("cd: %s is not a directory", dir)
+		}
+		s.remoteDir = dir
+		return nil
+	case "lcd":
+		dir, err := os.UserHomeDir()
+		if len(args) > 0 {
+			dir, err = s.localPath(args[0]), nil
+		}
+		if err != nil {
+			return fmt.Errorf("lcd: %w", err)
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("lcd: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("lcd: %s is not a directory", dir)
+		}
+		s.localDir = dir
+		return nil
+	case "ls":
+		dir := s.remoteDir
+		if len(args) > 0 {
+			dir = s.remotePath(args[0])
+		}
+		return ListRemote(s.client, dir, long, s.out)
+	case "mkdir":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: mkdir <remote dir>")
+		}
+		return MakeRemoteDir(s.client, s.remotePath(args[0]))
+	case "rm":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: rm [-r] <remote path>")
+		}
+		return RemoveRemote(s.client, s.remotePath(args[0]), recursive)
+	case "get":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: get [-r] <remote path> [local path]")
+		}
+		remote := s.remotePath(args[0])
+		local := filepath.Join(s.localDir, path.Base(remote))
+		if len(args) == 2 {
+			local = s.localPath(args[1])
+			if !recursive {
+				if hasTrailingSeparator(args[1]) {
+					local += string(filepath.Separator)
+				}
+				var err error
+				if local, err = AppendLocalBaseName(local, remote); err != nil {
+					return err
+				}
+			}
+		}
+		if recursive {
+			return RetrieveRemoteDir(ctx, s.client, local, remote, s.opts)
+		}
+		return RetrieveRemoteFiles(ctx, s.client, local, remote, s.opts)
+	case "put":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: put [-r] <local path> [remote path]")
+		}
+		local := s.localPath(args[0])
+		remote := s.remoteDir
+		if len(args) == 2 {
+			remote = s.remotePath(args[1])
+		}
+		if recursive {
+			return SendDir(ctx, s.client, local, remote, s.opts)
+		}
+		if len(args) == 1 || strings.HasSuffix(args[1], "/") {
+			// remotePath cleans away the trailing slash marking a directory
+			remote += "/"
+		}
+		return SendFile(ctx, s.client, local, AppendBaseName(s.client, remote, local, false), s.opts)
+	case "help", "?":
+		_, err = fmt.Fprint(s.out, sftpShellHelp)
+		return err
+	case "exit", "quit", "bye":
+		return errExitShell
+	default:
+		return fmt.Errorf("unknown command: %s. type help for a list of commands", cmd)
+	}
+}
+
+const sftpShellHelp = `cd [path]                        change the remote directory, or return to the remote home directory
+lcd [path]                       change the local directory, or return to the local home directory
+pwd                              show the remote directory
+lpwd                             show the local directory
+ls [-l] [path]                   list the remote directory or path
+get [-r] <remote> [local]        retrieve a remote file, or directory with -r
+put [-r] <local> [remote]        send a local file, or directory with -r
+mkdir <path>                     make a remote directory and any missing parents
+rm [-r] <path>                   remove a remote file or empty directory, or directory and its contents with -r
+help                             show this help
+exit                             leave the shell
+`
+
+// remotePath resolves p against the remote working directory
+func (s *SftpShell) remotePath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return path.Join(s.remoteHome, p[1:])
+	}
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(s.remoteDir, p)
+}
+
+// localPath resolves p against the local working directory
+func (s *SftpShell) localPath(p string) string {
+	p = expandHome(p)
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(s.localDir, p)
+}
+
+// splitShellWords splits line into words separated by whitespace. Single or double quotes group words containing
+// whitespace and a backslash escapes the following character outside of single quotes.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
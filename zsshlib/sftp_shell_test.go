@@ -0,0 +1,74 @@
+package zsshlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSftpShell(t *testing.T) {
+	client := newTestSftpClient(t)
+	remote := t.TempDir()
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "local file.txt"), []byte("from local"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	shell, err := NewSftpShell(client, remote, nil, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shell.localDir = local
+
+	script := strings.Join([]string{
+		"mkdir sub/dir",
+		"cd sub",
+		"pwd",
+		`put "local file.txt"`,
+		`put 'local file.txt' dir/renamed.txt`,
+		"ls dir",
+		"lcd ..",
+		"lcd " + filepath.Base(local),
+		"get dir/renamed.txt copy.txt",
+		"cd /no/such/dir",
+		"rm dir",
+		"rm -r dir",
+		"bogus",
+		"exit",
+		"pwd",
+	}, "\n")
+	assert.NoError(t, shell.run(context.Background(), bufio.NewScanner(strings.NewReader(script))))
+
+	output := out.String()
+	assert.Contains(t, output, "Remote working directory: "+filepath.ToSlash(filepath.Join(remote, "sub"))+"\n")
+	assert.Contains(t, output, "sftp> ls dir\nrenamed.txt\n")
+	assert.Contains(t, output, "cd: /no/such/dir")
+	assert.Contains(t, output, "use -r to remove its contents")
+	assert.Contains(t, output, "unknown command: bogus")
+	assert.Equal(t, 1, strings.Count(output, "Remote working directory:"), "commands after exit should not run")
+
+	content, err := os.ReadFile(filepath.Join(remote, "sub", "local file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "from local", string(content))
+	content, err = os.ReadFile(filepath.Join(local, "copy.txt"))
+	assert.NoError(t, err, "get should retrieve into the local working directory")
+	assert.Equal(t, "from local", string(content))
+	assert.NoDirExists(t, filepath.Join(remote, "sub", "dir"))
+	assert.Equal(t, filepath.Join(remote, "sub"), shell.remoteDir, "a failed cd should not change directory")
+}
+
+func TestSplitShellWords(t *testing.T) {
+	words, err := splitShellWords(`put "my file.txt"  'it''s' a\ b ""`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"put", "my file.txt", "its", "a b", ""}, words)
+
+	_, err = splitShellWords(`get "unterminated`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"io"
+)
+
+// sparseBlockSize is the granularity zero runs are detected at, the block size of most filesystems. Only whole
+// blocks of zeros, aligned to the destination offset, are skipped, as the filesystem can't leave part of a block
+// unallocated.
+const sparseBlockSize = 4096
+
+// sparseWriter writes to w, seeking over aligned blocks of zeros rather than writing them so the filesystem leaves
+// holes in the destination, see TransferOptions.Sparse. Consecutive blocks are coalesced into a single write or seek.
+// Seeking past the end of the file doesn't extend it, so finish must be called once everything is written.
+type sparseWriter struct {
+	w      io.WriteSeeker
+	offset int64
+}
+
+// newSparseWriter returns a sparseWriter writing to w from offset, where w is positioned
+func newSparseWriter(w io.WriteSeeker, offset int64) *sparseWriter {
+	return &sparseWriter{w: w, offset: offset}
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		zero := isZero(p[:blockLen(s.offset, len(p))])
+		n := 0
+		for n < len(p) {
+			block := p[n : n+blockLen(s.offset+int64(n), len(p)-n)]
+			if isZero(block) != zero {
+				break
+			}
+			n += len(block)
+		}
+		if zero {
+			if _, err := s.w.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := s.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		s.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// blockLen returns the length of the block at offset, at most remaining bytes, ending at the next block boundary
+func blockLen(offset int64, remaining int) int {
+	n := sparseBlockSize - int(offset%sparseBlockSize)
+	if n > remaining {
+		return remaining
+	}
+	return n
+}
+
+// finish sets the size of the destination to what was written with truncate, extending it over trailing zeros
+// which were skipped
+func (s *sparseWriter) finish(truncate func(size int64) error) error {
+	return truncate(s.offset)
+}
+
+// isZero reports whether every byte of p is zero
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSparseTestFile writes a file of size bytes which is zero apart from a little data at each of offsets
+func writeSparseTestFile(t *testing.T, path string, size int, offsets ...int) {
+	content := make([]byte, size)
+	for _, offset := range offsets {
+		copy(content[offset:], bytes.Repeat([]byte("data"), 1000))
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSparseWriter(t *testing.T) {
+	dir := t.TempDir()
+	dest, err := os.Create(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dest.Close() }()
+
+	content := make([]byte, 5*sparseBlockSize+100)
+	copy(content[10:], "head")
+	copy(content[3*sparseBlockSize-2:], "straddles")
+	w := newSparseWriter(dest, 0)
+	// unaligned writes, zero runs are still only skipped in whole blocks
+	for _, chunk := range [][]byte{content[:7], content[7 : 2*sparseBlockSize+5], content[2*sparseBlockSize+5:]} {
+		n, err := w.Write(chunk)
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.NoError(t, w.finish(dest.Truncate))
+	written, err := os.ReadFile(dest.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, content, written, "trailing zeros should be included")
+}
+
+func TestSparseTransfer(t *testing.T) {
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "source.img")
+	writeSparseTestFile(t, sourcePath, 4<<20, 0, 2<<20+100)
+	client := newTestSftpClient(t)
+	opts := &TransferOptions{Sparse: true, Verify: true}
+
+	uploadPath := filepath.Join(dir, "upload.img")
+	assert.NoError(t, SendFile(context.Background(), client, sourcePath, uploadPath, opts))
+	assert.Equal(t, hashFile(t, sourcePath), hashFile(t, uploadPath))
+
+	downloadPath := filepath.Join(dir, "download.img")
+	assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, downloadPath, uploadPath, opts))
+	assert.Equal(t, hashFile(t, sourcePath), hashFile(t, downloadPath))
+
+	// resuming a sparse copy
+	content, _ := os.ReadFile(sourcePath)
+	if err := os.WriteFile(downloadPath+partSuffix, content[:1<<20], 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(downloadPath)
+	assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, downloadPath, uploadPath, &TransferOptions{Sparse: true, Resume: true, Verify: true}))
+	assert.Equal(t, hashFile(t, sourcePath), hashFile(t, downloadPath))
+}
+
+// blockingWriterAt records what is written to it, blocking each write until want writes are in flight at once
+type blockingWriterAt struct {
+	mu      sync.Mutex
+	content []byte
+	want    int
+	arrived chan struct{}
+}
+
+func (w *blockingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	if end := int(off) + len(p); end > len(w.content) {
+		w.content = append(w.content, make([]byte, end-len(w.content))...)
+	}
+	copy(w.content[off:], p)
+	w.want--
+	if w.want == 0 {
+		close(w.arrived)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.arrived:
+		return len(p), nil
+	case <-time.After(5 * time.Second):
+		return 0, fmt.Errorf("writes weren't concurrent")
+	}
+}
+
+func TestChunkWriterConcurrent(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*sftpChunkSize/16+10)
+	dest := &blockingWriterAt{want: 5, arrived: make(chan struct{})}
+	w := &chunkWriter{w: dest, offset: 100}
+	n, err := w.Write(content)
+	assert.NoError(t, err, "a run of data should be written as concurrent chunks")
+	assert.Equal(t, len(content), n)
+	assert.Equal(t, content, dest.content[100:])
+
+	offset, err := w.Seek(sparseBlockSize, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100+len(content)+sparseBlockSize), offset)
+}
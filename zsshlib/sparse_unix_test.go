@@ -0,0 +1,47 @@
+//go:build linux || darwin
+
+package zsshlib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// allocatedSize returns the bytes the filesystem allocated for path, which are fewer than its size when it has holes
+func allocatedSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseTransferAllocatedSize(t *testing.T) {
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "source.img")
+	writeSparseTestFile(t, sourcePath, 16<<20, 0, 8<<20)
+	client := newTestSftpClient(t)
+
+	transfer := func(name string, opts *TransferOptions) (int64, int64) {
+		uploadPath := filepath.Join(dir, name+".up")
+		downloadPath := filepath.Join(dir, name+".down")
+		assert.NoError(t, SendFile(context.Background(), client, sourcePath, uploadPath, opts))
+		assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, downloadPath, sourcePath, opts))
+		assert.Equal(t, hashFile(t, sourcePath), hashFile(t, uploadPath))
+		assert.Equal(t, hashFile(t, sourcePath), hashFile(t, downloadPath))
+		return allocatedSize(t, uploadPath), allocatedSize(t, downloadPath)
+	}
+	fullUpload, fullDownload := transfer("full", nil)
+	if fullUpload < 16<<20 {
+		t.Skip("the filesystem of the temp directory doesn't allocate written zeros")
+	}
+	sparseUpload, sparseDownload := transfer("sparse", &TransferOptions{Sparse: true})
+	assert.GreaterOrEqual(t, fullDownload, int64(16<<20))
+	assert.Less(t, sparseUpload, int64(1<<20), "the upload should be sparse")
+	assert.Less(t, sparseDownload, int64(1<<20), "the download should be sparse")
+}
@@ -18,17 +18,25 @@ package zsshlib
 
 import (
 	"bufio"
+	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/securecookie"
 	"github.com/openziti/sdk-golang/ziti"
@@ -36,116 +44,418 @@ import (
 	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 const (
-	ID_RSA  = "id_rsa"
-	SSH_DIR = ".ssh"
-)
+	ID_RSA     = "id_rsa"
+	ID_ECDSA   = "id_ecdsa"
+	ID_ED25519 = "id_ed25519"
+	SSH_DIR    = ".ssh"
 
-var (
-	DefaultAuthScopes = "openid profile email"
-)
+	// KEY_PASSPHRASE_ENV names the environment variable consulted for the key passphrase when stdin is not a terminal
+	KEY_PASSPHRASE_ENV = "ZSSH_KEY_PASSPHRASE"
 
-func RemoteShell(client *ssh.Client, args []string) error {
-	session, err := client.NewSession()
-	if err != nil {
-		return err
-	}
+	// ASKPASS_ENV names the environment variable which may hold a program run to ask for key passphrases and MFA
+	// codes rather than reading them from the terminal, like SSH_ASKPASS
+	ASKPASS_ENV = "ZSSH_ASKPASS"
 
-	if len(args) > 0 {
-		if err := session.RequestPty("xterm", 80, 40, ssh.TerminalModes{}); err != nil {
-			logrus.Fatalf("Failed to request pseudo terminal: %v", err)
-		}
+	// PRIVATE_KEY_ENV names the environment variable which may hold the contents of a private key, tried before any
+	// key files
+	PRIVATE_KEY_ENV = "ZSSH_PRIVATE_KEY"
 
-		defer func() { _ = session.Close() }()
+	// STDIN_KEY_PATH is the key path meaning the private key is read from stdin
+	STDIN_KEY_PATH = "-"
 
-		stdoutPipe, err := session.StdoutPipe()
-		if err != nil {
-			logrus.Fatal(os.Stderr, "Failed to create stdout pipe:", err)
-		}
-
-		stderrPipe, err := session.StderrPipe()
-		if err != nil {
-			logrus.Fatal("Failed to create stderr pipe:", err)
-		}
+	maxPassphraseAttempts = 3
 
-		cmd := strings.Join(args, " ")
-		logrus.Infof("executing remote command: %v", cmd)
-		if err := session.Start(cmd); err != nil {
-			logrus.Fatal("Failed to start command:", err)
-		}
+	// DEFAULT_TERM is the terminal type requested for the remote pty when TERM is not set
+	DEFAULT_TERM = "xterm-256color"
+)
 
-		processOutput(stdoutPipe, stderrPipe)
+var (
+	DefaultAuthScopes = "openid profile email"
+	// OfflineAccessScope asks the provider for a refresh token, allowing tokens to be renewed without a new login
+	OfflineAccessScope = "offline_access"
+)
 
-		// Wait for the command to finish
-		if err := session.Wait(); err != nil {
-			logrus.Fatal("Command execution failed:", err)
-		}
+// RemoteShell opens an interactive shell on the remote, or runs args as a command when provided, and returns the
+// remote exit status once the shell exits. A pty is only requested when stdin is a terminal; when stdin is piped the
+// shell reads its commands from stdin instead. Cancelling ctx closes the session, as does --idle-timeout elapsing
+// without input to an interactive shell, returning ErrIdleTimeout. When the connection fails during an interactive
+// shell, or the server stops answering for --dead-after, the terminal is restored and ErrConnectionLost returned
+// rather than leaving the terminal frozen.
+func RemoteShell(ctx context.Context, client *ssh.Client, f *SshFlags, args []string, opts ...SessionOption) (int, error) {
+	if len(args) > 0 {
+		return RunCommand(ctx, client, strings.Join(args, " "), PipedStdin(), os.Stdout, os.Stderr, opts...)
+	}
 
-		return nil
+	session, err := newSession(client, opts)
+	if err != nil {
+		return -1, err
 	}
 
 	stdInFd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdInFd) {
+		defer func() { _ = session.Close() }()
+		session.Stdin = os.Stdin
+		session.Stdout = os.Stdout
+		session.Stderr = os.Stderr
+		if err := session.Shell(); err != nil {
+			return -1, err
+		}
+		return waitSession(ctx, session)
+	}
 	stdOutFd := int(os.Stdout.Fd())
 
 	oldState, err := terminal.MakeRaw(stdInFd)
 	if err != nil {
-		logrus.Fatal(err)
+		_ = session.Close()
+		return -1, fmt.Errorf("unable to put the terminal in raw mode: %w", err)
 	}
+	// deferred, the terminal is also restored when RemoteShell panics
+	guard := guardTerminal(stdInFd, oldState, func() { _ = session.Close() })
 	defer func() {
 		_ = session.Close()
-		_ = terminal.Restore(stdInFd, oldState)
+		guard.Restore()
 	}()
 
+	// stdin is only read through the pump, so once this session ends the next input reaches the session replacing it
+	stdinDone := make(chan struct{})
+	defer close(stdinDone)
+	stdin := terminalStdin.Reader(stdinDone)
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
-	session.Stdin = os.Stdin
+	session.Stdin = stdin
+	var idle *idleTimer
+	if f.IdleTimeout > 0 {
+		idle = newIdleTimer(f.IdleTimeout, func() { _ = session.Close() })
+		defer idle.Stop()
+		session.Stdin = idle.Reader(stdin)
+	}
 
 	termWidth, termHeight, err := terminal.GetSize(stdOutFd)
 	if err != nil {
-		logrus.Fatal(err)
+		return -1, fmt.Errorf("unable to read the terminal size: %w", err)
 	}
 
-	if err := session.RequestPty("xterm", termHeight, termWidth, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
-		return err
+	termType := termType(f)
+	if err := session.Setenv("TERM", termType); err != nil {
+		log.Debugf("remote did not accept TERM=%s: %v", termType, err)
+	}
+	if err := session.RequestPty(termType, termHeight, termWidth, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+		return -1, err
 	}
 
 	err = session.Shell()
 	if err != nil {
-		return err
+		return -1, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	watchWindowSize(session, stdOutFd, done)
+	lost := make(chan error, 1)
+	watchConnection(client, f.DeadAfter, done, func(err error) {
+		lost <- err
+		guard.Restore()
+		_ = session.Close()
+	})
+
+	exitCode, err := waitSession(ctx, session)
+	if sig := guard.Signal(); sig != nil {
+		return -1, fmt.Errorf("shell interrupted by %v", sig)
+	}
+	if idle != nil && idle.Stop() {
+		return -1, fmt.Errorf("%w: no input for %v", ErrIdleTimeout, f.IdleTimeout)
 	}
-	err = session.Wait()
 	if err != nil {
-		return err
+		// a shell which sent its exit status wasn't cut off, even if the connection closed after it
+		select {
+		case lostErr := <-lost:
+			return -1, lostErr
+		default:
+		}
 	}
-	return nil
+	return exitCode, err
+}
+
+// terminalGuard restores a terminal put in raw mode. Deferred calls to Restore are skipped by os.Exit, or a signal
+// killing the process, so it is also restored on SIGINT or SIGTERM and by logrus' Fatal.
+type terminalGuard struct {
+	fd    int
+	state *terminal.State
+	sigs  chan os.Signal
+	done  chan struct{}
+	once  sync.Once
+
+	mu       sync.Mutex
+	received os.Signal
+}
+
+// guardTerminal guards the terminal fd, restoring it to state. When a signal is received the terminal is restored
+// and onSignal is called, e.g. to close the session so the shell returns.
+func guardTerminal(fd int, state *terminal.State, onSignal func()) *terminalGuard {
+	g := &terminalGuard{fd: fd, state: state, sigs: make(chan os.Signal, 1), done: make(chan struct{})}
+	signal.Notify(g.sigs, os.Interrupt, syscall.SIGTERM)
+	logrus.RegisterExitHandler(g.Restore)
+	go func() {
+		select {
+		case sig := <-g.sigs:
+			g.mu.Lock()
+			g.received = sig
+			g.mu.Unlock()
+			g.Restore()
+			onSignal()
+		case <-g.done:
+		}
+	}()
+	return g
+}
+
+// Restore restores the terminal and stops watching for signals. It is safe to call more than once.
+func (g *terminalGuard) Restore() {
+	g.once.Do(func() {
+		signal.Stop(g.sigs)
+		close(g.done)
+		_ = terminal.Restore(g.fd, g.state)
+	})
+}
+
+// Signal returns the signal which restored the terminal, or nil when none was received
+func (g *terminalGuard) Signal() os.Signal {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.received
+}
+
+// termType returns the terminal type for the remote pty: the --term flag, then $TERM, then DEFAULT_TERM
+func termType(f *SshFlags) string {
+	if f.Term != "" {
+		return f.Term
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		return term
+	}
+	return DEFAULT_TERM
+}
+
+// PipedStdin returns os.Stdin when it is not a terminal, such as when input is piped or redirected from a file, and nil
+// otherwise. Interactive input belongs to a pty, so a terminal is never streamed to a command run without one.
+func PipedStdin() io.Reader {
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil
+	}
+	return os.Stdin
+}
+
+// RunCommand runs cmd on the remote without requesting a pty, wiring the provided streams to the session, and
+// returns the remote exit status. When stdin is provided it is streamed to the command, which sees EOF once stdin is
+// exhausted. A command which runs but exits with a non-zero status is not an error. Cancelling ctx closes the session,
+// abandoning the command.
+func RunCommand(ctx context.Context, client *ssh.Client, cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer, opts ...SessionOption) (int, error) {
+	session, err := newSession(client, opts)
+	if err != nil {
+		return -1, err
+	}
+	defer func() { _ = session.Close() }()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	log.Debugf("executing remote command: %v", cmd)
+	if err := session.Start(cmd); err != nil {
+		return -1, err
+	}
+	return waitSession(ctx, session)
+}
+
+// waitSession waits for the command or shell started on session to exit and returns its exit status. When ctx is done
+// first the session is closed without waiting any further.
+func waitSession(ctx context.Context, session *ssh.Session) (int, error) {
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	select {
+	case err := <-done:
+		return exitStatus(err)
+	case <-ctx.Done():
+		_ = session.Close()
+		return -1, ctx.Err()
+	}
+}
+
+// SessionOption customizes a session before its shell or command is started
+type SessionOption func(session *ssh.Session) error
+
+// WithAgentForwarding requests that the remote forward agent connections for the session back to the client. The
+// client must be serving them, see ForwardAgent.
+func WithAgentForwarding() SessionOption {
+	return func(session *ssh.Session) error {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return fmt.Errorf("failed to request agent forwarding: %w", err)
+		}
+		return nil
+	}
+}
+
+// WithEnv sets environment variables, each of the form KEY=VALUE, for the session. sshd commonly only accepts the
+// variables allowed by its AcceptEnv setting, so variables the remote rejects are logged rather than failing.
+func WithEnv(env []string) SessionOption {
+	return func(session *ssh.Session) error {
+		for _, kv := range env {
+			name, value, _ := strings.Cut(kv, "=")
+			if err := session.Setenv(name, value); err != nil {
+				log.Debugf("remote did not accept environment variable %s: %v", name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// ForwardAgent serves agent connections opened by the remote from the local ssh agent, allowing keys held locally to
+// be used from the remote. Sessions must also request forwarding using WithAgentForwarding.
+func ForwardAgent(client *ssh.Client) error {
+	keyring := sshAgentClient()
+	if keyring == nil {
+		return fmt.Errorf("no local ssh agent is available to forward")
+	}
+	return agent.ForwardToAgent(client, keyring)
+}
+
+// newSession creates a session on client with opts applied
+func newSession(client *ssh.Client, opts []SessionOption) (*ssh.Session, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	for _, opt := range opts {
+		if err := opt(session); err != nil {
+			_ = session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// exitStatus extracts the remote exit status from the error returned by ssh.Session Run/Wait
+func exitStatus(err error) (int, error) {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	} else if err != nil {
+		return -1, err
+	}
+	return 0, nil
 }
 
-func Dial(config *ssh.ClientConfig, conn net.Conn) (*ssh.Client, error) {
-	c, chans, reqs, err := ssh.NewClientConn(conn, "", config)
+// Dial performs the ssh handshake with target over conn. The host key is verified as target's, see knownHostsAddress,
+// rather than by the address of the edge router conn happens to pass through. When config.Timeout is set, the
+// handshake must complete within the timeout. Time spent waiting on the user to accept an unknown host key does not
+// count towards the timeout.
+func Dial(config *ssh.ClientConfig, target string, conn net.Conn) (*ssh.Client, error) {
+	if config.Timeout > 0 {
+		setDeadline := func() { _ = conn.SetDeadline(time.Now().Add(config.Timeout)) }
+		verify := config.HostKeyCallback
+		timed := *config
+		timed.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			_ = conn.SetDeadline(time.Time{})
+			defer setDeadline()
+			return verify(hostname, remote, key)
+		}
+		config = &timed
+		setDeadline()
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, knownHostsAddress(target), config)
 	if err != nil {
 		return nil, err
 	}
 	return ssh.NewClient(c, chans, reqs), nil
 }
 
+// isTimeout reports whether err was caused by a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded) || strings.Contains(strings.ToLower(err.Error()), "timeout")
+}
+
 // validateAndSetDefaults validates the config and sets default values.
 func (c *OIDCConfig) validateAndSetDefaults() error {
 	if c.ClientID == "" {
 		return fmt.Errorf("ClientID must be set")
 	}
+	switch c.AuthFlow {
+	case "", AuthFlowCode, AuthFlowDevice:
+	default:
+		return fmt.Errorf("unsupported auth flow [%s], expected %s or %s", c.AuthFlow, AuthFlowCode, AuthFlowDevice)
+	}
+
+	if c.CallbackHost == "" {
+		c.CallbackHost = DefaultCallbackHost
+	}
+	if c.AuthTimeout <= 0 {
+		c.AuthTimeout = DefaultAuthTimeout
+	}
+	if c.RedirectURL == "" {
+		c.RedirectURL = callbackURL(c.CallbackHost, c.CallbackPort, c.CallbackPath)
+	}
+	if c.AuthFlow != AuthFlowDevice {
+		redirect, err := url.Parse(c.RedirectURL)
+		if err != nil {
+			return fmt.Errorf("invalid redirect URI [%s]: %w", c.RedirectURL, err)
+		}
+		if redirect.Host != net.JoinHostPort(c.CallbackHost, c.CallbackPort) {
+			return fmt.Errorf("redirect URI [%s] does not match the callback listening on %s", c.RedirectURL,
+				net.JoinHostPort(c.CallbackHost, c.CallbackPort))
+		}
+	}
 
-	c.HashKey = securecookie.GenerateRandomKey(32)
-	c.BlockKey = securecookie.GenerateRandomKey(32)
+	if c.HashKey == nil {
+		c.HashKey = securecookie.GenerateRandomKey(32)
+	}
+	if c.BlockKey == nil {
+		c.BlockKey = securecookie.GenerateRandomKey(32)
+	}
 
 	if c.Logf == nil {
 		c.Logf = func(string, ...interface{}) {}
 	}
 
-	c.Scopes = strings.Split(DefaultAuthScopes, " ")
+	provider := &OIDCProvider{Scopes: strings.Split(DefaultAuthScopes, " ")}
+	if c.Provider != "" {
+		p, err := LookupOIDCProvider(c.Provider)
+		if err != nil {
+			return err
+		}
+		provider = p
+		if c.Issuer == "" {
+			c.Issuer = p.Issuer
+		}
+		if c.Issuer == "" {
+			return fmt.Errorf("an issuer must be set for %s, e.g. %s", p.Name, p.IssuerExample)
+		}
+		c.Issuer = p.normalizeIssuer(c.Issuer)
+	}
+
+	if len(c.Scopes) == 0 {
+		c.Scopes = provider.scopes(c.OfflineAccess)
+	} else if c.OfflineAccess && len(provider.OfflineAccessParams) == 0 && !slices.Contains(c.Scopes, OfflineAccessScope) {
+		c.Scopes = append(c.Scopes, OfflineAccessScope)
+	}
+	if c.OfflineAccess {
+		for _, param := range provider.OfflineAccessParams {
+			if !slices.Contains(c.AdditionalLoginParams, param) {
+				c.AdditionalLoginParams = append(c.AdditionalLoginParams, param)
+			}
+		}
+	}
 
 	return nil
 }
@@ -156,24 +466,111 @@ type SshConfigFactory interface {
 	Port() int
 	User() string
 	Config() *ssh.ClientConfig
-	KeyPath() string
+	KeyPaths() []string
 }
 
 type SshConfigFactoryImpl struct {
 	user            string
 	host            string
 	port            int
-	keyPath         string
+	keyPaths        []string
+	insecure        bool
+	noAgent         bool
+	quiet           bool
+	trace           bool
+	clientVersion   string
+	algorithms      Algorithms
 	resolveAuthOnce sync.Once
 	authMethods     []ssh.AuthMethod
+	signers         []ssh.Signer
+
+	// KnownHostsPath is the known_hosts file used to verify host keys. default: $HOME/.ssh/known_hosts
+	KnownHostsPath string
+
+	// HostKeyCallback, when set, verifies host keys in place of KnownHostsPath, e.g. FixedHostKey to pin a key
+	HostKeyCallback ssh.HostKeyCallback
 }
 
-func NewSshConfigFactoryImpl(user string, keyPath string) *SshConfigFactoryImpl {
+// SshConfigFactoryOption customizes a SshConfigFactoryImpl when passed to NewSshConfigFactoryImpl
+type SshConfigFactoryOption func(factory *SshConfigFactoryImpl)
+
+// WithKnownHostsPath overrides the known_hosts file used to verify host keys
+func WithKnownHostsPath(knownHostsPath string) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.KnownHostsPath = knownHostsPath
+	}
+}
+
+// WithHostKeyCallback verifies host keys using callback instead of the known_hosts file
+func WithHostKeyCallback(callback ssh.HostKeyCallback) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.HostKeyCallback = callback
+	}
+}
+
+// WithHost sets the host (the target identity) the factory creates configs for
+func WithHost(host string) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.host = host
+	}
+}
+
+// WithInsecure disables host key verification entirely when insecure is true
+func WithInsecure(insecure bool) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.insecure = insecure
+	}
+}
+
+// WithNoAgent leaves the keys of the ssh agent out of authentication when noAgent is true, so only the key files are
+// offered. Servers disconnect after too many failed attempts, which an agent holding many unrelated keys can cause
+// before the intended key is tried.
+func WithNoAgent(noAgent bool) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.noAgent = noAgent
+	}
+}
+
+// WithQuiet suppresses the banner the server sends before authentication when quiet is true
+func WithQuiet(quiet bool) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.quiet = quiet
+	}
+}
+
+// WithTrace logs the keys offered during authentication when trace is true, see traceConn
+func WithTrace(trace bool) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.trace = trace
+	}
+}
+
+// WithClientVersion identifies the client to servers with clientVersion, rather than DefaultClientVersion, when it
+// isn't empty. See ValidateClientVersion.
+func WithClientVersion(clientVersion string) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.clientVersion = clientVersion
+	}
+}
+
+// WithAlgorithms offers servers the selected ciphers, MACs and key exchange algorithms rather than the defaults. See
+// SshFlags.Algorithms.
+func WithAlgorithms(algorithms Algorithms) SshConfigFactoryOption {
+	return func(factory *SshConfigFactoryImpl) {
+		factory.algorithms = algorithms
+	}
+}
+
+// NewSshConfigFactoryImpl creates a factory authenticating as user with the private keys at keyPaths, tried in order
+func NewSshConfigFactoryImpl(user string, keyPaths []string, opts ...SshConfigFactoryOption) *SshConfigFactoryImpl {
 	factory := &SshConfigFactoryImpl{
-		user:    user,
-		host:    "",
-		port:    22,
-		keyPath: keyPath,
+		user:     user,
+		host:     "",
+		port:     22,
+		keyPaths: keyPaths,
+	}
+	for _, opt := range opts {
+		opt(factory)
 	}
 	return factory
 }
@@ -189,8 +586,8 @@ func (factory *SshConfigFactoryImpl) Port() int {
 	return factory.port
 }
 
-func (factory *SshConfigFactoryImpl) KeyPath() string {
-	return factory.keyPath
+func (factory *SshConfigFactoryImpl) KeyPaths() []string {
+	return factory.keyPaths
 }
 
 func (factory *SshConfigFactoryImpl) Address() string {
@@ -201,252 +598,726 @@ func (factory *SshConfigFactoryImpl) Config() *ssh.ClientConfig {
 	factory.resolveAuthOnce.Do(func() {
 		var methods []ssh.AuthMethod
 
-		if fileMethod, err := sshAuthMethodFromFile(factory.keyPath); err == nil {
-			methods = append(methods, fileMethod)
+		if content, found := os.LookupEnv(PRIVATE_KEY_ENV); found && content != "" {
+			log.Debugf("using ssh key from %s", PRIVATE_KEY_ENV)
+			if signer, err := sshSignerFromBytes(PRIVATE_KEY_ENV, []byte(content)); err != nil {
+				log.Warnf("skipping ssh key: %v", err)
+			} else {
+				factory.signers = append(factory.signers, signer)
+			}
+		}
+		for _, keyPath := range factory.keyPaths {
+			if keyPath == "" {
+				continue
+			}
+			log.Debugf("using ssh key file: %s", keyPath)
+			signer, err := sshSignerFromFile(keyPath)
+			if err != nil {
+				log.Warnf("skipping ssh key: %v", err)
+				continue
+			}
+			// like OpenSSH, the certificate is offered before the plain key, which is the fallback when the server
+			// doesn't trust the certificate's CA
+			if certSigner := sshCertSigner(keyPath, signer); certSigner != nil {
+				factory.signers = append(factory.signers, certSigner)
+			}
+			factory.signers = append(factory.signers, signer)
+		}
+		// only the first method of each kind is attempted, so the key files and the keys of the agent must all belong
+		// to the same publickey method, the key files first
+		var agentSigners func() ([]ssh.Signer, error)
+		if factory.noAgent {
+			log.Debug("not using the ssh agent (--no-agent)")
 		} else {
-			logrus.Error(err)
+			agentSigners = sshAgentSigners()
 		}
-
-		if agentMethod := sshAuthMethodAgent(); agentMethod != nil {
-			methods = append(methods, sshAuthMethodAgent())
+		if len(factory.signers) > 0 || agentSigners != nil {
+			methods = append(methods, factory.publicKeys(factory.signers, agentSigners))
 		}
 
-		methods = append(methods)
-
+		if len(methods) == 0 {
+			log.Warn("no usable authentication methods: none of the ssh keys could be read and no ssh agent holding keys is available")
+		}
 		factory.authMethods = methods
 	})
 
-	return &ssh.ClientConfig{
+	clientVersion := factory.clientVersion
+	if clientVersion == "" {
+		clientVersion = DefaultClientVersion()
+	}
+	config := &ssh.ClientConfig{
 		User:            factory.user,
 		Auth:            factory.authMethods,
-		HostKeyCallback: hostKeyCallback,
+		HostKeyCallback: factory.hostKeyCallback(),
+		BannerCallback:  factory.bannerCallback(),
+		ClientVersion:   clientVersion,
 	}
+	factory.algorithms.apply(&config.Config)
+	return config
 }
 
-func sshAuthMethodFromFile(keyPath string) (ssh.AuthMethod, error) {
-	content, err := os.ReadFile(keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("could not read zssh file [%s]: %w", keyPath, err)
+// publicKeys returns the publickey method offering the keys read from key files, then those listed by agentSigners
+// when not nil, logging each key offered when tracing. The key files are still offered when the agent can't list its
+// keys.
+func (factory *SshConfigFactoryImpl) publicKeys(keyFiles []ssh.Signer, agentSigners func() ([]ssh.Signer, error)) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		factory.traceKeys("key files", keyFiles)
+		signers := append([]ssh.Signer{}, keyFiles...)
+		if agentSigners == nil {
+			return signers, nil
+		}
+		keys, err := agentSigners()
+		if err != nil {
+			log.Debugf("unable to list the keys of the ssh agent: %v", err)
+			return signers, nil
+		}
+		factory.traceKeys("the ssh agent", keys)
+		return append(signers, keys...), nil
+	})
+}
+
+// traceKeys logs each key offered from source when tracing
+func (factory *SshConfigFactoryImpl) traceKeys(source string, keys []ssh.Signer) {
+	if !factory.trace {
+		return
 	}
-	_, _, _, _, pubkeyErr := ssh.ParseAuthorizedKey(content)
-	if pubkeyErr == nil {
-		log.Fatal("the provided key for ssh authentication is a public key, but a private key is required")
+	for _, key := range keys {
+		log.Tracef("offering publickey from %s: %s %s", source, key.PublicKey().Type(), ssh.FingerprintSHA256(key.PublicKey()))
 	}
+}
 
-	if signer, err := ssh.ParsePrivateKey(content); err == nil {
-		return ssh.PublicKeys(signer), nil
-	} else {
-		if err.Error() == "zssh: no key found" {
-			return nil, fmt.Errorf("no private key found in [%s]: %w", keyPath, err)
-		} else if err.(*ssh.PassphraseMissingError) != nil {
-			return nil, fmt.Errorf("file is password protected [%s] %w", keyPath, err)
-		} else {
-			return nil, fmt.Errorf("error parsing private key from [%s]L %w", keyPath, err)
+// bannerOut is where server banners are written, stderr so they aren't mixed with the output of remote commands
+var bannerOut io.Writer = os.Stderr
+
+// bannerCallback shows the banner sent by the server, often a legal notice users are required to see, unless the
+// factory is quiet. Control characters other than whitespace are dropped, as OpenSSH does, so a server can't send
+// escape sequences to the terminal.
+func (factory *SshConfigFactoryImpl) bannerCallback() ssh.BannerCallback {
+	return func(message string) error {
+		if factory.quiet {
+			return nil
+		}
+		_, err := io.WriteString(bannerOut, strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+				return -1
+			}
+			return r
+		}, message))
+		return err
+	}
+}
+
+// hostKeyCallback returns the callback used to verify the target's host key, which first logs the key's fingerprint
+// so it can be compared against one obtained out-of-band. A HostKeyCallback set on the factory then verifies the key
+// as is. Otherwise, unless the factory is insecure, keys are verified against KnownHostsPath, prompting to trust (and
+// record) keys that are not yet known.
+func (factory *SshConfigFactoryImpl) hostKeyCallback() ssh.HostKeyCallback {
+	knownHosts := factory.KnownHostsPath
+	if knownHosts == "" {
+		knownHosts = knownHostsFile()
+	}
+	target := factory.host
+
+	verify := factory.HostKeyCallback
+	if verify == nil && factory.insecure {
+		log.Warn("host key verification is disabled (--insecure)")
+		verify = ssh.InsecureIgnoreHostKey()
+	} else if verify == nil {
+		verify = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return verifyKnownHost(knownHosts, target, hostname, key)
 		}
 	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		logHostKey(knownHosts, target, hostname, key)
+		return verify(hostname, remote, key)
+	}
 }
 
-func SendFile(client *sftp.Client, localPath string, remotePath string) error {
-	localFile, err := os.ReadFile(localPath)
+// logHostKey logs the type and SHA-256 fingerprint of the host key presented for target, at info level the first time
+// the key is seen, and at debug level once it is in known_hosts
+func logHostKey(knownHosts string, target string, hostname string, key ssh.PublicKey) {
+	level := logrus.InfoLevel
+	if isKnownHost(knownHosts, hostname, key) {
+		level = logrus.DebugLevel
+	}
+	if target == "" {
+		target = hostname
+	}
+	log.Logf(level, "%s host key fingerprint for %s is %s", hostKeyType(key), target, ssh.FingerprintSHA256(key))
+}
 
+// isKnownHost reports whether key is recorded for hostname in knownHosts
+func isKnownHost(knownHosts string, hostname string, key ssh.PublicKey) bool {
+	if hostname == "" {
+		return false
+	}
+	cb, err := knownhosts.New(knownHosts)
 	if err != nil {
-		return errors.Wrapf(err, "unable to read local file %v", localFile)
+		return false
 	}
+	return cb(hostname, knownHostAddr(hostname), key) == nil
+}
 
-	rmtFile, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+// hostKeyType names the algorithm of key as ssh-keygen does, e.g. ED25519, RSA or ECDSA
+func hostKeyType(key ssh.PublicKey) string {
+	keyType := strings.TrimPrefix(key.Type(), "ssh-")
+	if strings.HasPrefix(keyType, "ecdsa-") {
+		keyType = "ecdsa"
+	}
+	return strings.ToUpper(keyType)
+}
 
-	if err != nil {
-		return errors.Wrapf(err, "unable to open remote file %v", remotePath)
+// FixedHostKey returns a callback which only accepts the host key with the given SHA-256 fingerprint, in the form
+// printed by ssh-keygen -l, e.g. SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s. The SHA256: prefix is optional.
+func FixedHostKey(fingerprint string) ssh.HostKeyCallback {
+	expected := "SHA256:" + strings.TrimPrefix(fingerprint, "SHA256:")
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		actual := ssh.FingerprintSHA256(key)
+		if actual != expected {
+			return fmt.Errorf("host key for %s does not match the pinned fingerprint: expected %s, got %s", hostname, expected, actual)
+		}
+		return nil
 	}
-	defer func() { _ = rmtFile.Close() }()
+}
 
-	_, err = rmtFile.Write(localFile)
+// sshAgentSigners returns the callback listing the keys of the ssh agent for the publickey method, or nil when the
+// agent is unreachable or holds no keys
+func sshAgentSigners() func() ([]ssh.Signer, error) {
+	sshAgent := sshAgentClient()
+	if sshAgent == nil {
+		log.Debug("no ssh agent available")
+		return nil
+	}
+	keys, err := sshAgent.List()
 	if err != nil {
-		return err
+		log.Debugf("unable to list the keys of the ssh agent: %v", err)
+		return nil
 	}
-
-	return nil
+	log.Debugf("ssh agent holds %d identities", len(keys))
+	if len(keys) == 0 {
+		return nil
+	}
+	return sshAgent.Signers
 }
 
-func RetrieveRemoteFiles(client *sftp.Client, localPath string, remotePath string) error {
+// keyStdin is where the private key is read from when the key path is STDIN_KEY_PATH. It is only read once, so the
+// jump host and target can share the key.
+var (
+	keyStdin        io.Reader = os.Stdin
+	keyStdinOnce    sync.Once
+	keyStdinContent []byte
+	keyStdinErr     error
+)
 
-	rf, err := client.Open(remotePath)
+// sshSignerFromFile reads the private key at keyPath, or from stdin when keyPath is STDIN_KEY_PATH
+func sshSignerFromFile(keyPath string) (ssh.Signer, error) {
+	if keyPath == STDIN_KEY_PATH {
+		keyStdinOnce.Do(func() { keyStdinContent, keyStdinErr = io.ReadAll(keyStdin) })
+		if keyStdinErr != nil {
+			return nil, fmt.Errorf("could not read private key from stdin: %w", keyStdinErr)
+		}
+		return sshSignerFromBytes("stdin", keyStdinContent)
+	}
+	content, err := os.ReadFile(keyPath)
 	if err != nil {
-		return fmt.Errorf("error opening remote file [%s] (%w)", remotePath, err)
+		return nil, fmt.Errorf("could not read zssh file [%s]: %w", keyPath, err)
 	}
-	defer func() { _ = rf.Close() }()
+	return sshSignerFromBytes(keyPath, content)
+}
 
-	lf, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+// sshCertSigner returns a signer presenting the certificate stored alongside the key at keyPath, as ssh-keygen
+// names it, e.g. id_rsa-cert.pub for id_rsa. nil is returned when there is no usable certificate, so the plain key
+// is used alone.
+func sshCertSigner(keyPath string, signer ssh.Signer) ssh.Signer {
+	if keyPath == STDIN_KEY_PATH {
+		return nil
+	}
+	certPath := keyPath + "-cert.pub"
+	content, err := os.ReadFile(certPath)
 	if err != nil {
-		return fmt.Errorf("error opening local file [%s] (%w)", localPath, err)
+		if !os.IsNotExist(err) {
+			log.Warnf("skipping ssh certificate: could not read [%s]: %v", certPath, err)
+		}
+		return nil
 	}
-	defer func() { _ = lf.Close() }()
-
-	_, err = io.Copy(lf, rf)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(content)
 	if err != nil {
-		return fmt.Errorf("error copying remote file to local [%s] (%w)", remotePath, err)
+		log.Warnf("skipping ssh certificate: could not parse [%s]: %v", certPath, err)
+		return nil
 	}
-	logrus.Infof("%s => %s", remotePath, localPath)
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		log.Warnf("skipping ssh certificate: [%s] is a public key, not a certificate", certPath)
+		return nil
+	}
+	if cert.CertType != ssh.UserCert {
+		log.Warnf("skipping ssh certificate: [%s] is not a user certificate", certPath)
+		return nil
+	}
+	if before := cert.ValidBefore; before != ssh.CertTimeInfinity && time.Now().After(time.Unix(int64(before), 0)) {
+		log.Warnf("skipping ssh certificate: [%s] expired at %s", certPath, time.Unix(int64(before), 0).Format(time.RFC3339))
+		return nil
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		log.Warnf("skipping ssh certificate [%s]: %v", certPath, err)
+		return nil
+	}
+	log.Debugf("using ssh certificate: %s (key id: %s)", certPath, cert.KeyId)
+	return certSigner
+}
 
-	return nil
+// sshSignerFromBytes parses the PEM encoded private key content, decrypting it when needed. source names where the
+// key came from in errors and prompts.
+func sshSignerFromBytes(source string, content []byte) (ssh.Signer, error) {
+	_, _, _, _, pubkeyErr := ssh.ParseAuthorizedKey(content)
+	if pubkeyErr == nil {
+		return nil, fmt.Errorf("the provided key [%s] for ssh authentication is a public key, but a private key is required", source)
+	}
+
+	signer, err := ssh.ParsePrivateKey(content)
+	if err == nil {
+		return signer, nil
+	}
+
+	var passphraseErr *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseErr) {
+		return parsePrivateKeyWithPassphrase(source, content)
+	} else if err.Error() == "ssh: no key found" {
+		return nil, fmt.Errorf("no private key found in [%s]: %w", source, err)
+	}
+	return nil, fmt.Errorf("error parsing private key from [%s]: %w", source, err)
 }
 
-func EstablishClient(f *SshFlags, target string, targetIdentity string) *ssh.Client {
-	ctx := NewContext(f, true)
-	Auth(ctx)
+// parsePrivateKeyWithPassphrase prompts for the passphrase of an encrypted key, allowing a few attempts. The
+// ASKPASS_ENV program is asked when set, otherwise the terminal. When stdin is not a terminal the passphrase is read
+// from the KEY_PASSPHRASE_ENV environment variable instead.
+func parsePrivateKeyWithPassphrase(keyPath string, content []byte) (ssh.Signer, error) {
+	stdInFd := int(os.Stdin.Fd())
+	prompt := fmt.Sprintf("Enter passphrase for key '%s': ", keyPath)
+	readPassphrase := func() ([]byte, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		passphrase, err := terminal.ReadPassword(stdInFd)
+		fmt.Fprintln(os.Stderr)
+		return passphrase, err
+	}
+	if askpassProgram() != "" {
+		readPassphrase = func() ([]byte, error) {
+			passphrase, err := askpass(prompt)
+			return []byte(passphrase), err
+		}
+	} else if !terminal.IsTerminal(stdInFd) {
+		passphrase, found := os.LookupEnv(KEY_PASSPHRASE_ENV)
+		if !found {
+			return nil, fmt.Errorf("file is password protected [%s] and stdin is not a terminal. set %s to provide the passphrase", keyPath, KEY_PASSPHRASE_ENV)
+		}
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(content, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt [%s] using %s: %w", keyPath, KEY_PASSPHRASE_ENV, err)
+		}
+		return signer, nil
+	}
 
-	_, ok := ctx.GetService(f.ServiceName)
-	if !ok {
-		log.Fatalf("service not found: %s", f.ServiceName)
+	for attempt := 1; attempt <= maxPassphraseAttempts; attempt++ {
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(content, passphrase)
+		if err == nil {
+			return signer, nil
+		} else if !errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("error parsing private key from [%s]: %w", keyPath, err)
+		}
+		log.Warn("incorrect passphrase")
+	}
+	return nil, fmt.Errorf("too many incorrect passphrase attempts for [%s]", keyPath)
+}
+
+// EstablishClient authenticates to ziti, dials the service for targetIdentity and performs the ssh handshake as
+// userName, see EstablishClientWithTransport.
+func EstablishClient(f *SshFlags, userName string, targetIdentity string) (*ssh.Client, error) {
+	if _, err := parseAppDataPairs(f.AppData); err != nil {
+		return nil, err
+	}
+	if err := ValidateClientVersion(f.ClientVersion); err != nil {
+		return nil, err
+	}
+	if _, err := f.Algorithms(); err != nil {
+		return nil, err
 	}
-	dialOptions := &ziti.DialOptions{
-		ConnectTimeout: 0,
-		Identity:       targetIdentity,
-		AppData:        nil,
+	transport, err := NewZitiTransport(f)
+	if err != nil {
+		return nil, err
 	}
-	svc, err := ctx.DialWithOptions(f.ServiceName, dialOptions)
+	return EstablishClientWithTransport(f, transport, userName, targetIdentity)
+}
+
+// EstablishClientWithTransport dials the service for targetIdentity over transport and performs the ssh handshake as
+// userName. targetIdentity may be a name listed in --hosts-file, see ResolveTarget, or with --gateway the host:port
+// behind the service, see ParseGatewayTarget. An empty userName falls back to
+// the configured username, then the current OS user. When --jump is set, the jump host is dialed instead and
+// targetIdentity is reached through it, see JumpThrough.
+func EstablishClientWithTransport(f *SshFlags, transport Transport, userName string, targetIdentity string) (*ssh.Client, error) {
+	if f.Jump != "" {
+		jumpFlags := *f
+		jumpFlags.Jump = ""
+		jumpHost := ParseTargetIdentity(f.Jump)
+		jump, err := EstablishClientWithTransport(&jumpFlags, transport, ParseUserName(f.Jump, false), jumpHost)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to jump host %s: %w", jumpHost, err)
+		}
+		return JumpThrough(f, jump, userName, targetIdentity)
+	}
+
+	targetIdentity, err := f.ResolveTarget(targetIdentity)
 	if err != nil {
-		log.Fatalf("error when dialing service name %s. %v", f.ServiceName, err)
+		return nil, err
 	}
-	username := ParseUserName(target, false)
-	if username == "" {
+	service, err := transport.Service(f.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	svcCfg, err := LookupServiceConfig(service)
+	if err != nil {
+		log.Warnf("ignoring config of service %s: %v", f.ServiceName, err)
+	} else if svcCfg != nil {
+		log.Debugf("service %s is configured for %s:%s:%d", f.ServiceName, svcCfg.Protocol, svcCfg.Hostname, svcCfg.Port)
+	}
+	dialOptions, err := f.dialOptions(svcCfg, targetIdentity)
+	if err != nil {
+		return nil, err
+	}
+	var svc net.Conn
+	err = withRetries(f.Retries, "dialing "+targetIdentity, func() (err error) {
+		svc, err = transport.Dial(f.ServiceName, dialOptions)
+		return err
+	})
+	if err != nil {
+		if isTimeout(err) {
+			return nil, fmt.Errorf("timed out connecting to %s after %v: %w", targetIdentity, f.Timeout, err)
+		}
+		if !f.Gateway && looksLikeHostPort(targetIdentity) {
+			return nil, fmt.Errorf("error when dialing service name %s: %w. to reach %s behind a gateway service, use --gateway", f.ServiceName, err, targetIdentity)
+		}
+		return nil, fmt.Errorf("error when dialing service name %s: %w", f.ServiceName, err)
+	}
+	return EstablishClientWithConn(f, svc, userName, targetIdentity)
+}
+
+// JumpThrough opens a tcp connection from the jump client to port 22 of target and performs the ssh handshake over
+// it, like ssh's ProxyJump. The jump client is closed along with the returned client.
+func JumpThrough(f *SshFlags, jump *ssh.Client, userName string, target string) (*ssh.Client, error) {
+	conn, err := jump.Dial("tcp", net.JoinHostPort(target, "22"))
+	if err != nil {
+		_ = jump.Close()
+		return nil, fmt.Errorf("jump host was unable to connect to %s: %w", target, err)
+	}
+	client, err := EstablishClientWithConn(f, conn, userName, target)
+	if err != nil {
+		_ = jump.Close()
+		return nil, err
+	}
+	go func() {
+		_ = client.Wait()
+		_ = jump.Close()
+	}()
+	return client, nil
+}
+
+// EstablishClientWithConn performs the ssh handshake with target as userName over an already established conn, which
+// is closed if the handshake fails. An empty userName falls back to the configured username, then the current OS
+// user.
+func EstablishClientWithConn(f *SshFlags, conn net.Conn, userName string, target string) (*ssh.Client, error) {
+	if userName == "" {
 		if f.Username == "" {
-			username = ParseUserName(target, true)
+			userName = ParseUserName("", true)
 		} else {
-			username = f.Username
+			userName = f.Username
 		}
 	}
-	factory := NewSshConfigFactoryImpl(username, f.SshKeyPath)
+	if err := ValidateClientVersion(f.ClientVersion); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	algorithms, err := f.Algorithms()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	factory := NewSshConfigFactoryImpl(userName, f.SshKeyPaths, WithHost(target), WithInsecure(f.Insecure), WithNoAgent(f.NoAgent),
+		WithQuiet(f.Quiet), WithTrace(f.Trace), WithClientVersion(f.ClientVersion), WithAlgorithms(algorithms))
 	config := factory.Config()
-	sshConn, err := Dial(config, svc)
+	config.Timeout = f.Timeout
+	if f.Trace {
+		conn = newTraceConn(conn)
+		log.Tracef("authenticating to %s as %s", target, userName)
+	}
+	sshConn, err := Dial(config, target, conn)
+	if err != nil {
+		_ = conn.Close()
+		if f.Trace {
+			log.Tracef("ssh handshake with %s failed: %v", target, err)
+		}
+		if isTimeout(err) {
+			return nil, fmt.Errorf("timed out connecting to %s after %v: %w", target, f.Timeout, err)
+		}
+		return nil, fmt.Errorf("error dialing SSH Conn: %w", err)
+	}
+	log.Debugf("connected to %s as %s, client version %s, server version %s", target, sshConn.User(),
+		sshConn.ClientVersion(), sshConn.ServerVersion())
+	if f.Trace {
+		log.Tracef("authenticated to %s as %s, session id %x", target, sshConn.User(), sshConn.SessionID())
+	}
+	StartKeepalive(sshConn, f.KeepAlive, f.KeepAliveMax)
+	return sshConn, nil
+}
+
+// serviceNotFound describes a service missing from the identity's services, listing those which are available
+func serviceNotFound(ctx ziti.Context, serviceName string) error {
+	services, err := ctx.GetServices()
 	if err != nil {
-		log.Fatalf("error dialing SSH Conn: %v", err)
+		return fmt.Errorf("service not found: %s. use -s/--service to specify the service to dial", serviceName)
 	}
-	return sshConn
+	var names []string
+	for _, svc := range services {
+		if svc.Name != nil {
+			names = append(names, *svc.Name)
+		}
+	}
+	sort.Strings(names)
+	return fmt.Errorf("service not found: %s. use -s/--service to specify the service to dial. services available to this identity: [%s]", serviceName, strings.Join(names, ", "))
 }
 
-func getConfig(cfgFile string) (zitiCfg *ziti.Config) {
+// getConfig loads the ziti identity file cfgFile, explaining how to obtain one when it doesn't exist
+func getConfig(cfgFile string) (*ziti.Config, error) {
+	if _, err := os.Stat(cfgFile); os.IsNotExist(err) {
+		return nil, fmt.Errorf("ziti config not found at %s, run 'ziti edge enroll' or pass -c", cfgFile)
+	}
 	zitiCfg, err := ziti.NewConfigFromFile(cfgFile)
 	if err != nil {
-		log.Fatalf("failed to load ziti configuration file: %v", err)
+		return nil, fmt.Errorf("failed to load ziti configuration file: %w", err)
 	}
-	return zitiCfg
+	return zitiCfg, nil
 }
 
-// AppendBaseName tags file name on back of remotePath if the path is blank or a directory/*
-func AppendBaseName(c *sftp.Client, remotePath string, localPath string, debug bool) string {
-	localPath = filepath.Base(localPath)
-	if remotePath == "" {
-		remotePath = filepath.Base(localPath)
-	} else {
-		info, err := c.Lstat(remotePath)
-		if err == nil && info.IsDir() {
-			remotePath = filepath.Join(remotePath, localPath)
-		} else if debug {
-			log.Infof("Remote File/Directory: %s doesn't exist [%v]", remotePath, err)
+// zitiConfigFile is a ziti identity file loaded by getConfigs
+type zitiConfigFile struct {
+	Path   string
+	Config *ziti.Config
+}
+
+// getConfigs loads the ziti identity files at paths, and the .json files in any directories among them, keyed by
+// network name: the file name without .json. More than one file for a name makes the name ambiguous. Files found in
+// a directory which aren't identity files are skipped, while a named file must load.
+func getConfigs(paths []string) (map[string][]*zitiConfigFile, error) {
+	configs := map[string][]*zitiConfigFile{}
+	add := func(cfgFile string) error {
+		cfg, err := getConfig(cfgFile)
+		if err != nil {
+			return err
 		}
+		name := strings.TrimSuffix(filepath.Base(cfgFile), ".json")
+		configs[name] = append(configs[name], &zitiConfigFile{Path: cfgFile, Config: cfg})
+		return nil
 	}
-	return remotePath
+	for _, p := range paths {
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			if err := add(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(p, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, cfgFile := range files {
+			if err := add(cfgFile); err != nil {
+				log.Warnf("skipping %s: %v", cfgFile, err)
+			}
+		}
+	}
+	return configs, nil
 }
 
-// processOutput processes the stdout and stderr streams concurrently
-func processOutput(stdout io.Reader, stderr io.Reader) {
-	var wg sync.WaitGroup
-	wg.Add(2)
+// selectConfig loads the ziti identity files at paths with getConfigs and returns the one for network. network may
+// be empty when only one file is found.
+func selectConfig(paths []string, network string) (*zitiConfigFile, error) {
+	configs, err := getConfigs(paths)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	// Goroutine to process stdout
-	go func() {
-		defer wg.Done()
-		if _, err := io.Copy(os.Stdout, stdout); err != nil {
-			log.Fatalf("Error copying stdout: %v", err)
+	if network == "" {
+		if len(configs) == 1 && len(configs[names[0]]) == 1 {
+			return configs[names[0]][0], nil
+		} else if len(configs) == 0 {
+			return nil, fmt.Errorf("no ziti configs found in %s", strings.Join(paths, ", "))
 		}
-	}()
+		return nil, fmt.Errorf("multiple ziti configs found, choose one with --network: [%s]", strings.Join(names, ", "))
+	}
+	found := configs[network]
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no ziti config for network %s. networks found: [%s]", network, strings.Join(names, ", "))
+	case 1:
+		return found[0], nil
+	default:
+		var files []string
+		for _, f := range found {
+			files = append(files, f.Path)
+		}
+		return nil, fmt.Errorf("network %s is ambiguous, it names each of: %s", network, strings.Join(files, ", "))
+	}
+}
 
-	// Goroutine to process stderr
-	go func() {
-		defer wg.Done()
-		if _, err := io.Copy(os.Stderr, stderr); err != nil {
-			log.Fatalf("Error copying stderr: %v", err)
+// AppendBaseName returns the remote path a local file is copied to. The file's base name is appended when remotePath
+// is blank, ends with / (a directory, whether or not it exists yet) or is an existing directory; otherwise remotePath
+// names the file itself.
+func AppendBaseName(c *sftp.Client, remotePath string, localPath string, debug bool) string {
+	baseName := filepath.Base(localPath)
+	if remotePath == "" {
+		return baseName
+	}
+	if strings.HasSuffix(remotePath, "/") {
+		return path.Join(remotePath, baseName)
+	}
+	info, err := c.Stat(remotePath)
+	if err == nil && info.IsDir() {
+		return path.Join(remotePath, baseName)
+	}
+	if debug && err != nil {
+		log.Infof("Remote File/Directory: %s doesn't exist [%v]", remotePath, err)
+	}
+	return remotePath
+}
+
+// AppendLocalBaseName returns the local path a remote file is retrieved to, the download analogue of
+// AppendBaseName. The remote file's base name is appended when localPath ends with a path separator or is an existing
+// directory; otherwise localPath names the file itself. The directory the file is written to must already exist.
+func AppendLocalBaseName(localPath string, remotePath string) (string, error) {
+	baseName := path.Base(strings.ReplaceAll(remotePath, `\`, "/"))
+	if hasTrailingSeparator(localPath) {
+		if info, err := os.Stat(localPath); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("local directory [%s] does not exist", localPath)
 		}
-	}()
+		return filepath.Join(localPath, baseName), nil
+	}
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		return filepath.Join(localPath, baseName), nil
+	}
+	if dir := filepath.Dir(localPath); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("local directory [%s] does not exist", dir)
+		}
+	}
+	return localPath, nil
+}
 
-	// Wait for both goroutines to finish
-	wg.Wait()
+// hasTrailingSeparator reports whether p ends with a path separator, naming a directory
+func hasTrailingSeparator(p string) bool {
+	return strings.HasSuffix(p, "/") || strings.HasSuffix(p, string(filepath.Separator))
 }
 
-type zitiEdgeConnAdapter struct {
-	orig net.Addr
+// knownHostsAddress is the address host keys of target are recorded under in known_hosts, target on port 22, which
+// known_hosts writes as the bare name like ssh does. Each target identity gets its own entry however the edge routers
+// route to it. Characters with a meaning in known_hosts, such as the whitespace some identity names contain, are
+// replaced by _.
+func knownHostsAddress(target string) string {
+	if target == "" {
+		return ""
+	}
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || strings.ContainsRune(",*?![]#|@", r) {
+			return '_'
+		}
+		return r
+	}, target)
+	return net.JoinHostPort(name, "22")
 }
 
-func (a zitiEdgeConnAdapter) Network() string {
-	return ""
+// knownHostAddr is a host:port as a net.Addr. knownhosts requires the remote address to be a host:port even when
+// given the hostname to check, which a ziti connection's address isn't.
+type knownHostAddr string
+
+func (a knownHostAddr) Network() string {
+	return "tcp"
 }
-func (a zitiEdgeConnAdapter) String() string {
-	// ziti connections will have the format: "ziti-edge-router connId=%v, logical=%v", e.MsgCh.Id(), e.MsgCh.LogicalName()
-	// see ziti/edge/addr.go in github.com/openziti/sdk-golang if it changes
-	// example: ziti-edge-router connId=1, logical=ziti-sdk[router=tls:ec2-3-18-113-172.us-east-2.compute.amazonaws.com:8442]
-	parts := strings.Split(a.orig.String(), ":")
-	answer := strings.Join(parts[len(parts)-2:], ":")
-	answer = strings.ReplaceAll(answer, "]", "")
-	return answer
+
+func (a knownHostAddr) String() string {
+	return string(a)
 }
 
 func keyToString(k ssh.PublicKey) string {
 	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal())
 }
 
-func hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+// knownHostsMu serializes host key checks, so connections made concurrently, e.g. with --targets, prompt for unknown
+// keys one at a time and don't race to update known_hosts
+var knownHostsMu sync.Mutex
+
+// verifyKnownHost checks key against the entry for hostname, the knownHostsAddress of target, in knownHosts,
+// prompting to trust and record the key when there is none
+func verifyKnownHost(knownHosts string, target string, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
 	var keyErr *knownhosts.KeyError
-	remoteCopy := zitiEdgeConnAdapter{
-		orig: remote,
+	if hostname == "" {
+		return fmt.Errorf("no host name to verify the host key of %s against", target)
 	}
+	remote := knownHostAddr(hostname)
 
-	if err := ensureKnownHosts(); err != nil {
+	if err := ensureKnownHosts(knownHosts); err != nil {
 		return err
 	}
 
-	knownHosts := knownHostsFile()
-
 	cb, err := knownhosts.New(knownHosts)
 	if err != nil {
 		return err
 	}
 
-	err = cb(hostname, remoteCopy, key)
+	err = cb(hostname, remote, key)
 	if err != nil {
-		if err.Error() == "knownhosts: key is unknown" {
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
 			log.Warnf("key is not known: %s", keyToString(key))
 			time.Sleep(50 * time.Millisecond)
-			fmt.Print("do you want to add this key to your known_hosts file? (N/y): ")
+			fmt.Fprint(os.Stderr, "do you want to add this key to your known_hosts file? (N/y): ")
 
 			reader := bufio.NewReader(os.Stdin)
 			answer, readerr := reader.ReadString('\n')
 			if readerr != nil {
-				log.Fatalf("error reading line: %v", readerr)
+				return fmt.Errorf("error reading line: %w", readerr)
 			}
 
-			if strings.ToLower(answer)[:1] == "y" {
-				adderr := addKnownHostUnhashed(remoteCopy.String(), key)
-				if adderr != nil {
-					log.Fatalf("error adding key to known_hosts: %v", adderr)
-				}
-				log.Infof("added key to known_hosts: %s", keyToString(key))
-
-				cb, err = knownhosts.New(knownHosts)
-				if err != nil {
-					return err
-				}
-				err = cb(hostname, remoteCopy, key)
-			} else {
-				os.Exit(1)
+			if !strings.HasPrefix(strings.ToLower(answer), "y") {
+				return fmt.Errorf("host key for %s was not accepted", target)
+			}
+			adderr := addKnownHostUnhashed(knownHosts, hostname, key)
+			if adderr != nil {
+				return fmt.Errorf("error adding key to known_hosts: %w", adderr)
+			}
+			log.Infof("added key to known_hosts: %s", keyToString(key))
+
+			cb, err = knownhosts.New(knownHosts)
+			if err != nil {
+				return err
 			}
+			err = cb(hostname, remote, key)
 		}
 	}
 
 	// Make sure that the error returned from the callback is host not in file error.
 	// If keyErr.Want is greater than 0 length, that means host is in file with different key.
 	if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
-		return keyErr
+		return fmt.Errorf("host key mismatch for %s, the key presented does not match %s:%d. "+
+			"the target may have been replaced or spoofed: %w", target, keyErr.Want[0].Filename, keyErr.Want[0].Line, keyErr)
 	}
 
 	if err != nil {
@@ -456,8 +1327,7 @@ func hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error
 	return nil
 }
 
-func ensureKnownHosts() error {
-	filePath := knownHostsFile()
+func ensureKnownHosts(filePath string) error {
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
 		// Create the directories if they don't exist
@@ -488,8 +1358,7 @@ func knownHostsFile() string {
 }
 
 // couldn't get the openssh hashing to work yet. unhashed works and it's good enoguh for now.
-func addKnownHostUnhashed(hostname string, key ssh.PublicKey) error {
-	knownHosts := knownHostsFile()
+func addKnownHostUnhashed(knownHosts string, hostname string, key ssh.PublicKey) error {
 	f, err := os.OpenFile(knownHosts, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 	if err != nil {
 		return err
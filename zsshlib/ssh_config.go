@@ -0,0 +1,113 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// SshConfigFile returns the path of the OpenSSH client config read for per-host settings
+func SshConfigFile() string {
+	return filepath.Join(os.Getenv("HOME"), SSH_DIR, "config")
+}
+
+// SshConfigHost holds the settings honored from the Host block(s) of an OpenSSH client config matching an alias:
+//
+//	HostName      the ziti identity to connect to
+//	User          the remote username
+//	IdentityFile  the private key to authenticate with. A leading ~ is expanded to $HOME
+//	ZitiService   the ziti service to dial. OpenSSH rejects unknown keywords, so also add: IgnoreUnknown ZitiService
+//
+// All other keywords, and Match blocks, are ignored.
+type SshConfigHost struct {
+	HostName     string
+	User         string
+	IdentityFile string
+	Service      string
+}
+
+// LoadSshConfigHost reads the settings for alias from the OpenSSH client config at path. A missing file is not an
+// error and results in empty settings.
+func LoadSshConfigHost(path string, alias string) (host *SshConfigHost, err error) {
+	host = &SshConfigHost{}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return host, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	cfg, err := ssh_config.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ssh config [%s]: %w", path, err)
+	}
+
+	// ssh_config panics rather than erroring when it reaches a Match directive
+	defer func() {
+		if r := recover(); r != nil {
+			host, err = nil, fmt.Errorf("unable to read ssh config [%s]: %v", path, r)
+		}
+	}()
+	get := func(key string) string {
+		val, _ := cfg.Get(alias, key)
+		return val
+	}
+	host.HostName = get("HostName")
+	host.User = get("User")
+	host.IdentityFile = expandHome(get("IdentityFile"))
+	host.Service = get("ZitiService")
+	return host, nil
+}
+
+// ApplySshConfig fills in the settings of f not given explicitly from the ~/.ssh/config Host block matching alias,
+// returning the ziti identity alias refers to. Settings from ~/.ssh/config take precedence over config.yaml and the
+// built-in defaults.
+func ApplySshConfig(f *SshFlags, alias string) string {
+	host, err := LoadSshConfigHost(SshConfigFile(), alias)
+	if err != nil {
+		log.Warnf("ignoring ssh config: %v", err)
+		return alias
+	}
+	if len(f.SshKeyPaths) == 0 && host.IdentityFile != "" {
+		f.SshKeyPaths = []string{host.IdentityFile}
+	}
+	if f.Username == "" {
+		f.Username = host.User
+	}
+	if f.ServiceName == "" {
+		f.ServiceName = host.Service
+	}
+	if host.HostName != "" {
+		log.Debugf("ssh config resolved %s to identity %s", alias, host.HostName)
+		return host.HostName
+	}
+	return alias
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[1:])
+	}
+	return path
+}
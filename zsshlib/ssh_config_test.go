@@ -0,0 +1,66 @@
+package zsshlib
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSshConfigHost(t *testing.T) {
+	t.Setenv("HOME", "/home/test")
+	path := filepath.Join(t.TempDir(), "config")
+	config := `
+IgnoreUnknown ZitiService
+
+Host prod
+    HostName prod-server-identity
+    User deploy
+    IdentityFile ~/.ssh/prod_ed25519
+    ZitiService prod-ssh
+
+Host *
+    User fallback
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := LoadSshConfigHost(path, "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, &SshConfigHost{
+		HostName:     "prod-server-identity",
+		User:         "deploy",
+		IdentityFile: "/home/test/.ssh/prod_ed25519",
+		Service:      "prod-ssh",
+	}, host)
+
+	host, err = LoadSshConfigHost(path, "other")
+	assert.NoError(t, err)
+	assert.Equal(t, &SshConfigHost{User: "fallback"}, host)
+
+	host, err = LoadSshConfigHost(filepath.Join(t.TempDir(), "missing"), "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, &SshConfigHost{}, host)
+}
+
+func TestApplySshConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.MkdirAll(filepath.Join(home, SSH_DIR), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := "Host prod\n  HostName prod-server-identity\n  User deploy\n  IdentityFile ~/.ssh/prod_key\n"
+	if err := os.WriteFile(SshConfigFile(), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &SshFlags{SshKeyPaths: []string{"/explicit/key"}}
+	assert.Equal(t, "prod-server-identity", ApplySshConfig(f, "prod"))
+	assert.Equal(t, []string{"/explicit/key"}, f.SshKeyPaths, "explicit flags take precedence over ssh config")
+	assert.Equal(t, "deploy", f.Username)
+
+	f = &SshFlags{}
+	assert.Equal(t, "unknown", ApplySshConfig(f, "unknown"))
+	assert.Equal(t, "", f.Username)
+}
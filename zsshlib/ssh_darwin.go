@@ -19,13 +19,41 @@ package zsshlib
 import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
-func sshAuthMethodAgent() ssh.AuthMethod {
-	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+// sshAgentClient connects to the agent listening on $SSH_AUTH_SOCK, returning nil when none is available
+func sshAgentClient() agent.ExtendedAgent {
+	if conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
+		return agent.NewClient(conn)
 	}
 	return nil
 }
+
+// watchWindowSize propagates local terminal resizes (SIGWINCH) to the remote pty until done is closed
+func watchWindowSize(session *ssh.Session, fd int, done <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				width, height, err := terminal.GetSize(fd)
+				if err != nil {
+					log.Debugf("unable to read terminal size: %v", err)
+					continue
+				}
+				if err := session.WindowChange(height, width); err != nil {
+					log.Debugf("unable to update remote window size: %v", err)
+				}
+			}
+		}
+	}()
+}
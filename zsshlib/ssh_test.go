@@ -1,34 +1,1234 @@
 package zsshlib
 
 import (
-	"github.com/pkg/sftp"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/zitadel/oidc/v2/pkg/client/rp/cli"
+	"github.com/zitadel/oidc/v2/pkg/oidc"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/oauth2"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// newTestSshServer starts an in-process ssh server on a loopback listener, handing each channel the client opens to
+// handleChannel, and returns the address it listens on
+func newTestSshServer(t *testing.T, handleChannel func(conn *ssh.ServerConn, newChannel ssh.NewChannel)) string {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	// both sides write their version first, so the connection must be buffered unlike net.Pipe
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			serverSide, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					handleChannel(conn, newChannel)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newTestSshClient returns a client connected to an in-process ssh server, which hands each session channel and its
+// requests to handleSession
+func newTestSshClient(t *testing.T, handleSession func(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request)) *ssh.Client {
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			return
+		}
+		ch, chReqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go handleSession(conn, ch, chReqs)
+	})
+
+	clientSide, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(&ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}, "target", clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// sendExitStatus reports status to the client and closes the session channel
+func sendExitStatus(ch ssh.Channel, status uint32) {
+	_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	_ = ch.Close()
+}
+
 func TestAppendBaseName(t *testing.T) {
-	conn, _ := net.Dial("tcp", "localhost:3838")
-	userHome, _ := os.UserHomeDir()
-	factory := NewSshConfigFactoryImpl(getOsUser(), filepath.Join(userHome, SSH_DIR, ID_RSA))
-	factory.port = 3838
+	client := newTestSftpClient(t)
+	dir := t.TempDir()
+	existingFile := filepath.Join(dir, "existing.txt")
+	if err := os.WriteFile(existingFile, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join("some", "local", "message.txt")
+
+	assert.Equal(t, "message.txt", AppendBaseName(client, "", local, false), "empty remote should use the base name")
+	assert.Equal(t, existingFile, AppendBaseName(client, existingFile, local, false), "existing file remote should be used as is")
+	assert.Equal(t, filepath.Join(dir, "new.txt"), AppendBaseName(client, filepath.Join(dir, "new.txt"), local, false), "missing remote should name the file")
+	assert.Equal(t, filepath.ToSlash(dir)+"/message.txt", AppendBaseName(client, dir, local, false), "existing directory remote should get the base name")
+	assert.Equal(t, filepath.ToSlash(dir)+"/missing/message.txt", AppendBaseName(client, dir+"/missing/", local, false), "trailing slash remote is a directory even if it doesn't exist")
+	assert.Equal(t, "/message.txt", AppendBaseName(client, "/", local, false))
+}
+
+func TestAppendLocalBaseName(t *testing.T) {
+	dir := t.TempDir()
+	remote := "/some/remote/message.txt"
+
+	local, err := AppendLocalBaseName(dir, remote)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "message.txt"), local, "existing directory should get the remote base name")
+
+	local, err = AppendLocalBaseName(dir+string(filepath.Separator), remote)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "message.txt"), local, "trailing separator should get the remote base name")
+
+	local, err = AppendLocalBaseName(filepath.Join(dir, "renamed.txt"), remote)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "renamed.txt"), local, "missing file should name the file")
+
+	existingFile := filepath.Join(dir, "existing.txt")
+	if err := os.WriteFile(existingFile, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	local, err = AppendLocalBaseName(existingFile, remote)
+	assert.NoError(t, err)
+	assert.Equal(t, existingFile, local, "existing file should be used as is")
+
+	missing := filepath.Join(dir, "missing")
+	_, err = AppendLocalBaseName(missing+"/", remote)
+	assert.ErrorContains(t, err, "local directory ["+missing+"/] does not exist")
+	_, err = AppendLocalBaseName(filepath.Join(missing, "message.txt"), remote)
+	assert.ErrorContains(t, err, "local directory ["+missing+"] does not exist")
+}
+
+func TestRetrieveToLocalDir(t *testing.T) {
+	remoteDir, localDir := t.TempDir(), t.TempDir()
+	remotePath := filepath.Join(remoteDir, "message.txt")
+	if err := os.WriteFile(remotePath, []byte("retrieved"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+
+	for name, tc := range map[string]struct{ local, expected string }{
+		"file to dir":  {localDir, filepath.Join(localDir, "message.txt")},
+		"file to file": {filepath.Join(localDir, "renamed.txt"), filepath.Join(localDir, "renamed.txt")},
+	} {
+		local, err := AppendLocalBaseName(tc.local, filepath.ToSlash(remotePath))
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, local, filepath.ToSlash(remotePath), nil), name)
+		content, err := os.ReadFile(tc.expected)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "retrieved", string(content), name)
+	}
+}
+
+func TestTerminalGuard(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close(); _ = w.Close() }()
+
+	// a pipe isn't a terminal, so restoring it fails quietly
+	signalled := make(chan struct{})
+	guard := guardTerminal(int(r.Fd()), &terminal.State{}, func() { close(signalled) })
+	guard.sigs <- os.Interrupt
+	select {
+	case <-signalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a signal should restore the terminal and close the session")
+	}
+	assert.Equal(t, os.Interrupt, guard.Signal())
+	guard.Restore()
+
+	guard = guardTerminal(int(r.Fd()), &terminal.State{}, func() { t.Error("no signal was received") })
+	guard.Restore()
+	guard.Restore()
+	assert.Nil(t, guard.Signal())
+}
+
+func TestDialTimeout(t *testing.T) {
+	conn, unresponsive := net.Pipe()
+	defer func() { _ = unresponsive.Close() }()
+
+	config := &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         100 * time.Millisecond,
+	}
+	_, err := Dial(config, "target", conn)
+	assert.Error(t, err)
+	assert.True(t, isTimeout(err), "expected a timeout error, got: %v", err)
+}
+
+func TestValidateAndSetDefaults(t *testing.T) {
+	cfg := &OIDCConfig{}
+	assert.Error(t, cfg.validateAndSetDefaults(), "ClientID should be required")
+
+	cfg.ClientID = "openziti-client"
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Equal(t, strings.Split(DefaultAuthScopes, " "), cfg.Scopes, "default scopes not set")
+	assert.Len(t, cfg.HashKey, 32)
+	assert.Len(t, cfg.BlockKey, 32)
+
+	hashKey := []byte("stable-hash-key-stable-hash-key!")
+	blockKey := []byte("stable-block-key-stable-block-k!")
+	cfg = &OIDCConfig{
+		HashKey:  hashKey,
+		BlockKey: blockKey,
+	}
+	cfg.ClientID = "openziti-client"
+	cfg.Scopes = []string{"openid", "groups"}
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Equal(t, []string{"openid", "groups"}, cfg.Scopes, "provided scopes were overwritten")
+	assert.Equal(t, hashKey, cfg.HashKey, "provided HashKey was overwritten")
+	assert.Equal(t, blockKey, cfg.BlockKey, "provided BlockKey was overwritten")
+}
+
+func TestOfflineAccess(t *testing.T) {
+	cfg := &OIDCConfig{OfflineAccess: true}
+	cfg.ClientID = "openziti-client"
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Equal(t, []string{"openid", "profile", "email", "offline_access"}, cfg.Scopes)
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Len(t, cfg.Scopes, 4, "offline_access should only be requested once")
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	tokens := newTokens(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: expiry}, "id")
+	assert.Equal(t, &Tokens{IDToken: "id", AccessToken: "access", RefreshToken: "refresh", Expiry: expiry}, tokens)
+
+	content, err := json.Marshal(&tokenCache{Issuer: "https://issuer", ClientID: "openziti-client", Tokens: *tokens})
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `"refresh_token":"refresh"`, "the cache file layout should be unchanged")
+	cache := &tokenCache{}
+	assert.NoError(t, json.Unmarshal(content, cache))
+	assert.Equal(t, *tokens, cache.Tokens)
+}
+
+func TestUserFromClaim(t *testing.T) {
+	idToken := func(claims string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+	}
+	tokens := &Tokens{AccessToken: "access", IDToken: idToken(`{"preferred_username":"alice","email":"alice.smith@example.com","groups":["ops"]}`)}
+	claims, err := tokens.Claims()
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", claims["preferred_username"])
+
+	user, err := tokens.UserFromClaim("preferred_username")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user)
+	user, err = tokens.UserFromClaim("email")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice.smith", user, "email addresses should be reduced to their local part")
+	_, err = tokens.UserFromClaim("upn")
+	assert.ErrorContains(t, err, "the ID token has no upn claim")
+	_, err = tokens.UserFromClaim("groups")
+	assert.ErrorContains(t, err, "is not a username")
+	_, err = (&Tokens{AccessToken: "access"}).Claims()
+	assert.ErrorContains(t, err, "issued no ID token")
+
+	flags := &SshFlags{Username: "configured"}
+	access, err := flags.useTokens(tokens)
+	assert.NoError(t, err)
+	assert.Equal(t, "access", access)
+	assert.Equal(t, "configured", flags.Username, "the username should only be taken from the token when requested")
+
+	flags.OIDC.UserFromCert = true
+	_, err = flags.useTokens(tokens)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", flags.Username, "the default claim should be preferred_username")
+
+	flags.OIDC.UserClaim = "upn"
+	_, err = flags.useTokens(tokens)
+	assert.Error(t, err)
+
+	_, err = NewContext(&SshFlags{OIDC: OIDCFlags{UserFromCert: true}}, false)
+	assert.ErrorContains(t, err, "--user-from-cert requires --oidc")
+}
+
+func TestOIDCAuthTimeout(t *testing.T) {
+	cfg := &OIDCConfig{CallbackHost: "127.0.0.1", CallbackPath: "/auth/callback"}
+	cfg.ClientID = "openziti-client"
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Equal(t, DefaultAuthTimeout, cfg.AuthTimeout)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := GetTokens(cancelled, cfg)
+	assert.ErrorContains(t, err, "OIDC authentication cancelled")
+
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+	assert.ErrorContains(t, authContextError(expired, cfg), "OIDC authentication timed out after 2m0s")
+
+	opened := make(chan string, 1)
+	openBrowser = func(url string) { opened <- url }
+	defer func() { openBrowser = cli.OpenBrowser }()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cfg.CallbackPort, _ = net.SplitHostPort(free.Addr().String())
+	_ = free.Close()
+	_, err = zsshCodeFlow[*oidc.IDTokenClaims](cancelled, nil, cfg)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "http://127.0.0.1:"+cfg.CallbackPort+"/login", <-opened)
+	listener, err := listenCallback(cfg)
+	assert.NoError(t, err, "the callback port should be freed once the flow is cancelled")
+	if listener != nil {
+		_ = listener.Close()
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	cfg := &OIDCConfig{CallbackPort: "63275", CallbackPath: "/auth/callback"}
+	cfg.ClientID = "openziti-client"
+	assert.NoError(t, cfg.validateAndSetDefaults())
+	assert.Equal(t, DefaultCallbackHost, cfg.CallbackHost)
+	assert.Equal(t, "http://localhost:63275/auth/callback", cfg.RedirectURL, "the redirect URI registered with providers shouldn't change")
+	assert.Equal(t, "http://[::1]:63275/auth/callback", callbackURL("::1", "63275", "/auth/callback"))
+
+	cfg = &OIDCConfig{CallbackHost: "127.0.0.1", CallbackPort: "63275"}
+	cfg.ClientID = "openziti-client"
+	cfg.RedirectURL = "http://localhost:1234/auth/callback"
+	assert.ErrorContains(t, cfg.validateAndSetDefaults(), "does not match the callback")
+	cfg.AuthFlow = AuthFlowDevice
+	assert.NoError(t, cfg.validateAndSetDefaults(), "the device flow has no callback")
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = taken.Close() }()
+	_, port, _ := net.SplitHostPort(taken.Addr().String())
+	_, err = listenCallback(&OIDCConfig{CallbackHost: "127.0.0.1", CallbackPort: port})
+	assert.ErrorContains(t, err, "already in use")
+
+	cfg = &OIDCConfig{}
+	cfg.RedirectURL = "http://127.0.0.1:63275/auth/callback"
+	cfg.ClientID = "openziti-client"
+	assert.ErrorContains(t, callbackError(cfg, "invalid_request", "redirect_uri mismatch"), "ensure http://127.0.0.1:63275/auth/callback is registered")
+	assert.NotContains(t, callbackError(cfg, "access_denied", "user cancelled").Error(), "redirect URI")
+}
+
+// newTestAgent serves an agent holding the given number of generated keys on a unix socket, pointing SSH_AUTH_SOCK
+// at it
+func newTestAgent(t *testing.T, keys int) []ssh.PublicKey {
+	keyring := agent.NewKeyring()
+	var publicKeys []ssh.PublicKey
+	for i := 0; i < keys; i++ {
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+		publicKey, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = agent.ServeAgent(keyring, conn) }()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	return publicKeys
+}
+
+func TestForwardAgent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("agent forwarding test requires a unix socket agent")
+	}
+
+	newTestAgent(t, 1)
+
+	// the server lists the keys of the forwarded agent when asked to exec, failing if forwarding wasn't requested
+	client := newTestSshClient(t, func(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+		forwarding := false
+		for req := range reqs {
+			switch req.Type {
+			case "auth-agent-req@openssh.com":
+				forwarding = true
+				_ = req.Reply(true, nil)
+			case "exec":
+				_ = req.Reply(true, nil)
+				if !forwarding {
+					sendExitStatus(ch, 1)
+					return
+				}
+				agentCh, agentReqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+				if err != nil {
+					sendExitStatus(ch, 2)
+					return
+				}
+				go ssh.DiscardRequests(agentReqs)
+				keys, err := agent.NewClient(agentCh).List()
+				_ = agentCh.Close()
+				if err != nil {
+					sendExitStatus(ch, 3)
+					return
+				}
+				_, _ = fmt.Fprintf(ch, "%d keys", len(keys))
+				sendExitStatus(ch, 0)
+				return
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	})
+
+	assert.NoError(t, ForwardAgent(client))
+
+	code, err := RunCommand(context.Background(), client, "ssh-add -l", nil, &bytes.Buffer{}, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, code, "agent forwarding should only be requested when asked for")
+
+	stdout := &bytes.Buffer{}
+	code, err = RunCommand(context.Background(), client, "ssh-add -l", nil, stdout, &bytes.Buffer{}, WithAgentForwarding())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1 keys", stdout.String())
+}
+
+func TestGetConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := getConfig(filepath.Join(dir, "missing.json"))
+	assert.ErrorContains(t, err, "ziti config not found at "+filepath.Join(dir, "missing.json"))
+
+	malformed := filepath.Join(dir, "malformed.json")
+	if err := os.WriteFile(malformed, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = getConfig(malformed)
+	assert.ErrorContains(t, err, "failed to load ziti configuration file")
+
+	valid := filepath.Join(dir, "valid.json")
+	if err := os.WriteFile(valid, []byte(`{"ztAPI": "https://controller:1280/edge/client/v1"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := getConfig(valid)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://controller:1280/edge/client/v1", cfg.ZtAPI)
+}
+
+func TestSelectConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(name string, ztAPI string) string {
+		cfgFile := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(cfgFile), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cfgFile, []byte(`{"ztAPI": "`+ztAPI+`"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return cfgFile
+	}
+	prod := writeConfig("networks/prod.json", "https://prod:1280")
+	writeConfig("networks/staging.json", "https://staging:1280")
+	if err := os.WriteFile(filepath.Join(dir, "networks", "notes.json"), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := writeConfig("other/prod.json", "https://other-prod:1280")
+	single := writeConfig("single/dev.json", "https://dev:1280")
+
+	selected, err := selectConfig([]string{single}, "")
+	assert.NoError(t, err, "a single config needs no --network")
+	assert.Equal(t, "https://dev:1280", selected.Config.ZtAPI)
+
+	selected, err = selectConfig([]string{filepath.Join(dir, "networks"), single}, "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, prod, selected.Path)
+	assert.Equal(t, "https://prod:1280", selected.Config.ZtAPI)
+
+	_, err = selectConfig([]string{filepath.Join(dir, "networks"), single}, "")
+	assert.ErrorContains(t, err, "choose one with --network: [dev, prod, staging]", "unloadable files in a directory are skipped")
+	_, err = selectConfig([]string{filepath.Join(dir, "networks")}, "qa")
+	assert.ErrorContains(t, err, "no ziti config for network qa. networks found: [prod, staging]")
+	_, err = selectConfig([]string{filepath.Join(dir, "networks"), other}, "prod")
+	assert.ErrorContains(t, err, "network prod is ambiguous")
+	_, err = selectConfig([]string{filepath.Join(dir, "networks", "notes.json")}, "")
+	assert.ErrorContains(t, err, "failed to load ziti configuration file", "a named file must load")
+	_, err = selectConfig([]string{filepath.Join(dir, "missing.json")}, "")
+	assert.ErrorContains(t, err, "ziti config not found")
+}
+
+func TestWithEnv(t *testing.T) {
+	// the server rejects REJECTED, as sshd does for variables not in AcceptEnv, and echoes the rest when asked to exec
+	client := newTestSshClient(t, func(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+		var env []string
+		for req := range reqs {
+			switch req.Type {
+			case "env":
+				kv := struct{ Name, Value string }{}
+				if err := ssh.Unmarshal(req.Payload, &kv); err != nil || kv.Name == "REJECTED" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				env = append(env, kv.Name+"="+kv.Value)
+				_ = req.Reply(true, nil)
+			case "exec":
+				_ = req.Reply(true, nil)
+				_, _ = fmt.Fprint(ch, strings.Join(env, "\n"))
+				sendExitStatus(ch, 0)
+				return
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	})
+
+	stdout := &bytes.Buffer{}
+	code, err := RunCommand(context.Background(), client, "env", nil, stdout, &bytes.Buffer{}, WithEnv([]string{"LANG=en_US.UTF-8", "REJECTED=1", "EMPTY="}))
+	assert.NoError(t, err, "rejected variables should not fail the session")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "LANG=en_US.UTF-8\nEMPTY=", stdout.String())
+}
+
+func TestRunCommandStdin(t *testing.T) {
+	// the server echoes stdin back once the client signals EOF, so the command only completes if stdin is closed
+	client := newTestSshClient(t, func(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			if req.Type != "exec" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				input, _ := io.ReadAll(ch)
+				_, _ = ch.Write(bytes.ToUpper(input))
+				sendExitStatus(ch, 0)
+			}()
+		}
+	})
+
+	stdout := &bytes.Buffer{}
+	code, err := RunCommand(context.Background(), client, "tr a-z A-Z", strings.NewReader("select 1;\n"), stdout, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "SELECT 1;\n", stdout.String())
+}
+
+func TestRunCommandSeparatesStreams(t *testing.T) {
+	// a pty would merge stderr into stdout, so the server fails the command if one is requested
+	client := newTestSshClient(t, func(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			if req.Type == "pty-req" {
+				_ = req.Reply(true, nil)
+				_, _ = ch.Write([]byte("pty requested\n"))
+				sendExitStatus(ch, 1)
+				continue
+			}
+			if req.Type != "exec" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				for i := 0; i < 3; i++ {
+					_, _ = fmt.Fprintf(ch, "out %d\n", i)
+					_, _ = fmt.Fprintf(ch.Stderr(), "err %d\n", i)
+				}
+				sendExitStatus(ch, 3)
+			}()
+		}
+	})
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code, err := RunCommand(context.Background(), client, "report", nil, stdout, stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, code)
+	assert.Equal(t, "out 0\nout 1\nout 2\n", stdout.String())
+	assert.Equal(t, "err 0\nerr 1\nerr 2\n", stderr.String())
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	pinned := FixedHostKey(fingerprint)
+	assert.NoError(t, pinned("target", nil, key))
+	assert.ErrorContains(t, pinned("target", nil, other), "does not match the pinned fingerprint")
+	assert.NoError(t, FixedHostKey(strings.TrimPrefix(fingerprint, "SHA256:"))("target", nil, key), "prefix should be optional")
+
+	// the injected callback replaces known_hosts verification, even when insecure
+	factory := NewSshConfigFactoryImpl("test", []string{filepath.Join(t.TempDir(), "missing")},
+		WithKnownHostsPath(filepath.Join(t.TempDir(), "known_hosts")), WithInsecure(true), WithHostKeyCallback(pinned))
+	config := factory.Config()
+	assert.NoError(t, config.HostKeyCallback("target", nil, key))
+	assert.Error(t, config.HostKeyCallback("target", nil, other))
+}
+
+func TestHostKeyFingerprintLogged(t *testing.T) {
+	out := &bytes.Buffer{}
+	level, output := log.Level, log.Out
+	t.Cleanup(func() {
+		log.SetLevel(level)
+		log.SetOutput(output)
+	})
+	log.SetOutput(out)
+	log.SetLevel(logrus.InfoLevel)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	factory := NewSshConfigFactoryImpl("test", nil, WithHost("target"), WithKnownHostsPath(knownHosts), WithInsecure(true))
+	callback := factory.Config().HostKeyCallback
+
+	assert.NoError(t, callback(knownHostsAddress("target"), remote, key))
+	assert.Contains(t, out.String(), "ED25519 host key fingerprint for target is "+ssh.FingerprintSHA256(key))
+
+	out.Reset()
+	assert.NoError(t, addKnownHostUnhashed(knownHosts, knownHostsAddress("target"), key))
+	assert.NoError(t, callback(knownHostsAddress("target"), remote, key))
+	assert.Empty(t, out.String(), "known keys should only be logged at debug level")
+
+	log.SetLevel(logrus.DebugLevel)
+	assert.NoError(t, callback(knownHostsAddress("target"), remote, key))
+	assert.Contains(t, out.String(), ssh.FingerprintSHA256(key))
+}
+
+func TestKnownHostsPerTarget(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	alpha, beta := newKey(), newKey()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	assert.NoError(t, addKnownHostUnhashed(knownHosts, knownHostsAddress("alpha"), alpha))
+	assert.NoError(t, addKnownHostUnhashed(knownHosts, knownHostsAddress("beta web"), beta))
+	content, err := os.ReadFile(knownHosts)
+	if assert.NoError(t, err) {
+		assert.True(t, strings.HasPrefix(string(content), "alpha ssh-ed25519 "), string(content))
+		assert.Contains(t, string(content), "\nbeta_web ssh-ed25519 ")
+	}
+
+	// targets behind the same edge router each have their own key, which is still theirs through another router
+	router := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8442}
+	other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8442}
+	for target, key := range map[string]ssh.PublicKey{"alpha": alpha, "beta web": beta} {
+		callback := NewSshConfigFactoryImpl("test", nil, WithHost(target), WithKnownHostsPath(knownHosts)).Config().HostKeyCallback
+		assert.NoError(t, callback(knownHostsAddress(target), router, key), target)
+		assert.NoError(t, callback(knownHostsAddress(target), other, key), target)
+	}
+	callback := NewSshConfigFactoryImpl("test", nil, WithHost("alpha"), WithKnownHostsPath(knownHosts)).Config().HostKeyCallback
+	assert.ErrorContains(t, callback(knownHostsAddress("alpha"), router, beta), "host key mismatch for alpha")
+
+	// the handshake verifies the key as the target's
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := ""
+	client, err := Dial(&ssh.ClientConfig{User: "test", HostKeyCallback: func(hostname string, _ net.Addr, _ ssh.PublicKey) error {
+		verified = hostname
+		return nil
+	}}, "alpha", conn)
+	if assert.NoError(t, err) {
+		_ = client.Close()
+	}
+	assert.Equal(t, knownHostsAddress("alpha"), verified)
+}
+
+func TestAgentAuthMethod(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("agent test requires a unix socket agent")
+	}
+	out := &bytes.Buffer{}
+	output := log.Out
+	t.Cleanup(func() { log.SetOutput(output) })
+	log.SetOutput(out)
+
+	t.Setenv("SSH_AUTH_SOCK", filepath.Join(t.TempDir(), "missing.sock"))
+	assert.Nil(t, sshAgentSigners(), "an unreachable agent should be skipped")
+	factory := NewSshConfigFactoryImpl("test", []string{filepath.Join(t.TempDir(), "missing")}, WithInsecure(true))
+	assert.Empty(t, factory.Config().Auth)
+	assert.Contains(t, out.String(), "no usable authentication methods")
+
+	newTestAgent(t, 0)
+	assert.Nil(t, sshAgentSigners(), "an agent without keys should be skipped")
+
+	newTestAgent(t, 2)
+	assert.NotNil(t, sshAgentSigners())
+	factory = NewSshConfigFactoryImpl("test", nil, WithInsecure(true))
+	assert.Len(t, factory.Config().Auth, 1)
+	factory = NewSshConfigFactoryImpl("test", nil, WithInsecure(true), WithNoAgent(true))
+	assert.Empty(t, factory.Config().Auth, "the agent should not be used with WithNoAgent")
+}
+
+func TestAgentKeysAfterKeyFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("agent test requires a unix socket agent")
+	}
+	authorized := newTestAgent(t, 1)[0]
+	_, fileKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(fileKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server only accepts the agent's key, recording the order keys are offered in
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offered := make(chan ssh.PublicKey, 10)
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			offered <- key
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unauthorized key")
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _, _, _ = ssh.NewServerConn(conn, serverConfig) }()
+		}
+	}()
+	dial := func(factory SshConfigFactory) error {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := Dial(factory.Config(), "target", conn)
+		if client != nil {
+			_ = client.Close()
+		}
+		return err
+	}
+
+	factory := NewSshConfigFactoryImpl("test", []string{keyPath}, WithInsecure(true))
+	assert.NoError(t, dial(factory), "the agent's keys should be offered once the key files are refused")
+	var keys []ssh.PublicKey
+	for len(offered) > 0 {
+		keys = append(keys, <-offered)
+	}
+	if assert.NotEmpty(t, keys) {
+		assert.Equal(t, factory.signers[0].PublicKey().Marshal(), keys[0].Marshal(), "the key file should be offered first")
+		assert.Equal(t, authorized.Marshal(), keys[len(keys)-1].Marshal())
+	}
+
+	factory = NewSshConfigFactoryImpl("test", []string{keyPath}, WithInsecure(true), WithNoAgent(true))
+	assert.Error(t, dial(factory), "the agent's keys should not be offered with WithNoAgent")
+}
+
+func TestPrivateKeySources(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := pem.EncodeToMemory(block)
+	expected, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := sshSignerFromBytes("memory", content)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Marshal(), signer.PublicKey().Marshal())
+	_, err = sshSignerFromBytes("memory", ssh.MarshalAuthorizedKey(expected))
+	assert.ErrorContains(t, err, "is a public key")
+
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err = sshSignerFromFile(keyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Marshal(), signer.PublicKey().Marshal())
+
+	stdin := keyStdin
+	t.Cleanup(func() { keyStdin, keyStdinOnce = stdin, sync.Once{} })
+	keyStdin, keyStdinOnce = bytes.NewReader(content), sync.Once{}
+	for i := 0; i < 2; i++ {
+		signer, err = sshSignerFromFile(STDIN_KEY_PATH)
+		assert.NoError(t, err, "the key read from stdin should be reusable")
+		assert.Equal(t, expected.Marshal(), signer.PublicKey().Marshal())
+	}
+
+	t.Setenv(PRIVATE_KEY_ENV, string(content))
+	factory := NewSshConfigFactoryImpl("test", []string{filepath.Join(t.TempDir(), "missing")}, WithInsecure(true))
+	factory.Config()
+	if assert.Len(t, factory.signers, 1) {
+		assert.Equal(t, expected.Marshal(), factory.signers[0].PublicKey().Marshal())
+	}
+}
+
+func TestAskpass(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake askpass program is a shell script")
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("s3cret pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := pem.EncodeToMemory(block)
+
+	dir := t.TempDir()
+	prompts := filepath.Join(dir, "prompts")
+	script := filepath.Join(dir, "askpass")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> '"+prompts+"'\necho 's3cret pass'\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ASKPASS_ENV, script)
+	t.Setenv(KEY_PASSPHRASE_ENV, "wrong")
+
+	signer, err := sshSignerFromBytes("id_ed25519", content)
+	assert.NoError(t, err, "the passphrase should come from the askpass program")
+	assert.NotNil(t, signer)
+	asked, _ := os.ReadFile(prompts)
+	assert.Equal(t, "Enter passphrase for key 'id_ed25519': \n", string(asked), "the prompt should be passed as the only argument")
+	assert.Equal(t, "s3cret pass", ReadCode(false))
+
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	_, err = sshSignerFromBytes("id_ed25519", content)
+	assert.ErrorContains(t, err, ASKPASS_ENV+" program ["+script+"] failed")
+}
+
+func TestMultipleIdentityFiles(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	writeKey := func(name string) ssh.PublicKey {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := ssh.MarshalPrivateKey(priv, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	writeKey("wrong_key")
+	authorized := writeKey("right_key")
+	if err := os.WriteFile(filepath.Join(dir, "garbage"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	factory := NewSshConfigFactoryImpl("test", []string{
+		filepath.Join(dir, "missing"),
+		filepath.Join(dir, "garbage"),
+		filepath.Join(dir, "wrong_key"),
+		filepath.Join(dir, "right_key"),
+	}, WithInsecure(true))
+	config := factory.Config()
+	assert.Len(t, factory.signers, 2, "unreadable keys should be skipped")
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unauthorized key")
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _, _, _ = ssh.NewServerConn(conn, serverConfig)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(config, "target", conn)
+	assert.NoError(t, err, "every key should be offered until one is accepted")
+	if client != nil {
+		_ = client.Close()
+	}
+}
+
+func TestJumpThrough(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	// the target only reports who it is, and is only reachable through the jump host's direct-tcpip forwarding
+	targetAddr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		for req := range reqs {
+			_ = req.Reply(req.Type == "exec", nil)
+			if req.Type == "exec" {
+				_, _ = fmt.Fprintf(ch, "%s on target", conn.User())
+				sendExitStatus(ch, 0)
+				return
+			}
+		}
+	})
+	_, targetPort, _ := net.SplitHostPort(targetAddr)
+
+	dialed := make(chan string, 1)
+	jumpAddr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			return
+		}
+		dest := struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}{}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &dest); err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		dialed <- net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port)))
+		// port 22 of the target is served by the test server's listener
+		target, err := net.Dial("tcp", net.JoinHostPort(dest.Host, targetPort))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			_, _ = io.Copy(target, ch)
+			_ = target.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(ch, target)
+			_ = ch.Close()
+		}()
+	})
+
+	f := &SshFlags{Insecure: true, Timeout: 5 * time.Second}
+	jumpConn, err := net.Dial("tcp", jumpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jump, err := EstablishClientWithConn(f, jumpConn, "bastionUser", "bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := JumpThrough(f, jump, "targetUser", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "127.0.0.1:22", <-dialed)
+
+	stdout := &bytes.Buffer{}
+	code, err := RunCommand(context.Background(), client, "whoami", nil, stdout, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "targetUser on target", stdout.String())
+
+	_ = client.Close()
+	assert.Eventually(t, func() bool { return jump.Wait() != nil }, time.Second, 10*time.Millisecond, "jump client should close with the target client")
+}
+
+func TestCertificateAuth(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyAndCert := func(name string, validBefore uint64) ssh.PublicKey {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := ssh.MarshalPrivateKey(priv, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &ssh.Certificate{
+			Key:             signer.PublicKey(),
+			CertType:        ssh.UserCert,
+			KeyId:           name,
+			ValidPrincipals: []string{"test"},
+			ValidBefore:     validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+"-cert.pub"), ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return signer.PublicKey()
+	}
+	writeKeyAndCert("id_ed25519", ssh.CertTimeInfinity)
+
+	factory := NewSshConfigFactoryImpl("test", []string{filepath.Join(dir, "id_ed25519")}, WithInsecure(true))
 	config := factory.Config()
-	sshConn, _ := Dial(config, conn)
+	if assert.Len(t, factory.signers, 2, "the certificate should be offered along with the plain key") {
+		cert, ok := factory.signers[0].PublicKey().(*ssh.Certificate)
+		if assert.True(t, ok, "the certificate should be offered first") {
+			assert.Equal(t, "id_ed25519", cert.KeyId)
+		}
+	}
+
+	var presented ssh.PublicKey
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool { return bytes.Equal(auth.Marshal(), caSigner.PublicKey().Marshal()) },
+	}
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			presented = key
+			return checker.Authenticate(conn, key)
+		},
+	}
+	serverConfig.AddHostKey(caSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _, _, _ = ssh.NewServerConn(conn, serverConfig)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(config, "target", conn)
+	assert.NoError(t, err, "the CA signed certificate should be accepted")
+	if client != nil {
+		_ = client.Close()
+	}
+	_, isCert := presented.(*ssh.Certificate)
+	assert.True(t, isCert, "the server should have been presented the certificate")
 
-	client, _ := sftp.NewClient(sshConn)
-	defer func() { _ = client.Close() }()
+	expiredKey := writeKeyAndCert("expired", uint64(time.Now().Add(-time.Hour).Unix()))
+	factory = NewSshConfigFactoryImpl("test", []string{filepath.Join(dir, "expired")}, WithInsecure(true))
+	factory.Config()
+	if assert.Len(t, factory.signers, 1, "an expired certificate should be skipped") {
+		assert.Equal(t, expiredKey.Marshal(), factory.signers[0].PublicKey().Marshal())
+	}
+
+	writeKeyAndCert("mismatched", ssh.CertTimeInfinity)
+	if err := os.Rename(filepath.Join(dir, "id_ed25519-cert.pub"), filepath.Join(dir, "mismatched-cert.pub")); err != nil {
+		t.Fatal(err)
+	}
+	factory = NewSshConfigFactoryImpl("test", []string{filepath.Join(dir, "mismatched")}, WithInsecure(true))
+	factory.Config()
+	assert.Len(t, factory.signers, 1, "a certificate for another key should be skipped")
+}
 
-	result := AppendBaseName(client, "", "message.txt", false)
-	assert.Equal(t, result, "message.txt", "Path not correct")
+func TestBannerCallback(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	banner := &bytes.Buffer{}
+	bannerOut = banner
+	defer func() { bannerOut = os.Stderr }()
 
-	result = AppendBaseName(client, "~", "message.txt", false)
-	assert.Equal(t, result, "message.txt", "Path not correct")
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		NoClientAuth:   true,
+		BannerCallback: func(ssh.ConnMetadata) string { return "Authorized use only\x1b[2J\r\n" },
+	}
+	serverConfig.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _, _, _ = ssh.NewServerConn(conn, serverConfig) }()
+		}
+	}()
 
-	result = AppendBaseName(client, "/", "message.txt", false)
-	assert.Equal(t, result, "message.txt", "Path not correct")
+	connect := func(opts ...SshConfigFactoryOption) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := Dial(NewSshConfigFactoryImpl("test", nil, append(opts, WithInsecure(true))...).Config(), "target", conn)
+		if assert.NoError(t, err) {
+			_ = client.Close()
+		}
+	}
+	connect()
+	assert.Equal(t, "Authorized use only[2J\r\n", banner.String(), "the banner should be shown without escape sequences")
 
-	result = AppendBaseName(client, "message.txt", "message.txt", false)
-	assert.Equal(t, result, "message.txt", "Path not correct")
+	banner.Reset()
+	connect(WithQuiet(true))
+	assert.Empty(t, banner.String(), "quiet should suppress the banner")
 }
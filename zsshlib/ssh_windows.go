@@ -27,13 +27,14 @@ import (
 var warnOnce = sync.Once{}
 var pipePresent = true
 
-func sshAuthMethodAgent() ssh.AuthMethod {
+// sshAgentClient connects to the OpenSSH Authentication Agent pipe, returning nil when none is available
+func sshAgentClient() agent.ExtendedAgent {
 	if !pipePresent {
 		return nil
 	}
 
-	if sshAgent, err := npipe.DialTimeout(`\\.\pipe\openssh-ssh-agent`, 1*time.Second); err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+	if conn, err := npipe.DialTimeout(`\\.\pipe\openssh-ssh-agent`, 1*time.Second); err == nil {
+		return agent.NewClient(conn)
 	} else {
 		warnOnce.Do(func() {
 			pipePresent = false
@@ -42,3 +43,7 @@ func sshAuthMethodAgent() ssh.AuthMethod {
 	}
 	return nil
 }
+
+// watchWindowSize is a no-op on windows, which has no SIGWINCH equivalent
+func watchWindowSize(_ *ssh.Session, _ int, _ <-chan struct{}) {
+}
@@ -0,0 +1,110 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TransferStats counts the bytes of every transfer made with the TransferOptions it is set on, and the time from the
+// first transfer starting to the last byte, for the summary zscp prints once done. Parallel transfers add to the
+// same totals.
+type TransferStats struct {
+	mu    sync.Mutex
+	files int
+	bytes int64
+	start time.Time
+	end   time.Time
+}
+
+// reader wraps r, counting the bytes read through it as a transfer of one file
+func (s *TransferStats) reader(r io.Reader) io.Reader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.files == 0 {
+		s.start, s.end = now, now
+	}
+	s.files++
+	return &statsReader{Reader: r, stats: s}
+}
+
+func (s *TransferStats) add(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += int64(n)
+	s.end = time.Now()
+}
+
+// Files returns the number of files transferred, including those which failed part way
+func (s *TransferStats) Files() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files
+}
+
+// Bytes returns the bytes transferred. Bytes skipped when resuming aren't counted, while those of retried files are
+// counted each time they are sent.
+func (s *TransferStats) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Elapsed returns the time from the first transfer starting to the last byte transferred
+func (s *TransferStats) Elapsed() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end.Sub(s.start)
+}
+
+// Summary describes what was transferred on one line, like scp, e.g. sent 12.3 MiB in 4.2s (2.9 MiB/s), where verb
+// is the direction. It is empty when nothing was transferred.
+func (s *TransferStats) Summary(verb string) string {
+	if s.Files() == 0 {
+		return ""
+	}
+	bytes, elapsed := s.Bytes(), s.Elapsed()
+	// transfers of small files complete within the clock's resolution
+	seconds := max(elapsed.Seconds(), time.Millisecond.Seconds())
+	return fmt.Sprintf("%s %s in %s (%s/s)", verb, formatBytes(bytes), formatElapsed(elapsed), formatBytes(int64(float64(bytes)/seconds)))
+}
+
+// formatElapsed formats d to a tenth of a second, e.g. 4.2s or 1m3.5s
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// statsReader counts the bytes read through it toward its TransferStats
+type statsReader struct {
+	io.Reader
+	stats *TransferStats
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.stats.add(n)
+	}
+	return n, err
+}
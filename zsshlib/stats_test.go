@@ -0,0 +1,70 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferStatsSummary(t *testing.T) {
+	assert.Equal(t, "", (&TransferStats{}).Summary("sent"), "nothing was transferred")
+
+	start := time.Now()
+	stats := &TransferStats{files: 3, bytes: 12897485, start: start, end: start.Add(4200 * time.Millisecond)}
+	assert.Equal(t, "sent 12.3 MiB in 4.2s (2.9 MiB/s)", stats.Summary("sent"))
+	stats.end = start.Add(63500 * time.Millisecond)
+	assert.Equal(t, "received 12.3 MiB in 1m3.5s (198.3 KiB/s)", stats.Summary("received"))
+}
+
+func TestTransferStats(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	localPath := filepath.Join(dir, "local.bin")
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree := filepath.Join(dir, "tree")
+	for _, name := range []string{"a.bin", "b.bin", filepath.Join("sub", "c.bin")} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tree, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tree, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := newTestSftpClient(t)
+	remoteDir := filepath.ToSlash(t.TempDir())
+
+	opts := &TransferOptions{Stats: &TransferStats{}}
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remoteDir+"/file.bin", opts))
+	assert.Equal(t, 1, opts.Stats.Files())
+	assert.Equal(t, int64(len(data)), opts.Stats.Bytes())
+	assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, filepath.Join(dir, "back.bin"), remoteDir+"/file.bin", opts))
+	assert.Equal(t, 2, opts.Stats.Files())
+	assert.Equal(t, int64(2*len(data)), opts.Stats.Bytes())
+
+	// parallel transfers add to the same totals
+	opts = &TransferOptions{Stats: &TransferStats{}, Parallel: 3}
+	assert.NoError(t, SendDir(context.Background(), client, tree, remoteDir, opts))
+	assert.Equal(t, 3, opts.Stats.Files())
+	assert.Equal(t, int64(3*len(data)), opts.Stats.Bytes())
+	assert.Contains(t, opts.Stats.Summary("sent"), "sent 3.0 MiB in ")
+
+	// the bytes skipped when resuming weren't transferred
+	if err := os.WriteFile(filepath.Join(remoteDir, "resumed.bin"+partSuffix), data[:len(data)/4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts = &TransferOptions{Stats: &TransferStats{}, Resume: true}
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remoteDir+"/resumed.bin", opts))
+	assert.Equal(t, int64(len(data)-len(data)/4), opts.Stats.Bytes())
+
+	// nothing is transferred in a dry run
+	opts = &TransferOptions{Stats: &TransferStats{}, DryRun: true}
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remoteDir+"/dry.bin", opts))
+	assert.Equal(t, "", opts.Stats.Summary("sent"))
+}
@@ -0,0 +1,118 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+// StdioPath is the zscp argument standing for stdin when sending, or stdout when retrieving
+const StdioPath = "-"
+
+// SendStream writes everything read from r to remotePath, e.g. to send stdin without a temporary file. The size of
+// the stream isn't known up front, so progress is reported without a total, and Resume and PreserveTimes don't
+// apply. Verify compares the SHA-256 of what was read to that of the remote file. remotePath is removed should the
+// transfer fail, unless KeepPartial is set or it isn't a regular file, such as /dev/null, which can't be verified
+// either.
+func SendStream(ctx context.Context, client *sftp.Client, r io.Reader, remotePath string, opts *TransferOptions) error {
+	if opts.dryRun() {
+		log.Infof("[dry run] would send stdin ==> %s", remotePath)
+		return nil
+	}
+	if err := opts.makeRemoteParent(client, remotePath); err != nil {
+		return err
+	}
+
+	_, regular := remoteDestination(client, remotePath)
+	removePartial := func() {
+		if regular {
+			opts.removePartial(remotePath, client.Remove)
+		}
+	}
+	rmtFile, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open remote file %v", remotePath)
+	}
+	defer func() { _ = rmtFile.Close() }()
+
+	var checksum hash.Hash
+	if opts != nil && opts.Verify && regular {
+		checksum = sha256.New()
+	}
+	src := opts.wrapSource(ctx, r, path.Base(remotePath), -1, 0, checksum)
+	stop := context.AfterFunc(ctx, func() { _ = rmtFile.Close() })
+	defer stop()
+	if err = opts.writeRemote(client, rmtFile, &contextReader{ctx: ctx, r: src}); err != nil {
+		_ = rmtFile.Close()
+		removePartial()
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "sending to %v cancelled", remotePath)
+		}
+		return errors.Wrapf(err, "unable to copy to remote file %v", remotePath)
+	}
+	if err = rmtFile.Close(); err != nil {
+		removePartial()
+		return errors.Wrapf(err, "unable to close remote file %v", remotePath)
+	}
+	if checksum != nil {
+		open := func(name string) (io.ReadCloser, error) { return client.Open(name) }
+		return verifyChecksum(checksum.Sum(nil), remotePath, open, client.Remove)
+	}
+	return nil
+}
+
+// RetrieveStream writes the contents of remotePath to w, e.g. to stream a remote file to stdout. What was written
+// can't be read back, so Verify doesn't apply.
+func RetrieveStream(ctx context.Context, client *sftp.Client, w io.Writer, remotePath string, opts *TransferOptions) error {
+	if opts.dryRun() {
+		log.Infof("[dry run] would retrieve file: %s ==> stdout", remotePath)
+		return nil
+	}
+
+	rf, err := client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("error opening remote file [%s] (%w)", remotePath, err)
+	}
+	defer func() { _ = rf.Close() }()
+	info, err := rf.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading remote file [%s] (%w)", remotePath, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cannot stream remote directory [%s]", remotePath)
+	}
+
+	src := opts.wrapSource(ctx, rf, path.Base(remotePath), info.Size(), 0, nil)
+	stop := context.AfterFunc(ctx, func() { _ = rf.Close() })
+	defer stop()
+	if err = opts.readRemote(w, &contextReader{ctx: ctx, r: src}); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("retrieving [%s] cancelled (%w)", remotePath, ctx.Err())
+		}
+		return fmt.Errorf("error copying remote file [%s] (%w)", remotePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendStream(t *testing.T) {
+	dir := t.TempDir()
+	remotePath := filepath.Join(dir, "deep", "remote.txt")
+	client := newTestSftpClient(t)
+
+	var totals []int64
+	opts := &TransferOptions{Verify: true, MakeDirs: true, Progress: func(_ string, _ int64, total int64) {
+		totals = append(totals, total)
+	}}
+	assert.NoError(t, SendStream(context.Background(), client, strings.NewReader("hello\n"), filepath.ToSlash(remotePath), opts))
+	content, err := os.ReadFile(remotePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(content))
+	assert.Equal(t, int64(-1), totals[0], "the size of a stream is unknown up front")
+	assert.Equal(t, int64(6), totals[len(totals)-1], "the size should be reported once the stream ends")
+
+	assert.NoError(t, SendStream(context.Background(), client, strings.NewReader("hi"), filepath.ToSlash(remotePath), nil))
+	content, err = os.ReadFile(remotePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(content), "existing files should be truncated")
+
+	assert.Error(t, SendStream(context.Background(), client, strings.NewReader("x"), filepath.ToSlash(filepath.Join(dir, "missing", "x.txt")), nil))
+
+	if runtime.GOOS != "windows" {
+		// devices are written in place, never replaced, removed or read back
+		opts := &TransferOptions{Verify: true}
+		assert.NoError(t, SendStream(context.Background(), client, strings.NewReader("discarded"), os.DevNull, opts))
+		info, err := os.Stat(os.DevNull)
+		assert.NoError(t, err)
+		assert.NotZero(t, info.Mode()&os.ModeDevice, "%s should still be a device", os.DevNull)
+		assert.NoFileExists(t, os.DevNull+partSuffix)
+	}
+}
+
+func TestRetrieveStream(t *testing.T) {
+	dir := t.TempDir()
+	remotePath := filepath.Join(dir, "remote.txt")
+	if err := os.WriteFile(remotePath, []byte("streamed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, RetrieveStream(context.Background(), client, out, filepath.ToSlash(remotePath), nil))
+	assert.Equal(t, "streamed", out.String())
+
+	assert.ErrorContains(t, RetrieveStream(context.Background(), client, out, filepath.ToSlash(dir), nil), "cannot stream remote directory")
+	assert.Error(t, RetrieveStream(context.Background(), client, out, filepath.ToSlash(filepath.Join(dir, "missing.txt")), nil))
+}
@@ -0,0 +1,134 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tokenExpirySkew treats tokens expiring within this window as already expired
+const tokenExpirySkew = 30 * time.Second
+
+// tokenCache is the on-disk representation of the tokens obtained from the last OIDC flow
+type tokenCache struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"client_id"`
+	Tokens
+}
+
+// TokenCacheFile returns the path of the file OIDC tokens are cached in, under the user's home directory
+func TokenCacheFile() string {
+	cacheFile, err := tokenCacheFile()
+	if err != nil {
+		return filepath.Join("~", ".ziti", "zssh", "token.json")
+	}
+	return cacheFile
+}
+
+// tokenCacheFile returns the path of the token cache, failing when there is no home directory to keep it in
+func tokenCacheFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine home directory for the token cache: %w", err)
+	}
+	return filepath.Join(home, ".ziti", "zssh", "token.json"), nil
+}
+
+func loadTokenCache() (*tokenCache, error) {
+	cacheFile, err := tokenCacheFile()
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	cache := &tokenCache{}
+	if err := json.Unmarshal(content, cache); err != nil {
+		return nil, fmt.Errorf("invalid token cache [%s]: %w", cacheFile, err)
+	}
+	return cache, nil
+}
+
+func saveTokenCache(cache *tokenCache) error {
+	cacheFile, err := tokenCacheFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0700); err != nil {
+		return fmt.Errorf("failed to create token cache directory: %w", err)
+	}
+	content, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cacheFile, content, 0600)
+}
+
+// ClearTokenCache removes any cached OIDC tokens. A missing cache is not an error
+func ClearTokenCache() error {
+	cacheFile, err := tokenCacheFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(cacheFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// matches reports whether the cache holds tokens for the given issuer and client
+func (c *tokenCache) matches(issuer string, clientID string) bool {
+	return c.Issuer == issuer && c.ClientID == clientID
+}
+
+// expired reports whether the cached access token is expired, preferring the token's exp claim
+func (c *tokenCache) expired() bool {
+	expiry := c.Expiry
+	if exp, err := jwtExpiry(c.AccessToken); err == nil {
+		expiry = exp
+	}
+	return expiry.IsZero() || time.Now().Add(tokenExpirySkew).After(expiry)
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it. Verification is left to the controller.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("JWT has no exp claim")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,86 @@
+package zsshlib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setTestHome points the user's home directory at a new temporary directory, returning it
+func setTestHome(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	return home
+}
+
+func TestTokenCache(t *testing.T) {
+	home := setTestHome(t)
+	cacheFile := filepath.Join(home, ".ziti", "zssh", "token.json")
+	assert.Equal(t, cacheFile, TokenCacheFile())
+
+	_, err := loadTokenCache()
+	assert.True(t, os.IsNotExist(err), "a missing cache should be reported as such: %v", err)
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	cache := &tokenCache{Issuer: "https://issuer", ClientID: "openziti-client",
+		Tokens: Tokens{AccessToken: "access", RefreshToken: "refresh", Expiry: expiry}}
+	assert.NoError(t, saveTokenCache(cache))
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(cacheFile); assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "only the user should be able to read the tokens")
+		}
+		if info, err := os.Stat(filepath.Dir(cacheFile)); assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+		}
+	}
+
+	loaded, err := loadTokenCache()
+	if assert.NoError(t, err) {
+		assert.Equal(t, cache, loaded)
+		assert.True(t, loaded.matches("https://issuer", "openziti-client"))
+		assert.False(t, loaded.matches("https://issuer", "other-client"))
+		assert.False(t, loaded.matches("https://other", "openziti-client"))
+	}
+
+	if err := os.WriteFile(cacheFile, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadTokenCache()
+	assert.ErrorContains(t, err, "invalid token cache")
+
+	// --logout removes the cache, and finding none to remove is fine
+	assert.NoError(t, ClearTokenCache())
+	assert.NoFileExists(t, cacheFile)
+	assert.NoError(t, ClearTokenCache())
+}
+
+func TestTokenCacheExpired(t *testing.T) {
+	jwt := func(exp time.Time) string {
+		claims := fmt.Sprintf(`{"exp":%d}`, exp.Unix())
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+	}
+	now := time.Now()
+	for _, test := range []struct {
+		name    string
+		tokens  Tokens
+		expired bool
+	}{
+		{"exp claim ahead", Tokens{AccessToken: jwt(now.Add(time.Hour))}, false},
+		{"exp claim passed", Tokens{AccessToken: jwt(now.Add(-time.Minute))}, true},
+		{"exp claim within the skew", Tokens{AccessToken: jwt(now.Add(tokenExpirySkew / 2))}, true},
+		{"exp claim preferred", Tokens{AccessToken: jwt(now.Add(-time.Minute)), Expiry: now.Add(time.Hour)}, true},
+		{"expiry of an opaque token", Tokens{AccessToken: "opaque", Expiry: now.Add(time.Hour)}, false},
+		{"passed expiry of an opaque token", Tokens{AccessToken: "opaque", Expiry: now.Add(-time.Minute)}, true},
+		{"no expiry", Tokens{AccessToken: "opaque"}, true},
+	} {
+		cache := &tokenCache{Tokens: test.tokens}
+		assert.Equal(t, test.expired, cache.expired(), test.name)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// maxTracedHandshake bounds what is buffered looking for the version and key exchange offer of each side
+	maxTracedHandshake = 64 * 1024
+
+	// msgKexInit is the type of the message offering the algorithms each side supports, see RFC 4253 section 7.1
+	msgKexInit = 20
+)
+
+// kexInit is the key exchange offer each side sends in the clear following its version, see RFC 4253 section 7.1
+type kexInit struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// traceConn wraps the connection to the ssh server for --trace. The ssh library doesn't expose what was negotiated,
+// but the version and key exchange offer of each side are sent in the clear, so they are read as they pass through and
+// logged, along with the algorithms chosen from them. Everything after is encrypted and passed through untouched.
+type traceConn struct {
+	net.Conn
+	client *handshakeTap
+	server *handshakeTap
+	once   sync.Once
+}
+
+func newTraceConn(conn net.Conn) *traceConn {
+	return &traceConn{Conn: conn, client: &handshakeTap{side: "client"}, server: &handshakeTap{side: "server"}}
+}
+
+func (c *traceConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.server.observe(b[:n]) {
+		c.negotiated()
+	}
+	return n, err
+}
+
+func (c *traceConn) Write(b []byte) (int, error) {
+	if c.client.observe(b) {
+		c.negotiated()
+	}
+	return c.Conn.Write(b)
+}
+
+// negotiated logs the algorithms chosen once the offers of both sides have been seen
+func (c *traceConn) negotiated() {
+	client, server := c.client.offer(), c.server.offer()
+	if client == nil || server == nil {
+		return
+	}
+	c.once.Do(func() {
+		log.Tracef("negotiated kex: %s, host key: %s", chooseAlgorithm(client.KexAlgos, server.KexAlgos),
+			chooseAlgorithm(client.ServerHostKeyAlgos, server.ServerHostKeyAlgos))
+		log.Tracef("negotiated client to server cipher: %s, mac: %s", chooseAlgorithm(client.CiphersClientServer, server.CiphersClientServer),
+			chooseAlgorithm(client.MACsClientServer, server.MACsClientServer))
+		log.Tracef("negotiated server to client cipher: %s, mac: %s", chooseAlgorithm(client.CiphersServerClient, server.CiphersServerClient),
+			chooseAlgorithm(client.MACsServerClient, server.MACsServerClient))
+	})
+}
+
+// chooseAlgorithm returns the first algorithm the client offers which the server supports, as the protocol chooses,
+// or none when there isn't one, which fails the handshake
+func chooseAlgorithm(client []string, server []string) string {
+	for _, algo := range client {
+		for _, supported := range server {
+			if algo == supported {
+				return algo
+			}
+		}
+	}
+	return "none in common"
+}
+
+// handshakeTap reads one side of the connection until it has seen the version and key exchange offer
+type handshakeTap struct {
+	side    string
+	mu      sync.Mutex
+	buf     []byte
+	version string
+	kexInit *kexInit
+	done    bool
+}
+
+// observe reads b, sent by the tap's side, returning true when it completed the key exchange offer
+func (t *handshakeTap) observe(b []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done || len(b) == 0 {
+		return false
+	}
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > maxTracedHandshake {
+		t.stop()
+		return false
+	}
+
+	// servers may send other lines before their version
+	for t.version == "" {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			return false
+		}
+		line := strings.TrimRight(string(t.buf[:i]), "\r")
+		t.buf = t.buf[i+1:]
+		if strings.HasPrefix(line, "SSH-") {
+			t.version = line
+			log.Tracef("%s version: %s", t.side, line)
+		}
+	}
+
+	// the first packet is the key exchange offer: length, padding length, payload and padding
+	if len(t.buf) < 5 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint32(t.buf))
+	if length > maxTracedHandshake {
+		t.stop()
+		return false
+	}
+	if len(t.buf) < 4+length {
+		return false
+	}
+	padding := int(t.buf[4])
+	if padding+2 > length || t.buf[5] != msgKexInit {
+		t.stop()
+		return false
+	}
+	offer := &kexInit{}
+	if err := ssh.Unmarshal(t.buf[5:4+length-padding], offer); err != nil {
+		log.Tracef("unable to read the %s key exchange offer: %v", t.side, err)
+		t.stop()
+		return false
+	}
+	t.kexInit = offer
+	t.stop()
+	log.Tracef("%s offers kex: %s", t.side, strings.Join(offer.KexAlgos, ","))
+	log.Tracef("%s offers host keys: %s", t.side, strings.Join(offer.ServerHostKeyAlgos, ","))
+	log.Tracef("%s offers ciphers: %s", t.side, strings.Join(offer.CiphersClientServer, ","))
+	log.Tracef("%s offers macs: %s", t.side, strings.Join(offer.MACsClientServer, ","))
+	return true
+}
+
+// offer returns the key exchange offer of the tap's side, or nil when it hasn't been seen
+func (t *handshakeTap) offer() *kexInit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.kexInit
+}
+
+func (t *handshakeTap) stop() {
+	t.done = true
+	t.buf = nil
+}
@@ -0,0 +1,68 @@
+package zsshlib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTraceHandshake(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	out := &bytes.Buffer{}
+	output, level := log.Out, log.Level
+	t.Cleanup(func() { log.SetOutput(output); log.SetLevel(level) })
+	log.SetOutput(out)
+	log.SetLevel(logrus.TraceLevel)
+
+	addr := newTestSshServer(t, func(_ *ssh.ServerConn, newChannel ssh.NewChannel) {
+		_ = newChannel.Reject(ssh.Prohibited, "no channels")
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := EstablishClientWithConn(&SshFlags{Insecure: true, Trace: true}, conn, "traced", "target")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_ = client.Close()
+
+	logged := out.String()
+	assert.Contains(t, logged, "client version: SSH-2.0-zssh_")
+	assert.Contains(t, logged, "server version: SSH-2.0-Go")
+	assert.Contains(t, logged, "server offers kex: ")
+	assert.Contains(t, logged, "client offers ciphers: ")
+	assert.Contains(t, logged, "negotiated kex: ")
+	assert.NotContains(t, logged, "none in common")
+	assert.Contains(t, logged, "authenticated to target as traced")
+}
+
+func TestChooseAlgorithm(t *testing.T) {
+	assert.Equal(t, "b", chooseAlgorithm([]string{"b", "a"}, []string{"a", "b"}), "the client's preference should win")
+	assert.Equal(t, "none in common", chooseAlgorithm([]string{"a"}, []string{"b"}))
+}
+
+func TestHandshakeTap(t *testing.T) {
+	tap := &handshakeTap{side: "server"}
+	payload := ssh.Marshal(&kexInit{KexAlgos: []string{"curve25519-sha256"}, ServerHostKeyAlgos: []string{"ssh-ed25519"}})
+	packet := append([]byte{0, 0, 0, byte(len(payload) + 5), 4}, payload...)
+	packet = append(packet, 0, 0, 0, 0)
+	stream := append([]byte("banner line\r\nSSH-2.0-Test\r\n"), packet...)
+
+	// the offer may arrive split across reads
+	assert.False(t, tap.observe(stream[:20]))
+	assert.False(t, tap.observe(stream[20:40]))
+	assert.True(t, tap.observe(stream[40:]))
+	assert.Equal(t, "SSH-2.0-Test", tap.version)
+	assert.Equal(t, []string{"curve25519-sha256"}, tap.offer().KexAlgos)
+	assert.False(t, tap.observe([]byte("encrypted")), "nothing should be read after the offer")
+
+	tap = &handshakeTap{side: "server"}
+	assert.False(t, tap.observe([]byte("SSH-2.0-Test\r\n\x00\x00\x00\x0c\x04\x15garbage....")))
+	assert.Nil(t, tap.offer(), "packets other than the key exchange offer should be ignored")
+	assert.True(t, tap.done)
+}
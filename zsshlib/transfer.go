@@ -0,0 +1,1313 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/time/rate"
+)
+
+// TransferOptions customizes SendFile, RetrieveRemoteFiles and RetrieveRemoteDir. A nil *TransferOptions uses the
+// defaults.
+type TransferOptions struct {
+	// Progress, when set, is notified as bytes are transferred
+	Progress ProgressFunc
+
+	// Stats, when set, counts the bytes and time of every transfer, see TransferStats
+	Stats *TransferStats
+
+	// PreserveTimes copies the modification time of the source to the destination. Permissions are always preserved.
+	PreserveTimes bool
+
+	// Verify compares the SHA-256 of the source, computed while copying, to that of the destination once written
+	Verify bool
+
+	// Limit caps the rate of each transfer in bytes per second. 0 is unlimited
+	Limit int64
+
+	// KeepPartial keeps the partial file of a failed transfer, the destination with partSuffix appended, which is
+	// otherwise removed. Unlike Resume, a later transfer starts over.
+	KeepPartial bool
+
+	// Resume keeps the partial file of a failed transfer, the destination with partSuffix appended, and continues a
+	// later transfer from it when smaller than the source by appending the remaining bytes. A partial file larger
+	// than the source is transferred in full.
+	Resume bool
+
+	// Parallel is the number of files SendDir transfers concurrently, at most maxParallelTransfers. Defaults to 1
+	Parallel int
+
+	// DryRun logs the files which would be transferred and directories which would be made without writing anything
+	DryRun bool
+
+	// FollowSymlinks copies what symlinks found by SendDir and RetrieveRemoteDir point to rather than recreating the
+	// links. Links may point outside the directory being copied, so following them can copy far more than intended,
+	// including sensitive files elsewhere on the source, and should only be used with trusted sources.
+	FollowSymlinks bool
+
+	// MakeDirs creates the missing parent directories of a remote destination before sending a file to it. SendDir
+	// always creates the remote directory it sends into.
+	MakeDirs bool
+
+	// FileRetries retries each file SendDir and RetrieveRemoteDir fail to transfer up to FileRetries times, waiting
+	// fileRetryDelay between attempts. Files which still fail are skipped and listed in the returned error.
+	FileRetries int
+
+	// KeepGoing carries on with the rest of a directory SendDir or RetrieveRemoteDir transfers once a file fails,
+	// listing the failures in the returned error, see skipFailures
+	KeepGoing bool
+
+	// Concurrency is the number of sftp requests kept in flight for each file, at most maxConcurrency, rather than
+	// waiting for each chunk to be acknowledged before sending the next. Defaults to DefaultConcurrency
+	Concurrency int
+
+	// Sparse skips over aligned blocks of zeros rather than writing them, leaving holes in the destination so sparse
+	// files, such as VM images, aren't inflated to their full size. Whether holes are left depends on the filesystem
+	// of the destination and, for uploads, on the sftp server.
+	Sparse bool
+}
+
+// dryRun reports whether opts requests a dry run
+func (opts *TransferOptions) dryRun() bool {
+	return opts != nil && opts.DryRun
+}
+
+// makeRemoteParent creates the missing parent directories of remotePath when opts.MakeDirs is set
+func (opts *TransferOptions) makeRemoteParent(client *sftp.Client, remotePath string) error {
+	if opts == nil || !opts.MakeDirs {
+		return nil
+	}
+	return makeRemoteDirs(client, path.Dir(remotePath))
+}
+
+// makeRemoteDirs creates the remote directory dir along with any missing parents, failing with the offending path when
+// one of them exists but is not a directory
+func makeRemoteDirs(client *sftp.Client, dir string) error {
+	info, err := client.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("cannot make remote directory [%s]: it exists and is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := makeRemoteDirs(client, parent); err != nil {
+			return err
+		}
+	}
+	if err := client.Mkdir(dir); err != nil {
+		// made concurrently by another transfer in the meantime
+		if info, statErr := client.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return fmt.Errorf("error making remote directory [%s] (%w)", dir, err)
+	}
+	log.Debugf("made directory: %s", dir)
+	return nil
+}
+
+// maxParallelTransfers bounds concurrent transfers so the outstanding requests, up to
+// sftp.MaxConcurrentRequestsPerFile per file, stay within what sftp servers accept
+const maxParallelTransfers = 8
+
+// parallelism returns the number of concurrent transfers requested, bounded to [1, maxParallelTransfers]
+func (opts *TransferOptions) parallelism() int {
+	if opts == nil || opts.Parallel < 1 {
+		return 1
+	}
+	if opts.Parallel > maxParallelTransfers {
+		log.Warnf("limiting parallel transfers to %d", maxParallelTransfers)
+		return maxParallelTransfers
+	}
+	return opts.Parallel
+}
+
+const (
+	// DefaultConcurrency is the number of sftp requests kept in flight for each file unless configured otherwise
+	DefaultConcurrency = 16
+
+	// maxConcurrency is the most requests the sftp client keeps in flight for a single file
+	maxConcurrency = 64
+
+	// sftpChunkSize is the size of each sftp read and write, the largest packet all sftp servers accept
+	sftpChunkSize = 32 * 1024
+)
+
+// concurrency returns the number of sftp requests to keep in flight for each file, bounded to [1, maxConcurrency]
+func (opts *TransferOptions) concurrency() int {
+	if opts == nil || opts.Concurrency < 1 {
+		return DefaultConcurrency
+	}
+	if opts.Concurrency > maxConcurrency {
+		log.Warnf("limiting concurrency to %d", maxConcurrency)
+		return maxConcurrency
+	}
+	return opts.Concurrency
+}
+
+// writeRemote copies src to the remote file f, keeping up to opts.concurrency() writes in flight so the copy isn't
+// bound by the round trip of each chunk. Writes following a failed one may have landed, so on failure f is truncated
+// to what was written before it, leaving no hole for a resumed transfer to skip over.
+func (opts *TransferOptions) writeRemote(client *sftp.Client, f *sftp.File, src io.Reader) error {
+	concurrency := opts.concurrency()
+	if opts.sparse() {
+		if concurrency == 1 {
+			return opts.writeSparse(f, src, f.Truncate)
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		return opts.writeSparse(&chunkWriter{w: f, offset: offset}, src, f.Truncate)
+	}
+	if concurrency == 1 {
+		_, err := io.Copy(f, src)
+		return err
+	}
+	if _, err := f.ReadFromWithConcurrency(src, concurrency); err != nil {
+		if written, seekErr := f.Seek(0, io.SeekCurrent); seekErr == nil {
+			_ = client.Truncate(f.Name(), written)
+		}
+		return err
+	}
+	return nil
+}
+
+// readRemote copies src, read from a remote file, to dst. Each read asks for opts.concurrency() chunks at once,
+// which the sftp client requests concurrently.
+func (opts *TransferOptions) readRemote(dst io.Writer, src io.Reader) error {
+	// hiding dst's ReadFrom, e.g. that of *os.File, keeps it from reading src in small chunks of its own
+	_, err := io.CopyBuffer(struct{ io.Writer }{dst}, src, make([]byte, opts.concurrency()*sftpChunkSize))
+	return err
+}
+
+// sparse reports whether opts requests sparse copies
+func (opts *TransferOptions) sparse() bool {
+	return opts != nil && opts.Sparse
+}
+
+// writeSparse copies src to dst, positioned where the copy starts, through a sparseWriter and sets the size of dst
+// with truncate once done. On failure dst is truncated to what was copied before it, as after a failed writeRemote.
+// Each run of data is written with a single write of up to opts.concurrency() chunks, which writeRemote passes to a
+// chunkWriter so they are sent concurrently.
+func (opts *TransferOptions) writeSparse(dst io.WriteSeeker, src io.Reader, truncate func(size int64) error) error {
+	offset, err := dst.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	w := newSparseWriter(dst, offset)
+	_, err = io.CopyBuffer(w, src, make([]byte, opts.concurrency()*sftpChunkSize))
+	if finishErr := w.finish(truncate); err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+// chunkWriter writes each Write to w as concurrent writes of sftpChunkSize, as the sftp client's writes to a file are
+// otherwise sent one chunk at a time. Writes following a failed one may have landed, which the truncate of a failed
+// writeSparse undoes. Only seeking relative to the current offset, as a sparseWriter does, is supported.
+type chunkWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	chunks := (len(p) + sftpChunkSize - 1) / sftpChunkSize
+	errs := make([]error, chunks)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < chunks; i++ {
+		start := i * sftpChunkSize
+		chunk := p[start:min(start+sftpChunkSize, len(p))]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.w.WriteAt(chunk, c.offset+int64(start))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			c.offset += int64(i * sftpChunkSize)
+			return i * sftpChunkSize, err
+		}
+	}
+	c.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (c *chunkWriter) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekCurrent {
+		return c.offset, fmt.Errorf("chunkWriter only seeks relative to its offset")
+	}
+	c.offset += offset
+	return c.offset, nil
+}
+
+// fileRetryDelay is the wait between attempts to transfer a file, see TransferOptions.FileRetries
+var fileRetryDelay = time.Second
+
+// retryFile calls transfer until it succeeds or has been retried opts.FileRetries times, returning the last error.
+// Cancelling ctx stops retrying.
+func (opts *TransferOptions) retryFile(ctx context.Context, name string, transfer func() error) error {
+	retries := 0
+	if opts != nil {
+		retries = opts.FileRetries
+	}
+	for i := 0; ; i++ {
+		err := transfer()
+		if err == nil || i >= retries || ctx.Err() != nil {
+			return err
+		}
+		log.Warnf("transferring [%s] failed, retrying in %v (%d/%d): %v", name, fileRetryDelay, i+1, retries, err)
+		select {
+		case <-time.After(fileRetryDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// transferFailures collects the files of a recursive transfer which failed, so the rest of the tree still transfers
+type transferFailures struct {
+	mu          sync.Mutex
+	files       int
+	failedFiles int
+	failed      []string
+
+	// stopOnFailure ends the transfer at the first failure, see TransferOptions.skipFailures
+	stopOnFailure bool
+}
+
+func (f *transferFailures) add(name string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failedFiles++
+	f.failed = append(f.failed, fmt.Sprintf("%s: %v", name, err))
+}
+
+// addDir records a directory which couldn't be made. The files beneath it are then skipped, see skip.
+func (f *transferFailures) addDir(name string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed = append(f.failed, fmt.Sprintf("%s: %v, skipping its contents", name, err))
+}
+
+// skip counts a file beneath a directory which couldn't be made as failed
+func (f *transferFailures) skip() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files++
+	f.failedFiles++
+}
+
+// stopped reports whether the transfer should stop, as a file or directory failed with stopOnFailure set
+func (f *transferFailures) stopped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stopOnFailure && len(f.failed) > 0
+}
+
+// err summarizes the failures, if any, listing the files and directories which failed
+func (f *transferFailures) err(verb string) error {
+	if len(f.failed) == 0 {
+		return nil
+	}
+	if f.stopOnFailure {
+		return fmt.Errorf("failed to %s %s", verb, f.failed[0])
+	}
+	return fmt.Errorf("failed to %s %d of %d files:\n  %s", verb, f.failedFiles, f.files, strings.Join(f.failed, "\n  "))
+}
+
+// skipFailures reports whether a recursive transfer carries on past a file which failed, listing it in the returned
+// error: with opts.KeepGoing, opts.FileRetries or parallel uploads. Otherwise the first failure stops the transfer.
+func (opts *TransferOptions) skipFailures() bool {
+	return opts != nil && (opts.KeepGoing || opts.FileRetries > 0 || opts.Parallel > 1)
+}
+
+// isBeneath reports whether p is beneath the directory dir, whose separator is sep
+func isBeneath(p string, dir string, sep string) bool {
+	return dir != "" && strings.HasPrefix(p, strings.TrimSuffix(dir, sep)+sep)
+}
+
+// ProgressFunc is notified of the bytes transferred so far for the named file. total is -1 when the size is unknown.
+type ProgressFunc func(name string, transferred int64, total int64)
+
+// ProgressReader wraps a reader, reporting the bytes read through it to a ProgressFunc
+type ProgressReader struct {
+	io.Reader
+	Name        string
+	Total       int64
+	Transferred int64
+	OnProgress  ProgressFunc
+}
+
+func (r *ProgressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Transferred += int64(n)
+	if n > 0 {
+		r.OnProgress(r.Name, r.Transferred, r.Total)
+	} else if err == io.EOF && r.Total < 0 {
+		// the size was unknown up front, report the final size now that it is known
+		r.OnProgress(r.Name, r.Transferred, r.Transferred)
+	}
+	return n, err
+}
+
+// progressReader wraps r when opts requests progress reporting, counting from offset when resuming
+func (opts *TransferOptions) progressReader(r io.Reader, name string, total int64, offset int64) io.Reader {
+	if opts == nil || opts.Progress == nil {
+		return r
+	}
+	opts.Progress(name, offset, total)
+	return &ProgressReader{Reader: r, Name: name, Total: total, Transferred: offset, OnProgress: opts.Progress}
+}
+
+// maxLimitBurst bounds the bytes a rate limited transfer may read at once
+const maxLimitBurst = 32 * 1024
+
+// rateLimitedReader throttles reads from the underlying reader to the rate of the limiter. Waiting for the limiter
+// ends once ctx is done, so a slow transfer can still be cancelled promptly.
+type rateLimitedReader struct {
+	io.Reader
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+// newRateLimitedReader returns r throttled to bytesPerSecond until ctx is done
+func newRateLimitedReader(ctx context.Context, r io.Reader, bytesPerSecond int64) *rateLimitedReader {
+	burst := maxLimitBurst
+	if bytesPerSecond < int64(burst) {
+		burst = int(bytesPerSecond)
+	}
+	limiter := rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+	// the bucket starts full, drain it so the first burst isn't free
+	limiter.AllowN(time.Now(), burst)
+	return &rateLimitedReader{Reader: r, ctx: ctx, limiter: limiter}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// sourceReader positions r at offset and wraps it as requested by opts, returning the hash to be verified after the
+// copy when verifying. The bytes skipped when resuming are included in the hash.
+func (opts *TransferOptions) sourceReader(ctx context.Context, r io.ReadSeeker, name string, total int64, offset int64) (io.Reader, hash.Hash, error) {
+	var h hash.Hash
+	if opts != nil && opts.Verify {
+		h = sha256.New()
+		if _, err := io.CopyN(h, r, offset); err != nil {
+			return nil, nil, err
+		}
+	} else if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	return opts.wrapSource(ctx, r, name, total, offset, h), h, nil
+}
+
+// wrapSource rate limits src, reports its progress and counts it toward the stats as requested by opts, writing what
+// is read to h when not nil
+func (opts *TransferOptions) wrapSource(ctx context.Context, src io.Reader, name string, total int64, offset int64, h hash.Hash) io.Reader {
+	if opts != nil && opts.Limit > 0 {
+		src = newRateLimitedReader(ctx, src, opts.Limit)
+	}
+	src = opts.progressReader(src, name, total, offset)
+	if opts != nil && opts.Stats != nil {
+		src = opts.Stats.reader(src)
+	}
+	if h != nil {
+		src = io.TeeReader(src, h)
+	}
+	return src
+}
+
+// resumeOffset returns the offset to continue a transfer from given the size of an existing destination, or 0 when
+// the transfer must start over
+func (opts *TransferOptions) resumeOffset(dest string, destSize int64, sourceSize int64) int64 {
+	if opts == nil || !opts.Resume || destSize <= 0 {
+		return 0
+	}
+	if destSize > sourceSize {
+		log.Infof("[%s] is larger than the source, transferring in full", dest)
+		return 0
+	}
+	log.Infof("resuming [%s] from %s", dest, formatBytes(destSize))
+	return destSize
+}
+
+// verifyChecksum compares the expected SHA-256 to that of dest, removing dest when they differ
+func verifyChecksum(expected []byte, dest string, open func(string) (io.ReadCloser, error), remove func(string) error) error {
+	f, err := open(dest)
+	if err != nil {
+		return fmt.Errorf("unable to open [%s] to verify checksum (%w)", dest, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("unable to read [%s] to verify checksum (%w)", dest, err)
+	}
+	actual := h.Sum(nil)
+	if !bytes.Equal(expected, actual) {
+		_ = f.Close()
+		if err := remove(dest); err != nil {
+			log.Warnf("unable to remove [%s] after checksum mismatch: %v", dest, err)
+		}
+		return fmt.Errorf("checksum mismatch for [%s]: source sha256 %x, destination sha256 %x", dest, expected, actual)
+	}
+	log.Debugf("verified sha256 %x: %s", actual, dest)
+	return nil
+}
+
+// contextReader fails reads once ctx is done, stopping a copy between chunks when cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// removePartial removes the partially written dest of a failed transfer, unless it is being kept to be resumed or
+// inspected. A transfer failing because the connection was lost can't remove it.
+func (opts *TransferOptions) removePartial(dest string, remove func(string) error) {
+	if opts != nil && opts.Resume {
+		log.Infof("keeping partial [%s] to resume", dest)
+		return
+	}
+	if opts != nil && opts.KeepPartial {
+		log.Infof("keeping partial [%s]", dest)
+		return
+	}
+	if err := remove(dest); err != nil {
+		log.Warnf("unable to remove partial [%s]: %v", dest, err)
+	}
+}
+
+// partSuffix names the file SendFile and RetrieveRemoteFiles write to, next to the destination, which is only renamed
+// into place once complete. An interrupted transfer never leaves a truncated file at the destination, and with
+// TransferOptions.Resume the partial file is kept to continue from.
+const partSuffix = ".part"
+
+// renameRemote moves the remote file from to to, replacing to. The posix-rename@openssh.com extension replaces to
+// atomically; plain sftp renames fail when to exists, so on servers without the extension it is removed first.
+func renameRemote(client *sftp.Client, from string, to string) error {
+	if err := client.PosixRename(from, to); err == nil {
+		return nil
+	}
+	err := client.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := client.Stat(to); statErr != nil {
+		return err
+	}
+	if err := client.Remove(to); err != nil {
+		return err
+	}
+	return client.Rename(from, to)
+}
+
+// remoteDestination resolves the symlinks at remotePath, so that a file sent there replaces the file linked to rather
+// than the link, and reports whether the file there is regular, or missing, and so may be replaced by renaming a
+// partial file over it. Anything else, such as /dev/null, is written in place, and can't be removed after a failed
+// transfer or read back to verify.
+func remoteDestination(client *sftp.Client, remotePath string) (string, bool) {
+	if _, err := client.Lstat(remotePath); err != nil {
+		return remotePath, true
+	}
+	real, err := remoteRealPath(client, remotePath)
+	if err != nil {
+		// a dangling link, writing through it still reaches its target
+		return remotePath, false
+	}
+	info, err := client.Stat(real)
+	if err != nil {
+		return remotePath, false
+	}
+	return real, info.Mode().IsRegular()
+}
+
+// localDestination resolves the symlinks at localPath and reports whether the file there may be replaced, see
+// remoteDestination
+func localDestination(localPath string) (string, bool) {
+	if resolved, err := filepath.EvalSymlinks(localPath); err == nil {
+		localPath = resolved
+	}
+	info, err := os.Stat(localPath)
+	return localPath, err != nil || info.Mode().IsRegular()
+}
+
+// SendFile uploads localPath to remotePath, writing to remotePath with partSuffix appended and renaming it into place
+// once fully written and verified. A symlink at remotePath is kept, replacing the file it links to, and a remotePath
+// which isn't a regular file, such as /dev/null, is written in place as SendStream would.
+func SendFile(ctx context.Context, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+	if opts.dryRun() {
+		log.Infof("[dry run] would send file: %s ==> %s", localPath, remotePath)
+		return nil
+	}
+
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open local file %v", localPath)
+	}
+	defer func() { _ = localFile.Close() }()
+
+	info, err := localFile.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat local file %v", localPath)
+	}
+
+	if err := opts.makeRemoteParent(client, remotePath); err != nil {
+		return err
+	}
+	remotePath, replaceable := remoteDestination(client, remotePath)
+	if !replaceable {
+		return SendStream(ctx, client, localFile, remotePath, opts)
+	}
+	partPath := remotePath + partSuffix
+	offset := int64(0)
+	if partInfo, err := client.Stat(partPath); err == nil {
+		offset = opts.resumeOffset(partPath, partInfo.Size(), info.Size())
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	rmtFile, err := client.OpenFile(partPath, flags)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open remote file %v", partPath)
+	}
+	defer func() { _ = rmtFile.Close() }()
+	if _, err = rmtFile.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "unable to seek remote file %v", partPath)
+	}
+
+	src, checksum, err := opts.sourceReader(ctx, localFile, filepath.Base(localPath), info.Size(), offset)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read local file %v", localPath)
+	}
+	// closing the remote file unblocks a copy stuck writing to it
+	stop := context.AfterFunc(ctx, func() { _ = rmtFile.Close() })
+	defer stop()
+	if err = opts.writeRemote(client, rmtFile, &contextReader{ctx: ctx, r: src}); err != nil {
+		_ = rmtFile.Close()
+		opts.removePartial(partPath, client.Remove)
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "sending %v cancelled", localPath)
+		}
+		return errors.Wrapf(err, "unable to copy local file %v to remote file %v", localPath, remotePath)
+	}
+	if err = rmtFile.Close(); err != nil {
+		opts.removePartial(partPath, client.Remove)
+		return errors.Wrapf(err, "unable to close remote file %v", partPath)
+	}
+	if err = finishRemoteFile(client, partPath, info, checksum, opts); err != nil {
+		return err
+	}
+	if err = renameRemote(client, partPath, remotePath); err != nil {
+		return errors.Wrapf(err, "unable to rename remote file %v to %v", partPath, remotePath)
+	}
+	return nil
+}
+
+// finishRemoteFile verifies the checksum of a file sent to remotePath, when verifying, and applies the permissions
+// and, when requested, modification time of the local file described by info
+func finishRemoteFile(client *sftp.Client, remotePath string, info os.FileInfo, checksum hash.Hash, opts *TransferOptions) error {
+	if checksum != nil {
+		open := func(name string) (io.ReadCloser, error) { return client.Open(name) }
+		if err := verifyChecksum(checksum.Sum(nil), remotePath, open, client.Remove); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Chmod(remotePath, info.Mode().Perm()); err != nil {
+		log.Warnf("unable to preserve permissions of remote file %s: %v", remotePath, err)
+	}
+	if opts != nil && opts.PreserveTimes {
+		if err := client.Chtimes(remotePath, info.ModTime(), info.ModTime()); err != nil {
+			log.Warnf("unable to preserve modification time of remote file %s: %v", remotePath, err)
+		}
+	}
+
+	return nil
+}
+
+// RetrieveRemoteFiles downloads remotePath to localPath, writing to localPath with partSuffix appended and renaming
+// it into place once fully written, synced and verified. A symlink at localPath is kept, replacing the file it links
+// to, and a localPath which isn't a regular file, such as /dev/null, is written in place as RetrieveStream would.
+func RetrieveRemoteFiles(ctx context.Context, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+	if opts.dryRun() {
+		log.Infof("[dry run] would retrieve file: %s ==> %s", remotePath, localPath)
+		return nil
+	}
+
+	dest, replaceable := localDestination(localPath)
+	if !replaceable {
+		lf, err := os.OpenFile(dest, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("error opening local file [%s] (%w)", localPath, err)
+		}
+		defer func() { _ = lf.Close() }()
+		if err := RetrieveStream(ctx, client, lf, remotePath, opts); err != nil {
+			return err
+		}
+		if err := lf.Close(); err != nil {
+			return fmt.Errorf("error closing local file [%s] (%w)", localPath, err)
+		}
+		log.Infof("%s => %s", remotePath, localPath)
+		return nil
+	}
+
+	rf, err := client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("error opening remote file [%s] (%w)", remotePath, err)
+	}
+	defer func() { _ = rf.Close() }()
+
+	info, err := rf.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading remote file [%s] (%w)", remotePath, err)
+	}
+
+	partPath := dest + partSuffix
+	offset := int64(0)
+	if partInfo, err := os.Stat(partPath); err == nil {
+		offset = opts.resumeOffset(partPath, partInfo.Size(), info.Size())
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	lf, err := os.OpenFile(partPath, flags, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error opening local file [%s] (%w)", partPath, err)
+	}
+	defer func() { _ = lf.Close() }()
+	if _, err = lf.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking local file [%s] (%w)", partPath, err)
+	}
+
+	src, checksum, err := opts.sourceReader(ctx, rf, path.Base(remotePath), info.Size(), offset)
+	if err != nil {
+		return fmt.Errorf("error reading remote file [%s] (%w)", remotePath, err)
+	}
+	// closing the remote file unblocks a copy stuck reading from it
+	stop := context.AfterFunc(ctx, func() { _ = rf.Close() })
+	defer stop()
+	if opts.sparse() {
+		err = opts.writeSparse(lf, &contextReader{ctx: ctx, r: src}, lf.Truncate)
+	} else {
+		err = opts.readRemote(lf, &contextReader{ctx: ctx, r: src})
+	}
+	if err != nil {
+		_ = lf.Close()
+		opts.removePartial(partPath, os.Remove)
+		if ctx.Err() != nil {
+			return fmt.Errorf("retrieving [%s] cancelled (%w)", remotePath, ctx.Err())
+		}
+		return fmt.Errorf("error copying remote file to local [%s] (%w)", remotePath, err)
+	}
+	if err = lf.Sync(); err == nil {
+		err = lf.Close()
+	}
+	if err != nil {
+		_ = lf.Close()
+		opts.removePartial(partPath, os.Remove)
+		return fmt.Errorf("error closing local file [%s] (%w)", partPath, err)
+	}
+	if err := finishLocalFile(partPath, info, checksum, opts); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, dest); err != nil {
+		return fmt.Errorf("error renaming local file [%s] to [%s] (%w)", partPath, dest, err)
+	}
+	log.Infof("%s => %s", remotePath, localPath)
+
+	return nil
+}
+
+// finishLocalFile verifies the checksum of a file retrieved to localPath, when verifying, and applies the permissions
+// and, when requested, modification time of the remote file described by info
+func finishLocalFile(localPath string, info os.FileInfo, checksum hash.Hash, opts *TransferOptions) error {
+	if checksum != nil {
+		open := func(name string) (io.ReadCloser, error) { return os.Open(name) }
+		if err := verifyChecksum(checksum.Sum(nil), localPath, open, os.Remove); err != nil {
+			return err
+		}
+	}
+
+	// the mode passed to OpenFile only applies to newly created files
+	if err := os.Chmod(localPath, info.Mode().Perm()); err != nil {
+		log.Warnf("unable to preserve permissions of local file %s: %v", localPath, err)
+	}
+	if opts != nil && opts.PreserveTimes {
+		if err := os.Chtimes(localPath, info.ModTime(), info.ModTime()); err != nil {
+			log.Warnf("unable to preserve modification time of local file %s: %v", localPath, err)
+		}
+	}
+	return nil
+}
+
+// SendDir recursively uploads localPath into remotePath, recreating the local directory structure, including the
+// base directory of localPath, remotely. Directories are created in order as they are walked while up to
+// opts.Parallel files are sent concurrently. The first file which fails to send stops the upload unless
+// opts.skipFailures, when the failures are summarized in the returned error once all transfers are done. remotePath,
+// and any missing parents, are created first.
+func SendDir(ctx context.Context, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+	if !opts.dryRun() {
+		if err := makeRemoteDirs(client, remotePath); err != nil {
+			return err
+		}
+	}
+
+	type sendTask struct {
+		localPath  string
+		remotePath string
+	}
+	tasks := make(chan sendTask)
+
+	failures := &transferFailures{stopOnFailure: !opts.skipFailures()}
+	fail := failures.add
+
+	send := func(task sendTask) {
+		err := opts.retryFile(ctx, task.localPath, func() error {
+			return SendFile(ctx, client, task.localPath, task.remotePath, opts)
+		})
+		if err != nil {
+			fail(task.localPath, err)
+		} else if !opts.dryRun() {
+			log.Infof("sent file: %s ==> %s", task.localPath, task.remotePath)
+		}
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < opts.parallelism(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for task := range tasks {
+				send(task)
+			}
+		}()
+	}
+
+	// directories entered by following symlinks, by their real path, so loops are only followed once
+	visited := map[string]bool{}
+	if real, err := filepath.EvalSymlinks(localPath); err == nil {
+		visited[real] = true
+	}
+
+	// the directory which couldn't be made remotely, whose contents are skipped
+	failedDir := ""
+	var walk func(localRoot string, remoteRoot string) error
+	walk = func(localRoot string, remoteRoot string) error {
+		return filepath.WalkDir(localRoot, func(localFile string, entry fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if failures.stopped() {
+				return filepath.SkipAll
+			}
+			if isBeneath(localFile, failedDir, string(filepath.Separator)) {
+				if entry != nil && !entry.IsDir() {
+					failures.skip()
+				}
+				return nil
+			}
+			if err != nil {
+				if entry == nil {
+					return err
+				}
+				fail(localFile, err)
+				return nil
+			}
+			rel, err := filepath.Rel(localRoot, localFile)
+			if err != nil {
+				return err
+			}
+			remoteFile := path.Join(remoteRoot, filepath.ToSlash(rel))
+			switch {
+			case entry.IsDir():
+				if opts.dryRun() {
+					log.Infof("[dry run] would make directory: %s", remoteFile)
+					return nil
+				}
+				if err := client.Mkdir(remoteFile); err != nil {
+					// a directory which already exists is reused
+					if info, statErr := client.Stat(remoteFile); statErr == nil && info.IsDir() {
+						return nil
+					}
+					failures.addDir(localFile, fmt.Errorf("unable to make remote directory [%s] (%w)", remoteFile, err))
+					failedDir = localFile
+					return nil
+				}
+				log.Debugf("made directory: %s", remoteFile)
+				return nil
+			case entry.Type()&fs.ModeSymlink != 0 && !opts.followSymlinks():
+				failures.files++
+				if err := sendSymlink(client, localFile, remoteFile, opts); err != nil {
+					fail(localFile, err)
+				}
+				return nil
+			case entry.Type()&fs.ModeSymlink != 0:
+				info, err := os.Stat(localFile)
+				if err != nil {
+					failures.files++
+					fail(localFile, err)
+					return nil
+				}
+				if info.IsDir() {
+					real, err := filepath.EvalSymlinks(localFile)
+					if err != nil {
+						fail(localFile, err)
+						return nil
+					}
+					if visited[real] {
+						log.Warnf("skipping symlink loop: %s -> %s", localFile, real)
+						return nil
+					}
+					visited[real] = true
+					return walk(real, remoteFile)
+				}
+			}
+			failures.files++
+			if failures.stopOnFailure {
+				// sent before walking on, so nothing after a failed file is sent
+				send(sendTask{localPath: localFile, remotePath: remoteFile})
+				return nil
+			}
+			tasks <- sendTask{localPath: localFile, remotePath: remoteFile}
+			return nil
+		})
+	}
+	walkErr := walk(localPath, path.Join(remotePath, filepath.Base(localPath)))
+	close(tasks)
+	workers.Wait()
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("sending [%s] cancelled (%w)", localPath, ctx.Err())
+	}
+	if walkErr != nil {
+		return fmt.Errorf("error walking local path [%s] (%w)", localPath, walkErr)
+	}
+	return failures.err("send")
+}
+
+// followSymlinks reports whether opts requests symlinks are followed
+func (opts *TransferOptions) followSymlinks() bool {
+	return opts != nil && opts.FollowSymlinks
+}
+
+// sendSymlink recreates the local symlink localPath as remotePath, replacing any symlink already there
+func sendSymlink(client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+	target, err := os.Readlink(localPath)
+	if err != nil {
+		return fmt.Errorf("unable to read symlink (%w)", err)
+	}
+	target = filepath.ToSlash(target)
+	if opts.dryRun() {
+		log.Infof("[dry run] would link: %s -> %s", remotePath, target)
+		return nil
+	}
+	if info, err := client.Lstat(remotePath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		_ = client.Remove(remotePath)
+	}
+	if err := client.Symlink(target, remotePath); err != nil {
+		return fmt.Errorf("unable to create remote symlink %s -> %s (%w)", remotePath, target, err)
+	}
+	log.Debugf("linked: %s -> %s", remotePath, target)
+	return nil
+}
+
+// retrieveSymlink recreates the remote symlink remotePath as localPath or, when following symlinks, retrieves what it
+// points to. Directories already in visited are skipped, to avoid looping forever.
+func retrieveSymlink(ctx context.Context, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions, visited map[string]bool, failures *transferFailures) error {
+	if !opts.followSymlinks() {
+		failures.files++
+		target, err := client.ReadLink(remotePath)
+		if err != nil {
+			return fmt.Errorf("error reading remote symlink [%s] (%w)", remotePath, err)
+		}
+		if opts.dryRun() {
+			log.Infof("[dry run] would link: %s -> %s", localPath, target)
+			return nil
+		}
+		if info, err := os.Lstat(localPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			_ = os.Remove(localPath)
+		}
+		if err := os.Symlink(filepath.FromSlash(target), localPath); err != nil {
+			return fmt.Errorf("error creating local symlink [%s] (%w)", localPath, err)
+		}
+		log.Debugf("linked: %s -> %s", localPath, target)
+		return nil
+	}
+
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		failures.files++
+		return fmt.Errorf("error following remote symlink [%s] (%w)", remotePath, err)
+	}
+	if !info.IsDir() {
+		failures.files++
+		return opts.retryFile(ctx, remotePath, func() error {
+			return RetrieveRemoteFiles(ctx, client, localPath, remotePath, opts)
+		})
+	}
+	real, err := remoteRealPath(client, remotePath)
+	if err != nil {
+		return err
+	}
+	if visited[real] {
+		log.Warnf("skipping symlink loop: %s -> %s", remotePath, real)
+		return nil
+	}
+	visited[real] = true
+	return retrieveTree(ctx, client, localPath, real, opts, visited, failures)
+}
+
+// remoteRealPath resolves the remote symlink remotePath, and any symlinks it leads to, to the path it refers to
+func remoteRealPath(client *sftp.Client, remotePath string) (string, error) {
+	for i := 0; i < maxSymlinkHops; i++ {
+		info, err := client.Lstat(remotePath)
+		if err != nil {
+			return "", fmt.Errorf("error reading remote path [%s] (%w)", remotePath, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return client.RealPath(remotePath)
+		}
+		target, err := client.ReadLink(remotePath)
+		if err != nil {
+			return "", fmt.Errorf("error reading remote symlink [%s] (%w)", remotePath, err)
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(remotePath), target)
+		}
+		remotePath = target
+	}
+	return "", fmt.Errorf("too many levels of symbolic links resolving [%s]", remotePath)
+}
+
+// maxSymlinkHops bounds symlink resolution, matching the limit of most operating systems
+const maxSymlinkHops = 40
+
+// RetrieveRemoteDir recursively downloads remotePath into localPath, recreating the remote directory structure
+// locally. When localPath is an existing directory the remote directory is created inside it. A remotePath which
+// refers to a single file is downloaded as-is. Symlinks are recreated unless opts.FollowSymlinks is set. Special files
+// such as sockets and devices are skipped. The first file which fails to download stops the download unless
+// opts.skipFailures, when the failures are summarized in the returned error.
+func RetrieveRemoteDir(ctx context.Context, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("error reading remote path [%s] (%w)", remotePath, err)
+	}
+	if localInfo, err := os.Stat(localPath); err == nil && localInfo.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+	if !info.IsDir() {
+		return RetrieveRemoteFiles(ctx, client, localPath, remotePath, opts)
+	}
+
+	visited := map[string]bool{}
+	if real, err := remoteRealPath(client, remotePath); err == nil {
+		visited[real] = true
+	}
+	failures := &transferFailures{stopOnFailure: !opts.skipFailures()}
+	if err := retrieveTree(ctx, client, localPath, remotePath, opts, visited, failures); err != nil {
+		return err
+	}
+	return failures.err("retrieve")
+}
+
+// retrieveTree downloads the remote directory tree at remotePath into localPath, adding the files which fail to
+// failures. Errors walking the tree are returned.
+func retrieveTree(ctx context.Context, client *sftp.Client, localPath string, remotePath string, opts *TransferOptions, visited map[string]bool, failures *transferFailures) error {
+	// the directory which couldn't be made locally, whose contents are skipped
+	failedDir := ""
+	walker := client.Walk(remotePath)
+	for walker.Step() {
+		if ctx.Err() != nil {
+			return fmt.Errorf("retrieving [%s] cancelled (%w)", remotePath, ctx.Err())
+		}
+		if failures.stopped() {
+			return nil
+		}
+		if isBeneath(walker.Path(), failedDir, "/") {
+			if walker.Err() == nil && !walker.Stat().IsDir() {
+				failures.skip()
+			}
+			continue
+		}
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("error walking remote path [%s] (%w)", walker.Path(), err)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remotePath), "/")
+		localFile := filepath.Join(localPath, filepath.FromSlash(rel))
+		mode := walker.Stat().Mode()
+		switch {
+		case mode.IsDir():
+			if opts.dryRun() {
+				log.Infof("[dry run] would make directory: %s", localFile)
+				continue
+			}
+			if err := os.MkdirAll(localFile, os.ModePerm); err != nil {
+				failures.addDir(walker.Path(), fmt.Errorf("error making local directory [%s] (%w)", localFile, err))
+				failedDir = walker.Path()
+				continue
+			}
+			log.Debugf("made directory: %s", localFile)
+		case mode.IsRegular():
+			failures.files++
+			err := opts.retryFile(ctx, walker.Path(), func() error {
+				return RetrieveRemoteFiles(ctx, client, localFile, walker.Path(), opts)
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				failures.add(walker.Path(), err)
+				continue
+			}
+			log.Debugf("retrieved file: %s ==> %s", walker.Path(), localFile)
+		case mode&os.ModeSymlink != 0:
+			if err := retrieveSymlink(ctx, client, localFile, walker.Path(), opts, visited, failures); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				failures.add(walker.Path(), err)
+			}
+		default:
+			log.Warnf("skipping special file: %s [%s]", walker.Path(), mode.Type())
+		}
+	}
+	return nil
+}
+
+// ExpandLocalGlobs expands any glob patterns in paths with filepath.Glob, for shells which don't expand them or when
+// they were quoted. Paths without glob characters are returned unchanged. A pattern matching nothing is an error.
+func ExpandLocalGlobs(paths []string) ([]string, error) {
+	var expanded []string
+	for _, p := range paths {
+		if !hasGlobMeta(p) {
+			expanded = append(expanded, p)
+			continue
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("file pattern [%s] not recognized (%w)", p, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no local files match [%s]", p)
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// hasGlobMeta reports whether p contains any glob metacharacters
+func hasGlobMeta(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// ExpandRemoteGlob expands the remote glob pattern with client.Glob, for downloads from remote paths the local shell
+// didn't expand. A path without glob characters is returned unchanged. Names which only look like patterns, such as
+// file[1].txt, are returned as they are when they match nothing but exist. Matching directories are skipped unless
+// recursive, failing when nothing else matched.
+func ExpandRemoteGlob(client *sftp.Client, pattern string, recursive bool) ([]string, error) {
+	if !hasGlobMeta(pattern) {
+		return []string{pattern}, nil
+	}
+	matches, err := client.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("file pattern [%s] not recognized (%w)", pattern, err)
+	}
+	if len(matches) == 0 {
+		if _, err := client.Lstat(pattern); err == nil {
+			return []string{pattern}, nil
+		}
+		return nil, fmt.Errorf("no remote files match [%s]", pattern)
+	}
+	// matches are in the order the server lists directories, unlike filepath.Glob
+	sort.Strings(matches)
+	if recursive {
+		return matches, nil
+	}
+	var files []string
+	for _, match := range matches {
+		if info, err := client.Stat(match); err == nil && info.IsDir() {
+			log.Warnf("skipping remote directory [%s], use -r to copy directories", match)
+			continue
+		}
+		files = append(files, match)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("[%s] only matches directories, use -r to copy them", pattern)
+	}
+	return files, nil
+}
+
+// PrepareGlobDestination makes the local directory matches files expanded from a remote glob are retrieved into.
+// Several matches need localPath to be a directory, which is created along with any missing parents when it doesn't
+// exist, as is a localPath ending with a path separator. A single match may be retrieved to a file named localPath.
+func PrepareGlobDestination(localPath string, matches int, dryRun bool) error {
+	if matches < 2 && !hasTrailingSeparator(localPath) {
+		return nil
+	}
+	info, err := os.Stat(localPath)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("cannot copy %d files to [%s]: local path is not a directory", matches, localPath)
+		}
+		return nil
+	}
+	if dryRun {
+		log.Infof("[dry run] would make directory: %s", localPath)
+		return nil
+	}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return fmt.Errorf("error making local directory [%s] (%w)", localPath, err)
+	}
+	log.Debugf("made directory: %s", localPath)
+	return nil
+}
+
+// ProgressBar renders the progress of one or more transfers as a single, continually redrawn line showing the
+// percent complete, transfer rate and estimated time remaining, along with the number of files completed. The line
+// shows whichever file was last updated, with parallel transfers each timed from their own start.
+type ProgressBar struct {
+	out      io.Writer
+	mu       sync.Mutex
+	starts   map[string]time.Time
+	lastDraw time.Time
+	files    int
+}
+
+func NewProgressBar(out io.Writer) *ProgressBar {
+	return &ProgressBar{out: out, starts: map[string]time.Time{}}
+}
+
+// Update is a ProgressFunc which redraws the progress bar at most every 100ms, and always when a file completes
+func (b *ProgressBar) Update(name string, transferred int64, total int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	start, ok := b.starts[name]
+	if !ok || transferred == 0 {
+		start = now
+		b.starts[name] = start
+	}
+	done := total >= 0 && transferred >= total
+	if done {
+		delete(b.starts, name)
+	}
+	if !done && now.Sub(b.lastDraw) < 100*time.Millisecond {
+		return
+	}
+	b.lastDraw = now
+
+	elapsed := now.Sub(start).Seconds()
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(transferred) / elapsed
+	}
+
+	line := fmt.Sprintf("%-30.30s %10s %10s/s", name, formatBytes(transferred), formatBytes(int64(rate)))
+	if total >= 0 {
+		percent := 100
+		if total > 0 {
+			percent = int(transferred * 100 / total)
+		}
+		eta := "--:--"
+		if rate > 0 {
+			remaining := time.Duration(float64(total-transferred)/rate) * time.Second
+			eta = fmt.Sprintf("%02d:%02d", int(remaining.Minutes()), int(remaining.Seconds())%60)
+		}
+		line = fmt.Sprintf("%s %3d%% ETA %s", line, percent, eta)
+	}
+	if done {
+		b.files++
+	}
+	if b.files > 0 {
+		line = fmt.Sprintf("%s [%d files]", line, b.files)
+	}
+	_, _ = fmt.Fprintf(b.out, "\r%s\033[K", line)
+	if done {
+		_, _ = fmt.Fprintln(b.out)
+	}
+}
+
+// ParseByteRate parses a rate in bytes per second with an optional binary (1024 based) K, M or G suffix, e.g. 2M or
+// 512K. An empty rate is 0, meaning unlimited.
+func ParseByteRate(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "KMG"); i >= 0 && i == len(value)-1 {
+		multiplier = int64(1) << (10 * (strings.IndexByte("KMG", value[i]) + 1))
+		value = value[:i]
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate [%s]: expected bytes per second, e.g. 512K or 2M", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatBytes formats n using binary (1024 based) units, e.g. 12.3 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,1128 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSftpClient returns a sftp client connected to an in-process sftp server serving the local filesystem
+func newTestSftpClient(t testing.TB) *sftp.Client {
+	return newTestSftpClientWithLatency(t, 0)
+}
+
+// newTestSftpClientWithLatency returns a sftp client like newTestSftpClient, delaying each packet by latency in each
+// direction to simulate a high latency link
+func newTestSftpClientWithLatency(t testing.TB, latency time.Duration) *sftp.Client {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, newLatencyWriter(serverWriter, latency)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve() }()
+
+	client, err := sftp.NewClientPipe(clientReader, newLatencyWriter(clientWriter, latency))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+	return client
+}
+
+// latencyWriter delivers each write to w once latency has passed, without blocking the writer meanwhile, so
+// pipelined requests overlap as they would over a real link
+type latencyWriter struct {
+	w       io.WriteCloser
+	latency time.Duration
+	writes  chan latencyWrite
+	close   sync.Once
+}
+
+type latencyWrite struct {
+	data []byte
+	due  time.Time
+}
+
+func newLatencyWriter(w io.WriteCloser, latency time.Duration) io.WriteCloser {
+	if latency <= 0 {
+		return w
+	}
+	lw := &latencyWriter{w: w, latency: latency, writes: make(chan latencyWrite, 4096)}
+	go func() {
+		defer func() { _ = w.Close() }()
+		for write := range lw.writes {
+			time.Sleep(time.Until(write.due))
+			if _, err := w.Write(write.data); err != nil {
+				for range lw.writes {
+				}
+				return
+			}
+		}
+	}()
+	return lw
+}
+
+func (lw *latencyWriter) Write(p []byte) (int, error) {
+	lw.writes <- latencyWrite{data: append([]byte(nil), p...), due: time.Now().Add(lw.latency)}
+	return len(p), nil
+}
+
+func (lw *latencyWriter) Close() error {
+	lw.close.Do(func() { close(lw.writes) })
+	return nil
+}
+
+func hashFile(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		t.Fatal(err)
+	}
+	return h.Sum(nil)
+}
+
+func TestSendFileLarge(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "large.bin")
+	remotePath := filepath.Join(dir, "remote.bin")
+
+	f, err := os.Create(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := rand.New(rand.NewSource(1))
+	expected := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(f, expected), src, 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	client := newTestSftpClient(t)
+	err = SendFile(context.Background(), client, localPath, remotePath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Sum(nil), hashFile(t, remotePath), "remote file content differs")
+
+	err = SendFile(context.Background(), client, filepath.Join(dir, "missing.bin"), remotePath, nil)
+	assert.ErrorContains(t, err, "missing.bin")
+}
+
+func TestTransferConcurrency(t *testing.T) {
+	assert.Equal(t, DefaultConcurrency, (*TransferOptions)(nil).concurrency())
+	assert.Equal(t, maxConcurrency, (&TransferOptions{Concurrency: 1000}).concurrency())
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "local.bin")
+	content := make([]byte, 1<<20+123)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := hashFile(t, localPath)
+
+	client := newTestSftpClientWithLatency(t, time.Millisecond)
+	for _, concurrency := range []int{1, 4, maxConcurrency} {
+		opts := &TransferOptions{Concurrency: concurrency}
+		remotePath := filepath.Join(dir, fmt.Sprintf("remote-%d.bin", concurrency))
+		assert.NoError(t, SendFile(context.Background(), client, localPath, filepath.ToSlash(remotePath), opts))
+		assert.Equal(t, expected, hashFile(t, remotePath), "content sent with concurrency %d differs", concurrency)
+
+		retrieved := filepath.Join(dir, fmt.Sprintf("retrieved-%d.bin", concurrency))
+		assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, retrieved, filepath.ToSlash(remotePath), opts))
+		assert.Equal(t, expected, hashFile(t, retrieved), "content retrieved with concurrency %d differs", concurrency)
+	}
+}
+
+// benchmarkConcurrency runs transfer, given a 4MiB local file and a remote path, over a link with a 5ms round trip at
+// increasing concurrency. Run with: go test ./zsshlib -run '^$' -bench Concurrency
+func benchmarkConcurrency(b *testing.B, transfer func(client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error) {
+	localPath := filepath.Join(b.TempDir(), "local.bin")
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		b.Fatal(err)
+	}
+	level := log.GetLevel()
+	log.SetLevel(logrus.WarnLevel)
+	defer log.SetLevel(level)
+	for _, concurrency := range []int{1, 4, DefaultConcurrency, maxConcurrency} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			client := newTestSftpClientWithLatency(b, 2500*time.Microsecond)
+			remotePath := filepath.ToSlash(filepath.Join(b.TempDir(), "remote.bin"))
+			opts := &TransferOptions{Concurrency: concurrency}
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := transfer(client, localPath, remotePath, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSendFileConcurrency(b *testing.B) {
+	benchmarkConcurrency(b, func(client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+		return SendFile(context.Background(), client, localPath, remotePath, opts)
+	})
+}
+
+func BenchmarkRetrieveRemoteFilesConcurrency(b *testing.B) {
+	benchmarkConcurrency(b, func(client *sftp.Client, localPath string, remotePath string, opts *TransferOptions) error {
+		// the local file is the source, retrieving it from the server's view of the local filesystem
+		return RetrieveRemoteFiles(context.Background(), client, localPath+".retrieved", filepath.ToSlash(localPath), opts)
+	})
+}
+
+func TestRetrieveRemoteFiles(t *testing.T) {
+	dir := t.TempDir()
+	remotePath := filepath.Join(dir, "remote.txt")
+	localPath := filepath.Join(dir, "local.txt")
+	content := []byte("retrieved over sftp\n")
+	if err := os.WriteFile(remotePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestSftpClient(t)
+	err := RetrieveRemoteFiles(context.Background(), client, localPath, remotePath, nil)
+	assert.NoError(t, err)
+
+	downloaded, err := os.ReadFile(localPath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded, "downloaded content differs")
+
+	err = RetrieveRemoteFiles(context.Background(), client, localPath, filepath.Join(dir, "missing.txt"), nil)
+	assert.ErrorContains(t, err, "missing.txt")
+}
+
+func TestRetrieveRemoteDir(t *testing.T) {
+	remoteDir := filepath.Join(t.TempDir(), "project")
+	for _, d := range []string{"src/pkg", "empty"} {
+		if err := os.MkdirAll(filepath.Join(remoteDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"README.md":       "readme",
+		"src/main.go":     "package main",
+		"src/pkg/util.go": "package pkg",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := newTestSftpClient(t)
+	localDir := t.TempDir()
+	err := RetrieveRemoteDir(context.Background(), client, localDir, filepath.ToSlash(remoteDir), nil)
+	assert.NoError(t, err)
+
+	for name, content := range files {
+		downloaded, err := os.ReadFile(filepath.Join(localDir, "project", name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(downloaded), "content of %s differs", name)
+	}
+	info, err := os.Stat(filepath.Join(localDir, "project", "empty"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir(), "empty directory not recreated")
+
+	err = RetrieveRemoteDir(context.Background(), client, localDir, filepath.ToSlash(filepath.Join(remoteDir, "README.md")), nil)
+	assert.NoError(t, err)
+	downloaded, err := os.ReadFile(filepath.Join(localDir, "README.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "readme", string(downloaded))
+}
+
+func TestRetrieveRemoteDirFailures(t *testing.T) {
+	remoteDir := filepath.Join(t.TempDir(), "project")
+	for _, d := range []string{"src", "docs"} {
+		if err := os.MkdirAll(filepath.Join(remoteDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"README.md", "src/main.go", "src/util.go", "docs/a.md", "docs/b.md"} {
+		if err := os.WriteFile(filepath.Join(remoteDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a directory in place of the local README.md fails only that file, and a file in place of the local docs
+	// directory skips its contents
+	localDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(localDir, "project", "README.md"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(localDir, "project", "docs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestSftpClient(t)
+	err := RetrieveRemoteDir(context.Background(), client, localDir, filepath.ToSlash(remoteDir), &TransferOptions{FileRetries: 1})
+	assert.ErrorContains(t, err, "failed to retrieve 3 of 5 files")
+	assert.ErrorContains(t, err, filepath.ToSlash(filepath.Join(remoteDir, "README.md")))
+	assert.ErrorContains(t, err, "error making local directory")
+	for _, name := range []string{"src/main.go", "src/util.go"} {
+		content, err := os.ReadFile(filepath.Join(localDir, "project", name))
+		assert.NoError(t, err)
+		assert.Equal(t, name, string(content))
+	}
+}
+
+func TestRetryFile(t *testing.T) {
+	fileRetryDelay = time.Millisecond
+	defer func() { fileRetryDelay = time.Second }()
+
+	attempts := 0
+	flaky := func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("write failed")
+		}
+		return nil
+	}
+	assert.NoError(t, (&TransferOptions{FileRetries: 2}).retryFile(context.Background(), "flaky", flaky))
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	assert.ErrorContains(t, (&TransferOptions{FileRetries: 1}).retryFile(context.Background(), "flaky", flaky), "write failed")
+	assert.Equal(t, 2, attempts, "should give up after the retries")
+
+	attempts = 0
+	assert.Error(t, (*TransferOptions)(nil).retryFile(context.Background(), "flaky", flaky))
+	assert.Equal(t, 1, attempts, "files aren't retried by default")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	assert.Error(t, (&TransferOptions{FileRetries: 5}).retryFile(ctx, "flaky", flaky))
+	assert.Equal(t, 1, attempts, "cancelled transfers shouldn't be retried")
+}
+
+func TestSendDir(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "project")
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[filepath.Join(fmt.Sprintf("dir%d", i%4), fmt.Sprintf("file%d.txt", i))] = fmt.Sprintf("content %d", i)
+	}
+	files["broken/file.txt"] = "cannot be sent"
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(localDir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(localDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a file in place of the remote "broken" directory causes its contents to fail
+	remoteDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(remoteDir, "project"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(remoteDir, "project", "broken"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestSftpClient(t)
+	err := SendDir(context.Background(), client, localDir, filepath.ToSlash(remoteDir), &TransferOptions{Parallel: 4})
+	assert.ErrorContains(t, err, "failed to send 1 of 21 files")
+	assert.ErrorContains(t, err, "unable to make remote directory", "the directory should be reported rather than each file in it")
+
+	for name, content := range files {
+		if strings.HasPrefix(name, "broken") {
+			continue
+		}
+		sent, err := os.ReadFile(filepath.Join(remoteDir, "project", name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(sent), "content of %s differs", name)
+	}
+}
+
+func TestRecursiveTransferStopsAtFirstFailure(t *testing.T) {
+	tree := filepath.Join(t.TempDir(), "project")
+	for _, name := range []string{"a.txt", "b/file.txt", "c.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tree, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tree, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a file in place of the directory "b" makes it fail, after a.txt and before c.txt are transferred
+	blocked := func(t *testing.T) string {
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, "project"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "project", "b"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	client := newTestSftpClient(t)
+
+	for _, test := range []struct {
+		name    string
+		opts    *TransferOptions
+		carryOn bool
+	}{
+		{"default", nil, false},
+		{"keep going", &TransferOptions{KeepGoing: true}, true},
+		{"file retries", &TransferOptions{FileRetries: 1}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			remoteDir := blocked(t)
+			err := SendDir(context.Background(), client, tree, filepath.ToSlash(remoteDir), test.opts)
+			assert.ErrorContains(t, err, "unable to make remote directory")
+			assert.FileExists(t, filepath.Join(remoteDir, "project", "a.txt"))
+			if test.carryOn {
+				assert.ErrorContains(t, err, "failed to send 1 of 3 files")
+				assert.FileExists(t, filepath.Join(remoteDir, "project", "c.txt"))
+			} else {
+				assert.NoFileExists(t, filepath.Join(remoteDir, "project", "c.txt"), "the upload should stop at the first failure")
+			}
+
+			// remote directories are listed in no particular order, so which files precede "b" isn't known
+			localDir := blocked(t)
+			err = RetrieveRemoteDir(context.Background(), client, localDir, filepath.ToSlash(tree), test.opts)
+			assert.ErrorContains(t, err, "error making local directory")
+			if test.carryOn {
+				assert.ErrorContains(t, err, "failed to retrieve 1 of 3 files")
+				assert.FileExists(t, filepath.Join(localDir, "project", "a.txt"))
+				assert.FileExists(t, filepath.Join(localDir, "project", "c.txt"))
+			} else {
+				assert.NotContains(t, err.Error(), "of 3 files", "the download should stop at the first failure")
+			}
+		})
+	}
+}
+
+func TestTransferDryRun(t *testing.T) {
+	out := &bytes.Buffer{}
+	output := log.Out
+	log.SetOutput(out)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	localDir := filepath.Join(t.TempDir(), "project")
+	if err := os.MkdirAll(filepath.Join(localDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(localDir, "sub", "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remoteDir := t.TempDir()
+	client := newTestSftpClient(t)
+	opts := &TransferOptions{DryRun: true}
+
+	assert.NoError(t, SendDir(context.Background(), client, localDir, filepath.ToSlash(remoteDir), opts))
+	assert.NoDirExists(t, filepath.Join(remoteDir, "project"))
+	assert.Contains(t, out.String(), "would make directory: "+filepath.ToSlash(filepath.Join(remoteDir, "project", "sub")))
+	assert.Contains(t, out.String(), "would send file: "+filepath.Join(localDir, "sub", "file.txt"))
+
+	downloadDir := t.TempDir()
+	assert.NoError(t, RetrieveRemoteDir(context.Background(), client, downloadDir, filepath.ToSlash(localDir), opts))
+	assert.NoDirExists(t, filepath.Join(downloadDir, "project"))
+	assert.Contains(t, out.String(), "would retrieve file: "+filepath.ToSlash(filepath.Join(localDir, "sub", "file.txt")))
+}
+
+// newSymlinkTree creates a directory "src" containing a file, a link to the file, a link to a directory outside of
+// src and a link back to src itself
+func newSymlinkTree(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires additional privileges on windows")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{src, outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "other.txt"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"file-link": "file.txt", "outside-link": outside, "loop": src} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src
+}
+
+func TestTransferSymlinks(t *testing.T) {
+	src := newSymlinkTree(t)
+	client := newTestSftpClient(t)
+
+	assertLinksRecreated := func(dir string) {
+		for link, target := range map[string]string{"file-link": "file.txt", "outside-link": filepath.Join(filepath.Dir(src), "outside"), "loop": src} {
+			actual, err := os.Readlink(filepath.Join(dir, link))
+			assert.NoError(t, err, "%s should be a symlink", link)
+			assert.Equal(t, target, actual)
+		}
+	}
+	assertLinksFollowed := func(dir string) {
+		for name, content := range map[string]string{"file-link": "file", "outside-link/other.txt": "other"} {
+			info, err := os.Lstat(filepath.Join(dir, name))
+			assert.NoError(t, err)
+			if err == nil {
+				assert.Zero(t, info.Mode()&os.ModeSymlink, "%s should not be a symlink", name)
+			}
+			copied, err := os.ReadFile(filepath.Join(dir, name))
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(copied))
+		}
+		_, err := os.Lstat(filepath.Join(dir, "loop"))
+		assert.True(t, os.IsNotExist(err), "the symlink back to the source should be skipped")
+	}
+
+	remoteDir := t.TempDir()
+	assert.NoError(t, SendDir(context.Background(), client, src, filepath.ToSlash(remoteDir), nil))
+	assertLinksRecreated(filepath.Join(remoteDir, "src"))
+
+	localDir := t.TempDir()
+	assert.NoError(t, RetrieveRemoteDir(context.Background(), client, localDir, filepath.ToSlash(src), nil))
+	assertLinksRecreated(filepath.Join(localDir, "src"))
+
+	follow := &TransferOptions{FollowSymlinks: true}
+	remoteDir = t.TempDir()
+	assert.NoError(t, SendDir(context.Background(), client, src, filepath.ToSlash(remoteDir), follow))
+	assertLinksFollowed(filepath.Join(remoteDir, "src"))
+
+	localDir = t.TempDir()
+	assert.NoError(t, RetrieveRemoteDir(context.Background(), client, localDir, filepath.ToSlash(src), follow))
+	assertLinksFollowed(filepath.Join(localDir, "src"))
+}
+
+func TestProgressReader(t *testing.T) {
+	var updates []int64
+	content := strings.Repeat("x", 10000)
+	r := &ProgressReader{
+		Reader: strings.NewReader(content),
+		Name:   "file",
+		Total:  int64(len(content)),
+		OnProgress: func(name string, transferred int64, total int64) {
+			assert.Equal(t, "file", name)
+			assert.Equal(t, int64(len(content)), total)
+			updates = append(updates, transferred)
+		},
+	}
+	n, err := io.Copy(io.Discard, r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.NotEmpty(t, updates)
+	assert.Equal(t, int64(len(content)), updates[len(updates)-1], "final update should report the full size")
+}
+
+func TestProgressBar(t *testing.T) {
+	out := &bytes.Buffer{}
+	bar := NewProgressBar(out)
+	bar.Update("file.txt", 0, 2048)
+	bar.Update("file.txt", 2048, 2048)
+	assert.Contains(t, out.String(), "file.txt")
+	assert.Contains(t, out.String(), "100%")
+	assert.Contains(t, out.String(), "[1 files]")
+}
+
+func TestProgressBarParallel(t *testing.T) {
+	out := &bytes.Buffer{}
+	bar := NewProgressBar(out)
+	bar.Update("a.bin", 0, 2048)
+	bar.starts["a.bin"] = time.Now().Add(-time.Second)
+	// another file starting doesn't restart the timing of the first
+	bar.Update("b.bin", 0, 4096)
+	bar.lastDraw = time.Time{}
+	out.Reset()
+	bar.Update("a.bin", 1024, 2048)
+	assert.Contains(t, out.String(), "a.bin")
+	assert.Contains(t, out.String(), "50% ETA 00:01")
+	bar.Update("a.bin", 2048, 2048)
+	assert.NotContains(t, bar.starts, "a.bin", "completed files should be forgotten")
+	assert.Contains(t, bar.starts, "b.bin")
+}
+
+func TestTransferPreservesAttributes(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "script.sh")
+	remotePath := filepath.Join(dir, "remote.sh")
+	downloadPath := filepath.Join(dir, "downloaded.sh")
+	if err := os.WriteFile(localPath, []byte("#!/bin/sh\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestSftpClient(t)
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remotePath, nil))
+	info, err := os.Stat(remotePath)
+	assert.NoError(t, err)
+	assert.False(t, info.ModTime().Equal(mtime), "modification time should only be preserved when requested")
+
+	opts := &TransferOptions{PreserveTimes: true}
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remotePath, opts))
+	assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, downloadPath, remotePath, opts))
+	for _, p := range []string{remotePath, downloadPath} {
+		info, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.True(t, info.ModTime().Equal(mtime), "modification time of %s not preserved", p)
+		if runtime.GOOS != "windows" {
+			assert.Equal(t, os.FileMode(0750), info.Mode().Perm(), "permissions of %s not preserved", p)
+		}
+	}
+}
+
+func TestTransferVerify(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "local.txt")
+	remotePath := filepath.Join(dir, "remote.txt")
+	if err := os.WriteFile(localPath, []byte("verify me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestSftpClient(t)
+	opts := &TransferOptions{Verify: true}
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remotePath, opts))
+	assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, filepath.Join(dir, "downloaded.txt"), remotePath, opts))
+
+	expected := sha256.Sum256([]byte("something else"))
+	open := func(name string) (io.ReadCloser, error) { return os.Open(name) }
+	err := verifyChecksum(expected[:], remotePath, open, os.Remove)
+	assert.ErrorContains(t, err, "checksum mismatch")
+	_, err = os.Stat(remotePath)
+	assert.True(t, os.IsNotExist(err), "destination should be removed after a checksum mismatch")
+}
+
+func TestExpandLocalGlobs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain := filepath.Join(dir, "c.log")
+
+	paths, err := ExpandLocalGlobs([]string{filepath.Join(dir, "*.txt"), plain})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt"), plain}, paths)
+
+	_, err = ExpandLocalGlobs([]string{filepath.Join(dir, "*.none")})
+	assert.ErrorContains(t, err, "no local files match")
+}
+
+func TestExpandRemoteGlob(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	for _, name := range []string{"a.log", "b.log", "c.txt", "file[1].txt"} {
+		if err := os.WriteFile(path.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(path.Join(dir, "old.log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+
+	matches, err := ExpandRemoteGlob(client, path.Join(dir, "*.log"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join(dir, "a.log"), path.Join(dir, "b.log")}, matches, "directories are skipped")
+	matches, err = ExpandRemoteGlob(client, path.Join(dir, "*.log"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join(dir, "a.log"), path.Join(dir, "b.log"), path.Join(dir, "old.log")}, matches)
+
+	literal := path.Join(dir, "file[1].txt")
+	matches, err = ExpandRemoteGlob(client, literal, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{literal}, matches, "an existing name which looks like a pattern is kept")
+	matches, err = ExpandRemoteGlob(client, path.Join(dir, "missing.txt"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join(dir, "missing.txt")}, matches, "paths without glob characters are left to fail when retrieved")
+
+	_, err = ExpandRemoteGlob(client, path.Join(dir, "*.none"), false)
+	assert.ErrorContains(t, err, "no remote files match")
+	_, err = ExpandRemoteGlob(client, path.Join(dir, "old.*"), false)
+	assert.ErrorContains(t, err, "only matches directories, use -r")
+
+	local := filepath.Join(t.TempDir(), "logs", "new")
+	assert.NoError(t, PrepareGlobDestination(local, 1, false))
+	assert.NoDirExists(t, local, "a single match may name a file")
+	assert.NoError(t, PrepareGlobDestination(local, 2, true))
+	assert.NoDirExists(t, local)
+	assert.NoError(t, PrepareGlobDestination(local, 2, false))
+	assert.DirExists(t, local)
+	for _, match := range []string{path.Join(dir, "a.log"), path.Join(dir, "b.log")} {
+		localPath, err := AppendLocalBaseName(local, match)
+		assert.NoError(t, err)
+		assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, localPath, match, nil))
+	}
+	assert.FileExists(t, filepath.Join(local, "a.log"))
+	assert.FileExists(t, filepath.Join(local, "b.log"))
+	assert.ErrorContains(t, PrepareGlobDestination(filepath.Join(local, "a.log"), 2, false), "local path is not a directory")
+}
+
+func TestParseByteRate(t *testing.T) {
+	for input, expected := range map[string]int64{"": 0, "0": 0, "1000": 1000, "512K": 512 * 1024, "2M": 2 * 1024 * 1024, "1.5m": 1536 * 1024, "1G": 1 << 30} {
+		actual, err := ParseByteRate(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, actual, input)
+	}
+	for _, invalid := range []string{"fast", "2MB", "-1K", "K"} {
+		_, err := ParseByteRate(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTransferLimit(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "local.bin")
+	const limit = 64 * 1024
+	const size = 2 * limit
+	if err := os.WriteFile(localPath, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestSftpClient(t)
+	start := time.Now()
+	assert.NoError(t, SendFile(context.Background(), client, localPath, filepath.Join(dir, "remote.bin"), &TransferOptions{Limit: limit}))
+	elapsed := time.Since(start)
+
+	expected := time.Duration(size / limit * int64(time.Second))
+	assert.GreaterOrEqual(t, elapsed, expected*95/100, "throttled transfer finished too quickly")
+	assert.Less(t, elapsed, expected*3/2, "throttled transfer took too long")
+
+	// cancelling doesn't wait for the limiter
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	err := SendFile(ctx, client, localPath, filepath.Join(dir, "cancelled.bin"), &TransferOptions{Limit: 1})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "cancelling a throttled transfer took too long")
+}
+
+func TestTransferResume(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	localPath := filepath.Join(dir, "local.bin")
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+	opts := &TransferOptions{Resume: true, Verify: true}
+
+	// a partial upload is completed
+	remotePath := filepath.Join(dir, "remote.bin")
+	if err := os.WriteFile(remotePath+partSuffix, content[:300*1024], 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remotePath, opts))
+	assert.Equal(t, hashFile(t, localPath), hashFile(t, remotePath))
+	assert.NoFileExists(t, remotePath+partSuffix)
+
+	// a partial download is completed
+	downloadPath := filepath.Join(dir, "download.bin")
+	if err := os.WriteFile(downloadPath+partSuffix, content[:700*1024], 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, RetrieveRemoteFiles(context.Background(), client, downloadPath, remotePath, opts))
+	assert.Equal(t, hashFile(t, localPath), hashFile(t, downloadPath))
+	assert.NoFileExists(t, downloadPath+partSuffix)
+
+	// a partial file larger than the source is transferred in full
+	if err := os.WriteFile(remotePath+partSuffix, append(content, content...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remotePath, opts))
+	assert.Equal(t, hashFile(t, localPath), hashFile(t, remotePath))
+
+	// a partial file which doesn't match the source fails verification rather than going unnoticed, leaving the
+	// destination as it was
+	if err := os.WriteFile(remotePath+partSuffix, make([]byte, 300*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, SendFile(context.Background(), client, localPath, remotePath, opts), "checksum mismatch")
+	assert.Equal(t, hashFile(t, localPath), hashFile(t, remotePath))
+	assert.NoFileExists(t, remotePath+partSuffix)
+}
+
+func TestTransferFailureLeavesDestination(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	sourcePath := filepath.Join(dir, "source.bin")
+	if err := os.WriteFile(sourcePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous := []byte("the previous version")
+
+	// the connection is lost part way through each copy, by the server going away
+	failing := func() (*sftp.Client, *TransferOptions) {
+		clientReader, serverWriter := io.Pipe()
+		serverReader, clientWriter := io.Pipe()
+		server, err := sftp.NewServer(struct {
+			io.Reader
+			io.WriteCloser
+		}{serverReader, serverWriter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = server.Serve() }()
+		client, err := sftp.NewClientPipe(clientReader, clientWriter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		return client, &TransferOptions{Progress: func(_ string, transferred int64, _ int64) {
+			if transferred > 0 {
+				_ = server.Close()
+			}
+		}}
+	}
+
+	uploadPath := filepath.Join(dir, "upload.bin")
+	if err := os.WriteFile(uploadPath, previous, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, opts := failing()
+	assert.Error(t, SendFile(context.Background(), client, sourcePath, uploadPath, opts))
+	written, _ := os.ReadFile(uploadPath)
+	assert.Equal(t, previous, written, "the destination should be untouched")
+
+	downloadPath := filepath.Join(dir, "download.bin")
+	if err := os.WriteFile(downloadPath, previous, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, opts = failing()
+	assert.Error(t, RetrieveRemoteFiles(context.Background(), client, downloadPath, sourcePath, opts))
+	written, _ = os.ReadFile(downloadPath)
+	assert.Equal(t, previous, written, "the destination should be untouched")
+	assert.NoFileExists(t, downloadPath+partSuffix, "the partial file should be removed")
+
+	// as are compressed downloads, whose connection is lost by the ssh client closing
+	if _, err := exec.LookPath("gzip"); err == nil && runtime.GOOS != "windows" {
+		sshClient := newTestShellClient(t)
+		opts := &TransferOptions{Progress: func(_ string, transferred int64, _ int64) {
+			if transferred > 0 {
+				_ = sshClient.Close()
+			}
+		}}
+		assert.Error(t, RetrieveFileCompressed(context.Background(), sshClient, newTestSftpClient(t), downloadPath, sourcePath, opts))
+		written, _ = os.ReadFile(downloadPath)
+		assert.Equal(t, previous, written, "the destination should be untouched")
+		assert.NoFileExists(t, downloadPath+partSuffix, "the partial file should be removed")
+	}
+
+	// once complete, the destination is replaced
+	assert.NoError(t, RetrieveRemoteFiles(context.Background(), newTestSftpClient(t), downloadPath, sourcePath, nil))
+	assert.Equal(t, hashFile(t, sourcePath), hashFile(t, downloadPath))
+	assert.NoError(t, SendFile(context.Background(), newTestSftpClient(t), sourcePath, uploadPath, nil))
+	assert.Equal(t, hashFile(t, sourcePath), hashFile(t, uploadPath))
+}
+
+func TestTransferReplacesLinkTargets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and devices differ on windows")
+	}
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "source.txt")
+	if err := os.WriteFile(sourcePath, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+
+	// a symlink at the destination is kept, and the file it links to replaced
+	for _, transfer := range []func(dest string) error{
+		func(dest string) error {
+			return SendFile(context.Background(), client, sourcePath, filepath.ToSlash(dest), nil)
+		},
+		func(dest string) error {
+			return RetrieveRemoteFiles(context.Background(), client, dest, filepath.ToSlash(sourcePath), nil)
+		},
+	} {
+		linkDir := t.TempDir()
+		target := filepath.Join(linkDir, "target.txt")
+		if err := os.WriteFile(target, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(linkDir, "link.txt")
+		if err := os.Symlink("target.txt", link); err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, transfer(link))
+		if info, err := os.Lstat(link); assert.NoError(t, err) {
+			assert.NotZero(t, info.Mode()&os.ModeSymlink, "the link should be kept")
+		}
+		written, _ := os.ReadFile(target)
+		assert.Equal(t, "new", string(written))
+		assert.NoFileExists(t, target+partSuffix)
+		assert.NoFileExists(t, link+partSuffix)
+	}
+
+	// devices are written in place rather than replaced
+	for _, transfer := range []func(dest string) error{
+		func(dest string) error { return SendFile(context.Background(), client, sourcePath, dest, nil) },
+		func(dest string) error {
+			return RetrieveRemoteFiles(context.Background(), client, dest, filepath.ToSlash(sourcePath), nil)
+		},
+	} {
+		assert.NoError(t, transfer(os.DevNull))
+		if info, err := os.Stat(os.DevNull); assert.NoError(t, err) {
+			assert.NotZero(t, info.Mode()&os.ModeDevice, "%s should still be a device", os.DevNull)
+		}
+		assert.NoFileExists(t, os.DevNull+partSuffix)
+	}
+}
+
+func TestTransferCancel(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "local.bin")
+	remotePath := filepath.Join(dir, "remote.bin")
+	if err := os.WriteFile(localPath, bytes.Repeat([]byte("x"), 4<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestSftpClient(t)
+	cancelling := func(resume bool) (context.Context, *TransferOptions) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		opts := &TransferOptions{Resume: resume, Progress: func(_ string, transferred int64, _ int64) {
+			if transferred > 0 {
+				cancel()
+			}
+		}}
+		return ctx, opts
+	}
+
+	ctx, opts := cancelling(false)
+	err := SendFile(ctx, client, localPath, remotePath, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, remotePath, "partial file should be removed")
+
+	downloadPath := filepath.Join(dir, "downloaded.bin")
+	ctx, opts = cancelling(false)
+	err = RetrieveRemoteFiles(ctx, client, downloadPath, localPath, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, downloadPath, "partial file should be removed")
+
+	ctx, opts = cancelling(true)
+	err = SendFile(ctx, client, localPath, remotePath, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, remotePath)
+	assert.FileExists(t, remotePath+partSuffix, "partial file should be kept to resume")
+}
+
+// treeLayout lists every file and directory beneath root by its slash separated path relative to root, directories
+// ending with a slash, with the content of each file
+func treeLayout(t *testing.T, root string) map[string]string {
+	layout := map[string]string{}
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			layout[filepath.ToSlash(rel)+"/"] = ""
+			return nil
+		}
+		content, err := os.ReadFile(p)
+		layout[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func TestSendDirLayout(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "project")
+	for _, d := range []string{"empty", "src/pkg/internal", "src/pkg/empty/nested", "docs"} {
+		if err := os.MkdirAll(filepath.Join(localDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files sharing a name in different directories would collide if the tree were flattened
+	for name, content := range map[string]string{
+		"README.md":                  "top",
+		"docs/README.md":             "docs",
+		"src/README.md":              "src",
+		"src/pkg/util.go":            "package pkg",
+		"src/pkg/internal/README.md": "internal",
+	} {
+		if err := os.WriteFile(filepath.Join(localDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the directory itself is recreated within the remote one
+	expected := map[string]string{"project/": ""}
+	for name, content := range treeLayout(t, localDir) {
+		expected["project/"+name] = content
+	}
+	client := newTestSftpClient(t)
+
+	for _, parallel := range []int{1, 4} {
+		remoteDir := t.TempDir()
+		assert.NoError(t, SendDir(context.Background(), client, localDir, filepath.ToSlash(remoteDir), &TransferOptions{Parallel: parallel}))
+		assert.Equal(t, expected, treeLayout(t, remoteDir), "the remote tree should match the local one exactly")
+	}
+
+	// a trailing separator on the local directory sends it the same way
+	remoteDir := t.TempDir()
+	assert.NoError(t, SendDir(context.Background(), client, localDir+string(filepath.Separator), filepath.ToSlash(remoteDir), nil))
+	assert.Equal(t, expected, treeLayout(t, remoteDir))
+}
+
+// failingWriter is a remote file which fails writes past limit bytes, as when the remote disk fills up
+type failingWriter struct {
+	io.WriterAt
+	limit int64
+}
+
+func (w *failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > w.limit {
+		return 0, errors.New("no space left on device")
+	}
+	return w.WriterAt.WriteAt(p, off)
+}
+
+// failingPut hands out failingWriters for files opened for writing
+type failingPut struct {
+	sftp.FileWriter
+	limit int64
+}
+
+func (p failingPut) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	w, err := p.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	return &failingWriter{WriterAt: w, limit: p.limit}, nil
+}
+
+// newFailingSftpClient returns a sftp client connected to an in-memory sftp server whose writes fail past limit bytes
+// into a file
+func newFailingSftpClient(t *testing.T, limit int64) *sftp.Client {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	handlers := sftp.InMemHandler()
+	handlers.FilePut = failingPut{FileWriter: handlers.FilePut, limit: limit}
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter}, handlers)
+	go func() { _ = server.Serve() }()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+	return client
+}
+
+func TestSendFailureRemovesPartial(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "local.bin")
+	if err := os.WriteFile(localPath, bytes.Repeat([]byte("x"), 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remoteExists := func(client *sftp.Client, name string) bool {
+		_, err := client.Lstat(name)
+		return err == nil
+	}
+
+	for _, concurrency := range []int{1, DefaultConcurrency} {
+		client := newFailingSftpClient(t, 100*1024)
+		opts := &TransferOptions{Concurrency: concurrency}
+		assert.ErrorContains(t, SendFile(context.Background(), client, localPath, "/file.bin", opts), "no space left on device")
+		assert.False(t, remoteExists(client, "/file.bin"), "concurrency %d", concurrency)
+		assert.False(t, remoteExists(client, "/file.bin"+partSuffix), "the partial file should be removed, concurrency %d", concurrency)
+
+		err := SendStream(context.Background(), client, bytes.NewReader(make([]byte, 1<<20)), "/stream.bin", opts)
+		assert.ErrorContains(t, err, "no space left on device")
+		assert.False(t, remoteExists(client, "/stream.bin"), "the partial file should be removed, concurrency %d", concurrency)
+	}
+
+	client := newFailingSftpClient(t, 100*1024)
+	for _, opts := range []*TransferOptions{{KeepPartial: true}, {Resume: true}} {
+		assert.Error(t, SendFile(context.Background(), client, localPath, "/kept.bin", opts))
+		assert.False(t, remoteExists(client, "/kept.bin"))
+		assert.True(t, remoteExists(client, "/kept.bin"+partSuffix), "the partial file should be kept")
+	}
+	err := SendStream(context.Background(), client, bytes.NewReader(make([]byte, 1<<20)), "/kept-stream.bin", &TransferOptions{KeepPartial: true})
+	assert.Error(t, err)
+	assert.True(t, remoteExists(client, "/kept-stream.bin"), "the partial file should be kept")
+
+	// the file is sent when it fits
+	client = newFailingSftpClient(t, 2<<20)
+	assert.NoError(t, SendFile(context.Background(), client, localPath, "/file.bin", nil))
+	info, err := client.Stat("/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<20), info.Size())
+	assert.False(t, remoteExists(client, "/file.bin"+partSuffix))
+}
+
+func TestSendFileMakeDirs(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "local.txt")
+	if err := os.WriteFile(localPath, []byte("deep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSftpClient(t)
+	remotePath := filepath.ToSlash(filepath.Join(dir, "deep", "new", "path", "file.txt"))
+
+	assert.Error(t, SendFile(context.Background(), client, localPath, remotePath, nil), "parents are only made when requested")
+	assert.NoError(t, SendFile(context.Background(), client, localPath, remotePath, &TransferOptions{MakeDirs: true}))
+	assert.FileExists(t, remotePath)
+
+	blocked := filepath.ToSlash(filepath.Join(dir, "local.txt", "file.txt"))
+	err := SendFile(context.Background(), client, localPath, blocked, &TransferOptions{MakeDirs: true})
+	assert.ErrorContains(t, err, "is not a directory")
+
+	localDir := filepath.Join(dir, "tree")
+	if err := os.MkdirAll(filepath.Join(localDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(localDir, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remoteDir := filepath.Join(dir, "missing", "dest")
+	assert.NoError(t, SendDir(context.Background(), client, localDir, filepath.ToSlash(remoteDir), nil), "recursive uploads always make the destination")
+	assert.FileExists(t, filepath.Join(remoteDir, "tree", "sub", "a.txt"))
+	assert.ErrorContains(t, SendDir(context.Background(), client, localDir, filepath.ToSlash(localPath), nil), "is not a directory")
+}
@@ -0,0 +1,87 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/sdk-golang/ziti"
+)
+
+// Transport looks up and dials the services of an overlay network. NewZitiTransport provides the real implementation
+// while tests can substitute their own.
+type Transport interface {
+	// Service returns the named service, failing when the identity has no access to it
+	Service(name string) (*rest_model.ServiceDetail, error)
+
+	// Dial connects to the named service with opts
+	Dial(service string, opts *ziti.DialOptions) (net.Conn, error)
+}
+
+// zitiTransport is a Transport over an authenticated ziti context
+type zitiTransport struct {
+	ctx ziti.Context
+}
+
+// NewZitiTransport creates a ziti context as configured by f and authenticates it
+func NewZitiTransport(f *SshFlags) (Transport, error) {
+	ctx, err := NewContext(f, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := Auth(ctx); err != nil {
+		return nil, err
+	}
+	return &zitiTransport{ctx: ctx}, nil
+}
+
+func (t *zitiTransport) Service(name string) (*rest_model.ServiceDetail, error) {
+	service, ok := t.ctx.GetService(name)
+	if !ok {
+		return nil, serviceNotFound(t.ctx, name)
+	}
+	if !canDial(service) {
+		return nil, fmt.Errorf("%s has no Dial policy for service %s, its permissions are %v. a dial service policy is needed to connect", t.identityName(), name, service.Permissions)
+	}
+	return service, nil
+}
+
+// identityName describes the authenticated identity for error messages, by name when the controller provides it
+func (t *zitiTransport) identityName() string {
+	identity, err := t.ctx.GetCurrentIdentity()
+	if err != nil || identity == nil || identity.Name == nil {
+		return "this identity"
+	}
+	return "identity " + *identity.Name
+}
+
+// canDial reports whether the identity a service was looked up for may dial it. Identities see the services they may
+// dial or bind, and a service only bound by the identity, such as one hosted by the same identity, fails when dialed.
+// Controllers which don't report permissions are assumed to allow dialing.
+func canDial(service *rest_model.ServiceDetail) bool {
+	if len(service.Permissions) == 0 {
+		return true
+	}
+	return slices.Contains(service.Permissions, rest_model.DialBindDial)
+}
+
+func (t *zitiTransport) Dial(service string, opts *ziti.DialOptions) (net.Conn, error) {
+	return t.ctx.DialWithOptions(service, opts)
+}
@@ -0,0 +1,167 @@
+package zsshlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeTransport offers services and dials them with dial, recording the options of each dial
+type fakeTransport struct {
+	services map[string]*rest_model.ServiceDetail
+	dial     func(attempt int) (net.Conn, error)
+	dials    []*ziti.DialOptions
+}
+
+func (t *fakeTransport) Service(name string) (*rest_model.ServiceDetail, error) {
+	service, ok := t.services[name]
+	if !ok {
+		return nil, fmt.Errorf("service not found: %s", name)
+	}
+	return service, nil
+}
+
+func (t *fakeTransport) Dial(_ string, opts *ziti.DialOptions) (net.Conn, error) {
+	t.dials = append(t.dials, opts)
+	return t.dial(len(t.dials))
+}
+
+func TestEstablishClientWithTransport(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = time.Second }()
+
+	// the server reports the user it was connected as
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		for req := range reqs {
+			_ = req.Reply(req.Type == "exec", nil)
+			if req.Type == "exec" {
+				_, _ = fmt.Fprint(ch, conn.User())
+				sendExitStatus(ch, 0)
+				return
+			}
+		}
+	})
+	dialServer := func(int) (net.Conn, error) { return net.Dial("tcp", addr) }
+	// the handshake fails against a listener which closes connections straight away
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = closing.Close() }()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	services := map[string]*rest_model.ServiceDetail{"zssh": {}}
+	tests := []struct {
+		name     string
+		flags    SshFlags
+		dial     func(attempt int) (net.Conn, error)
+		attempts int
+		err      string
+	}{
+		{
+			name:     "connects",
+			flags:    SshFlags{ServiceName: "zssh", Username: "fallback"},
+			dial:     dialServer,
+			attempts: 1,
+		},
+		{
+			name:  "service not found",
+			flags: SshFlags{ServiceName: "missing"},
+			dial:  dialServer,
+			err:   "service not found: missing",
+		},
+		{
+			name:     "retries transient failures",
+			flags:    SshFlags{ServiceName: "zssh", Retries: 3},
+			attempts: 3,
+			dial: func(attempt int) (net.Conn, error) {
+				if attempt < 3 {
+					return nil, errors.New("service zssh has no terminators")
+				}
+				return dialServer(attempt)
+			},
+		},
+		{
+			name:     "times out once retries are exhausted",
+			flags:    SshFlags{ServiceName: "zssh", Retries: 1, Timeout: time.Second},
+			attempts: 2,
+			dial:     func(int) (net.Conn, error) { return nil, os.ErrDeadlineExceeded },
+			err:      "timed out connecting to target after 1s",
+		},
+		{
+			name:     "does not retry other dial failures",
+			flags:    SshFlags{ServiceName: "zssh", Retries: 3},
+			attempts: 1,
+			dial:     func(int) (net.Conn, error) { return nil, errors.New("no access") },
+			err:      "error when dialing service name zssh: no access",
+		},
+		{
+			name:     "fails the handshake",
+			flags:    SshFlags{ServiceName: "zssh"},
+			attempts: 1,
+			dial:     func(int) (net.Conn, error) { return net.Dial("tcp", closing.Addr().String()) },
+			err:      "error dialing SSH Conn",
+		},
+		{
+			name:  "rejects invalid app data",
+			flags: SshFlags{ServiceName: "zssh", AppData: []string{"invalid"}},
+			dial:  dialServer,
+			err:   "invalid app data",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.flags.Insecure = true
+			transport := &fakeTransport{services: services, dial: test.dial}
+			client, err := EstablishClientWithTransport(&test.flags, transport, "", "target")
+			assert.Len(t, transport.dials, test.attempts)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer func() { _ = client.Close() }()
+			assert.Equal(t, "target", transport.dials[0].Identity)
+
+			stdout := &bytes.Buffer{}
+			_, err = RunCommand(context.Background(), client, "whoami", nil, stdout, &bytes.Buffer{})
+			assert.NoError(t, err)
+			assert.NotEmpty(t, stdout.String())
+			if test.flags.Username != "" {
+				assert.Equal(t, test.flags.Username, stdout.String(), "the configured username should be used when none is given")
+			}
+		})
+	}
+}
+
+func TestCanDial(t *testing.T) {
+	assert.True(t, canDial(&rest_model.ServiceDetail{Permissions: rest_model.DialBindArray{rest_model.DialBindDial}}))
+	assert.True(t, canDial(&rest_model.ServiceDetail{Permissions: rest_model.DialBindArray{rest_model.DialBindBind, rest_model.DialBindDial}}))
+	assert.False(t, canDial(&rest_model.ServiceDetail{Permissions: rest_model.DialBindArray{rest_model.DialBindBind}}), "a service the identity only hosts can't be dialed")
+	assert.True(t, canDial(&rest_model.ServiceDetail{}), "services without permissions are assumed dialable")
+}
@@ -0,0 +1,91 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"zssh/version"
+)
+
+// clientVersionPrefix starts every identification string, see RFC 4253 section 4.2
+const clientVersionPrefix = "SSH-2.0-"
+
+// maxClientVersion is the longest identification string allowed, 255 characters less the trailing CR LF
+const maxClientVersion = 253
+
+// Version is the version of zssh, see DefaultClientVersion
+var Version = version.Get().Version
+
+// DefaultClientVersion returns the identification string sent to servers when --client-version isn't set, e.g.
+// SSH-2.0-zssh_1.2.3. Characters of Version not allowed in the software version, such as -, are replaced with _.
+func DefaultClientVersion() string {
+	software := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '-' {
+			return '_'
+		}
+		return r
+	}, strings.TrimPrefix(Version, "v"))
+	return clientVersionPrefix + "zssh_" + software
+}
+
+// ValidateClientVersion checks clientVersion is an identification string servers accept: SSH-2.0- followed by the
+// software version, optionally followed by a space and comments, in printable ASCII. The software version can't
+// contain - or spaces. An empty clientVersion, meaning DefaultClientVersion, is valid.
+func ValidateClientVersion(clientVersion string) error {
+	if clientVersion == "" {
+		return nil
+	}
+	if !strings.HasPrefix(clientVersion, clientVersionPrefix) {
+		return fmt.Errorf("invalid client version [%s]: it must start with %s, e.g. %s", clientVersion, clientVersionPrefix, DefaultClientVersion())
+	}
+	if len(clientVersion) > maxClientVersion {
+		return fmt.Errorf("invalid client version [%s]: it must be at most %d characters", clientVersion, maxClientVersion)
+	}
+	for _, r := range clientVersion {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("invalid client version [%s]: only printable ASCII characters are allowed", clientVersion)
+		}
+	}
+	software, _, _ := strings.Cut(strings.TrimPrefix(clientVersion, clientVersionPrefix), " ")
+	if software == "" || strings.Contains(software, "-") {
+		return fmt.Errorf("invalid client version [%s]: the software version following %s must be set and can't contain -", clientVersion, clientVersionPrefix)
+	}
+	return nil
+}
+
+// AddVersionCommand adds the version subcommand to cmd, printing the version, commit, build date and the versions of
+// key dependencies, and makes its --version flag print the same
+func AddVersionCommand(cmd *cobra.Command) {
+	info := version.Get()
+	out := &bytes.Buffer{}
+	info.Write(out, cmd.Name())
+	cmd.Version = info.Version
+	// cobra parses the template, which the build information has no actions in
+	cmd.SetVersionTemplate(out.String())
+	cmd.AddCommand(&cobra.Command{
+		Use:   "version",
+		Short: "Print the version, commit, build date and versions of key dependencies",
+		Args:  cobra.NoArgs,
+		Run: func(c *cobra.Command, _ []string) {
+			info.Write(c.OutOrStdout(), cmd.Name())
+		},
+	})
+}
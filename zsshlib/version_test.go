@@ -0,0 +1,75 @@
+package zsshlib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"zssh/version"
+)
+
+func TestClientVersion(t *testing.T) {
+	version := Version
+	t.Cleanup(func() { Version = version })
+	Version = "v1.2.3-rc1"
+	assert.Equal(t, "SSH-2.0-zssh_1.2.3_rc1", DefaultClientVersion())
+	assert.NoError(t, ValidateClientVersion(DefaultClientVersion()))
+
+	assert.NoError(t, ValidateClientVersion(""))
+	assert.NoError(t, ValidateClientVersion("SSH-2.0-OpenSSH_9.6"))
+	assert.NoError(t, ValidateClientVersion("SSH-2.0-custom_1.0 with comments - allowed"))
+	assert.ErrorContains(t, ValidateClientVersion("SSH-1.99-old"), "it must start with SSH-2.0-")
+	assert.ErrorContains(t, ValidateClientVersion("zssh"), "it must start with SSH-2.0-")
+	assert.ErrorContains(t, ValidateClientVersion("SSH-2.0-"), "must be set")
+	assert.ErrorContains(t, ValidateClientVersion("SSH-2.0-zssh-1.0"), "can't contain -")
+	assert.ErrorContains(t, ValidateClientVersion("SSH-2.0-zssh\r\n"), "only printable ASCII")
+	assert.ErrorContains(t, ValidateClientVersion("SSH-2.0-"+string(make([]byte, 250))), "at most 253 characters")
+
+	seen := make(chan string, 2)
+	addr := newTestSshServer(t, func(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+		seen <- string(conn.ClientVersion())
+		_ = newChannel.Reject(ssh.Prohibited, "no channels")
+	})
+	for _, clientVersion := range []string{"", "SSH-2.0-custom_1.0"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := EstablishClientWithConn(&SshFlags{Insecure: true, ClientVersion: clientVersion}, conn, "test", "target")
+		if !assert.NoError(t, err) {
+			continue
+		}
+		_, _, _ = client.OpenChannel("session", nil)
+		_ = client.Close()
+	}
+	assert.Equal(t, "SSH-2.0-zssh_1.2.3_rc1", <-seen, "the default should identify zssh")
+	assert.Equal(t, "SSH-2.0-custom_1.0", <-seen)
+
+	conn, unused := net.Pipe()
+	defer func() { _ = unused.Close() }()
+	_, err := EstablishClientWithConn(&SshFlags{Insecure: true, ClientVersion: "OpenSSH"}, conn, "test", "target")
+	assert.ErrorContains(t, err, "invalid client version [OpenSSH]")
+}
+
+func TestAddVersionCommand(t *testing.T) {
+	commit, date := version.Commit, version.Date
+	t.Cleanup(func() { version.Commit, version.Date = commit, date })
+	version.Commit, version.Date = "abc1234", "2024-01-02T03:04:05Z"
+
+	for _, args := range [][]string{{"version"}, {"--version"}} {
+		cmd := &cobra.Command{Use: "zssh <target>", Run: func(*cobra.Command, []string) {}}
+		AddVersionCommand(cmd)
+		out := &bytes.Buffer{}
+		cmd.SetOut(out)
+		cmd.SetArgs(args)
+		assert.NoError(t, cmd.Execute())
+		assert.Contains(t, out.String(), "zssh v", args)
+		assert.Contains(t, out.String(), "commit: abc1234\n", args)
+		assert.Contains(t, out.String(), "built:  2024-01-02T03:04:05Z\n", args)
+		assert.Contains(t, out.String(), "golang.org/x/crypto v", args)
+		assert.Contains(t, out.String(), "github.com/openziti/sdk-golang v", args)
+	}
+}